@@ -0,0 +1,127 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+
+	"github.com/immutos/oci2erofs/internal/browse"
+	"github.com/urfave/cli/v2"
+)
+
+func newBrowseCommands() []*cli.Command {
+	return []*cli.Command{
+		{
+			Name:      "ls",
+			Usage:     "List a directory in the root filesystem of an image",
+			ArgsUsage: "image_path [path]",
+			Flags: append([]cli.Flag{
+				&cli.BoolFlag{
+					Name:    "long",
+					Aliases: []string{"l"},
+					Usage:   "Include the mode, ownership, size, and modification time of each entry",
+				},
+			}, newImageFlags()...),
+			Action: browseAction(0, func(c *cli.Context, fsys fs.FS, paths []string) error {
+				return browse.List(os.Stdout, fsys, pathOrRoot(paths), c.Bool("long"))
+			}),
+		},
+		{
+			Name:      "tree",
+			Usage:     "Print the hierarchy below a directory in the root filesystem of an image",
+			ArgsUsage: "image_path [path]",
+			Flags:     newImageFlags(),
+			Action: browseAction(0, func(c *cli.Context, fsys fs.FS, paths []string) error {
+				return browse.Tree(os.Stdout, fsys, pathOrRoot(paths))
+			}),
+		},
+		{
+			Name:      "cat",
+			Usage:     "Print the contents of files in the root filesystem of an image",
+			ArgsUsage: "image_path path...",
+			Flags:     newImageFlags(),
+			Action: browseAction(1, func(c *cli.Context, fsys fs.FS, paths []string) error {
+				return eachPath(os.Stdout, fsys, paths, browse.Cat)
+			}),
+		},
+		{
+			Name:      "stat",
+			Usage:     "Describe a file in the root filesystem of an image",
+			ArgsUsage: "image_path path...",
+			Flags:     newImageFlags(),
+			Action: browseAction(1, func(c *cli.Context, fsys fs.FS, paths []string) error {
+				return eachPath(os.Stdout, fsys, paths, browse.Stat)
+			}),
+		},
+		{
+			Name:      "readlink",
+			Usage:     "Print the target of a symlink in the root filesystem of an image",
+			ArgsUsage: "image_path path...",
+			Flags:     newImageFlags(),
+			Action: browseAction(1, func(c *cli.Context, fsys fs.FS, paths []string) error {
+				return eachPath(os.Stdout, fsys, paths, browse.ReadLink)
+			}),
+		},
+	}
+}
+
+// browseAction loads the image named by the first argument, and invokes fn
+// with its root filesystem and the remaining arguments.
+func browseAction(minPaths int, fn func(c *cli.Context, fsys fs.FS, paths []string) error) cli.ActionFunc {
+	return func(c *cli.Context) error {
+		if c.NArg() < 1+minPaths {
+			if minPaths > 0 {
+				slog.Error("Image path and file path are required")
+			} else {
+				slog.Error("Image path is required")
+			}
+			return cli.ShowSubcommandHelp(c)
+		}
+
+		img, release, err := loadImage(c, c.Args().First(), c.String("ref"), c.String("platform"))
+		if err != nil {
+			return err
+		}
+		defer release()
+
+		return fn(c, img.RootFS(), c.Args().Tail())
+	}
+}
+
+// eachPath invokes fn for each of the given paths.
+func eachPath(w io.Writer, fsys fs.FS, paths []string, fn func(io.Writer, fs.FS, string) error) error {
+	for _, name := range paths {
+		if err := fn(w, fsys, name); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func pathOrRoot(paths []string) string {
+	if len(paths) == 0 {
+		return "/"
+	}
+
+	return paths[0]
+}
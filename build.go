@@ -0,0 +1,162 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+
+	"github.com/immutos/oci2erofs/internal/buildfile"
+	"github.com/immutos/oci2erofs/internal/util"
+	"github.com/urfave/cli/v2"
+)
+
+func newBuildCommand(convertJob func(c *cli.Context, job buildfile.Job) error) *cli.Command {
+	return &cli.Command{
+		Name:      "build",
+		Usage:     "Run the conversion jobs declared in a build file",
+		ArgsUsage: "[job_name...]",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:    "file",
+				Aliases: []string{"f"},
+				Usage:   "Path of the build file",
+				Value:   "oci2erofs.yaml",
+			},
+		},
+		Action: func(c *cli.Context) error {
+			file, err := buildfile.Load(c.String("file"))
+			if err != nil {
+				return err
+			}
+
+			jobs := file.Jobs
+			if c.NArg() > 0 {
+				jobs = nil
+				for _, name := range c.Args().Slice() {
+					i := slices.IndexFunc(file.Jobs, func(job buildfile.Job) bool { return job.Name == name })
+					if i < 0 {
+						return fmt.Errorf("job %q not found in build file", name)
+					}
+
+					jobs = append(jobs, file.Jobs[i])
+				}
+			}
+
+			// Flags given on the command line provide the defaults for unset
+			// fields of the jobs.
+			defaults := jobFromFlags(c)
+
+			// Jobs run one after the other (each converting in parallel), and
+			// share the layer cache.
+			for _, job := range jobs {
+				if err := c.Context.Err(); err != nil {
+					return err
+				}
+
+				slog.Info("Running job", slog.String("name", job.Name))
+
+				if err := convertJob(c, withDefaults(job, defaults)); err != nil {
+					return fmt.Errorf("job %q failed: %w", job.Name, err)
+				}
+			}
+
+			return nil
+		},
+	}
+}
+
+// jobFromFlags returns the conversion job described by the command line flags
+// (apart from its input).
+func jobFromFlags(c *cli.Context) buildfile.Job {
+	sameOwner := c.Bool("same-owner")
+
+	job := buildfile.Job{
+		Ref:                c.String("ref"),
+		Platform:           c.String("platform"),
+		Output:             c.String("output"),
+		Format:             c.String("format"),
+		Tag:                c.String("tag"),
+		Push:               c.String("push"),
+		All:                c.Bool("all"),
+		NoClobber:          c.Bool("no-clobber"),
+		Report:             c.String("report"),
+		SameOwner:          &sameOwner,
+		NumericOwner:       c.Bool("numeric-owner"),
+		SkipDevices:        c.Bool("skip-devices"),
+		XattrsAllow:        splitList(c.String("xattrs-allow")),
+		XattrsDeny:         splitList(c.String("xattrs-deny")),
+		Compression:        c.String("compression"),
+		CompressionLevel:   c.Int("compression-level"),
+		CompressionExclude: splitList(c.String("compression-exclude")),
+		Reproducible:       c.Bool("reproducible"),
+	}
+
+	if size, ok := c.Generic("pcluster-size").(*util.SizeFlag); ok {
+		job.PclusterSize = size.String()
+	}
+
+	return job
+}
+
+// withDefaults returns the job with its unset fields taken from defaults.
+func withDefaults(job, defaults buildfile.Job) buildfile.Job {
+	job.Ref = cmp.Or(job.Ref, defaults.Ref)
+	job.Platform = cmp.Or(job.Platform, defaults.Platform)
+	job.Output = cmp.Or(job.Output, defaults.Output)
+	job.Format = cmp.Or(job.Format, defaults.Format)
+	job.Tag = cmp.Or(job.Tag, defaults.Tag)
+	job.Push = cmp.Or(job.Push, defaults.Push)
+	job.All = job.All || defaults.All
+	job.NoClobber = job.NoClobber || defaults.NoClobber
+	job.Report = cmp.Or(job.Report, defaults.Report)
+	job.SameOwner = cmp.Or(job.SameOwner, defaults.SameOwner)
+	job.NumericOwner = job.NumericOwner || defaults.NumericOwner
+	job.SkipDevices = job.SkipDevices || defaults.SkipDevices
+	if job.XattrsAllow == nil {
+		job.XattrsAllow = defaults.XattrsAllow
+	}
+	if job.XattrsDeny == nil {
+		job.XattrsDeny = defaults.XattrsDeny
+	}
+	job.Compression = cmp.Or(job.Compression, defaults.Compression)
+	job.CompressionLevel = cmp.Or(job.CompressionLevel, defaults.CompressionLevel)
+	job.PclusterSize = cmp.Or(job.PclusterSize, defaults.PclusterSize)
+	if job.CompressionExclude == nil {
+		job.CompressionExclude = defaults.CompressionExclude
+	}
+	job.Reproducible = job.Reproducible || defaults.Reproducible
+
+	return job
+}
+
+// splitList splits a comma separated list, dropping empty items.
+func splitList(list string) []string {
+	var items []string
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+
+	return items
+}
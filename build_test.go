@@ -0,0 +1,99 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/immutos/oci2erofs/internal/buildfile"
+	"github.com/immutos/oci2erofs/internal/erofs"
+	"github.com/immutos/oci2erofs/pkg/convert"
+	"github.com/stretchr/testify/require"
+	"github.com/urfave/cli/v2"
+)
+
+func TestBuildJobDefaults(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "oci2erofs.yaml")
+
+	require.NoError(t, os.WriteFile(path, []byte(`version: 1
+jobs:
+  - name: a
+    input: image.tar
+    compression: lz4
+    pclusterSize: 1MiB
+  - name: b
+    input: image.tar
+  - name: c
+    input: image.tar
+    format: tar
+    xattrsDeny: [user]
+`), 0o644))
+
+	var jobs []buildfile.Job
+	var pclusterSizes []int
+	newApp := func() *cli.App {
+		return &cli.App{
+			Name:  "oci2erofs",
+			Flags: append(newFilesystemFlags(), newExtractFlags()...),
+			Commands: []*cli.Command{newBuildCommand(func(c *cli.Context, job buildfile.Job) error {
+				var opts convert.Options
+				if err := applyFilesystemOptions(job, &opts); err != nil {
+					return err
+				}
+
+				jobs = append(jobs, job)
+				pclusterSizes = append(pclusterSizes, opts.Compression.PclusterSize)
+				return nil
+			})},
+		}
+	}
+
+	t.Run("Flag Defaults", func(t *testing.T) {
+		jobs, pclusterSizes = nil, nil
+
+		require.NoError(t, newApp().Run([]string{"oci2erofs", "build", "--file", path}))
+
+		// The second job must not inherit the first job's cluster size.
+		require.Equal(t, []int{1 << 20, erofs.BlockSize, erofs.BlockSize}, pclusterSizes)
+		require.Equal(t, "lz4", jobs[0].Compression)
+		require.Empty(t, jobs[1].Compression)
+		require.Equal(t, "tar", jobs[2].Format)
+		require.Equal(t, []string{"user"}, jobs[2].XattrsDeny)
+	})
+
+	t.Run("Command Line", func(t *testing.T) {
+		jobs, pclusterSizes = nil, nil
+
+		require.NoError(t, newApp().Run([]string{"oci2erofs", "--compression", "lzma", "--pcluster-size", "64KiB", "--xattrs-deny", "security", "--skip-devices", "build", "--file", path}))
+
+		// Fields set in the build file take precedence over the command line.
+		require.Equal(t, []int{1 << 20, 64 << 10, 64 << 10}, pclusterSizes)
+		require.Equal(t, "lz4", jobs[0].Compression)
+		require.Equal(t, "lzma", jobs[1].Compression)
+		require.Equal(t, []string{"security"}, jobs[1].XattrsDeny)
+		require.Equal(t, []string{"user"}, jobs[2].XattrsDeny)
+
+		for _, job := range jobs {
+			require.True(t, job.SkipDevices)
+			require.Equal(t, "image.tar", filepath.Base(job.Input))
+		}
+	})
+}
@@ -0,0 +1,82 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"fmt"
+	"log/slog"
+
+	"github.com/immutos/oci2erofs/internal/cache"
+	"github.com/immutos/oci2erofs/internal/util"
+	"github.com/urfave/cli/v2"
+)
+
+func newCacheDirFlag() cli.Flag {
+	// If the user cache directory can't be determined, caching is disabled
+	// unless a directory is explicitly specified.
+	defaultCacheDir, _ := cache.DefaultDir()
+
+	return &cli.StringFlag{
+		Name:    "cache-dir",
+		Usage:   "Directory in which layers (and layer indexes) are cached",
+		Value:   defaultCacheDir,
+		EnvVars: []string{"OCI2EROFS_CACHE_DIR"},
+	}
+}
+
+func newCacheCommand() *cli.Command {
+	return &cli.Command{
+		Name:  "cache",
+		Usage: "Manage the layer cache",
+		Subcommands: []*cli.Command{
+			{
+				Name:  "prune",
+				Usage: "Remove the least recently used entries from the cache",
+				Flags: []cli.Flag{
+					newCacheDirFlag(),
+					&cli.GenericFlag{
+						Name:  "max-size",
+						Usage: "Remove entries until the cache is no larger than this size (by default all entries are removed)",
+						Value: util.FromSize(0),
+					},
+				},
+				Action: func(c *cli.Context) error {
+					if c.String("cache-dir") == "" {
+						return fmt.Errorf("cache directory is required")
+					}
+
+					layerCache, err := cache.Open(c.String("cache-dir"), 0)
+					if err != nil {
+						return fmt.Errorf("failed to open cache: %w", err)
+					}
+
+					stats, err := layerCache.Prune(int64(*c.Generic("max-size").(*util.SizeFlag)))
+					if err != nil {
+						return fmt.Errorf("failed to prune cache: %w", err)
+					}
+
+					slog.Info("Pruned cache",
+						slog.Int("layers", stats.Entries), slog.String("size", util.FromSize(stats.Size).String()))
+
+					return nil
+				},
+			},
+		},
+	}
+}
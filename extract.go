@@ -0,0 +1,153 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+
+	"github.com/immutos/oci2erofs/internal/atomicfile"
+	"github.com/immutos/oci2erofs/internal/buildfile"
+	"github.com/immutos/oci2erofs/internal/extract"
+	"github.com/urfave/cli/v2"
+)
+
+func newExtractCommand() *cli.Command {
+	return &cli.Command{
+		Name:      "extract",
+		Usage:     "Extract the merged root filesystem of an image to a directory or tar archive",
+		ArgsUsage: "image_path | transport:image_path[:ref] | docker://image_ref",
+		Flags: append([]cli.Flag{
+			&cli.StringFlag{
+				Name:    "output",
+				Aliases: []string{"o"},
+				Usage:   "Output directory (or tar archive)",
+			},
+			&cli.StringFlag{
+				Name:  "format",
+				Usage: "Output format, either 'dir' (a directory) or 'tar' (a tar archive)",
+				Value: "dir",
+			},
+			&cli.BoolFlag{
+				Name:  "no-clobber",
+				Usage: "Do not overwrite an existing output tar archive",
+			},
+		}, append(newExtractFlags(), newImageFlags()...)...),
+		Action: func(c *cli.Context) error {
+			if c.NArg() != 1 {
+				slog.Error("Image path is required")
+				return cli.ShowSubcommandHelp(c)
+			}
+
+			job := jobFromFlags(c)
+			job.Input = c.Args().First()
+
+			return extractImage(c, job)
+		},
+	}
+}
+
+// newExtractFlags returns the flags that configure the extraction of the root
+// filesystem.
+func newExtractFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.BoolFlag{
+			Name:  "same-owner",
+			Usage: "Apply the ownership recorded in the image to extracted files (for the 'dir' output format, the default when running as root)",
+			Value: os.Geteuid() == 0,
+		},
+		&cli.BoolFlag{
+			Name:  "numeric-owner",
+			Usage: "Record only numeric user and group IDs (for the 'tar' output format)",
+		},
+		&cli.BoolFlag{
+			Name:  "skip-devices",
+			Usage: "Omit character and block devices (eg. when extracting without root privileges)",
+		},
+	}
+}
+
+// extractImage writes the merged root filesystem of the image to a directory
+// or tar archive (as described by the job).
+func extractImage(c *cli.Context, job buildfile.Job) error {
+	suffix := "-rootfs"
+	switch job.Format {
+	case "dir":
+	case "tar":
+		suffix += ".tar"
+	default:
+		return fmt.Errorf("unsupported output format: %s", job.Format)
+	}
+
+	outputPath, err := outputPathFor(job.Output, job.Input, suffix)
+	if err != nil {
+		return err
+	}
+
+	img, release, err := loadImage(c, job.Input, job.Ref, job.Platform)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	opts := extract.Options{
+		SameOwner:    job.SameOwner != nil && *job.SameOwner,
+		NumericOwner: job.NumericOwner,
+		SkipDevices:  job.SkipDevices,
+	}
+
+	if job.Format == "dir" {
+		if outputPath == stdioPath {
+			return errors.New("cannot extract a directory to stdout")
+		}
+
+		if err := extract.ToDir(c.Context, img.RootFS(), outputPath, opts); err != nil {
+			return fmt.Errorf("failed to extract root filesystem: %w", err)
+		}
+
+		return nil
+	}
+
+	if outputPath == stdioPath {
+		if err := extract.ToTar(c.Context, img.RootFS(), os.Stdout, opts); err != nil {
+			return fmt.Errorf("failed to extract root filesystem: %w", err)
+		}
+
+		return nil
+	}
+
+	// The output file is only replaced once the extraction succeeds.
+	outputFile, err := atomicfile.Create(outputPath, job.NoClobber)
+	if err != nil {
+		return fmt.Errorf("failed to create output file: %w", err)
+	}
+	defer outputFile.Close()
+
+	if err := extract.ToTar(c.Context, img.RootFS(), outputFile, opts); err != nil {
+		return fmt.Errorf("failed to extract root filesystem: %w", err)
+	}
+
+	if err := outputFile.Commit(); err != nil {
+		return fmt.Errorf("failed to write output file: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,105 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/immutos/oci2erofs/internal/buildfile"
+	"github.com/immutos/oci2erofs/internal/erofs"
+	"github.com/immutos/oci2erofs/internal/util"
+	"github.com/immutos/oci2erofs/internal/xattr"
+	"github.com/immutos/oci2erofs/pkg/convert"
+	"github.com/urfave/cli/v2"
+)
+
+// newFilesystemFlags returns the flags that configure the EROFS filesystem
+// image.
+func newFilesystemFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.StringFlag{
+			Name:  "xattrs-allow",
+			Usage: "Comma separated extended attribute namespaces (eg. 'security') or names (eg. 'security.capability') to store in the EROFS filesystem image (default: all)",
+		},
+		&cli.StringFlag{
+			Name:  "xattrs-deny",
+			Usage: "Comma separated extended attribute namespaces or names not to store in the EROFS filesystem image ('*' for all)",
+		},
+		&cli.StringFlag{
+			Name:  "compression",
+			Usage: "Compress regular files with the algorithm (one of 'lz4', 'lz4hc', 'lzma', or 'deflate')",
+		},
+		&cli.IntFlag{
+			Name:  "compression-level",
+			Usage: "Compression level from 1 to 9 (for 'lz4hc' and 'deflate', default: the algorithm's default)",
+		},
+		&cli.GenericFlag{
+			Name:  "pcluster-size",
+			Usage: "Maximum size of a physical cluster of compressed data (a multiple of 4KiB up to 1MiB)",
+			Value: util.FromSize(erofs.BlockSize),
+		},
+		&cli.StringFlag{
+			Name:  "compression-exclude",
+			Usage: "Comma separated patterns of files to store uncompressed (eg. '*.gz,/usr/share/fonts')",
+		},
+		&cli.BoolFlag{
+			Name:  "reproducible",
+			Usage: "Derive the UUID of the EROFS filesystem image from the image's digest, and honour SOURCE_DATE_EPOCH (which is only read in this mode) as the build time and the latest modification time",
+		},
+	}
+}
+
+// applyFilesystemOptions sets the options of the conversion that configure
+// the EROFS filesystem image (as described by the job).
+func applyFilesystemOptions(job buildfile.Job, opts *convert.Options) error {
+	filter, err := xattr.ParseFilter(strings.Join(job.XattrsAllow, ","), strings.Join(job.XattrsDeny, ","))
+	if err != nil {
+		return err
+	}
+	opts.XattrFilter = filter
+	opts.SkipDevices = job.SkipDevices
+
+	opts.Reproducible = job.Reproducible
+	if epoch := os.Getenv("SOURCE_DATE_EPOCH"); opts.Reproducible && epoch != "" {
+		seconds, err := strconv.ParseInt(epoch, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid SOURCE_DATE_EPOCH %q: %w", epoch, err)
+		}
+		opts.SourceDateEpoch = time.Unix(seconds, 0)
+	}
+
+	opts.Compression = convert.Compression{
+		Algorithm: job.Compression,
+		Level:     job.CompressionLevel,
+		Exclude:   job.CompressionExclude,
+	}
+	if job.PclusterSize != "" {
+		size, err := util.ParseSize(job.PclusterSize)
+		if err != nil {
+			return fmt.Errorf("invalid physical cluster size: %w", err)
+		}
+		opts.Compression.PclusterSize = int(size)
+	}
+
+	return opts.Compression.Validate()
+}
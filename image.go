@@ -0,0 +1,162 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+
+	"github.com/containerd/containerd/platforms"
+	"github.com/immutos/oci2erofs/internal/cache"
+	"github.com/immutos/oci2erofs/internal/image"
+	"github.com/immutos/oci2erofs/internal/layer"
+	"github.com/immutos/oci2erofs/internal/source"
+	"github.com/immutos/oci2erofs/internal/util"
+	"github.com/immutos/oci2erofs/pkg/convert"
+	ocispecs "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/urfave/cli/v2"
+)
+
+// stdioPath is the path denoting stdin (for images) or stdout (for outputs).
+const stdioPath = "-"
+
+// newImageFlags returns the flags that select (and configure the loading of)
+// the source image.
+func newImageFlags() []cli.Flag {
+	return append([]cli.Flag{
+		&cli.StringFlag{
+			Name:    "ref",
+			Aliases: []string{"r"},
+			Usage:   "Image reference (if more than one image is present)",
+		},
+		&cli.StringFlag{
+			Name:    "platform",
+			Aliases: []string{"p"},
+			Usage:   "Target platform in the 'os/arch' format",
+		},
+		&cli.IntFlag{
+			Name:    "jobs",
+			Aliases: []string{"j"},
+			Usage:   "Maximum number of layers to load concurrently",
+			Value:   runtime.NumCPU(),
+		},
+		newCacheDirFlag(),
+		&cli.GenericFlag{
+			Name:  "cache-max-size",
+			Usage: "Maximum size of the layer cache, least recently used entries are evicted",
+			Value: util.FromSize(convert.DefaultCacheMaxSize),
+		},
+		&cli.BoolFlag{
+			Name:  "no-cache",
+			Usage: "Disable the layer cache",
+		},
+	}, newRegistryFlags()...)
+}
+
+// parsePlatform parses the target platform (if specified).
+func parsePlatform(platform string) (*ocispecs.Platform, error) {
+	if platform == "" {
+		return nil, nil
+	}
+
+	parsed, err := platforms.Parse(platform)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse platform: %w", err)
+	}
+
+	return &parsed, nil
+}
+
+// cacheDirFromFlags returns the layer cache directory (or an empty string if
+// the cache is disabled).
+func cacheDirFromFlags(c *cli.Context) string {
+	if c.Bool("no-cache") {
+		return ""
+	}
+
+	return c.String("cache-dir")
+}
+
+// loadImage loads the image selected by ref and platform (in the 'os/arch'
+// format) from the source image. The returned function releases the image.
+func loadImage(c *cli.Context, imagePath, ref, platform string) (*image.Image, func(), error) {
+	target, err := parsePlatform(platform)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	tempDir, err := os.MkdirTemp("", "oci2erofs")
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create temporary directory: %w", err)
+	}
+
+	path, reader := imageInput(imagePath)
+
+	src, err := source.Open(c.Context, source.Options{
+		Path:     path,
+		Reader:   reader,
+		Registry: registryOptions(c),
+		TempDir:  tempDir,
+	})
+	if err != nil {
+		_ = os.RemoveAll(tempDir)
+		return nil, nil, err
+	}
+
+	release := func() {
+		_ = src.Close()
+		_ = os.RemoveAll(tempDir)
+	}
+
+	loader := &layer.Loader{
+		TempDir: tempDir,
+		Jobs:    c.Int("jobs"),
+	}
+
+	if cacheDir := cacheDirFromFlags(c); cacheDir != "" {
+		loader.Cache, err = cache.Open(cacheDir, int64(*c.Generic("cache-max-size").(*util.SizeFlag)))
+		if err != nil {
+			release()
+			return nil, nil, fmt.Errorf("failed to open layer cache: %w", err)
+		}
+	}
+
+	img, err := src.Load(c.Context, loader, ref, target)
+	if err != nil {
+		release()
+		return nil, nil, err
+	}
+
+	return img, func() {
+		_ = img.Close()
+		release()
+	}, nil
+}
+
+// imageInput returns the path of the source image, or a reader of stdin if the
+// image path is "-".
+func imageInput(imagePath string) (string, io.Reader) {
+	if imagePath == stdioPath {
+		return "", os.Stdin
+	}
+
+	return imagePath, nil
+}
@@ -0,0 +1,107 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+
+	"github.com/immutos/oci2erofs/internal/inspect"
+	"github.com/immutos/oci2erofs/internal/registry"
+	"github.com/immutos/oci2erofs/internal/source"
+	"github.com/urfave/cli/v2"
+)
+
+func newInspectCommand() *cli.Command {
+	return &cli.Command{
+		Name:      "inspect",
+		Usage:     "Describe the refs, manifests, platforms, layers, and configuration of an image",
+		ArgsUsage: "image_path | transport:image_path[:ref] | docker://image_ref",
+		Flags: append([]cli.Flag{
+			&cli.BoolFlag{
+				Name:  "json",
+				Usage: "Output in JSON format",
+			},
+		}, newRegistryFlags()...),
+		Action: func(c *cli.Context) error {
+			if c.NArg() != 1 {
+				slog.Error("Image path is required")
+				return cli.ShowSubcommandHelp(c)
+			}
+
+			tempDir, err := os.MkdirTemp("", "oci2erofs")
+			if err != nil {
+				return fmt.Errorf("failed to create temporary directory: %w", err)
+			}
+			defer os.RemoveAll(tempDir)
+
+			path, reader := imageInput(c.Args().First())
+
+			src, err := source.Open(c.Context, source.Options{
+				Path:     path,
+				Reader:   reader,
+				Registry: registryOptions(c),
+				TempDir:  tempDir,
+			})
+			if err != nil {
+				return err
+			}
+			defer src.Close()
+
+			report, err := inspect.Inspect(src)
+			if err != nil {
+				return fmt.Errorf("failed to inspect image: %w", err)
+			}
+
+			if c.Bool("json") {
+				return report.WriteJSON(os.Stdout)
+			}
+
+			return report.WriteText(os.Stdout)
+		},
+	}
+}
+
+func newRegistryFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.StringFlag{
+			Name:    "username",
+			Usage:   "Username for source registry authentication",
+			EnvVars: []string{"OCI2EROFS_USERNAME"},
+		},
+		&cli.StringFlag{
+			Name:    "password",
+			Usage:   "Password (or token) for source registry authentication",
+			EnvVars: []string{"OCI2EROFS_PASSWORD"},
+		},
+		&cli.BoolFlag{
+			Name:  "plain-http",
+			Usage: "Connect to the source registry over plain HTTP",
+		},
+	}
+}
+
+func registryOptions(c *cli.Context) registry.Options {
+	return registry.Options{
+		Username:  c.String("username"),
+		Password:  c.String("password"),
+		PlainHTTP: c.Bool("plain-http"),
+	}
+}
@@ -0,0 +1,142 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+// Package artifact packages EROFS filesystem images as OCI artifacts.
+package artifact
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/opencontainers/go-digest"
+	specs "github.com/opencontainers/image-spec/specs-go"
+	ocispecs "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+const (
+	// ArtifactType is the artifact type of manifests describing an EROFS
+	// filesystem image.
+	ArtifactType = "application/vnd.erofs.image.v1"
+	// MediaTypeLayer is the media type of an EROFS filesystem image layer.
+	MediaTypeLayer = "application/vnd.erofs.layer.v1"
+)
+
+// Options describes the image an EROFS filesystem image was converted from.
+type Options struct {
+	// Config is the configuration of the source image. The runtime
+	// configuration and platform are carried over to the artifact.
+	Config ocispecs.Image
+	// Subject is the descriptor of the source image manifest (if known).
+	Subject *ocispecs.Descriptor
+	// BaseName is the reference of the source image (if known).
+	BaseName string
+}
+
+// Artifact is an EROFS filesystem image packaged as an OCI artifact.
+type Artifact struct {
+	// Layer is the descriptor of the EROFS filesystem image.
+	Layer ocispecs.Descriptor
+	// Config is the descriptor of the artifact's image configuration.
+	Config ocispecs.Descriptor
+	// ConfigData is the serialized image configuration.
+	ConfigData []byte
+	// Manifest is the descriptor of the artifact's manifest (including the
+	// platform of the source image).
+	Manifest ocispecs.Descriptor
+	// ManifestData is the serialized manifest.
+	ManifestData []byte
+}
+
+// New packages the EROFS filesystem image described by layer as an OCI
+// artifact.
+func New(layer ocispecs.Descriptor, opts Options) (*Artifact, error) {
+	layer.MediaType = MediaTypeLayer
+
+	// The artifact is a single layer image (with the same runtime
+	// configuration as the source image).
+	config := opts.Config
+	config.RootFS = ocispecs.RootFS{
+		Type:    "layers",
+		DiffIDs: []digest.Digest{layer.Digest},
+	}
+	config.History = nil
+
+	configData, err := json.Marshal(config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal config: %w", err)
+	}
+
+	configDescriptor := ocispecs.Descriptor{
+		MediaType: ocispecs.MediaTypeImageConfig,
+		Digest:    digest.FromBytes(configData),
+		Size:      int64(len(configData)),
+	}
+
+	annotations := map[string]string{}
+	if opts.Subject != nil {
+		annotations[ocispecs.AnnotationBaseImageDigest] = opts.Subject.Digest.String()
+	}
+	if opts.BaseName != "" {
+		annotations[ocispecs.AnnotationBaseImageName] = opts.BaseName
+	}
+	if len(annotations) == 0 {
+		annotations = nil
+	}
+
+	var subject *ocispecs.Descriptor
+	if opts.Subject != nil {
+		subject = &ocispecs.Descriptor{
+			MediaType: opts.Subject.MediaType,
+			Digest:    opts.Subject.Digest,
+			Size:      opts.Subject.Size,
+		}
+	}
+
+	manifestData, err := json.Marshal(ocispecs.Manifest{
+		Versioned:    specs.Versioned{SchemaVersion: 2},
+		MediaType:    ocispecs.MediaTypeImageManifest,
+		ArtifactType: ArtifactType,
+		Config:       configDescriptor,
+		Layers:       []ocispecs.Descriptor{layer},
+		Subject:      subject,
+		Annotations:  annotations,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal manifest: %w", err)
+	}
+
+	manifestDescriptor := ocispecs.Descriptor{
+		MediaType:    ocispecs.MediaTypeImageManifest,
+		ArtifactType: ArtifactType,
+		Digest:       digest.FromBytes(manifestData),
+		Size:         int64(len(manifestData)),
+	}
+
+	if config.OS != "" {
+		platform := config.Platform
+		manifestDescriptor.Platform = &platform
+	}
+
+	return &Artifact{
+		Layer:        layer,
+		Config:       configDescriptor,
+		ConfigData:   configData,
+		Manifest:     manifestDescriptor,
+		ManifestData: manifestData,
+	}, nil
+}
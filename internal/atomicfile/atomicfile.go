@@ -0,0 +1,145 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+// Package atomicfile writes files atomically, so that readers (and failed
+// writes) never observe a partially written file.
+package atomicfile
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// File is written to a temporary file in the same directory as its final
+// path, and renamed into place when committed.
+type File struct {
+	*os.File
+	path      string
+	noClobber bool
+	done      bool
+}
+
+// Create creates a temporary file that will replace the file at path when
+// committed. If noClobber is set, an existing file at path is never replaced
+// (and an error satisfying fs.ErrExist is returned).
+func Create(path string, noClobber bool) (*File, error) {
+	if noClobber {
+		if _, err := os.Lstat(path); err == nil {
+			return nil, &fs.PathError{Op: "create", Path: path, Err: fs.ErrExist}
+		}
+	}
+
+	f, err := createTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp-")
+	if err != nil {
+		return nil, err
+	}
+
+	return &File{
+		File:      f,
+		path:      path,
+		noClobber: noClobber,
+	}, nil
+}
+
+// Commit flushes the file to stable storage and moves it into place.
+func (f *File) Commit() error {
+	if f.done {
+		return errors.New("file already committed or closed")
+	}
+	f.done = true
+
+	if err := f.File.Sync(); err != nil {
+		_ = f.File.Close()
+		_ = os.Remove(f.File.Name())
+		return fmt.Errorf("failed to sync file: %w", err)
+	}
+
+	if err := f.File.Close(); err != nil {
+		_ = os.Remove(f.File.Name())
+		return fmt.Errorf("failed to close file: %w", err)
+	}
+
+	// The file being replaced keeps its mode (new files are created subject
+	// to the umask).
+	if fi, err := os.Lstat(f.path); err == nil && fi.Mode().IsRegular() {
+		mode := fi.Mode() & (fs.ModePerm | fs.ModeSetuid | fs.ModeSetgid | fs.ModeSticky)
+		if err := os.Chmod(f.File.Name(), mode); err != nil {
+			_ = os.Remove(f.File.Name())
+			return fmt.Errorf("failed to change file permissions: %w", err)
+		}
+	}
+
+	if f.noClobber {
+		// Unlike renaming, linking fails if the path exists.
+		err := os.Link(f.File.Name(), f.path)
+		_ = os.Remove(f.File.Name())
+		if err != nil {
+			return fmt.Errorf("failed to move file into place: %w", err)
+		}
+	} else if err := os.Rename(f.File.Name(), f.path); err != nil {
+		_ = os.Remove(f.File.Name())
+		return fmt.Errorf("failed to move file into place: %w", err)
+	}
+
+	syncDir(filepath.Dir(f.path))
+
+	return nil
+}
+
+// Close discards the file, unless it has already been committed.
+func (f *File) Close() error {
+	if f.done {
+		return nil
+	}
+	f.done = true
+
+	return errors.Join(f.File.Close(), os.Remove(f.File.Name()))
+}
+
+// createTemp creates a new temporary file in dir, named with the prefix and a
+// random suffix. Unlike os.CreateTemp (which uses 0600), the file is created
+// with the permissions of a new file, 0666 less the umask.
+func createTemp(dir, prefix string) (*os.File, error) {
+	for try := 0; ; try++ {
+		name := filepath.Join(dir, prefix+strconv.FormatUint(uint64(rand.Uint32()), 10))
+
+		f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0o666)
+		if errors.Is(err, fs.ErrExist) && try < 10000 {
+			continue
+		}
+
+		return f, err
+	}
+}
+
+// syncDir flushes the directory entry of a renamed file to stable storage (on
+// a best effort basis, as not all platforms support syncing directories).
+func syncDir(dir string) {
+	d, err := os.Open(dir)
+	if err != nil {
+		return
+	}
+	defer d.Close()
+
+	_ = d.Sync()
+}
@@ -0,0 +1,138 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package atomicfile_test
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/immutos/oci2erofs/internal/atomicfile"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFile(t *testing.T) {
+	t.Run("Commit", func(t *testing.T) {
+		dir := t.TempDir()
+		path := filepath.Join(dir, "image.erofs")
+		require.NoError(t, os.WriteFile(path, []byte("previous"), 0o644))
+
+		f, err := atomicfile.Create(path, false)
+		require.NoError(t, err)
+
+		_, err = f.WriteString("next")
+		require.NoError(t, err)
+
+		// The previous file is untouched until committed.
+		data, err := os.ReadFile(path)
+		require.NoError(t, err)
+		require.Equal(t, "previous", string(data))
+
+		require.NoError(t, f.Commit())
+		require.NoError(t, f.Close())
+
+		data, err = os.ReadFile(path)
+		require.NoError(t, err)
+		require.Equal(t, "next", string(data))
+
+		entries, err := os.ReadDir(dir)
+		require.NoError(t, err)
+		require.Len(t, entries, 1)
+	})
+
+	t.Run("Mode", func(t *testing.T) {
+		dir := t.TempDir()
+
+		// New files are created subject to the umask.
+		newPath := filepath.Join(dir, "new.erofs")
+		require.NoError(t, os.WriteFile(filepath.Join(dir, "reference"), nil, 0o666))
+
+		f, err := atomicfile.Create(newPath, false)
+		require.NoError(t, err)
+		require.NoError(t, f.Commit())
+
+		reference, err := os.Stat(filepath.Join(dir, "reference"))
+		require.NoError(t, err)
+
+		fi, err := os.Stat(newPath)
+		require.NoError(t, err)
+		require.Equal(t, reference.Mode(), fi.Mode())
+
+		// Replaced files keep their mode.
+		existingPath := filepath.Join(dir, "existing.erofs")
+		require.NoError(t, os.WriteFile(existingPath, []byte("previous"), 0o600))
+		require.NoError(t, os.Chmod(existingPath, 0o640))
+
+		f, err = atomicfile.Create(existingPath, false)
+		require.NoError(t, err)
+		require.NoError(t, f.Commit())
+
+		fi, err = os.Stat(existingPath)
+		require.NoError(t, err)
+		require.Equal(t, fs.FileMode(0o640), fi.Mode())
+	})
+
+	t.Run("Close", func(t *testing.T) {
+		dir := t.TempDir()
+		path := filepath.Join(dir, "image.erofs")
+		require.NoError(t, os.WriteFile(path, []byte("previous"), 0o644))
+
+		f, err := atomicfile.Create(path, false)
+		require.NoError(t, err)
+
+		_, err = f.WriteString("partial")
+		require.NoError(t, err)
+		require.NoError(t, f.Close())
+
+		data, err := os.ReadFile(path)
+		require.NoError(t, err)
+		require.Equal(t, "previous", string(data))
+
+		entries, err := os.ReadDir(dir)
+		require.NoError(t, err)
+		require.Len(t, entries, 1)
+	})
+
+	t.Run("No Clobber", func(t *testing.T) {
+		dir := t.TempDir()
+		path := filepath.Join(dir, "image.erofs")
+		require.NoError(t, os.WriteFile(path, []byte("previous"), 0o644))
+
+		_, err := atomicfile.Create(path, true)
+		require.ErrorIs(t, err, fs.ErrExist)
+
+		// The file may appear while the temporary file is being written.
+		otherPath := filepath.Join(dir, "other.erofs")
+
+		f, err := atomicfile.Create(otherPath, true)
+		require.NoError(t, err)
+
+		require.NoError(t, os.WriteFile(otherPath, []byte("concurrent"), 0o644))
+		require.ErrorIs(t, f.Commit(), fs.ErrExist)
+
+		data, err := os.ReadFile(otherPath)
+		require.NoError(t, err)
+		require.Equal(t, "concurrent", string(data))
+
+		entries, err := os.ReadDir(dir)
+		require.NoError(t, err)
+		require.Len(t, entries, 2)
+	})
+}
@@ -0,0 +1,303 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+// Package browse describes the contents of (merged) root filesystems, in the
+// style of ls, tree, cat, stat, and readlink.
+package browse
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"text/tabwriter"
+	"time"
+
+	"github.com/immutos/oci2erofs/internal/fsutil"
+)
+
+const timeFormat = "2006-01-02 15:04"
+
+// CleanPath converts a (possibly absolute) path within the root filesystem
+// into a path suitable for use with fs.FS.
+func CleanPath(name string) string {
+	name = path.Clean("/" + name)
+	if name == "/" {
+		return "."
+	}
+
+	return name[1:]
+}
+
+// List writes the entries of the named directory to w (or the named file
+// itself, if it is not a directory). If long is set, the mode, ownership,
+// size, and modification time of each entry are included.
+func List(w io.Writer, fsys fs.FS, name string, long bool) error {
+	name = CleanPath(name)
+
+	fi, err := fsutil.StatLink(fsys, name)
+	if err != nil {
+		return err
+	}
+
+	if !isDir(fsys, name, fi) {
+		return listEntry(w, fsys, name, fi, long)
+	}
+
+	entries, err := fs.ReadDir(fsys, name)
+	if err != nil {
+		return fmt.Errorf("failed to read directory: %w", err)
+	}
+
+	for _, entry := range entries {
+		fi, err := entry.Info()
+		if err != nil {
+			return fmt.Errorf("failed to stat %q: %w", entry.Name(), err)
+		}
+
+		if err := listEntry(w, fsys, path.Join(name, entry.Name()), fi, long); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func listEntry(w io.Writer, fsys fs.FS, name string, fi fs.FileInfo, long bool) error {
+	display := fi.Name()
+	if fi.Mode()&fs.ModeSymlink != 0 && long {
+		target, err := fsutil.ReadLink(fsys, name)
+		if err != nil {
+			return err
+		}
+
+		display += " -> " + target
+	}
+
+	if !long {
+		_, err := fmt.Fprintln(w, display)
+		return err
+	}
+
+	uid, gid := fsutil.Owner(fi)
+	_, err := fmt.Fprintf(w, "%s %5d %5d %10d %s %s\n",
+		FormatMode(fi.Mode()), uid, gid, fi.Size(), fi.ModTime().UTC().Format(timeFormat), display)
+	return err
+}
+
+// Tree writes the hierarchy below the named directory to w. Symlinks below
+// the named directory are not followed.
+func Tree(w io.Writer, fsys fs.FS, name string) error {
+	name = CleanPath(name)
+
+	fi, err := fsutil.StatLink(fsys, name)
+	if err != nil {
+		return err
+	}
+
+	if _, err := fmt.Fprintln(w, fsutil.DisplayPath(name)); err != nil {
+		return err
+	}
+
+	if !isDir(fsys, name, fi) {
+		return nil
+	}
+
+	return tree(w, fsys, name, "")
+}
+
+func tree(w io.Writer, fsys fs.FS, name, prefix string) error {
+	entries, err := fs.ReadDir(fsys, name)
+	if err != nil {
+		return fmt.Errorf("failed to read directory %q: %w", fsutil.DisplayPath(name), err)
+	}
+
+	for i, entry := range entries {
+		branch, indent := "├── ", "│   "
+		if i == len(entries)-1 {
+			branch, indent = "└── ", "    "
+		}
+
+		entryPath := path.Join(name, entry.Name())
+
+		display := entry.Name()
+		if entry.Type()&fs.ModeSymlink != 0 {
+			target, err := fsutil.ReadLink(fsys, entryPath)
+			if err != nil {
+				return err
+			}
+
+			display += " -> " + target
+		}
+
+		if _, err := fmt.Fprintln(w, prefix+branch+display); err != nil {
+			return err
+		}
+
+		if entry.IsDir() {
+			if err := tree(w, fsys, entryPath, prefix+indent); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// Cat writes the contents of the named file to w (following symlinks).
+func Cat(w io.Writer, fsys fs.FS, name string) error {
+	f, err := fsys.Open(CleanPath(name))
+	if err != nil {
+		return fmt.Errorf("failed to open file: %w", err)
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to stat file: %w", err)
+	}
+
+	if !fi.Mode().IsRegular() {
+		return fmt.Errorf("%s is not a regular file", fsutil.DisplayPath(CleanPath(name)))
+	}
+
+	if _, err := io.Copy(w, f); err != nil {
+		return fmt.Errorf("failed to read file: %w", err)
+	}
+
+	return nil
+}
+
+// Stat writes a description of the named file to w (without following
+// symlinks).
+func Stat(w io.Writer, fsys fs.FS, name string) error {
+	name = CleanPath(name)
+
+	fi, err := fsutil.StatLink(fsys, name)
+	if err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 4, 1, ' ', 0)
+
+	fmt.Fprintf(tw, "Path:\t%s\n", fsutil.DisplayPath(name))
+	fmt.Fprintf(tw, "Type:\t%s\n", fsutil.TypeName(fi.Mode()))
+	fmt.Fprintf(tw, "Mode:\t%04o (%s)\n", fsutil.UnixPerm(fi.Mode()), FormatMode(fi.Mode()))
+
+	uid, gid := fsutil.Owner(fi)
+	fmt.Fprintf(tw, "Uid:\t%d%s\n", uid, ownerName(fi, true))
+	fmt.Fprintf(tw, "Gid:\t%d%s\n", gid, ownerName(fi, false))
+	fmt.Fprintf(tw, "Size:\t%d\n", fi.Size())
+	fmt.Fprintf(tw, "Modified:\t%s\n", fi.ModTime().UTC().Format(time.RFC3339))
+
+	if fi.Mode()&fs.ModeSymlink != 0 {
+		target, err := fsutil.ReadLink(fsys, name)
+		if err != nil {
+			return err
+		}
+
+		fmt.Fprintf(tw, "Target:\t%s\n", target)
+	}
+
+	return tw.Flush()
+}
+
+// ReadLink writes the target of the named symlink to w.
+func ReadLink(w io.Writer, fsys fs.FS, name string) error {
+	target, err := fsutil.ReadLink(fsys, CleanPath(name))
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintln(w, target)
+	return err
+}
+
+// FormatMode formats the file mode in the style of ls (eg. "drwxr-xr-x").
+func FormatMode(mode fs.FileMode) string {
+	b := []byte("----------")
+
+	switch mode.Type() {
+	case fs.ModeDir:
+		b[0] = 'd'
+	case fs.ModeSymlink:
+		b[0] = 'l'
+	case fs.ModeNamedPipe:
+		b[0] = 'p'
+	case fs.ModeSocket:
+		b[0] = 's'
+	case fs.ModeDevice | fs.ModeCharDevice:
+		b[0] = 'c'
+	case fs.ModeDevice:
+		b[0] = 'b'
+	}
+
+	const rwx = "rwxrwxrwx"
+	for i := 0; i < 9; i++ {
+		if mode&(1<<uint(8-i)) != 0 {
+			b[i+1] = rwx[i]
+		}
+	}
+
+	special := func(i int, set bool, exec, noExec byte) {
+		if !set {
+			return
+		}
+
+		if b[i] == '-' {
+			b[i] = noExec
+		} else {
+			b[i] = exec
+		}
+	}
+
+	special(3, mode&fs.ModeSetuid != 0, 's', 'S')
+	special(6, mode&fs.ModeSetgid != 0, 's', 'S')
+	special(9, mode&fs.ModeSticky != 0, 't', 'T')
+
+	return string(b)
+}
+
+func ownerName(fi fs.FileInfo, user bool) string {
+	hdr, ok := fi.Sys().(*tar.Header)
+	if !ok {
+		return ""
+	}
+
+	name := hdr.Gname
+	if user {
+		name = hdr.Uname
+	}
+
+	if name == "" {
+		return ""
+	}
+
+	return " (" + name + ")"
+}
+
+// isDir reports whether the named file is a directory, or a symlink to one.
+func isDir(fsys fs.FS, name string, fi fs.FileInfo) bool {
+	if fi.Mode()&fs.ModeSymlink == 0 {
+		return fi.IsDir()
+	}
+
+	fi, err := fs.Stat(fsys, name)
+	return err == nil && fi.IsDir()
+}
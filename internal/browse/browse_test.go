@@ -0,0 +1,132 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package browse_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/fs"
+	"testing"
+	"time"
+
+	"github.com/immutos/oci2erofs/internal/browse"
+	"github.com/immutos/oci2erofs/internal/tarfs"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBrowse(t *testing.T) {
+	modTime := time.Date(2024, 7, 23, 5, 45, 0, 0, time.UTC)
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+
+	for _, hdr := range []tar.Header{
+		{Typeflag: tar.TypeDir, Name: "etc/", Mode: 0o755},
+		{Typeflag: tar.TypeReg, Name: "etc/hostname", Mode: 0o644, Uid: 1000, Gid: 1000, Uname: "user", Gname: "users", Size: 9},
+		{Typeflag: tar.TypeDir, Name: "tmp/", Mode: 0o1777},
+		{Typeflag: tar.TypeSymlink, Name: "hostname", Linkname: "etc/hostname", Mode: 0o777},
+		{Typeflag: tar.TypeSymlink, Name: "config", Linkname: "etc", Mode: 0o777},
+	} {
+		hdr.ModTime = modTime
+		require.NoError(t, tw.WriteHeader(&hdr))
+
+		if hdr.Size > 0 {
+			_, err := tw.Write([]byte("localhost"))
+			require.NoError(t, err)
+		}
+	}
+	require.NoError(t, tw.Close())
+
+	fsys, err := tarfs.Open(bytes.NewReader(buf.Bytes()))
+	require.NoError(t, err)
+
+	t.Run("List", func(t *testing.T) {
+		var out bytes.Buffer
+		require.NoError(t, browse.List(&out, fsys, "/", false))
+		require.Equal(t, "config\netc\nhostname\ntmp\n", out.String())
+
+		out.Reset()
+		require.NoError(t, browse.List(&out, fsys, "/", true))
+		require.Equal(t, `lrwxrwxrwx     0     0          0 2024-07-23 05:45 config -> etc
+drwxr-xr-x     0     0          0 2024-07-23 05:45 etc
+lrwxrwxrwx     0     0          0 2024-07-23 05:45 hostname -> etc/hostname
+drwxrwxrwt     0     0          0 2024-07-23 05:45 tmp
+`, out.String())
+
+		out.Reset()
+		require.NoError(t, browse.List(&out, fsys, "/config", false))
+		require.Equal(t, "hostname\n", out.String())
+
+		out.Reset()
+		require.Error(t, browse.List(&out, fsys, "/missing", false))
+	})
+
+	t.Run("Tree", func(t *testing.T) {
+		var out bytes.Buffer
+		require.NoError(t, browse.Tree(&out, fsys, "/"))
+		require.Equal(t, `/
+├── config -> etc
+├── etc
+│   └── hostname
+├── hostname -> etc/hostname
+└── tmp
+`, out.String())
+	})
+
+	t.Run("Cat", func(t *testing.T) {
+		var out bytes.Buffer
+		require.NoError(t, browse.Cat(&out, fsys, "/hostname"))
+		require.Equal(t, "localhost", out.String())
+
+		require.Error(t, browse.Cat(&out, fsys, "/etc"))
+	})
+
+	t.Run("Stat", func(t *testing.T) {
+		var out bytes.Buffer
+		require.NoError(t, browse.Stat(&out, fsys, "/etc/hostname"))
+		require.Equal(t, `Path:     /etc/hostname
+Type:     regular file
+Mode:     0644 (-rw-r--r--)
+Uid:      1000 (user)
+Gid:      1000 (users)
+Size:     9
+Modified: 2024-07-23T05:45:00Z
+`, out.String())
+
+		out.Reset()
+		require.NoError(t, browse.Stat(&out, fsys, "/hostname"))
+		require.Contains(t, out.String(), "Type:     symbolic link\n")
+		require.Contains(t, out.String(), "Target:   etc/hostname\n")
+	})
+
+	t.Run("ReadLink", func(t *testing.T) {
+		var out bytes.Buffer
+		require.NoError(t, browse.ReadLink(&out, fsys, "/hostname"))
+		require.Equal(t, "etc/hostname\n", out.String())
+
+		require.Error(t, browse.ReadLink(&out, fsys, "/etc/hostname"))
+	})
+
+	t.Run("FormatMode", func(t *testing.T) {
+		require.Equal(t, "-rwsr-xr-x", browse.FormatMode(0o755|fs.ModeSetuid))
+		require.Equal(t, "-rw-r-Sr--", browse.FormatMode(0o644|fs.ModeSetgid))
+		require.Equal(t, "crw-rw-rw-", browse.FormatMode(0o666|fs.ModeDevice|fs.ModeCharDevice))
+		require.Equal(t, "brw-------", browse.FormatMode(0o600|fs.ModeDevice))
+	})
+}
@@ -0,0 +1,275 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+// Package buildfile reads build files, which declare conversion jobs (so
+// that conversions can be versioned alongside the code that uses them).
+package buildfile
+
+import (
+	"bytes"
+	"cmp"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/containerd/containerd/platforms"
+	"github.com/immutos/oci2erofs/internal/registry"
+	"github.com/immutos/oci2erofs/internal/source"
+	"github.com/immutos/oci2erofs/internal/util"
+	"github.com/immutos/oci2erofs/internal/xattr"
+	"github.com/immutos/oci2erofs/pkg/convert"
+	"gopkg.in/yaml.v3"
+)
+
+// Version is the version of the build file schema.
+const Version = 1
+
+// Formats are the supported output formats.
+var Formats = []string{"erofs", "oci", "dir", "tar"}
+
+// File is a build file.
+type File struct {
+	// Version is the version of the build file schema (see Version).
+	Version int `yaml:"version"`
+	// Jobs are the conversions to perform (in order).
+	Jobs []Job `yaml:"jobs"`
+}
+
+// Job is a conversion job. The fields correspond to the command line flags
+// of the same name, unset fields take the value given on the command line
+// (or the flag's default).
+type Job struct {
+	// Name identifies the job (defaults to its input).
+	Name string `yaml:"name"`
+	// Input is the path of the source image (optionally prefixed with a
+	// transport, eg. "oci-archive:image.tar:latest"), or a registry reference
+	// prefixed with "docker://". Relative paths are relative to the build
+	// file.
+	Input string `yaml:"input"`
+	// Ref is the image reference (if more than one image is present).
+	Ref string `yaml:"ref"`
+	// Platform is the target platform in the 'os/arch' format.
+	Platform string `yaml:"platform"`
+	// Output is the path of the output. Relative paths are relative to the
+	// build file.
+	Output string `yaml:"output"`
+	// Format is the output format (one of Formats).
+	Format string `yaml:"format"`
+	// Tag is the tag of the artifact in the OCI image layout.
+	Tag string `yaml:"tag"`
+	// Push is a registry reference to push the EROFS filesystem image to.
+	Push string `yaml:"push"`
+	// All converts every image in the archive (the output is a naming
+	// template).
+	All bool `yaml:"all"`
+	// NoClobber prevents existing output files from being overwritten.
+	NoClobber bool `yaml:"noClobber"`
+	// Report is the path to write the conversion report to. Relative paths
+	// are relative to the build file.
+	Report string `yaml:"report"`
+	// SameOwner applies the ownership recorded in the image to extracted
+	// files (for the 'dir' output format).
+	SameOwner *bool `yaml:"sameOwner"`
+	// NumericOwner records only numeric user and group IDs (for the 'tar'
+	// output format).
+	NumericOwner bool `yaml:"numericOwner"`
+	// SkipDevices omits character and block devices from the output.
+	SkipDevices bool `yaml:"skipDevices"`
+	// XattrsAllow are the extended attribute namespaces (or names) to store
+	// in the EROFS filesystem image.
+	XattrsAllow []string `yaml:"xattrsAllow"`
+	// XattrsDeny are the extended attribute namespaces (or names) not to
+	// store in the EROFS filesystem image.
+	XattrsDeny []string `yaml:"xattrsDeny"`
+	// Compression is the algorithm used to compress regular files in the
+	// EROFS filesystem image (one of "lz4", "lz4hc", "lzma", or "deflate").
+	Compression string `yaml:"compression"`
+	// CompressionLevel is the compression level.
+	CompressionLevel int `yaml:"compressionLevel"`
+	// PclusterSize is the maximum size of a physical cluster of compressed
+	// data (with an optional binary unit suffix, eg. "64KiB").
+	PclusterSize string `yaml:"pclusterSize"`
+	// CompressionExclude are patterns of files to store uncompressed.
+	CompressionExclude []string `yaml:"compressionExclude"`
+	// Reproducible produces byte-identical EROFS filesystem images from the
+	// same image.
+	Reproducible bool `yaml:"reproducible"`
+}
+
+// Load reads and validates the build file at path. Relative paths in the
+// build file are resolved against its directory.
+func Load(path string) (*File, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open build file: %w", err)
+	}
+	defer f.Close()
+
+	file, err := Decode(f)
+	if err != nil {
+		return nil, err
+	}
+
+	file.resolvePaths(filepath.Dir(path))
+
+	return file, nil
+}
+
+// Decode reads and validates a build file. Unknown fields are rejected.
+func Decode(r io.Reader) (*File, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read build file: %w", err)
+	}
+
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+
+	var file File
+	if err := dec.Decode(&file); err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, errors.New("build file is empty")
+		}
+
+		return nil, fmt.Errorf("failed to decode build file: %w", err)
+	}
+
+	// Default the names first, so that unnamed jobs with the same input are
+	// reported as duplicates.
+	for i := range file.Jobs {
+		if file.Jobs[i].Name == "" {
+			file.Jobs[i].Name = file.Jobs[i].Input
+		}
+	}
+
+	if err := file.Validate(); err != nil {
+		return nil, err
+	}
+
+	return &file, nil
+}
+
+// Validate checks that the build file is well formed.
+func (f *File) Validate() error {
+	if f.Version != Version {
+		return fmt.Errorf("unsupported build file version %d (expected %d)", f.Version, Version)
+	}
+
+	if len(f.Jobs) == 0 {
+		return errors.New("build file has no jobs")
+	}
+
+	var errs []error
+	names := make(map[string]bool)
+	for i, job := range f.Jobs {
+		for _, err := range job.problems() {
+			errs = append(errs, fmt.Errorf("jobs[%d]: %w", i, err))
+		}
+
+		if name := cmp.Or(job.Name, job.Input); name != "" {
+			if names[name] {
+				errs = append(errs, fmt.Errorf("jobs[%d]: duplicate job name %q", i, name))
+			}
+			names[name] = true
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// Validate checks that the job is well formed.
+func (j *Job) Validate() error {
+	return errors.Join(j.problems()...)
+}
+
+// problems returns the reasons the job is not well formed.
+func (j *Job) problems() []error {
+	var errs []error
+
+	if j.Input == "" {
+		errs = append(errs, errors.New("input is required"))
+	}
+
+	if j.Format != "" && !slices.Contains(Formats, j.Format) {
+		errs = append(errs, fmt.Errorf("unsupported format %q (expected one of %s)", j.Format, strings.Join(Formats, ", ")))
+	}
+
+	if j.Platform != "" {
+		if _, err := platforms.Parse(j.Platform); err != nil {
+			errs = append(errs, fmt.Errorf("invalid platform: %w", err))
+		}
+	}
+
+	if j.Push != "" && !strings.HasPrefix(j.Push, registry.TransportPrefix) {
+		errs = append(errs, fmt.Errorf("push reference must be prefixed with %q", registry.TransportPrefix))
+	}
+
+	if j.All && (j.Ref != "" || j.Platform != "") {
+		errs = append(errs, errors.New("ref and platform cannot be specified when converting all images"))
+	}
+
+	if _, err := xattr.ParseFilter(strings.Join(j.XattrsAllow, ","), strings.Join(j.XattrsDeny, ",")); err != nil {
+		errs = append(errs, err)
+	}
+
+	compression := convert.Compression{
+		Algorithm: j.Compression,
+		Level:     j.CompressionLevel,
+		Exclude:   j.CompressionExclude,
+	}
+
+	if j.PclusterSize != "" {
+		size, err := util.ParseSize(j.PclusterSize)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("invalid physical cluster size: %w", err))
+		}
+		compression.PclusterSize = int(size)
+	}
+
+	if err := compression.Validate(); err != nil {
+		errs = append(errs, fmt.Errorf("invalid compression options: %w", err))
+	}
+
+	return errs
+}
+
+// resolvePaths makes relative paths in the jobs relative to dir.
+func (f *File) resolvePaths(dir string) {
+	resolve := func(path string) string {
+		if path == "" || path == "-" || filepath.IsAbs(path) {
+			return path
+		}
+
+		return filepath.Join(dir, path)
+	}
+
+	for i := range f.Jobs {
+		job := &f.Jobs[i]
+
+		if input := source.ParseInput(job.Input); input.Transport != source.TransportDocker {
+			input.Path = resolve(input.Path)
+			job.Input = input.String()
+		}
+		job.Output = resolve(job.Output)
+		job.Report = resolve(job.Report)
+	}
+}
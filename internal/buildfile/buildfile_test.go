@@ -0,0 +1,123 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package buildfile_test
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/immutos/oci2erofs/internal/buildfile"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoad(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "oci2erofs.yaml")
+
+	require.NoError(t, os.WriteFile(path, []byte(`version: 1
+jobs:
+  - name: busybox
+    input: docker://docker.io/library/busybox:latest
+    platform: linux/arm64
+    output: out/busybox.erofs
+    report: /tmp/report.json
+  - input: images/toybox.tar
+    format: tar
+    sameOwner: false
+`), 0o644))
+
+	file, err := buildfile.Load(path)
+	require.NoError(t, err)
+
+	falseValue := false
+	require.Equal(t, []buildfile.Job{
+		{
+			Name:     "busybox",
+			Input:    "docker://docker.io/library/busybox:latest",
+			Platform: "linux/arm64",
+			Output:   filepath.Join(dir, "out/busybox.erofs"),
+			Report:   "/tmp/report.json",
+		},
+		{
+			Name:      "images/toybox.tar",
+			Input:     filepath.Join(dir, "images/toybox.tar"),
+			Format:    "tar",
+			SameOwner: &falseValue,
+		},
+	}, file.Jobs)
+}
+
+func TestDecode(t *testing.T) {
+	t.Run("Empty", func(t *testing.T) {
+		_, err := buildfile.Decode(strings.NewReader(""))
+		require.ErrorContains(t, err, "build file is empty")
+	})
+
+	t.Run("Unsupported Version", func(t *testing.T) {
+		_, err := buildfile.Decode(strings.NewReader("version: 2\njobs:\n  - input: image.tar\n"))
+		require.ErrorContains(t, err, "unsupported build file version 2")
+	})
+
+	t.Run("No Jobs", func(t *testing.T) {
+		_, err := buildfile.Decode(strings.NewReader("version: 1\n"))
+		require.ErrorContains(t, err, "build file has no jobs")
+	})
+
+	t.Run("Unknown Field", func(t *testing.T) {
+		_, err := buildfile.Decode(strings.NewReader("version: 1\njobs:\n  - input: image.tar\n    squash: true\n"))
+		require.ErrorContains(t, err, "field squash not found")
+	})
+
+	t.Run("Invalid Job", func(t *testing.T) {
+		_, err := buildfile.Decode(strings.NewReader("version: 1\njobs:\n  - format: squashfs\n    platform: a/b/c/d\n"))
+		require.ErrorContains(t, err, "jobs[0]: input is required\njobs[0]: unsupported format \"squashfs\"")
+	})
+
+	t.Run("Duplicate Names", func(t *testing.T) {
+		_, err := buildfile.Decode(strings.NewReader("version: 1\njobs:\n  - name: a\n    input: a.tar\n  - name: a\n    input: b.tar\n"))
+		require.ErrorContains(t, err, "jobs[1]: duplicate job name \"a\"")
+	})
+
+	t.Run("Duplicate Default Names", func(t *testing.T) {
+		_, err := buildfile.Decode(strings.NewReader("version: 1\njobs:\n  - input: a.tar\n    platform: linux/amd64\n  - input: a.tar\n    platform: linux/arm64\n"))
+		require.ErrorContains(t, err, "jobs[1]: duplicate job name \"a.tar\"")
+	})
+
+	t.Run("All With Platform", func(t *testing.T) {
+		_, err := buildfile.Decode(strings.NewReader("version: 1\njobs:\n  - input: a.tar\n    all: true\n    platform: linux/amd64\n"))
+		require.ErrorContains(t, err, "ref and platform cannot be specified when converting all images")
+	})
+
+	t.Run("Push Without Transport", func(t *testing.T) {
+		_, err := buildfile.Decode(strings.NewReader("version: 1\njobs:\n  - input: a.tar\n    push: registry.example.com/a\n"))
+		require.ErrorContains(t, err, "push reference must be prefixed with \"docker://\"")
+	})
+
+	t.Run("Invalid Xattr Pattern", func(t *testing.T) {
+		_, err := buildfile.Decode(strings.NewReader("version: 1\njobs:\n  - input: a.tar\n    xattrsDeny: [user.]\n"))
+		require.ErrorContains(t, err, "jobs[0]: invalid denied extended attributes: invalid pattern \"user.\"")
+	})
+
+	t.Run("Invalid Compression", func(t *testing.T) {
+		_, err := buildfile.Decode(strings.NewReader("version: 1\njobs:\n  - input: a.tar\n    compression: lz4\n    compressionLevel: 9\n    pclusterSize: 6KiB\n"))
+		require.ErrorContains(t, err, "jobs[0]: invalid compression options: compression algorithm \"lz4\" does not support levels")
+	})
+}
@@ -0,0 +1,296 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+// Package cache implements a content addressed cache of image layers (and data
+// derived from them), that can be safely shared between concurrent processes.
+package cache
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+)
+
+// DefaultMaxSize is the default size in bytes above which the least recently
+// used entries are evicted from the cache.
+const DefaultMaxSize = 10 << 30
+
+const tempPrefix = ".tmp-"
+
+// Cache is a content addressed cache of image layers.
+//
+// Entries are populated while holding a shared lock on the cache (and an
+// exclusive lock on the entry), pruning takes an exclusive lock on the cache.
+type Cache struct {
+	dir     string
+	maxSize int64
+}
+
+// DefaultDir returns the default cache directory, eg. on Linux
+// "$XDG_CACHE_HOME/oci2erofs".
+func DefaultDir() (string, error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", fmt.Errorf("failed to determine user cache directory: %w", err)
+	}
+
+	return filepath.Join(dir, "oci2erofs"), nil
+}
+
+// Open opens the cache in dir, creating it if it does not exist. After a new
+// entry is added, least recently used entries are evicted until the total
+// size of the cache is no more than maxSize bytes (if maxSize is positive).
+func Open(dir string, maxSize int64) (*Cache, error) {
+	c := &Cache{
+		dir:     dir,
+		maxSize: maxSize,
+	}
+
+	for _, dir := range []string{c.entriesDir(), c.locksDir()} {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return nil, fmt.Errorf("failed to create cache directory: %w", err)
+		}
+	}
+
+	return c, nil
+}
+
+// Get opens the cache entry for the given digest. If the entry does not exist,
+// fill is called to write its content. It is the responsibility of fill to
+// verify that the content it writes matches the digest.
+func (c *Cache) Get(dgst digest.Digest, fill func(w io.Writer) error) (*os.File, error) {
+	return c.GetDerived(dgst, "", fill)
+}
+
+// GetDerived opens the cache entry of the given kind (eg. an index) that is
+// derived from the content with the given digest. If the entry does not exist,
+// fill is called to write its content.
+func (c *Cache) GetDerived(dgst digest.Digest, kind string, fill func(w io.Writer) error) (*os.File, error) {
+	name, err := entryName(dgst, kind)
+	if err != nil {
+		return nil, err
+	}
+
+	f, added, err := c.get(name, fill)
+	if err != nil {
+		return nil, err
+	}
+
+	if added && c.maxSize > 0 {
+		if _, err := c.Prune(c.maxSize); err != nil {
+			slog.Warn("Failed to prune cache", slog.Any("error", err))
+		}
+	}
+
+	return f, nil
+}
+
+// Lookup opens the cache entry for the given digest, returning an error
+// satisfying errors.Is(err, fs.ErrNotExist) if there is no such entry.
+func (c *Cache) Lookup(dgst digest.Digest) (*os.File, error) {
+	name, err := entryName(dgst, "")
+	if err != nil {
+		return nil, err
+	}
+
+	unlock, err := lockFile(c.lockPath(), false)
+	if err != nil {
+		return nil, fmt.Errorf("failed to lock cache: %w", err)
+	}
+	defer unlock()
+
+	return c.open(filepath.Join(c.entriesDir(), name))
+}
+
+func (c *Cache) get(name string, fill func(w io.Writer) error) (*os.File, bool, error) {
+	unlock, err := lockFile(c.lockPath(), false)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to lock cache: %w", err)
+	}
+	defer unlock()
+
+	path := filepath.Join(c.entriesDir(), name)
+
+	if f, err := c.open(path); err == nil || !errors.Is(err, os.ErrNotExist) {
+		return f, false, err
+	}
+
+	unlockEntry, err := lockFile(filepath.Join(c.locksDir(), name), true)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to lock cache entry: %w", err)
+	}
+	defer unlockEntry()
+
+	// Another process may have populated the entry while we were waiting.
+	if f, err := c.open(path); err == nil || !errors.Is(err, os.ErrNotExist) {
+		return f, false, err
+	}
+
+	slog.Debug("Populating cache entry", slog.String("name", name))
+
+	tempFile, err := os.CreateTemp(c.entriesDir(), tempPrefix+"*")
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to create temporary cache file: %w", err)
+	}
+	defer os.Remove(tempFile.Name())
+	defer tempFile.Close()
+
+	if err := fill(tempFile); err != nil {
+		return nil, false, err
+	}
+
+	if err := tempFile.Chmod(0o644); err != nil {
+		return nil, false, fmt.Errorf("failed to set cache file permissions: %w", err)
+	}
+
+	if err := tempFile.Close(); err != nil {
+		return nil, false, fmt.Errorf("failed to close temporary cache file: %w", err)
+	}
+
+	if err := os.Rename(tempFile.Name(), path); err != nil {
+		return nil, false, fmt.Errorf("failed to rename temporary cache file: %w", err)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to open cache entry: %w", err)
+	}
+
+	return f, true, nil
+}
+
+// open opens an existing cache entry, recording the time it was last used.
+func (c *Cache) open(path string) (*os.File, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	if err := os.Chtimes(path, now, now); err != nil {
+		slog.Debug("Failed to update cache entry modification time", slog.Any("error", err))
+	}
+
+	return f, nil
+}
+
+// PruneStats describes the entries removed from the cache by Prune.
+type PruneStats struct {
+	// Entries is the number of entries removed.
+	Entries int
+	// Size is the total size in bytes of the entries removed.
+	Size int64
+}
+
+// Prune removes the least recently used entries from the cache until its
+// total size is no more than maxSize bytes. A maxSize of zero removes all
+// entries.
+func (c *Cache) Prune(maxSize int64) (*PruneStats, error) {
+	unlock, err := lockFile(c.lockPath(), true)
+	if err != nil {
+		return nil, fmt.Errorf("failed to lock cache: %w", err)
+	}
+	defer unlock()
+
+	dirEntries, err := os.ReadDir(c.entriesDir())
+	if err != nil {
+		return nil, fmt.Errorf("failed to read cache directory: %w", err)
+	}
+
+	var entries []fs.FileInfo
+	var totalSize int64
+	for _, dirEntry := range dirEntries {
+		// No entries can be in the process of being populated while we hold the
+		// exclusive lock, so any temporary files must have been left behind.
+		if strings.HasPrefix(dirEntry.Name(), tempPrefix) {
+			_ = os.Remove(filepath.Join(c.entriesDir(), dirEntry.Name()))
+			continue
+		}
+
+		fi, err := dirEntry.Info()
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+
+			return nil, fmt.Errorf("failed to stat cache entry: %w", err)
+		}
+
+		entries = append(entries, fi)
+		totalSize += fi.Size()
+	}
+
+	// Least recently used first.
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].ModTime().Before(entries[j].ModTime())
+	})
+
+	var stats PruneStats
+	for _, fi := range entries {
+		if totalSize <= maxSize {
+			break
+		}
+
+		if err := os.Remove(filepath.Join(c.entriesDir(), fi.Name())); err != nil {
+			// Eg. on Windows, files that are open can not be removed.
+			slog.Debug("Failed to remove cache entry", slog.String("name", fi.Name()), slog.Any("error", err))
+			continue
+		}
+		_ = os.Remove(filepath.Join(c.locksDir(), fi.Name()))
+
+		totalSize -= fi.Size()
+		stats.Entries++
+		stats.Size += fi.Size()
+	}
+
+	return &stats, nil
+}
+
+func (c *Cache) entriesDir() string {
+	return filepath.Join(c.dir, "layers")
+}
+
+func (c *Cache) locksDir() string {
+	return filepath.Join(c.dir, "locks")
+}
+
+func (c *Cache) lockPath() string {
+	return filepath.Join(c.dir, "cache.lock")
+}
+
+func entryName(dgst digest.Digest, kind string) (string, error) {
+	if err := dgst.Validate(); err != nil {
+		return "", fmt.Errorf("invalid digest: %w", err)
+	}
+
+	name := dgst.Algorithm().String() + "-" + dgst.Encoded()
+	if kind != "" {
+		name += "." + kind
+	}
+
+	return name, nil
+}
@@ -0,0 +1,210 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package cache_test
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/immutos/oci2erofs/internal/cache"
+	"github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCache(t *testing.T) {
+	t.Run("Get", func(t *testing.T) {
+		c, err := cache.Open(t.TempDir(), 0)
+		require.NoError(t, err)
+
+		content := []byte("hello world")
+		dgst := digest.FromBytes(content)
+
+		var fills atomic.Int32
+		fill := func(w io.Writer) error {
+			fills.Add(1)
+			_, err := w.Write(content)
+			return err
+		}
+
+		var wg sync.WaitGroup
+		results := make([][]byte, 8)
+		errs := make([]error, 8)
+		for i := range results {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+
+				f, err := c.Get(dgst, fill)
+				if err != nil {
+					errs[i] = err
+					return
+				}
+				defer f.Close()
+
+				results[i], errs[i] = io.ReadAll(f)
+			}(i)
+		}
+		wg.Wait()
+
+		for i := range results {
+			require.NoError(t, errs[i])
+			require.Equal(t, content, results[i])
+		}
+
+		require.Equal(t, int32(1), fills.Load())
+	})
+
+	t.Run("Fill Error", func(t *testing.T) {
+		c, err := cache.Open(t.TempDir(), 0)
+		require.NoError(t, err)
+
+		dgst := digest.FromString("hello world")
+
+		_, err = c.Get(dgst, func(w io.Writer) error {
+			_, _ = w.Write([]byte("partial"))
+			return errors.New("boom")
+		})
+		require.Error(t, err)
+
+		// The failed entry should not have been cached.
+		f, err := c.Get(dgst, func(w io.Writer) error {
+			_, err := w.Write([]byte("hello world"))
+			return err
+		})
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			require.NoError(t, f.Close())
+		})
+
+		data, err := io.ReadAll(f)
+		require.NoError(t, err)
+		require.Equal(t, "hello world", string(data))
+	})
+
+	t.Run("Lookup", func(t *testing.T) {
+		c, err := cache.Open(t.TempDir(), 0)
+		require.NoError(t, err)
+
+		dgst := digest.FromString("hello world")
+
+		_, err = c.Lookup(dgst)
+		require.ErrorIs(t, err, fs.ErrNotExist)
+
+		// Derived entries are distinct from the content entry.
+		f, err := c.GetDerived(dgst, "index", func(w io.Writer) error {
+			_, err := io.WriteString(w, "index")
+			return err
+		})
+		require.NoError(t, err)
+		require.NoError(t, f.Close())
+
+		_, err = c.Lookup(dgst)
+		require.ErrorIs(t, err, fs.ErrNotExist)
+
+		f, err = c.Get(dgst, func(w io.Writer) error {
+			_, err := io.WriteString(w, "hello world")
+			return err
+		})
+		require.NoError(t, err)
+		require.NoError(t, f.Close())
+
+		f, err = c.Lookup(dgst)
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			require.NoError(t, f.Close())
+		})
+
+		data, err := io.ReadAll(f)
+		require.NoError(t, err)
+		require.Equal(t, "hello world", string(data))
+	})
+
+	t.Run("Eviction", func(t *testing.T) {
+		c, err := cache.Open(t.TempDir(), 20)
+		require.NoError(t, err)
+
+		put := func(content string) {
+			f, err := c.Get(digest.FromString(content), func(w io.Writer) error {
+				_, err := io.WriteString(w, content)
+				return err
+			})
+			require.NoError(t, err)
+			require.NoError(t, f.Close())
+
+			// Ensure distinct modification times.
+			time.Sleep(10 * time.Millisecond)
+		}
+
+		put("first entry")
+		put("second entry")
+
+		// Only the second entry should remain.
+		var fills int
+		for _, content := range []string{"second entry", "first entry"} {
+			f, err := c.Get(digest.FromString(content), func(w io.Writer) error {
+				fills++
+				_, err := io.WriteString(w, content)
+				return err
+			})
+			require.NoError(t, err)
+			require.NoError(t, f.Close())
+		}
+
+		require.Equal(t, 1, fills)
+	})
+
+	t.Run("Prune", func(t *testing.T) {
+		c, err := cache.Open(t.TempDir(), 0)
+		require.NoError(t, err)
+
+		for _, content := range []string{"first entry", "second entry"} {
+			f, err := c.Get(digest.FromString(content), func(w io.Writer) error {
+				_, err := io.WriteString(w, content)
+				return err
+			})
+			require.NoError(t, err)
+			require.NoError(t, f.Close())
+		}
+
+		stats, err := c.Prune(0)
+		require.NoError(t, err)
+
+		require.Equal(t, 2, stats.Entries)
+		require.Equal(t, int64(len("first entry")+len("second entry")), stats.Size)
+
+		stats, err = c.Prune(0)
+		require.NoError(t, err)
+		require.Zero(t, stats.Entries)
+	})
+
+	t.Run("Invalid Digest", func(t *testing.T) {
+		c, err := cache.Open(t.TempDir(), 0)
+		require.NoError(t, err)
+
+		_, err = c.Get(digest.Digest("sha256:../../etc/passwd"), func(w io.Writer) error {
+			return nil
+		})
+		require.Error(t, err)
+	})
+}
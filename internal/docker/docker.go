@@ -19,34 +19,36 @@
 package docker
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
-	"io"
 	"io/fs"
-	"os"
+	"log/slog"
 	"path/filepath"
-	"strings"
 
-	"github.com/dpeckett/archivefs/tarfs"
-	"github.com/dpeckett/uncompr"
+	"github.com/containerd/containerd/platforms"
+	"github.com/immutos/oci2erofs/internal/image"
+	"github.com/immutos/oci2erofs/internal/layer"
 	"github.com/immutos/oci2erofs/internal/overlayfs"
+	"github.com/opencontainers/go-digest"
 	ocispecs "github.com/opencontainers/image-spec/specs-go/v1"
 )
 
-// LoadImage loads a Docker image from the given imageFS, ref, and platform.
-// It returns an overlayfs.FS of the image's root filesystem, a function to
-// close the image, and an error if any.
-func LoadImage(tempDir string, imageFS fs.FS, ref string, platform *ocispecs.Platform) (fs.FS, func() error, error) {
-	config, err := configForRef(imageFS, ref, platform)
+// LoadImage loads a Docker image from the given imageFS, ref, and platform
+// (using loader to load the image layers).
+// It returns the image (including an overlayfs.FS of the image's root
+// filesystem), and an error if any.
+func LoadImage(ctx context.Context, loader *layer.Loader, imageFS fs.FS, ref string, platform *ocispecs.Platform) (*image.Image, error) {
+	configDescriptor, config, err := configForRef(imageFS, ref, platform)
 	if err != nil {
-		return nil, nil, fmt.Errorf("failed to get image config: %w", err)
+		return nil, fmt.Errorf("failed to get image config: %w", err)
 	}
 
-	var layers []fs.FS
-	var closers []func() error
+	var layersToLoad []layer.Layer
+	var layerDescriptors []ocispecs.Descriptor
 
-	for _, layerDescriptor := range config.RootFS.DiffIDs {
-		layerDigest := strings.TrimPrefix(layerDescriptor, "sha256:")
+	for _, diffID := range config.RootFS.DiffIDs {
+		layerDigest := diffID.Encoded()
 
 		potentialLayerPaths := []string{
 			layerDigest + ".tar",
@@ -55,45 +57,85 @@ func LoadImage(tempDir string, imageFS fs.FS, ref string, platform *ocispecs.Pla
 		}
 
 		var actualLayerPath string
+		var layerSize int64
 		for _, layerPath := range potentialLayerPaths {
-			if f, err := imageFS.Open(layerPath); err == nil {
-				_ = f.Close()
+			if fi, err := fs.Stat(imageFS, layerPath); err == nil {
 				actualLayerPath = layerPath
+				layerSize = fi.Size()
 				break
 			}
 		}
 		if actualLayerPath == "" {
-			return nil, nil, fmt.Errorf("layer %s not found", layerDigest)
+			return nil, fmt.Errorf("layer %s not found", layerDigest)
 		}
 
-		layer, close, err := loadLayer(tempDir, imageFS, actualLayerPath)
-		if err != nil {
-			return nil, nil, fmt.Errorf("failed to load layer %s: %w", layerDigest, err)
-		}
+		layersToLoad = append(layersToLoad, layer.Layer{
+			Path:   actualLayerPath,
+			DiffID: diffID,
+		})
 
-		layers = append(layers, layer)
-		closers = append(closers, close)
+		// Docker archives store layers as uncompressed tarballs.
+		layerDescriptors = append(layerDescriptors, ocispecs.Descriptor{
+			MediaType: ocispecs.MediaTypeImageLayer,
+			Digest:    diffID,
+			Size:      layerSize,
+		})
 	}
 
-	closeAll := func() error {
-		for _, close := range closers {
-			if err := close(); err != nil {
-				return err
-			}
-		}
-		return nil
+	layers, closeAll, err := loader.LoadAll(ctx, imageFS, layersToLoad)
+	if err != nil {
+		return nil, err
 	}
 
-	rootFS, err := overlayfs.New(layers)
+	rootFS, err := overlayfs.New(ctx, layers)
 	if err != nil {
 		_ = closeAll()
-		return nil, nil, fmt.Errorf("failed to create overlayfs: %w", err)
+		return nil, fmt.Errorf("failed to create overlayfs: %w", err)
 	}
 
-	return rootFS, closeAll, nil
+	return image.New(ocispecs.Descriptor{}, *configDescriptor, *config, layerDescriptors, rootFS, closeAll), nil
 }
 
-func configForRef(imageFS fs.FS, ref string, platform *ocispecs.Platform) (*Config, error) {
+// Targets returns the ref and platform of every image in the archive. Images
+// that cannot be selected by ref (eg. untagged images alongside others) are
+// omitted.
+func Targets(imageFS fs.FS) ([]image.Target, error) {
+	manifests, err := readManifests(imageFS)
+	if err != nil {
+		return nil, err
+	}
+
+	var targets []image.Target
+	for _, m := range manifests {
+		refs := m.RepoTags
+		if len(refs) == 0 {
+			if len(manifests) > 1 {
+				slog.Warn("Skipping untagged image", slog.String("config", m.Config))
+				continue
+			}
+
+			refs = []string{""}
+		}
+
+		configData, err := fs.ReadFile(imageFS, m.Config)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read image config: %w", err)
+		}
+
+		var config ocispecs.Image
+		if err := json.Unmarshal(configData, &config); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal image config: %w", err)
+		}
+
+		for _, ref := range refs {
+			targets = append(targets, image.Target{Ref: ref, Platform: config.Platform})
+		}
+	}
+
+	return targets, nil
+}
+
+func readManifests(imageFS fs.FS) ([]Manifest, error) {
 	manifestFile, err := imageFS.Open("manifest.json")
 	if err != nil {
 		return nil, fmt.Errorf("failed to open manifest: %w", err)
@@ -105,14 +147,23 @@ func configForRef(imageFS fs.FS, ref string, platform *ocispecs.Platform) (*Conf
 		return nil, fmt.Errorf("failed to unmarshal manifest: %w", err)
 	}
 
+	return manifests, nil
+}
+
+func configForRef(imageFS fs.FS, ref string, platform *ocispecs.Platform) (*ocispecs.Descriptor, *ocispecs.Image, error) {
+	manifests, err := readManifests(imageFS)
+	if err != nil {
+		return nil, nil, err
+	}
+
 	if len(manifests) == 0 {
-		return nil, fmt.Errorf("no manifests found")
+		return nil, nil, fmt.Errorf("no manifests found")
 	}
 
 	var manifest *Manifest
 	if ref == "" {
 		if len(manifests) > 1 {
-			return nil, fmt.Errorf("multiple manifests found, ref must be specified")
+			return nil, nil, fmt.Errorf("multiple manifests found, ref must be specified")
 		}
 
 		manifest = &manifests[0]
@@ -127,54 +178,28 @@ func configForRef(imageFS fs.FS, ref string, platform *ocispecs.Platform) (*Conf
 		}
 	}
 	if manifest == nil {
-		return nil, fmt.Errorf("no manifest found for ref %s", ref)
+		return nil, nil, fmt.Errorf("no manifest found for ref %s", ref)
 	}
 
-	configFile, err := imageFS.Open(manifest.Config)
+	configData, err := fs.ReadFile(imageFS, manifest.Config)
 	if err != nil {
-		return nil, fmt.Errorf("failed to open image config: %w", err)
+		return nil, nil, fmt.Errorf("failed to read image config: %w", err)
 	}
-	defer configFile.Close()
 
-	var config Config
-	if err := json.NewDecoder(configFile).Decode(&config); err != nil {
-		return nil, fmt.Errorf("failed to unmarshal image config: %w", err)
+	var config ocispecs.Image
+	if err := json.Unmarshal(configData, &config); err != nil {
+		return nil, nil, fmt.Errorf("failed to unmarshal image config: %w", err)
 	}
 
 	if platform != nil && (config.Architecture != platform.Architecture || config.OS != platform.OS) {
-		return nil, fmt.Errorf("no manifest found for platform %s/%s", platform.Architecture, platform.OS)
-	}
-
-	return &config, nil
-}
-
-func loadLayer(tempDir string, imageFS fs.FS, layerPath string) (fs.FS, func() error, error) {
-	f, err := imageFS.Open(layerPath)
-	if err != nil {
-		return nil, nil, fmt.Errorf("failed to open layer: %w", err)
-	}
-	defer f.Close()
-
-	dr, err := uncompr.NewReader(f)
-	if err != nil {
-		return nil, nil, fmt.Errorf("failed to create decompressing reader: %w", err)
-	}
-	defer dr.Close()
-
-	decompressedLayerPath := filepath.Join(tempDir, filepath.Base(layerPath)+".tar")
-	decompressedLayerFile, err := os.OpenFile(decompressedLayerPath, os.O_CREATE|os.O_RDWR, 0o644)
-	if err != nil {
-		return nil, nil, fmt.Errorf("failed to create temporary tar file: %w", err)
+		return nil, nil, fmt.Errorf("no manifest found for platform %s", platforms.Format(*platform))
 	}
 
-	if _, err := io.Copy(decompressedLayerFile, dr); err != nil {
-		return nil, nil, fmt.Errorf("failed to decompress layer: %w", err)
-	}
-
-	fsys, err := tarfs.Open(decompressedLayerFile)
-	if err != nil {
-		return nil, nil, fmt.Errorf("failed to open decompressed layer: %w", err)
+	configDescriptor := ocispecs.Descriptor{
+		MediaType: ocispecs.MediaTypeImageConfig,
+		Digest:    digest.FromBytes(configData),
+		Size:      int64(len(configData)),
 	}
 
-	return fsys, decompressedLayerFile.Close, nil
+	return &configDescriptor, &config, nil
 }
@@ -19,16 +19,21 @@
 package docker_test
 
 import (
+	"context"
 	"os"
 	"testing"
 
-	"github.com/dpeckett/archivefs/tarfs"
 	"github.com/immutos/oci2erofs/internal/docker"
+	"github.com/immutos/oci2erofs/internal/image"
+	"github.com/immutos/oci2erofs/internal/layer"
+	"github.com/immutos/oci2erofs/internal/tarfs"
 	"github.com/immutos/oci2erofs/internal/util"
+	ocispecs "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/stretchr/testify/require"
 )
 
 func TestLoadImage(t *testing.T) {
+	ctx := context.Background()
 	ref := "docker.io/tianon/toybox:0.8.11"
 
 	imageFile, err := os.Open("testdata/toybox.tar")
@@ -40,14 +45,37 @@ func TestLoadImage(t *testing.T) {
 	imageFS, err := tarfs.Open(imageFile)
 	require.NoError(t, err)
 
-	rootFS, closeAll, err := docker.LoadImage(t.TempDir(), imageFS, ref, nil)
+	img, err := docker.LoadImage(ctx, &layer.Loader{TempDir: t.TempDir()}, imageFS, ref, nil)
 	require.NoError(t, err)
 	t.Cleanup(func() {
-		require.NoError(t, closeAll())
+		require.NoError(t, img.Close())
 	})
 
-	h, err := util.HashFS(rootFS)
+	require.Empty(t, img.ManifestDigest())
+	require.Equal(t, "sha256:73e30ac9c7813c3bbd8287d440e693cedb153218d1aefe616b4e1089341edbe6", img.ConfigDescriptor().Digest.String())
+	require.Equal(t, []string{"sh"}, img.Config().Config.Cmd)
+	require.Equal(t, img.DiffIDs()[0], img.Layers()[0].Digest)
+
+	h, err := util.HashFS(img.RootFS())
 	require.NoError(t, err)
 
 	require.Equal(t, "h1:J674XgTpeE71MnUmfTovrhKIlFnWOa8rctDF6SL/Kzg=", h)
 }
+
+func TestTargets(t *testing.T) {
+	imageFile, err := os.Open("testdata/toybox.tar")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, imageFile.Close())
+	})
+
+	imageFS, err := tarfs.Open(imageFile)
+	require.NoError(t, err)
+
+	targets, err := docker.Targets(imageFS)
+	require.NoError(t, err)
+
+	require.Equal(t, []image.Target{
+		{Ref: "docker.io/tianon/toybox:0.8.11", Platform: ocispecs.Platform{OS: "linux", Architecture: "amd64"}},
+	}, targets)
+}
@@ -18,8 +18,6 @@
 
 package docker
 
-import "time"
-
 // Manifest represents the Docker image manifest, typically found in manifest.json.
 type Manifest struct {
 	SchemaVersion int      `json:"schemaVersion"`
@@ -28,46 +26,3 @@ type Manifest struct {
 	RepoTags      []string `json:"RepoTags"`
 	Layers        []string `json:"Layers"`
 }
-
-// Config represents the Docker image configuration, typically found in the config.json file.
-type Config struct {
-	Architecture string      `json:"architecture"`
-	OS           string      `json:"os"`
-	OSVersion    string      `json:"os.version,omitempty"`
-	OSFeatures   []string    `json:"os.features,omitempty"`
-	Variant      string      `json:"variant,omitempty"`
-	Created      time.Time   `json:"created"`
-	Config       ImageConfig `json:"config"`
-	RootFS       RootFS      `json:"rootfs"`
-	History      []History   `json:"history"`
-}
-
-// ImageConfig represents the image configuration section of the Docker image config.
-type ImageConfig struct {
-	User         string              `json:"User,omitempty"`
-	ExposedPorts map[string]struct{} `json:"ExposedPorts,omitempty"`
-	Env          []string            `json:"Env,omitempty"`
-	Entrypoint   []string            `json:"Entrypoint,omitempty"`
-	Cmd          []string            `json:"Cmd,omitempty"`
-	Volumes      map[string]struct{} `json:"Volumes,omitempty"`
-	WorkingDir   string              `json:"WorkingDir,omitempty"`
-	Labels       map[string]string   `json:"Labels,omitempty"`
-	StopSignal   string              `json:"StopSignal,omitempty"`
-	ArgsEscaped  bool                `json:"ArgsEscaped,omitempty"`
-	Shell        []string            `json:"Shell,omitempty"`
-}
-
-// RootFS represents the root filesystem section of the Docker image config.
-type RootFS struct {
-	Type    string   `json:"type"`
-	DiffIDs []string `json:"diff_ids"`
-}
-
-// History represents the history section of the Docker image config, detailing each layer.
-type History struct {
-	Created    time.Time `json:"created"`
-	CreatedBy  string    `json:"created_by,omitempty"`
-	Author     string    `json:"author,omitempty"`
-	Comment    string    `json:"comment,omitempty"`
-	EmptyLayer bool      `json:"empty_layer,omitempty"`
-}
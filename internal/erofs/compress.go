@@ -0,0 +1,696 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package erofs
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/pierrec/lz4/v4"
+	"github.com/ulikunitz/xz/lzma"
+)
+
+// Compression is a compression algorithm for regular files.
+type Compression string
+
+const (
+	CompressionLZ4     Compression = "lz4"
+	CompressionLZ4HC   Compression = "lz4hc"
+	CompressionLZMA    Compression = "lzma"
+	CompressionDeflate Compression = "deflate"
+)
+
+// Compressions are the supported compression algorithms.
+var Compressions = []Compression{CompressionLZ4, CompressionLZ4HC, CompressionLZMA, CompressionDeflate}
+
+// On-disk compression algorithm types.
+const (
+	CompressionAlgLZ4     = 0
+	CompressionAlgLZMA    = 1
+	CompressionAlgDeflate = 2
+)
+
+// Logical cluster types (in LclusterIndex::Advise).
+const (
+	LclusterTypePlain   = 0
+	LclusterTypeHead1   = 1
+	LclusterTypeNonHead = 2
+	LclusterTypeHead2   = 3
+
+	LclusterTypeMask = 3
+
+	// Set on the first non-head logical cluster of a big physical cluster,
+	// whose first delta holds the compressed block count instead.
+	LclusterD0CblkCnt = 1 << 11
+)
+
+// Bit definitions for MapHeader::Advise.
+const (
+	MapAdviseBigPcluster1 = 0x0002
+)
+
+const (
+	// MaxPclusterSize is the largest supported physical cluster size.
+	MaxPclusterSize = 1 << 20
+
+	// maxExtentsPerPcluster limits the decompressed size of an extent to a
+	// multiple of the physical cluster size (up to MaxPclusterSize).
+	maxExtentsPerPcluster = 16
+)
+
+// MapHeader represents the on-disk header of the logical cluster indexes of
+// a compressed inode. It follows the inode (and its extended attributes),
+// aligned to 8 bytes.
+type MapHeader struct {
+	Reserved      uint16 // Reserved for future use
+	IdataSize     uint16 // Size of the tail packing data (unused)
+	Advise        uint16 // Map hints
+	AlgorithmType uint8  // Compression algorithms of head 1 (bits 0-3) and head 2 (bits 4-7)
+	ClusterBits   uint8  // Logical cluster size in bit shift (minus 12)
+}
+
+// LclusterIndex represents an on-disk (full) logical cluster index.
+type LclusterIndex struct {
+	Advise     uint16 // Logical cluster type
+	ClusterOfs uint16 // Offset of the decompressed extent in a head cluster
+	// The physical block address of a head cluster, or for a non-head
+	// cluster, the distance to its head cluster (low 16 bits) and the
+	// distance to the next head cluster (high 16 bits).
+	BlkAddr uint32
+}
+
+var (
+	MapHeaderSize     = int64(binary.Size(MapHeader{}))
+	LclusterIndexSize = int64(binary.Size(LclusterIndex{}))
+)
+
+// mapSize returns the size of the map header (plus its reserved padding)
+// and logical cluster indexes of a compressed inode of the given size.
+func mapSize(size int64) int64 {
+	return 2*MapHeaderSize + (size+BlockSize-1)/BlockSize*LclusterIndexSize
+}
+
+// CompressionOptions configures the compression of regular files.
+type CompressionOptions struct {
+	// Algorithm is the compression algorithm.
+	Algorithm Compression
+	// Level is the compression level (zero for the algorithm's default).
+	Level int
+	// PclusterSize is the maximum size of a physical cluster (the unit of
+	// compressed data), it must be a multiple of BlockSize (zero for
+	// BlockSize). Larger clusters compress better but reads must
+	// decompress more data.
+	PclusterSize int
+	// Filter, if set, selects the regular files (by path) to compress.
+	Filter func(path string) bool
+}
+
+// Validate checks that the compression options are supported.
+func (o *CompressionOptions) Validate() error {
+	var minLevel, maxLevel int
+	switch o.Algorithm {
+	case CompressionLZ4, CompressionLZMA:
+	case CompressionLZ4HC, CompressionDeflate:
+		minLevel, maxLevel = 1, 9
+	default:
+		return fmt.Errorf("unsupported compression algorithm %q", o.Algorithm)
+	}
+
+	if o.Level != 0 && (o.Level < minLevel || o.Level > maxLevel) {
+		if maxLevel == 0 {
+			return fmt.Errorf("compression algorithm %q does not support levels", o.Algorithm)
+		}
+
+		return fmt.Errorf("invalid %s compression level %d (expected %d-%d)", o.Algorithm, o.Level, minLevel, maxLevel)
+	}
+
+	if o.PclusterSize < 0 || o.PclusterSize%BlockSize != 0 || o.PclusterSize > MaxPclusterSize {
+		return fmt.Errorf("invalid physical cluster size %d (expected a multiple of %d up to %d)",
+			o.PclusterSize, BlockSize, MaxPclusterSize)
+	}
+
+	return nil
+}
+
+// pclusterSize returns the maximum size of a physical cluster.
+func (o *CompressionOptions) pclusterSize() int {
+	if o.PclusterSize == 0 {
+		return BlockSize
+	}
+
+	return o.PclusterSize
+}
+
+// maxExtentSize returns the maximum decompressed size of an extent.
+func (o *CompressionOptions) maxExtentSize() int {
+	return min(maxExtentsPerPcluster*o.pclusterSize(), MaxPclusterSize)
+}
+
+// compressor compresses the data of a single extent.
+type compressor interface {
+	// alg returns the on-disk compression algorithm type.
+	alg() uint8
+	// compress returns the compressed data, or nil if the data is not
+	// compressible.
+	compress(src []byte) ([]byte, error)
+	// config returns the on-disk compression configuration (recorded after
+	// the superblock).
+	config() []byte
+}
+
+func newCompressor(opts *CompressionOptions) (compressor, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+
+	switch opts.Algorithm {
+	case CompressionLZ4:
+		return &lz4Compressor{opts: opts}, nil
+	case CompressionLZ4HC:
+		level := opts.Level
+		if level == 0 {
+			level = 9
+		}
+
+		return &lz4Compressor{opts: opts, hc: &lz4.CompressorHC{Level: lz4.CompressionLevel(1 << (8 + level))}}, nil
+	case CompressionLZMA:
+		return &lzmaCompressor{opts: opts}, nil
+	case CompressionDeflate:
+		return &deflateCompressor{opts: opts}, nil
+	default:
+		return nil, fmt.Errorf("unsupported compression algorithm %q", opts.Algorithm)
+	}
+}
+
+type lz4Compressor struct {
+	opts *CompressionOptions
+	c    lz4.Compressor
+	hc   *lz4.CompressorHC
+}
+
+func (c *lz4Compressor) alg() uint8 {
+	return CompressionAlgLZ4
+}
+
+func (c *lz4Compressor) compress(src []byte) ([]byte, error) {
+	dst := make([]byte, lz4.CompressBlockBound(len(src)))
+
+	var n int
+	var err error
+	if c.hc != nil {
+		n, err = c.hc.CompressBlock(src, dst)
+	} else {
+		n, err = c.c.CompressBlock(src, dst)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if n == 0 {
+		return nil, nil
+	}
+
+	return dst[:n], nil
+}
+
+func (c *lz4Compressor) config() []byte {
+	// struct z_erofs_lz4_cfgs
+	buf := make([]byte, 14)
+	// The maximum distance is left at its default (64KiB).
+	binary.LittleEndian.PutUint16(buf[2:], uint16(c.opts.pclusterSize()/BlockSize))
+	return buf
+}
+
+// lzmaCompressor produces MicroLZMA streams, raw LZMA streams without an end
+// marker whose first byte (always zero) is replaced by the complement of the
+// properties byte.
+type lzmaCompressor struct {
+	opts *CompressionOptions
+}
+
+var lzmaProperties = lzma.Properties{LC: 3, LP: 0, PB: 2}
+
+func (c *lzmaCompressor) alg() uint8 {
+	return CompressionAlgLZMA
+}
+
+func (c *lzmaCompressor) compress(src []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w, err := lzma.WriterConfig{
+		Properties: &lzmaProperties,
+		DictCap:    c.dictSize(),
+		Matcher:    lzma.HashTable4,
+		Size:       int64(len(src)),
+	}.NewWriter(&buf)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := w.Write(src); err != nil {
+		return nil, err
+	}
+
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+
+	// Strip the classic header.
+	data := buf.Bytes()[lzma.HeaderLen:]
+	if len(data) == 0 || data[0] != 0 {
+		return nil, errors.New("unexpected lzma stream")
+	}
+	data[0] = ^lzmaProperties.Code()
+
+	return data, nil
+}
+
+func (c *lzmaCompressor) dictSize() int {
+	return max(c.opts.maxExtentSize(), lzma.MinDictCap)
+}
+
+func (c *lzmaCompressor) config() []byte {
+	// struct z_erofs_lzma_cfgs
+	buf := make([]byte, 14)
+	binary.LittleEndian.PutUint32(buf, uint32(c.dictSize()))
+	return buf
+}
+
+type deflateCompressor struct {
+	opts *CompressionOptions
+	// w is reused between extents (it's expensive to allocate).
+	w   *flate.Writer
+	buf bytes.Buffer
+}
+
+func (c *deflateCompressor) alg() uint8 {
+	return CompressionAlgDeflate
+}
+
+func (c *deflateCompressor) compress(src []byte) ([]byte, error) {
+	c.buf.Reset()
+	if c.w == nil {
+		level := c.opts.Level
+		if level == 0 {
+			level = flate.DefaultCompression
+		}
+
+		var err error
+		c.w, err = flate.NewWriter(&c.buf, level)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		c.w.Reset(&c.buf)
+	}
+
+	if _, err := c.w.Write(src); err != nil {
+		return nil, err
+	}
+
+	if err := c.w.Close(); err != nil {
+		return nil, err
+	}
+
+	return bytes.Clone(c.buf.Bytes()), nil
+}
+
+func (c *deflateCompressor) config() []byte {
+	// struct z_erofs_deflate_cfgs
+	buf := make([]byte, 6)
+	buf[0] = 15 // window bits
+	return buf
+}
+
+// needsConfig reports whether the compression configuration must be recorded
+// after the superblock (lz4 with single block physical clusters is
+// understood by older kernels without it).
+func needsConfig(c compressor, opts *CompressionOptions) bool {
+	return c.alg() != CompressionAlgLZ4 || opts.pclusterSize() > BlockSize
+}
+
+// encodeCompressionConfig returns the compression configuration recorded
+// after the superblock.
+func encodeCompressionConfig(c compressor) []byte {
+	cfg := c.config()
+
+	buf := make([]byte, roundUp(int64(2+len(cfg)), 4))
+	binary.LittleEndian.PutUint16(buf, uint16(len(cfg)))
+	copy(buf[2:], cfg)
+
+	return buf
+}
+
+// zextent is a decompressed extent of a compressed file.
+type zextent struct {
+	// offset is the offset of the extent in the decompressed file.
+	offset int64
+	// size is the decompressed size of the extent.
+	size int64
+	// blkAddr is the address of the physical cluster.
+	blkAddr uint32
+	// blocks is the size of the physical cluster in blocks.
+	blocks uint32
+	// plain indicates that the extent is stored uncompressed.
+	plain bool
+}
+
+// compressFile compresses the data of a regular file into physical clusters
+// starting at blkAddr, it returns the extents of the file and the number of
+// blocks written.
+func (w *writer) compressFile(path string, r io.Reader, size int64, blkAddr uint32) ([]zextent, uint32, error) {
+	buf := make([]byte, 0, w.opts.Compression.maxExtentSize())
+
+	var extents []zextent
+	var blocks uint32
+	for pos := int64(0); pos < size; {
+		// Top up the buffer.
+		want := min(int64(cap(buf)), size-pos)
+		if _, err := io.ReadFull(r, buf[len(buf):want]); err != nil {
+			return nil, 0, fmt.Errorf("failed to read %q: %w", path, err)
+		}
+		buf = buf[:want]
+
+		ext, data, err := w.nextExtent(pos, size, buf)
+		if err != nil {
+			return nil, 0, fmt.Errorf("failed to compress %q: %w", path, err)
+		}
+		ext.blkAddr = blkAddr + blocks
+
+		// Compressed data is aligned to the end of the physical cluster (the
+		// leading zeros are skipped when it is decompressed).
+		pcluster := make([]byte, ext.blocks*BlockSize)
+		if ext.plain {
+			copy(pcluster, data)
+		} else {
+			copy(pcluster[len(pcluster)-len(data):], data)
+		}
+
+		if _, err := w.dst.WriteAt(pcluster, int64(ext.blkAddr)*BlockSize); err != nil {
+			return nil, 0, fmt.Errorf("failed to write compressed data for %q: %w", path, err)
+		}
+
+		extents = append(extents, ext)
+		blocks += ext.blocks
+		pos += ext.size
+
+		buf = buf[:copy(buf, buf[ext.size:])]
+	}
+
+	return extents, blocks, nil
+}
+
+// nextExtent compresses the next extent of a file from the buffered data
+// (which begins at pos), it returns the extent and its physical data.
+//
+// The extents are chosen so that each logical cluster has a single index,
+// every extent but the last ends in a later logical cluster than it starts
+// in. Uncompressed extents must end by the logical cluster following their
+// head, and compressed extents can't start in the final logical cluster (the
+// index following the head records the size of big physical clusters).
+func (w *writer) nextExtent(pos, size int64, buf []byte) (zextent, []byte, error) {
+	remaining := size - pos
+	clusterOfs := pos % BlockSize
+
+	plain := func() (zextent, []byte, error) {
+		n := min(remaining, BlockSize)
+		if n == remaining && clusterOfs+n > BlockSize {
+			n = BlockSize - clusterOfs
+		}
+		return zextent{offset: pos, size: n, blocks: 1, plain: true}, buf[:n], nil
+	}
+
+	// The final logical cluster can't start a compressed extent.
+	if pos/BlockSize == (size-1)/BlockSize {
+		return plain()
+	}
+
+	pclusterSize := int64(w.opts.Compression.pclusterSize())
+	maxSize := min(int64(len(buf)), remaining)
+	minSize := min(BlockSize+1, maxSize)
+
+	clamp := func(n int64) int64 {
+		return max(min(n, maxSize), minSize)
+	}
+
+	// Guess the size of the input that fills a physical cluster.
+	n := clamp(int64(float64(pclusterSize) * w.zratio * 0.9))
+
+	var best []byte
+	var bestSize int64
+	for attempt := 0; attempt < 8; attempt++ {
+		data, err := w.compressor.compress(buf[:n])
+		if err != nil {
+			return zextent{}, nil, err
+		}
+
+		// The leading zeros of compressed data are treated as padding.
+		if len(data) > 0 && data[0] == 0 {
+			data = nil
+		}
+
+		fits := data != nil && int64(len(data)) <= pclusterSize
+		if fits {
+			best, bestSize = data, n
+		}
+
+		next := n
+		switch {
+		case fits && (n == maxSize || int64(len(data)) >= pclusterSize*7/8):
+		case fits, data != nil && best == nil:
+			next = clamp(n * pclusterSize / int64(len(data)) * 15 / 16)
+		case best == nil:
+			next = clamp(n / 2)
+		}
+		if next <= bestSize || next == n {
+			break
+		}
+		n = next
+	}
+
+	// Store the extent uncompressed unless it saves space.
+	blocks := (int64(len(best)) + BlockSize - 1) / BlockSize
+	if best == nil || blocks*BlockSize >= bestSize {
+		// Start small again after incompressible data.
+		w.zratio = 1
+		return plain()
+	}
+
+	w.zratio = float64(bestSize) / float64(len(best))
+
+	return zextent{offset: pos, size: bestSize, blocks: uint32(blocks)}, best, nil
+}
+
+// encodeMap returns the map header and logical cluster indexes of a
+// compressed file.
+func (w *writer) encodeMap(extents []zextent, size int64) ([]byte, error) {
+	hdr := MapHeader{
+		AlgorithmType: w.compressor.alg(),
+	}
+
+	bigPcluster := w.opts.Compression.pclusterSize() > BlockSize
+	if bigPcluster {
+		hdr.Advise |= MapAdviseBigPcluster1
+	}
+
+	indexes := make([]LclusterIndex, (size+BlockSize-1)/BlockSize)
+	for i, ext := range extents {
+		head := ext.offset / BlockSize
+
+		nextHead := int64(len(indexes))
+		if i < len(extents)-1 {
+			nextHead = extents[i+1].offset / BlockSize
+		}
+
+		typ := uint16(LclusterTypeHead1)
+		if ext.plain {
+			typ = LclusterTypePlain
+		}
+
+		indexes[head] = LclusterIndex{
+			Advise:     typ,
+			ClusterOfs: uint16(ext.offset % BlockSize),
+			BlkAddr:    ext.blkAddr,
+		}
+
+		for lcn := head + 1; lcn < nextHead; lcn++ {
+			delta0 := uint32(lcn - head)
+			if lcn == head+1 && bigPcluster && !ext.plain {
+				delta0 = ext.blocks | LclusterD0CblkCnt
+			}
+
+			indexes[lcn] = LclusterIndex{
+				Advise:  LclusterTypeNonHead,
+				BlkAddr: delta0 | uint32(nextHead-lcn)<<16,
+			}
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := binary.Write(&buf, binary.LittleEndian, hdr); err != nil {
+		return nil, err
+	}
+
+	// The header is followed by 8 reserved bytes.
+	buf.Write(make([]byte, 8))
+
+	if err := binary.Write(&buf, binary.LittleEndian, indexes); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// zreader reads the decompressed data of a compressed inode.
+type zreader struct {
+	ino     *Inode
+	hdr     MapHeader
+	indexes []LclusterIndex
+	// lcn is the logical cluster of the next extent.
+	lcn int
+	// buf holds the unread decompressed data of the current extent.
+	buf []byte
+}
+
+func newZReader(ino *Inode) (*zreader, error) {
+	r := &zreader{ino: ino}
+
+	if err := ino.image.unmarshalFrom(ino.zmapOff, &r.hdr); err != nil {
+		return nil, err
+	}
+
+	if r.hdr.ClusterBits != 0 {
+		return nil, fmt.Errorf("unsupported logical cluster size at inode %d", ino.Nid())
+	}
+
+	r.indexes = make([]LclusterIndex, (ino.size+uint64(BlockSize)-1)/uint64(BlockSize))
+	if err := ino.image.unmarshalFrom(ino.zmapOff+2*MapHeaderSize, r.indexes); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+func (r *zreader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		if r.lcn >= len(r.indexes) {
+			return 0, io.EOF
+		}
+
+		if err := r.nextExtent(); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+func (r *zreader) nextExtent() error {
+	head := r.indexes[r.lcn]
+	typ := head.Advise & LclusterTypeMask
+	if typ != LclusterTypePlain && typ != LclusterTypeHead1 {
+		return fmt.Errorf("unexpected logical cluster type %d at inode %d", typ, r.ino.Nid())
+	}
+
+	start := int64(r.lcn)*BlockSize + int64(head.ClusterOfs)
+
+	next := r.lcn + 1
+	for next < len(r.indexes) && r.indexes[next].Advise&LclusterTypeMask == LclusterTypeNonHead {
+		next++
+	}
+
+	end := int64(r.ino.size)
+	if next < len(r.indexes) {
+		end = int64(next)*BlockSize + int64(r.indexes[next].ClusterOfs)
+	}
+
+	blocks := int64(1)
+	if typ == LclusterTypeHead1 && r.hdr.Advise&MapAdviseBigPcluster1 != 0 && r.lcn+1 < next {
+		if delta0 := uint16(r.indexes[r.lcn+1].BlkAddr); delta0&LclusterD0CblkCnt != 0 {
+			blocks = int64(delta0 &^ LclusterD0CblkCnt)
+		}
+	}
+
+	src, err := r.ino.image.bytesAt(r.ino.image.sb.BlockAddrToOffset(head.BlkAddr), blocks*BlockSize)
+	if err != nil {
+		return err
+	}
+
+	size := end - start
+	if size <= 0 || (typ == LclusterTypePlain && size > int64(len(src))) {
+		return fmt.Errorf("corrupted extent at inode %d", r.ino.Nid())
+	}
+
+	if typ == LclusterTypePlain {
+		r.buf = src[:size]
+	} else {
+		// Skip the leading padding.
+		for len(src) > 0 && src[0] == 0 {
+			src = src[1:]
+		}
+		if len(src) == 0 {
+			return fmt.Errorf("corrupted extent at inode %d", r.ino.Nid())
+		}
+
+		r.buf, err = decompress(r.hdr.AlgorithmType&0xf, src, size)
+		if err != nil {
+			return fmt.Errorf("failed to decompress extent at inode %d: %w", r.ino.Nid(), err)
+		}
+	}
+
+	r.lcn = next
+	return nil
+}
+
+// decompress returns the decompressed data of a physical cluster.
+func decompress(alg uint8, src []byte, size int64) ([]byte, error) {
+	dst := make([]byte, size)
+
+	switch alg {
+	case CompressionAlgLZ4:
+		n, err := lz4.UncompressBlock(src, dst)
+		if err != nil {
+			return nil, err
+		}
+		if int64(n) != size {
+			return nil, io.ErrUnexpectedEOF
+		}
+
+	case CompressionAlgLZMA:
+		// Restore the classic header and the first byte of the stream.
+		hdr := make([]byte, lzma.HeaderLen)
+		hdr[0] = ^src[0]
+		binary.LittleEndian.PutUint32(hdr[1:], MaxPclusterSize)
+		binary.LittleEndian.PutUint64(hdr[5:], uint64(size))
+
+		lr, err := lzma.NewReader(io.MultiReader(bytes.NewReader(hdr), bytes.NewReader([]byte{0}), bytes.NewReader(src[1:])))
+		if err != nil {
+			return nil, err
+		}
+
+		if _, err := io.ReadFull(lr, dst); err != nil {
+			return nil, err
+		}
+
+	case CompressionAlgDeflate:
+		if _, err := io.ReadFull(flate.NewReader(bytes.NewReader(src)), dst); err != nil {
+			return nil, err
+		}
+
+	default:
+		return nil, fmt.Errorf("unsupported compression algorithm %d", alg)
+	}
+
+	return dst, nil
+}
@@ -0,0 +1,767 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package erofs_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"math/rand"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/immutos/oci2erofs/internal/erofs"
+	"github.com/immutos/oci2erofs/internal/overlayfs"
+	"github.com/immutos/oci2erofs/internal/tarfs"
+	"github.com/rogpeppe/go-internal/dirhash"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestEROFS(t *testing.T) {
+	f, err := os.Open("testdata/toybox.img")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, f.Close())
+	})
+
+	fsys, err := erofs.Open(f)
+	require.NoError(t, err)
+
+	t.Run("Open", func(t *testing.T) {
+		t.Run("File", func(t *testing.T) {
+			f, err := fsys.Open("/usr/bin/toybox")
+			require.NoError(t, err)
+			t.Cleanup(func() {
+				require.NoError(t, f.Close())
+			})
+
+			info, err := f.Stat()
+			require.NoError(t, err)
+
+			require.Equal(t, "toybox", info.Name())
+			require.Equal(t, 849544, int(info.Size()))
+			require.Equal(t, os.FileMode(0o555), info.Mode()&fs.ModePerm)
+			require.False(t, info.IsDir())
+
+			h := sha256.New()
+
+			n, err := io.Copy(h, f)
+			require.NoError(t, err)
+
+			require.Equal(t, int64(849544), n)
+
+			require.Equal(t, "31aa01d6d46f63edcadc00fd5c40f3474f0df6c22a39ed0c5751ba3efa2855ac", hex.EncodeToString(h.Sum(nil)))
+		})
+
+		t.Run("Symlink", func(t *testing.T) {
+			f, err := fsys.Open("bin/sh")
+			require.NoError(t, err)
+			t.Cleanup(func() {
+				require.NoError(t, f.Close())
+			})
+
+			info, err := f.Stat()
+			require.NoError(t, err)
+
+			require.Equal(t, "toybox", info.Name())
+			require.Equal(t, os.FileMode(0o555), info.Mode()&fs.ModePerm)
+			require.False(t, info.IsDir())
+
+			h := sha256.New()
+
+			n, err := io.Copy(h, f)
+			require.NoError(t, err)
+
+			require.Equal(t, int64(849544), n)
+
+			require.Equal(t, "31aa01d6d46f63edcadc00fd5c40f3474f0df6c22a39ed0c5751ba3efa2855ac", hex.EncodeToString(h.Sum(nil)))
+		})
+	})
+
+	t.Run("ReadDir", func(t *testing.T) {
+		entries, err := fsys.ReadDir("/etc")
+		require.NoError(t, err)
+
+		require.Len(t, entries, 5)
+
+		require.Equal(t, "group", entries[0].Name())
+		require.False(t, entries[0].IsDir())
+		require.Equal(t, 0o644, int(entries[0].Type()))
+
+		require.Equal(t, "os-release", entries[1].Name())
+		require.False(t, entries[1].IsDir())
+		require.Equal(t, 0o644, int(entries[1].Type()))
+
+		require.Equal(t, "passwd", entries[2].Name())
+		require.False(t, entries[2].IsDir())
+		require.Equal(t, 0o644, int(entries[2].Type()))
+
+		require.Equal(t, "rc", entries[3].Name())
+		require.True(t, entries[3].IsDir())
+		require.True(t, entries[3].Type()&fs.ModeDir > 0)
+
+		require.Equal(t, "resolv.conf", entries[4].Name())
+		require.False(t, entries[4].IsDir())
+		require.Equal(t, 0o644, int(entries[4].Type()))
+	})
+
+	t.Run("Stat", func(t *testing.T) {
+		t.Run("File", func(t *testing.T) {
+			info, err := fsys.Stat("/usr/bin/toybox")
+			require.NoError(t, err)
+
+			require.Equal(t, "toybox", info.Name())
+			require.Equal(t, 849544, int(info.Size()))
+			require.Equal(t, os.FileMode(0o555), info.Mode()&fs.ModePerm)
+			require.False(t, info.IsDir())
+
+			ino, ok := info.Sys().(*erofs.Inode)
+			require.True(t, ok)
+
+			require.Equal(t, uint64(0x327), ino.Nid())
+			require.Zero(t, ino.UID())
+			require.Zero(t, ino.GID())
+		})
+
+		t.Run("Dir", func(t *testing.T) {
+			info, err := fsys.Stat("usr")
+			require.NoError(t, err)
+
+			require.Equal(t, "usr", info.Name())
+			require.Equal(t, os.FileMode(0o755), info.Mode()&fs.ModePerm)
+			require.True(t, info.IsDir())
+
+			ino, ok := info.Sys().(*erofs.Inode)
+			require.True(t, ok)
+
+			require.Equal(t, uint64(0x9c), ino.Nid())
+			require.Zero(t, ino.UID())
+			require.Zero(t, ino.GID())
+		})
+
+		t.Run("Symlink", func(t *testing.T) {
+			info, err := fsys.Stat("bin/sh")
+			require.NoError(t, err)
+
+			require.Equal(t, "toybox", info.Name())
+			require.Equal(t, os.FileMode(0o555), info.Mode()&fs.ModePerm)
+			require.False(t, info.IsDir())
+
+			ino, ok := info.Sys().(*erofs.Inode)
+			require.True(t, ok)
+
+			require.Equal(t, uint64(0x327), ino.Nid())
+			require.Zero(t, ino.UID())
+			require.Zero(t, ino.GID())
+		})
+	})
+
+	t.Run("Readlink", func(t *testing.T) {
+		target, err := fsys.ReadLink("bin")
+		require.NoError(t, err)
+
+		require.Equal(t, "usr/bin", target)
+	})
+
+	t.Run("StatLink", func(t *testing.T) {
+		info, err := fsys.StatLink("bin")
+		require.NoError(t, err)
+
+		require.Equal(t, "bin", info.Name())
+		require.Equal(t, os.FileMode(0o777), info.Mode()&fs.ModePerm)
+		require.False(t, info.IsDir())
+
+		ino, ok := info.Sys().(*erofs.Inode)
+		require.True(t, ok)
+
+		require.Equal(t, uint64(0x2f), ino.Nid())
+		require.Zero(t, ino.UID())
+		require.Zero(t, ino.GID())
+	})
+
+	t.Run("WalkDir", func(t *testing.T) {
+		var paths []string
+		err := fs.WalkDir(fsys, ".", func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+
+			paths = append(paths, path)
+
+			return nil
+		})
+		require.NoError(t, err)
+
+		require.Len(t, paths, 266)
+
+		require.Equal(t, []string{
+			".",
+			"bin",
+			"dev",
+			"etc",
+			"etc/group",
+		}, paths[:5])
+	})
+
+	t.Run("DirHash", func(t *testing.T) {
+		var files []string
+		err = fs.WalkDir(fsys, ".", func(file string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+
+			if d.IsDir() || d.Type()&fs.ModeSymlink != 0 {
+				return nil
+			}
+
+			files = append(files, filepath.ToSlash(file))
+			return nil
+		})
+		require.NoError(t, err)
+
+		h, err := dirhash.Hash1(files, func(name string) (io.ReadCloser, error) {
+			return fsys.Open(name)
+		})
+		require.NoError(t, err)
+
+		require.Equal(t, "h1:adgxkqVceeKMyJdMZMvcUIbg94TthnXUmOeufCPuzQI=", h)
+	})
+}
+
+func TestEROFSCreate(t *testing.T) {
+	srcFile, err := os.Open("testdata/toybox.img")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, srcFile.Close())
+	})
+
+	srcFS, err := erofs.Open(srcFile)
+	require.NoError(t, err)
+
+	dstFile, err := os.OpenFile(filepath.Join(t.TempDir()+"/toybox.img"), os.O_RDWR|os.O_CREATE, 0o644)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, dstFile.Close())
+	})
+
+	require.NoError(t, erofs.Create(dstFile, srcFS, nil))
+
+	dstFS, err := erofs.Open(dstFile)
+	require.NoError(t, err)
+
+	var files []string
+	err = fs.WalkDir(dstFS, ".", func(file string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if d.IsDir() || d.Type()&fs.ModeSymlink != 0 {
+			return nil
+		}
+
+		files = append(files, filepath.ToSlash(file))
+		return nil
+	})
+	require.NoError(t, err)
+
+	h, err := dirhash.Hash1(files, func(name string) (io.ReadCloser, error) {
+		return srcFS.Open(name)
+	})
+	require.NoError(t, err)
+
+	require.Equal(t, "h1:adgxkqVceeKMyJdMZMvcUIbg94TthnXUmOeufCPuzQI=", h)
+}
+
+func TestEROFSXattrs(t *testing.T) {
+	capability := "\x01\x00\x00\x02\x00\x20\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00"
+	large := strings.Repeat("x", 6000)
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+
+	for _, hdr := range []tar.Header{
+		{Typeflag: tar.TypeDir, Name: "bin/", Mode: 0o755, PAXRecords: map[string]string{
+			"SCHILY.xattr.system.posix_acl_default": "\x02\x00\x00\x00",
+		}},
+		{Typeflag: tar.TypeReg, Name: "bin/ping", Mode: 0o755, Size: 4, PAXRecords: map[string]string{
+			"SCHILY.xattr.security.capability": capability,
+			"SCHILY.xattr.user.comment":        "hello",
+		}},
+		{Typeflag: tar.TypeReg, Name: "bin/large", Mode: 0o644, Size: 5, PAXRecords: map[string]string{
+			"SCHILY.xattr.user.large": large,
+		}},
+		{Typeflag: tar.TypeReg, Name: "bin/empty", Mode: 0o644, PAXRecords: map[string]string{
+			"SCHILY.xattr.trusted.overlay.opaque": "y",
+		}},
+		{Typeflag: tar.TypeSymlink, Name: "ping", Linkname: "bin/ping", PAXRecords: map[string]string{
+			"SCHILY.xattr.security.selinux": "system_u:object_r:bin_t:s0",
+		}},
+	} {
+		require.NoError(t, tw.WriteHeader(&hdr))
+		_, err := tw.Write([]byte(strings.Repeat("a", int(hdr.Size))))
+		require.NoError(t, err)
+	}
+	require.NoError(t, tw.Close())
+
+	src, err := tarfs.Open(bytes.NewReader(buf.Bytes()))
+	require.NoError(t, err)
+
+	create := func(t *testing.T, opts *erofs.CreateOptions) *erofs.Filesystem {
+		f, err := os.Create(filepath.Join(t.TempDir(), "xattrs.img"))
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			require.NoError(t, f.Close())
+		})
+
+		require.NoError(t, erofs.Create(f, src, opts))
+
+		fsys, err := erofs.Open(f)
+		require.NoError(t, err)
+
+		return fsys
+	}
+
+	t.Run("Create", func(t *testing.T) {
+		fsys := create(t, nil)
+
+		attrs, err := fsys.Xattrs("bin")
+		require.NoError(t, err)
+		require.Equal(t, map[string]string{"system.posix_acl_default": "\x02\x00\x00\x00"}, attrs)
+
+		attrs, err = fsys.Xattrs("bin/ping")
+		require.NoError(t, err)
+		require.Equal(t, map[string]string{"security.capability": capability, "user.comment": "hello"}, attrs)
+
+		attrs, err = fsys.Xattrs("bin/large")
+		require.NoError(t, err)
+		require.Equal(t, map[string]string{"user.large": large}, attrs)
+
+		attrs, err = fsys.Xattrs("bin/empty")
+		require.NoError(t, err)
+		require.Equal(t, map[string]string{"trusted.overlay.opaque": "y"}, attrs)
+
+		attrs, err = fsys.Xattrs("ping")
+		require.NoError(t, err)
+		require.Equal(t, map[string]string{"security.selinux": "system_u:object_r:bin_t:s0"}, attrs)
+
+		attrs, err = fsys.Xattrs(".")
+		require.NoError(t, err)
+		require.Empty(t, attrs)
+
+		// The contents are stored after the extended attributes.
+		data, err := fs.ReadFile(fsys, "bin/ping")
+		require.NoError(t, err)
+		require.Equal(t, "aaaa", string(data))
+
+		data, err = fs.ReadFile(fsys, "bin/large")
+		require.NoError(t, err)
+		require.Equal(t, "aaaaa", string(data))
+
+		target, err := fsys.ReadLink("ping")
+		require.NoError(t, err)
+		require.Equal(t, "bin/ping", target)
+	})
+
+	t.Run("Filter", func(t *testing.T) {
+		fsys := create(t, &erofs.CreateOptions{
+			XattrFilter: func(name string) bool {
+				return strings.HasPrefix(name, "security.")
+			},
+		})
+
+		attrs, err := fsys.Xattrs("bin/ping")
+		require.NoError(t, err)
+		require.Equal(t, map[string]string{"security.capability": capability}, attrs)
+
+		attrs, err = fsys.Xattrs("bin/large")
+		require.NoError(t, err)
+		require.Empty(t, attrs)
+	})
+
+	t.Run("Unsupported", func(t *testing.T) {
+		require.True(t, erofs.XattrSupported("system.posix_acl_access"))
+		require.False(t, erofs.XattrSupported("system.posix_acl_access.x"))
+		require.False(t, erofs.XattrSupported("system.nfs4_acl"))
+	})
+}
+
+func TestEROFSHardlinks(t *testing.T) {
+	layer := func(hdrs []tar.Header) fs.FS {
+		var buf bytes.Buffer
+		tw := tar.NewWriter(&buf)
+
+		for _, hdr := range hdrs {
+			require.NoError(t, tw.WriteHeader(&hdr))
+			_, err := tw.Write([]byte(strings.Repeat("a", int(hdr.Size))))
+			require.NoError(t, err)
+		}
+		require.NoError(t, tw.Close())
+
+		fsys, err := tarfs.Open(bytes.NewReader(buf.Bytes()))
+		require.NoError(t, err)
+
+		return fsys
+	}
+
+	lower := layer([]tar.Header{
+		{Typeflag: tar.TypeReg, Name: "bin/busybox", Mode: 0o755, Size: 8000},
+		{Typeflag: tar.TypeLink, Name: "bin/sh", Linkname: "bin/busybox"},
+		{Typeflag: tar.TypeLink, Name: "bin/ls", Linkname: "bin/busybox"},
+		{Typeflag: tar.TypeReg, Name: "etc/passwd", Mode: 0o644, Size: 10},
+		{Typeflag: tar.TypeLink, Name: "etc/passwd-", Linkname: "etc/passwd"},
+		{Typeflag: tar.TypeLink, Name: "passwd", Linkname: "etc/passwd"},
+	})
+
+	upper := layer([]tar.Header{
+		{Typeflag: tar.TypeReg, Name: "bin/.wh.busybox"},
+	})
+
+	src, err := overlayfs.New(context.Background(), []fs.FS{lower, upper})
+	require.NoError(t, err)
+
+	f, err := os.Create(filepath.Join(t.TempDir(), "hardlinks.img"))
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, f.Close())
+	})
+
+	var stats erofs.Stats
+	require.NoError(t, erofs.Create(f, src, &erofs.CreateOptions{Stats: &stats}))
+
+	fsys, err := erofs.Open(f)
+	require.NoError(t, err)
+
+	inode := func(t *testing.T, name string) *erofs.Inode {
+		fi, err := fsys.StatLink(name)
+		require.NoError(t, err)
+
+		return fi.Sys().(*erofs.Inode)
+	}
+
+	t.Run("Shared", func(t *testing.T) {
+		passwd := inode(t, "etc/passwd")
+		require.Equal(t, uint32(3), passwd.Nlink())
+		require.Equal(t, passwd.Nid(), inode(t, "etc/passwd-").Nid())
+		require.Equal(t, passwd.Nid(), inode(t, "passwd").Nid())
+
+		data, err := fs.ReadFile(fsys, "passwd")
+		require.NoError(t, err)
+		require.Equal(t, strings.Repeat("a", 10), string(data))
+	})
+
+	t.Run("Whited Out Target", func(t *testing.T) {
+		ls := inode(t, "bin/ls")
+		require.Equal(t, uint32(2), ls.Nlink())
+		require.Equal(t, ls.Nid(), inode(t, "bin/sh").Nid())
+
+		data, err := fs.ReadFile(fsys, "bin/sh")
+		require.NoError(t, err)
+		require.Equal(t, strings.Repeat("a", 8000), string(data))
+
+		_, err = fsys.StatLink("bin/busybox")
+		require.ErrorIs(t, err, fs.ErrNotExist)
+	})
+
+	t.Run("Inodes", func(t *testing.T) {
+		img, err := erofs.OpenImage(f)
+		require.NoError(t, err)
+
+		// The root, bin, etc, and the two shared files.
+		require.Equal(t, uint64(5), img.SuperBlock().Inodes)
+		require.Equal(t, erofs.Stats{Inodes: 5, Files: 2, Dirs: 3}, stats)
+	})
+}
+
+func TestEROFSDevices(t *testing.T) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+
+	for _, hdr := range []tar.Header{
+		{Typeflag: tar.TypeDir, Name: "dev/", Mode: 0o755},
+		{Typeflag: tar.TypeChar, Name: "dev/console", Mode: 0o600, Devmajor: 5, Devminor: 1},
+		{Typeflag: tar.TypeChar, Name: "dev/null", Mode: 0o666, Devmajor: 1, Devminor: 3},
+		{Typeflag: tar.TypeBlock, Name: "dev/nvme0n1p300", Mode: 0o660, Devmajor: 259, Devminor: 300},
+		{Typeflag: tar.TypeFifo, Name: "dev/initctl", Mode: 0o600},
+		{Typeflag: tar.TypeReg, Name: "etc/hostname", Mode: 0o644, Size: 5},
+	} {
+		require.NoError(t, tw.WriteHeader(&hdr))
+		_, err := tw.Write([]byte(strings.Repeat("a", int(hdr.Size))))
+		require.NoError(t, err)
+	}
+	require.NoError(t, tw.Close())
+
+	src, err := tarfs.Open(bytes.NewReader(buf.Bytes()))
+	require.NoError(t, err)
+
+	create := func(t *testing.T, opts *erofs.CreateOptions) *erofs.Filesystem {
+		f, err := os.Create(filepath.Join(t.TempDir(), "devices.img"))
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			require.NoError(t, f.Close())
+		})
+
+		require.NoError(t, erofs.Create(f, src, opts))
+
+		fsys, err := erofs.Open(f)
+		require.NoError(t, err)
+
+		return fsys
+	}
+
+	device := func(t *testing.T, fsys *erofs.Filesystem, name string) (fs.FileMode, uint32, uint32) {
+		fi, err := fsys.StatLink(name)
+		require.NoError(t, err)
+
+		major, minor := fi.Sys().(*erofs.Inode).Device()
+		return fi.Mode(), major, minor
+	}
+
+	t.Run("Create", func(t *testing.T) {
+		var stats erofs.Stats
+		fsys := create(t, &erofs.CreateOptions{Stats: &stats})
+		require.Equal(t, erofs.Stats{Inodes: 8, Files: 1, Dirs: 3, Other: 4}, stats)
+
+		mode, major, minor := device(t, fsys, "dev/console")
+		require.Equal(t, fs.ModeDevice|fs.ModeCharDevice|0o600, mode)
+		require.Equal(t, []uint32{5, 1}, []uint32{major, minor})
+
+		mode, major, minor = device(t, fsys, "dev/null")
+		require.Equal(t, fs.ModeDevice|fs.ModeCharDevice|0o666, mode)
+		require.Equal(t, []uint32{1, 3}, []uint32{major, minor})
+
+		mode, major, minor = device(t, fsys, "dev/nvme0n1p300")
+		require.Equal(t, fs.ModeDevice|0o660, mode)
+		require.Equal(t, []uint32{259, 300}, []uint32{major, minor})
+
+		mode, _, _ = device(t, fsys, "dev/initctl")
+		require.Equal(t, fs.ModeNamedPipe|0o600, mode)
+
+		entries, err := fs.ReadDir(fsys, "dev")
+		require.NoError(t, err)
+		require.Len(t, entries, 4)
+		require.Equal(t, fs.ModeDevice|fs.ModeCharDevice, entries[0].Type().Type())
+
+		// Devices have no data, so don't displace the data of other files.
+		data, err := fs.ReadFile(fsys, "etc/hostname")
+		require.NoError(t, err)
+		require.Equal(t, "aaaaa", string(data))
+	})
+
+	t.Run("Skip Devices", func(t *testing.T) {
+		var stats erofs.Stats
+		fsys := create(t, &erofs.CreateOptions{SkipDevices: true, Stats: &stats})
+
+		entries, err := fs.ReadDir(fsys, "dev")
+		require.NoError(t, err)
+		require.Len(t, entries, 1)
+		require.Equal(t, "initctl", entries[0].Name())
+
+		_, err = fsys.StatLink("dev/null")
+		require.ErrorIs(t, err, fs.ErrNotExist)
+
+		// Skipped devices aren't counted (the FIFO is kept).
+		require.Equal(t, erofs.Stats{Inodes: 5, Files: 1, Dirs: 3, Other: 1}, stats)
+	})
+}
+
+func TestEROFSCompression(t *testing.T) {
+	var text bytes.Buffer
+	for i := 0; i < 20000; i++ {
+		fmt.Fprintf(&text, "line %d of a compressible file\n", i)
+	}
+
+	random := make([]byte, 50000)
+	_, err := rand.New(rand.NewSource(1)).Read(random)
+	require.NoError(t, err)
+
+	files := map[string][]byte{
+		"text":          text.Bytes(),
+		"random":        random,
+		"mixed":         append(append(text.Bytes()[:30000:30000], random...), text.Bytes()[:30000]...),
+		"small":         []byte("hello"),
+		"excluded.gz":   text.Bytes()[:20000],
+		"unaligned.txt": text.Bytes()[:8193],
+	}
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, name := range []string{"excluded.gz", "mixed", "random", "small", "text", "unaligned.txt"} {
+		require.NoError(t, tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: name, Mode: 0o644, Size: int64(len(files[name]))}))
+		_, err := tw.Write(files[name])
+		require.NoError(t, err)
+	}
+	require.NoError(t, tw.Close())
+
+	src, err := tarfs.Open(bytes.NewReader(buf.Bytes()))
+	require.NoError(t, err)
+
+	create := func(t *testing.T, opts *erofs.CreateOptions) (*erofs.Filesystem, int64) {
+		f, err := os.Create(filepath.Join(t.TempDir(), "compressed.img"))
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			require.NoError(t, f.Close())
+		})
+
+		require.NoError(t, erofs.Create(f, src, opts))
+
+		fi, err := f.Stat()
+		require.NoError(t, err)
+
+		fsys, err := erofs.Open(f)
+		require.NoError(t, err)
+
+		return fsys, fi.Size()
+	}
+
+	dataLayout := func(t *testing.T, fsys *erofs.Filesystem, name string) uint16 {
+		fi, err := fs.Stat(fsys, name)
+		require.NoError(t, err)
+
+		return fi.Sys().(*erofs.Inode).DataLayout()
+	}
+
+	_, uncompressedSize := create(t, nil)
+
+	for _, opts := range []erofs.CompressionOptions{
+		{Algorithm: erofs.CompressionLZ4},
+		{Algorithm: erofs.CompressionLZ4HC, Level: 4},
+		{Algorithm: erofs.CompressionLZMA},
+		{Algorithm: erofs.CompressionDeflate, PclusterSize: 4 * erofs.BlockSize},
+	} {
+		t.Run(string(opts.Algorithm), func(t *testing.T) {
+			opts.Filter = func(path string) bool {
+				return !strings.HasSuffix(path, ".gz")
+			}
+
+			fsys, size := create(t, &erofs.CreateOptions{Compression: &opts})
+			require.Less(t, size, uncompressedSize)
+
+			for name, expected := range files {
+				data, err := fs.ReadFile(fsys, name)
+				require.NoError(t, err)
+				require.Equal(t, expected, data, name)
+			}
+
+			require.Equal(t, uint16(erofs.InodeDataLayoutFlatCompressionLegacy), dataLayout(t, fsys, "text"))
+			require.Equal(t, uint16(erofs.InodeDataLayoutFlatCompressionLegacy), dataLayout(t, fsys, "mixed"))
+
+			// Excluded, incompressible, and small files are stored uncompressed.
+			require.Equal(t, uint16(erofs.InodeDataLayoutFlatPlain), dataLayout(t, fsys, "excluded.gz"))
+			require.Equal(t, uint16(erofs.InodeDataLayoutFlatPlain), dataLayout(t, fsys, "random"))
+			require.Equal(t, uint16(erofs.InodeDataLayoutFlatInline), dataLayout(t, fsys, "small"))
+		})
+	}
+
+	t.Run("Invalid Options", func(t *testing.T) {
+		f, err := os.Create(filepath.Join(t.TempDir(), "invalid.img"))
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			require.NoError(t, f.Close())
+		})
+
+		err = erofs.Create(f, src, &erofs.CreateOptions{Compression: &erofs.CompressionOptions{Algorithm: "zstd"}})
+		require.ErrorContains(t, err, "unsupported compression algorithm \"zstd\"")
+
+		err = erofs.Create(f, src, &erofs.CreateOptions{Compression: &erofs.CompressionOptions{Algorithm: erofs.CompressionLZ4, PclusterSize: 6000}})
+		require.ErrorContains(t, err, "invalid physical cluster size 6000")
+	})
+}
+
+// TestEROFSCompressionErofsUtils checks compressed images with fsck.erofs and
+// dump.erofs from erofs-utils, it's skipped if erofs-utils isn't installed.
+func TestEROFSCompressionErofsUtils(t *testing.T) {
+	fsck, err := exec.LookPath("fsck.erofs")
+	if err != nil {
+		t.Skip("fsck.erofs (erofs-utils) is not installed")
+	}
+	dump, _ := exec.LookPath("dump.erofs")
+
+	var text bytes.Buffer
+	for i := 0; i < 100000; i++ {
+		fmt.Fprintf(&text, "line %d of a compressible file\n", i)
+	}
+
+	random := make([]byte, 200000)
+	_, err = rand.New(rand.NewSource(1)).Read(random)
+	require.NoError(t, err)
+
+	files := map[string][]byte{
+		"dir/text":      text.Bytes(),
+		"dir/mixed":     append(append(text.Bytes()[:300000:300000], random...), text.Bytes()[:300000]...),
+		"random":        random,
+		"small":         []byte("hello"),
+		"unaligned.txt": text.Bytes()[:8193],
+	}
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	require.NoError(t, tw.WriteHeader(&tar.Header{Typeflag: tar.TypeDir, Name: "dir/", Mode: 0o755}))
+	for _, name := range []string{"dir/mixed", "dir/text", "random", "small", "unaligned.txt"} {
+		require.NoError(t, tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: name, Mode: 0o644, Size: int64(len(files[name]))}))
+		_, err := tw.Write(files[name])
+		require.NoError(t, err)
+	}
+	require.NoError(t, tw.Close())
+
+	src, err := tarfs.Open(bytes.NewReader(buf.Bytes()))
+	require.NoError(t, err)
+
+	for _, opts := range []erofs.CompressionOptions{
+		{Algorithm: erofs.CompressionLZ4},
+		{Algorithm: erofs.CompressionLZ4, PclusterSize: 16 * erofs.BlockSize},
+		{Algorithm: erofs.CompressionLZ4HC, Level: 9},
+		{Algorithm: erofs.CompressionLZ4HC, PclusterSize: erofs.MaxPclusterSize},
+		{Algorithm: erofs.CompressionLZMA},
+		{Algorithm: erofs.CompressionLZMA, PclusterSize: erofs.MaxPclusterSize},
+		{Algorithm: erofs.CompressionDeflate},
+		{Algorithm: erofs.CompressionDeflate, PclusterSize: 4 * erofs.BlockSize},
+	} {
+		t.Run(fmt.Sprintf("%s Pcluster %d", opts.Algorithm, opts.PclusterSize), func(t *testing.T) {
+			image := filepath.Join(t.TempDir(), "compressed.img")
+
+			f, err := os.Create(image)
+			require.NoError(t, err)
+
+			require.NoError(t, erofs.Create(f, src, &erofs.CreateOptions{Compression: &opts}))
+			require.NoError(t, f.Close())
+
+			extractDir := filepath.Join(t.TempDir(), "extracted")
+
+			out, err := exec.Command(fsck, "--extract="+extractDir, image).CombinedOutput()
+			require.NoError(t, err, string(out))
+
+			for name, expected := range files {
+				data, err := os.ReadFile(filepath.Join(extractDir, name))
+				require.NoError(t, err)
+				require.Equal(t, expected, data, name)
+			}
+
+			if dump == "" {
+				return
+			}
+
+			out, err = exec.Command(dump, "-s", image).CombinedOutput()
+			require.NoError(t, err, string(out))
+
+			out, err = exec.Command(dump, "--path=/dir/mixed", image).CombinedOutput()
+			require.NoError(t, err, string(out))
+			require.Contains(t, string(out), fmt.Sprintf("Size: %d", len(files["dir/mixed"])))
+		})
+	}
+}
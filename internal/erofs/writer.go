@@ -0,0 +1,903 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package erofs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"maps"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+)
+
+const (
+	BlockSize         = 4096
+	BlockSizeBits     = 12
+	InodeSlotSize     = 1 << InodeSlotBits
+	MaxInlineDataSize = BlockSize / 4
+)
+
+// CreateOptions configures the creation of an EROFS filesystem image.
+type CreateOptions struct {
+	// XattrFilter, if set, selects the extended attributes to store. Extended
+	// attributes are read from source filesystems that implement
+	// Xattrs(name string) (map[string]string, error).
+	XattrFilter func(name string) bool
+	// Compression, if set, compresses regular files.
+	Compression *CompressionOptions
+	// SkipDevices omits character and block devices (eg. for images that are
+	// mounted without the privileges to use them).
+	SkipDevices bool
+	// UUID, if set, is the UUID of the filesystem.
+	UUID [16]byte
+	// BuildTime, if set, is the build time of the filesystem (which is also
+	// the modification time of files that don't record one).
+	BuildTime time.Time
+	// MaxMtime, if set, clamps the modification times of files (eg. to
+	// SOURCE_DATE_EPOCH for reproducible builds).
+	MaxMtime time.Time
+	// Stats, if set, receives the counts of the inodes in the image.
+	Stats *Stats
+}
+
+// Stats counts the inodes in an EROFS filesystem image.
+type Stats struct {
+	// Inodes is the total number of inodes (the names of a hardlinked file
+	// share a single inode).
+	Inodes int
+	// Files is the number of regular files.
+	Files int
+	// Dirs is the number of directories.
+	Dirs int
+	// Symlinks is the number of symbolic links.
+	Symlinks int
+	// Other is the number of other inodes (eg. device nodes).
+	Other int
+}
+
+// Create creates an EROFS filesystem image from the source filesystem and writes
+// it to the destination writer. The options may be nil.
+func Create(dst io.WriterAt, src fs.FS, opts *CreateOptions) error {
+	if opts == nil {
+		opts = &CreateOptions{}
+	}
+
+	w := &writer{
+		src:    src,
+		dst:    dst,
+		opts:   opts,
+		zratio: 2,
+	}
+
+	if opts.Compression != nil {
+		var err error
+		w.compressor, err = newCompressor(opts.Compression)
+		if err != nil {
+			return fmt.Errorf("invalid compression options: %w", err)
+		}
+	}
+
+	return w.write()
+}
+
+type writer struct {
+	src        fs.FS
+	dst        io.WriterAt
+	opts       *CreateOptions
+	inodes     map[string]any
+	inodeOrder []string
+	// links maps the names of hardlinks to the name of the inode they share.
+	links map[string]string
+	// xattrs are the encoded inline extended attributes of each inode (if
+	// any).
+	xattrs map[string][]byte
+	// compressor compresses regular files (if enabled), zratio is the
+	// compression ratio of the last extent, and zmaps are the encoded
+	// logical cluster indexes of each compressed inode.
+	compressor compressor
+	zratio     float64
+	zmaps      map[string][]byte
+}
+
+func (w *writer) write() error {
+	if err := w.populateInodes(); err != nil {
+		return fmt.Errorf("failed to populate inodes: %w", err)
+	}
+
+	if w.opts.Stats != nil {
+		*w.opts.Stats = w.stats()
+	}
+
+	metaSize, dataSize, err := w.firstPass()
+	if err != nil {
+		return fmt.Errorf("failed to calculate metadata and data size: %w", err)
+	}
+
+	// Reserve the first block for the superblock.
+	metaBlockAddr := int64(1)
+
+	// Compressed data follows the uncompressed data (its size isn't known
+	// until it's written).
+	zBlockAddr := 1 + (metaSize+dataSize)/BlockSize
+
+	zBlocks, err := w.writeData(uint32(zBlockAddr))
+	if err != nil {
+		return fmt.Errorf("failed to write data blocks: %w", err)
+	}
+
+	if err := w.writeMetadata(metaBlockAddr); err != nil {
+		return fmt.Errorf("failed to write metadata blocks: %w", err)
+	}
+
+	sb := SuperBlock{
+		Magic:         SuperBlockMagicV1,
+		BlockSizeBits: BlockSizeBits,
+		Inodes:        uint64(len(w.inodes)),
+		Blocks:        uint32(zBlockAddr) + zBlocks,
+		MetaBlockAddr: uint32(metaBlockAddr),
+		UUID:          w.opts.UUID,
+		// TODO: other fields (volume name, etc.)
+	}
+
+	if buildTime := w.opts.BuildTime; !buildTime.IsZero() {
+		sb.BuildTime = uint64(buildTime.Unix())
+		sb.BuildTimeNsec = uint32(buildTime.Nanosecond())
+	}
+
+	// The compression configuration (if any) follows the superblock.
+	var sbExtra []byte
+	if len(w.zmaps) > 0 {
+		sb.FeatureIncompat |= FeatureIncompatZeroPadding
+
+		if needsConfig(w.compressor, w.opts.Compression) {
+			sb.FeatureIncompat |= FeatureIncompatComprCfgs
+			sb.Union1 = 1 << w.compressor.alg()
+			sbExtra = encodeCompressionConfig(w.compressor)
+		}
+	}
+
+	if err := sb.checksum(sbExtra); err != nil {
+		return fmt.Errorf("failed to calculate superblock checksum: %w", err)
+	}
+
+	if err := binary.Write(io.NewOffsetWriter(w.dst, SuperBlockOffset), binary.LittleEndian, &sb); err != nil {
+		return fmt.Errorf("failed to write superblock: %w", err)
+	}
+
+	if _, err := w.dst.WriteAt(sbExtra, SuperBlockOffset+int64(binary.Size(sb))); err != nil {
+		return fmt.Errorf("failed to write compression configuration: %w", err)
+	}
+
+	if f, ok := w.dst.(*os.File); ok {
+		if err := f.Truncate(int64(sb.Blocks) * BlockSize); err != nil {
+			return fmt.Errorf("failed to truncate destination file: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// firstPass precomputes the layout of the blocks, and inodes.
+func (w *writer) firstPass() (metaSize, dataSize int64, err error) {
+	for _, path := range w.inodeOrder {
+		ino := w.inodes[path]
+
+		data, size, err := w.dataForInode(path, ino)
+		if err != nil {
+			return metaSize, dataSize, fmt.Errorf("failed to get data for %q: %w", path, err)
+		}
+		_ = data.Close()
+
+		// The inode is followed by its extended attributes.
+		inodeSize := int64(binary.Size(ino)) + int64(len(w.xattrs[path]))
+
+		// Devices, FIFOs, and sockets have no data (devices record their
+		// device number in place of the block address).
+		special := isSpecial(ino)
+
+		// Compressed files are followed by their logical cluster indexes.
+		compressed := w.compressible(path, ino, size)
+		if compressed {
+			inodeSize = roundUp(inodeSize, 8) + mapSize(size)
+		}
+
+		// Empty files have no data to inline.
+		inlined := !compressed && size > 0 && size <= MaxInlineDataSize && inodeSize+size <= BlockSize
+		if inlined {
+			// if the size of the inode and data exceeds the block size, we need to
+			// pad to the next block boundary before inlining the data.
+			spaceAvailable := roundUp(metaSize, BlockSize) - metaSize
+			if spaceAvailable > 0 && inodeSize+size > spaceAvailable {
+				// Pad the metadata to the next block boundary.
+				metaSize = roundUp(metaSize, BlockSize)
+			}
+		}
+
+		// Allocate the inode number.
+		nid, err := offsetToNID(metaSize)
+		if err != nil {
+			return metaSize, dataSize, fmt.Errorf("failed to convert offset to inode number: %w", err)
+		}
+
+		switch ino := ino.(type) {
+		case InodeCompact:
+			ino.Ino = nid
+			ino.Size = uint32(size)
+			if compressed {
+				ino.Format = setBits(ino.Format, InodeDataLayoutFlatCompressionLegacy, InodeDataLayoutBit, InodeDataLayoutBits)
+			} else if inlined {
+				ino.Format = setBits(ino.Format, InodeDataLayoutFlatInline, InodeDataLayoutBit, InodeDataLayoutBits)
+			} else {
+				ino.Format = setBits(ino.Format, InodeDataLayoutFlatPlain, InodeDataLayoutBit, InodeDataLayoutBits)
+				if !special {
+					ino.RawBlockAddr = uint32(dataSize / BlockSize)
+				}
+			}
+			w.inodes[path] = ino
+
+		case InodeExtended:
+			ino.Ino = nid
+			ino.Size = uint64(size)
+			if compressed {
+				ino.Format = setBits(ino.Format, InodeDataLayoutFlatCompressionLegacy, InodeDataLayoutBit, InodeDataLayoutBits)
+			} else if inlined {
+				ino.Format = setBits(ino.Format, InodeDataLayoutFlatInline, InodeDataLayoutBit, InodeDataLayoutBits)
+			} else {
+				ino.Format = setBits(ino.Format, InodeDataLayoutFlatPlain, InodeDataLayoutBit, InodeDataLayoutBits)
+				if !special {
+					ino.RawBlockAddr = uint32(dataSize / BlockSize)
+				}
+			}
+			w.inodes[path] = ino
+
+		default:
+			return metaSize, dataSize, fmt.Errorf("unsupported inode type %T", ino)
+		}
+
+		metaSize += inodeSize
+
+		if inlined {
+			metaSize += size
+		} else if !compressed {
+			dataSize += size
+			dataSize = roundUp(dataSize, BlockSize)
+		}
+
+		metaSize = roundUp(metaSize, InodeSlotSize)
+	}
+
+	metaSize = roundUp(metaSize, BlockSize)
+
+	dataBlockAddr := 1 + (metaSize / BlockSize)
+
+	// fix up the raw block addresses now that we know the total size of the
+	// metadata space.
+	for _, path := range w.inodeOrder {
+		ino := w.inodes[path]
+
+		switch ino := ino.(type) {
+		case InodeCompact:
+			if dataLayout(ino) == InodeDataLayoutFlatPlain && !isSpecial(ino) {
+				ino.RawBlockAddr += uint32(dataBlockAddr)
+				w.inodes[path] = ino
+			}
+		case InodeExtended:
+			if dataLayout(ino) == InodeDataLayoutFlatPlain && !isSpecial(ino) {
+				ino.RawBlockAddr += uint32(dataBlockAddr)
+				w.inodes[path] = ino
+			}
+		default:
+			return metaSize, dataSize, fmt.Errorf("unsupported inode type %T", ino)
+		}
+	}
+
+	return
+}
+
+func (w *writer) writeMetadata(metaBlockAddr int64) error {
+	for _, path := range w.inodeOrder {
+		ino := w.inodes[path]
+
+		var nid uint32
+		switch ino := ino.(type) {
+		case InodeCompact:
+			nid = ino.Ino
+		case InodeExtended:
+			nid = ino.Ino
+		default:
+			return fmt.Errorf("unsupported inode type %T", ino)
+		}
+
+		// Get the address of the inode.
+		off := metaBlockAddr*BlockSize + int64(nid)*InodeSlotSize
+
+		// Write the inode.
+		if err := binary.Write(io.NewOffsetWriter(w.dst, off), binary.LittleEndian, ino); err != nil {
+			return fmt.Errorf("failed to write inode for %q: %w", path, err)
+		}
+		off += int64(binary.Size(ino))
+
+		// Followed by its extended attributes.
+		if xattrs := w.xattrs[path]; len(xattrs) > 0 {
+			if _, err := w.dst.WriteAt(xattrs, off); err != nil {
+				return fmt.Errorf("failed to write xattrs for %q: %w", path, err)
+			}
+			off += int64(len(xattrs))
+		}
+
+		// Compressed files are followed by their logical cluster indexes.
+		if zmap := w.zmaps[path]; len(zmap) > 0 {
+			if _, err := w.dst.WriteAt(zmap, roundUp(off, 8)); err != nil {
+				return fmt.Errorf("failed to write logical cluster indexes for %q: %w", path, err)
+			}
+		}
+
+		// Small files are stored in the inline with the inode.
+		if isInlined(ino) {
+			data, _, err := w.dataForInode(path, ino)
+			if err != nil {
+				return fmt.Errorf("failed to get data for %q: %w", path, err)
+			}
+
+			// Write the inlined data.
+			_, err = io.Copy(io.NewOffsetWriter(w.dst, off), data)
+			_ = data.Close()
+			if err != nil {
+				return fmt.Errorf("failed to write inline data for %q: %w", path, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// writeData writes the data blocks of the inodes, compressed files are
+// written from zBlockAddr onwards. It returns the number of blocks used by
+// compressed files.
+func (w *writer) writeData(zBlockAddr uint32) (uint32, error) {
+	var zBlocks uint32
+	for _, path := range w.inodeOrder {
+		ino := w.inodes[path]
+
+		if isInlined(ino) || isSpecial(ino) {
+			// Small files are stored in the inline with the inode, and special
+			// files have no data.
+			continue
+		}
+
+		if dataLayout(ino) == InodeDataLayoutFlatCompressionLegacy {
+			blocks, err := w.writeCompressed(path, ino, zBlockAddr+zBlocks)
+			if err != nil {
+				return 0, err
+			}
+
+			zBlocks += blocks
+			continue
+		}
+
+		var rawBlockAddr uint32
+		switch ino := ino.(type) {
+		case InodeCompact:
+			rawBlockAddr = ino.RawBlockAddr
+		case InodeExtended:
+			rawBlockAddr = ino.RawBlockAddr
+		default:
+			return 0, fmt.Errorf("unsupported inode type %T", ino)
+		}
+
+		data, _, err := w.dataForInode(path, ino)
+		if err != nil {
+			return 0, fmt.Errorf("failed to get data for %q: %w", path, err)
+		}
+
+		_, err = io.Copy(io.NewOffsetWriter(w.dst, int64(rawBlockAddr)*BlockSize), data)
+		_ = data.Close()
+		if err != nil {
+			return 0, fmt.Errorf("failed to write data for %q: %w", path, err)
+		}
+	}
+
+	return zBlocks, nil
+}
+
+// writeCompressed compresses the data of a regular file into the blocks
+// starting at blkAddr, it returns the number of blocks used. Files that
+// don't compress are stored uncompressed instead.
+func (w *writer) writeCompressed(path string, ino any, blkAddr uint32) (uint32, error) {
+	data, size, err := w.dataForInode(path, ino)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get data for %q: %w", path, err)
+	}
+
+	extents, blocks, err := w.compressFile(path, data, size, blkAddr)
+	_ = data.Close()
+	if err != nil {
+		return 0, err
+	}
+
+	plainBlocks := uint32((size + BlockSize - 1) / BlockSize)
+	if blocks >= plainBlocks {
+		data, _, err := w.dataForInode(path, ino)
+		if err != nil {
+			return 0, fmt.Errorf("failed to get data for %q: %w", path, err)
+		}
+
+		// Overwrite the compressed data (zeroing the remainder of the last
+		// block).
+		_, err = io.Copy(io.NewOffsetWriter(w.dst, int64(blkAddr)*BlockSize), io.MultiReader(data,
+			bytes.NewReader(make([]byte, int64(plainBlocks)*BlockSize-size))))
+		_ = data.Close()
+		if err != nil {
+			return 0, fmt.Errorf("failed to write data for %q: %w", path, err)
+		}
+
+		w.inodes[path] = withData(ino, InodeDataLayoutFlatPlain, blkAddr)
+		return plainBlocks, nil
+	}
+
+	w.zmaps[path], err = w.encodeMap(extents, size)
+	if err != nil {
+		return 0, fmt.Errorf("failed to encode logical cluster indexes for %q: %w", path, err)
+	}
+
+	// The compressed block count is recorded in place of the block address.
+	w.inodes[path] = withData(ino, InodeDataLayoutFlatCompressionLegacy, blocks)
+	return blocks, nil
+}
+
+// compressible reports whether the data of the inode should be compressed.
+func (w *writer) compressible(path string, ino any, size int64) bool {
+	if w.compressor == nil || size <= BlockSize {
+		return false
+	}
+
+	var mode uint16
+	switch ino := ino.(type) {
+	case InodeCompact:
+		mode = ino.Mode
+	case InodeExtended:
+		mode = ino.Mode
+	}
+
+	if mode&S_IFMT != S_IFREG {
+		return false
+	}
+
+	return w.opts.Compression.Filter == nil || w.opts.Compression.Filter(path)
+}
+
+func (w *writer) populateInodes() error {
+	type xattrFS interface {
+		Xattrs(name string) (map[string]string, error)
+	}
+
+	type hardlinkFS interface {
+		Hardlink(name string) (string, int, error)
+	}
+
+	w.inodes = map[string]any{}
+	w.links = map[string]string{}
+	w.xattrs = map[string][]byte{}
+	w.zmaps = map[string][]byte{}
+
+	xfs, hasXattrs := w.src.(xattrFS)
+	hfs, hasHardlinks := w.src.(hardlinkFS)
+
+	err := fs.WalkDir(w.src, ".", func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		if w.skipped(fi.Mode()) {
+			return nil
+		}
+
+		nlink := 1
+		if fi.IsDir() {
+			entries, err := fs.ReadDir(w.src, path)
+			if err != nil {
+				return fmt.Errorf("failed to read directory entries: %w", err)
+			}
+
+			entries = slices.DeleteFunc(entries, func(de fs.DirEntry) bool {
+				return w.skipped(de.Type())
+			})
+
+			nlink = len(entries) + 2
+		} else if hasHardlinks && fi.Mode().IsRegular() {
+			first, n, err := hfs.Hardlink(path)
+			if err != nil {
+				return fmt.Errorf("failed to read hardlinks of %q: %w", path, err)
+			}
+
+			// Hardlinks share the inode of the first link.
+			if _, ok := w.inodes[first]; ok && first != path {
+				w.links[path] = first
+				return nil
+			}
+
+			nlink = n
+		}
+
+		var xattrCount uint16
+		if hasXattrs {
+			attrs, err := xfs.Xattrs(path)
+			if err != nil {
+				return fmt.Errorf("failed to read xattrs of %q: %w", path, err)
+			}
+
+			if w.opts.XattrFilter != nil {
+				maps.DeleteFunc(attrs, func(name, _ string) bool {
+					return !w.opts.XattrFilter(name)
+				})
+			}
+
+			w.xattrs[path], xattrCount, err = encodeXattrs(attrs)
+			if err != nil {
+				return fmt.Errorf("failed to encode xattrs of %q: %w", path, err)
+			}
+		}
+
+		mtime := fi.ModTime()
+		if !w.opts.MaxMtime.IsZero() && mtime.After(w.opts.MaxMtime) {
+			mtime = w.opts.MaxMtime
+		}
+
+		w.inodes[path] = toInode(fi, mtime, nlink, xattrCount)
+		w.inodeOrder = append(w.inodeOrder, path)
+
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to walk source filesystem: %w", err)
+	}
+
+	return nil
+}
+
+func (w *writer) dataForInode(path string, ino any) (io.ReadCloser, int64, error) {
+	type readLinkFS interface {
+		ReadLink(name string) (string, error)
+	}
+
+	var mode uint16
+	switch ino := ino.(type) {
+	case InodeCompact:
+		mode = ino.Mode
+	case InodeExtended:
+		mode = ino.Mode
+	default:
+		return nil, 0, fmt.Errorf("unsupported inode type %T", ino)
+	}
+
+	switch mode & S_IFMT {
+	case S_IFREG:
+		f, err := w.src.Open(path)
+		if err != nil {
+			return nil, 0, fmt.Errorf("failed to open file %q: %w", path, err)
+		}
+
+		fi, err := f.Stat()
+		if err != nil {
+			_ = f.Close()
+			return nil, 0, fmt.Errorf("failed to stat source file %q: %w", path, err)
+		}
+
+		return f, fi.Size(), nil
+
+	case S_IFDIR:
+		entries, err := fs.ReadDir(w.src, path)
+		if err != nil {
+			return nil, 0, fmt.Errorf("failed to read directory entries: %w", err)
+		}
+
+		dirents := []Dirent{{FileType: uint8(fileTypeFromFileMode(fs.ModeDir))}}
+		names := []string{"."}
+
+		if path != "." {
+			dirents = append(dirents, Dirent{FileType: uint8(fileTypeFromFileMode(fs.ModeDir))})
+			names = append(names, "..")
+		}
+
+		for _, de := range entries {
+			if w.skipped(de.Type()) {
+				continue
+			}
+
+			path := filepath.Clean(filepath.Join(path, de.Name()))
+			if first, ok := w.links[path]; ok {
+				path = first
+			}
+
+			ino, ok := w.inodes[path]
+			if !ok {
+				return nil, 0, fmt.Errorf("failed to find inode for path %q", path)
+			}
+
+			var nid uint32
+			switch ino := ino.(type) {
+			case InodeCompact:
+				nid = ino.Ino
+			case InodeExtended:
+				nid = ino.Ino
+			default:
+				return nil, 0, fmt.Errorf("unsupported inode type %T", ino)
+			}
+
+			dirents = append(dirents, Dirent{
+				Nid:      uint64(nid),
+				FileType: uint8(fileTypeFromFileMode(de.Type())),
+			})
+			names = append(names, de.Name())
+		}
+
+		buf, err := encodeDirents(dirents, names)
+		if err != nil {
+			return nil, 0, fmt.Errorf("failed to encode directory entries: %w", err)
+		}
+
+		return io.NopCloser(bytes.NewReader(buf)), int64(len(buf)), nil
+
+	case S_IFLNK:
+		fsys, ok := w.src.(readLinkFS)
+		if !ok {
+			return nil, 0, errors.New("source filesystem must implement readLinkFS")
+		}
+
+		target, err := fsys.ReadLink(path)
+		if err != nil {
+			return nil, 0, fmt.Errorf("failed to read symlink target: %w", err)
+		}
+
+		return io.NopCloser(bytes.NewReader([]byte(target))), int64(len(target)), nil
+
+	case S_IFCHR, S_IFBLK, S_IFIFO, S_IFSOCK:
+		return io.NopCloser(bytes.NewReader(nil)), 0, nil
+
+	default:
+		return nil, 0, fmt.Errorf("unsupported file type %o", mode&S_IFMT)
+	}
+}
+
+func toInode(fi fs.FileInfo, mtime time.Time, nlink int, xattrCount uint16) any {
+	uid, gid := getOwner(fi)
+
+	// Devices record their device number in place of the block address.
+	var rdev uint32
+	if fi.Mode()&fs.ModeDevice != 0 {
+		rdev = encodeDevice(getDevice(fi))
+	}
+
+	// Can we use a compact inode?
+	compact := fi.Size() <= math.MaxUint32 && nlink <= math.MaxUint16 &&
+		uid <= math.MaxUint16 && gid <= math.MaxUint16 &&
+		mtime == time.Time{}
+
+	if compact {
+		return InodeCompact{
+			Format:       setBits(0, InodeLayoutCompact, InodeLayoutBit, InodeLayoutBits),
+			XattrCount:   xattrCount,
+			Mode:         statModeFromFileMode(fi.Mode()),
+			Nlink:        uint16(nlink),
+			UID:          uint16(uid),
+			GID:          uint16(gid),
+			RawBlockAddr: rdev,
+		}
+	}
+
+	return InodeExtended{
+		Format:       setBits(0, InodeLayoutExtended, InodeLayoutBit, InodeLayoutBits),
+		XattrCount:   xattrCount,
+		Mode:         statModeFromFileMode(fi.Mode()),
+		Nlink:        uint32(nlink),
+		UID:          uint32(uid),
+		GID:          uint32(gid),
+		Mtime:        uint64(mtime.Unix()),
+		MtimeNsec:    uint32(mtime.Nanosecond()),
+		RawBlockAddr: rdev,
+	}
+}
+
+func encodeDirents(dirents []Dirent, names []string) ([]byte, error) {
+	blocks := splitIntoDirentBlocks(dirents, names)
+
+	var buf bytes.Buffer
+	for i, block := range blocks {
+		nameOff := uint16(int64(len(block.entries)) * DirentSize) // nameoff0
+
+		// write the dirents
+		for i, dirent := range block.entries {
+			dirent.NameOff = nameOff
+			nameOff += uint16(len(block.names[i]))
+
+			if err := binary.Write(&buf, binary.LittleEndian, dirent); err != nil {
+				return nil, fmt.Errorf("failed to write dirent: %w", err)
+			}
+		}
+
+		// write the names
+		for _, name := range block.names {
+			if _, err := buf.WriteString(name); err != nil {
+				return nil, fmt.Errorf("failed to write name: %w", err)
+			}
+		}
+
+		// Null-terminate the final name.
+		if err := buf.WriteByte(0); err != nil {
+			return nil, fmt.Errorf("failed to write null terminator: %w", err)
+		}
+
+		if i < len(blocks)-1 {
+			// Pad to the next block boundary.
+			paddingBytes := roundUp(int64(buf.Len()), BlockSize) - int64(buf.Len())
+			if _, err := buf.Write(make([]byte, paddingBytes)); err != nil {
+				return nil, fmt.Errorf("failed to write padding: %w", err)
+			}
+		}
+	}
+
+	return buf.Bytes(), nil
+}
+
+type direntBlock struct {
+	entries []Dirent
+	names   []string
+}
+
+func splitIntoDirentBlocks(dirents []Dirent, names []string) []direntBlock {
+	var blocks []direntBlock
+	var currentBlock direntBlock
+	currentBlockSize := int64(0)
+
+	for i, dirent := range dirents {
+		name := names[i]
+		nameSize := int64(len(name))
+
+		// Check if adding this dirent and name (plus null terminator)
+		// exceeds the block size
+		if currentBlockSize+DirentSize+nameSize+1 > BlockSize {
+			// Start a new block
+			blocks = append(blocks, currentBlock)
+			currentBlock = direntBlock{}
+			currentBlockSize = 0
+		}
+
+		// Add dirent and name to the current block
+		currentBlock.entries = append(currentBlock.entries, dirent)
+		currentBlock.names = append(currentBlock.names, name)
+		currentBlockSize += DirentSize + nameSize
+	}
+
+	if len(currentBlock.entries) > 0 {
+		blocks = append(blocks, currentBlock)
+	}
+
+	return blocks
+}
+
+func offsetToNID(metaOffset int64) (uint32, error) {
+	// The inode number is the relative offset divided by the inode slot size.
+	if metaOffset%InodeSlotSize != 0 {
+		return 0, fmt.Errorf("offset %d is not properly aligned", metaOffset)
+	}
+
+	nid := uint32(metaOffset >> InodeSlotBits)
+	return nid, nil
+}
+
+// stats counts the inodes by type.
+func (w *writer) stats() Stats {
+	stats := Stats{Inodes: len(w.inodes)}
+	for _, ino := range w.inodes {
+		var mode uint16
+		switch ino := ino.(type) {
+		case InodeCompact:
+			mode = ino.Mode
+		case InodeExtended:
+			mode = ino.Mode
+		}
+
+		switch mode & S_IFMT {
+		case S_IFREG:
+			stats.Files++
+		case S_IFDIR:
+			stats.Dirs++
+		case S_IFLNK:
+			stats.Symlinks++
+		default:
+			stats.Other++
+		}
+	}
+
+	return stats
+}
+
+// isSpecial reports whether the inode is a device, FIFO, or socket.
+func isSpecial(ino any) bool {
+	var mode uint16
+	switch ino := ino.(type) {
+	case InodeCompact:
+		mode = ino.Mode
+	case InodeExtended:
+		mode = ino.Mode
+	}
+
+	switch mode & S_IFMT {
+	case S_IFCHR, S_IFBLK, S_IFIFO, S_IFSOCK:
+		return true
+	default:
+		return false
+	}
+}
+
+// skipped reports whether files of the given type are omitted from the image.
+func (w *writer) skipped(mode fs.FileMode) bool {
+	return w.opts.SkipDevices && mode&fs.ModeDevice != 0
+}
+
+func isInlined(ino any) bool {
+	return dataLayout(ino) == InodeDataLayoutFlatInline
+}
+
+func dataLayout(ino any) uint16 {
+	var format uint16
+	switch ino := ino.(type) {
+	case InodeCompact:
+		format = ino.Format
+	case InodeExtended:
+		format = ino.Format
+	default:
+		return InodeDataLayoutMax
+	}
+
+	return bitRange(format, InodeDataLayoutBit, InodeDataLayoutBits)
+}
+
+// withData returns the inode with the given data layout and raw block
+// address.
+func withData(ino any, layout uint16, rawBlockAddr uint32) any {
+	switch ino := ino.(type) {
+	case InodeCompact:
+		ino.Format = setBits(ino.Format, layout, InodeDataLayoutBit, InodeDataLayoutBits)
+		ino.RawBlockAddr = rawBlockAddr
+		return ino
+	case InodeExtended:
+		ino.Format = setBits(ino.Format, layout, InodeDataLayoutBit, InodeDataLayoutBits)
+		ino.RawBlockAddr = rawBlockAddr
+		return ino
+	default:
+		return ino
+	}
+}
+
+func setBits(value, newValue, bit, bits uint16) uint16 {
+	mask := uint16((1<<bits)-1) << bit
+	return (value & ^mask) | ((newValue << bit) & mask)
+}
+
+func roundUp(x, align int64) int64 {
+	if x%align == 0 {
+		return x
+	}
+
+	return (x + align - 1) &^ (align - 1)
+}
@@ -0,0 +1,220 @@
+// SPDX-License-Identifier: MPL-2.0
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ */
+
+package erofs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// Extended attribute name indexes, which stand in for the well known name
+// prefixes on disk.
+const (
+	XattrIndexUser            = 1
+	XattrIndexPosixACLAccess  = 2
+	XattrIndexPosixACLDefault = 3
+	XattrIndexTrusted         = 4
+	XattrIndexLustre          = 5
+	XattrIndexSecurity        = 6
+)
+
+var xattrPrefixes = map[uint8]string{
+	XattrIndexUser:            "user.",
+	XattrIndexPosixACLAccess:  "system.posix_acl_access",
+	XattrIndexPosixACLDefault: "system.posix_acl_default",
+	XattrIndexTrusted:         "trusted.",
+	XattrIndexLustre:          "lustre.",
+	XattrIndexSecurity:        "security.",
+}
+
+// XattrIbodyHeader represents the on-disk header of the extended attributes
+// stored inline after an inode.
+type XattrIbodyHeader struct {
+	NameFilter  uint32   // Bloom filter of the attribute names (if enabled)
+	SharedCount uint8    // Number of shared attribute ids following the header
+	Reserved    [7]uint8 // Reserved for future use
+}
+
+// XattrEntry represents an on-disk extended attribute entry, it is followed
+// by the name (without its prefix) and the value.
+type XattrEntry struct {
+	NameLen   uint8  // Length of the name
+	NameIndex uint8  // Name prefix index
+	ValueSize uint16 // Size of the value
+}
+
+var (
+	XattrIbodyHeaderSize = int64(binary.Size(XattrIbodyHeader{}))
+	XattrEntrySize       = int64(binary.Size(XattrEntry{}))
+)
+
+// XattrSupported reports whether the extended attribute can be stored, that
+// is whether its name has a well known prefix.
+func XattrSupported(name string) bool {
+	_, _, ok := splitXattrName(name)
+	return ok
+}
+
+// splitXattrName splits the name of an extended attribute into its prefix
+// index and the remainder of the name.
+func splitXattrName(name string) (uint8, string, bool) {
+	for index, prefix := range xattrPrefixes {
+		suffix, ok := strings.CutPrefix(name, prefix)
+		if !ok {
+			continue
+		}
+
+		// The POSIX ACL prefixes are complete names.
+		if !strings.HasSuffix(prefix, ".") && suffix != "" {
+			continue
+		}
+
+		return index, suffix, true
+	}
+
+	return 0, "", false
+}
+
+// xattrIbodySize returns the size of the inline extended attributes of an
+// inode with the given xattr count.
+func xattrIbodySize(xattrCount uint16) int64 {
+	if xattrCount == 0 {
+		return 0
+	}
+
+	return XattrIbodyHeaderSize + int64(xattrCount-1)*4
+}
+
+// encodeXattrs encodes the extended attributes to be stored inline after an
+// inode, returning the encoded attributes and the xattr count of the inode.
+func encodeXattrs(attrs map[string]string) ([]byte, uint16, error) {
+	if len(attrs) == 0 {
+		return nil, 0, nil
+	}
+
+	names := make([]string, 0, len(attrs))
+	for name := range attrs {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	var buf bytes.Buffer
+	if err := binary.Write(&buf, binary.LittleEndian, XattrIbodyHeader{}); err != nil {
+		return nil, 0, fmt.Errorf("failed to write xattr header: %w", err)
+	}
+
+	for _, name := range names {
+		index, suffix, ok := splitXattrName(name)
+		if !ok {
+			return nil, 0, fmt.Errorf("unsupported xattr %q", name)
+		}
+
+		value := attrs[name]
+		if len(suffix) > MaxNameLen || len(value) > 0xffff {
+			return nil, 0, fmt.Errorf("xattr %q is too large", name)
+		}
+
+		entry := XattrEntry{
+			NameLen:   uint8(len(suffix)),
+			NameIndex: index,
+			ValueSize: uint16(len(value)),
+		}
+
+		if err := binary.Write(&buf, binary.LittleEndian, entry); err != nil {
+			return nil, 0, fmt.Errorf("failed to write xattr entry: %w", err)
+		}
+
+		buf.WriteString(suffix)
+		buf.WriteString(value)
+
+		// Entries are aligned to 4 bytes.
+		buf.Write(make([]byte, roundUp(int64(buf.Len()), 4)-int64(buf.Len())))
+	}
+
+	xattrCount := (int64(buf.Len())-XattrIbodyHeaderSize)/4 + 1
+	if xattrCount > 0xffff {
+		return nil, 0, errors.New("too many xattrs")
+	}
+
+	return buf.Bytes(), uint16(xattrCount), nil
+}
+
+// xattrEntryAt returns the name and value of the extended attribute entry at
+// offset off within the image, and the (aligned) size of the entry.
+func (i *Image) xattrEntryAt(off int64) (string, string, int64, error) {
+	var entry XattrEntry
+	if err := i.unmarshalFrom(off, &entry); err != nil {
+		return "", "", 0, err
+	}
+
+	prefix, ok := xattrPrefixes[entry.NameIndex]
+	if !ok {
+		return "", "", 0, fmt.Errorf("unsupported xattr name index %d at offset %d", entry.NameIndex, off)
+	}
+
+	buf, err := i.bytesAt(off+XattrEntrySize, int64(entry.NameLen)+int64(entry.ValueSize))
+	if err != nil {
+		return "", "", 0, err
+	}
+
+	name := prefix + string(buf[:entry.NameLen])
+	value := string(buf[entry.NameLen:])
+
+	return name, value, roundUp(XattrEntrySize+int64(len(buf)), 4), nil
+}
+
+// Xattrs returns the extended attributes of this inode.
+func (ino *Inode) Xattrs() (map[string]string, error) {
+	if ino.xattrSize == 0 {
+		return nil, nil
+	}
+
+	var hdr XattrIbodyHeader
+	if err := ino.image.unmarshalFrom(ino.xattrOff, &hdr); err != nil {
+		return nil, err
+	}
+
+	attrs := make(map[string]string)
+
+	// Shared attributes are referenced by their offset (in 4 byte units)
+	// within the shared xattr area.
+	off := ino.xattrOff + XattrIbodyHeaderSize
+	for n := 0; n < int(hdr.SharedCount); n++ {
+		buf, err := ino.image.bytesAt(off, 4)
+		if err != nil {
+			return nil, err
+		}
+		off += 4
+
+		sharedOff := ino.image.sb.BlockAddrToOffset(ino.image.sb.XattrBlockAddr) + int64(binary.LittleEndian.Uint32(buf))*4
+		name, value, _, err := ino.image.xattrEntryAt(sharedOff)
+		if err != nil {
+			return nil, err
+		}
+		attrs[name] = value
+	}
+
+	end := ino.xattrOff + ino.xattrSize
+	for off < end {
+		name, value, size, err := ino.image.xattrEntryAt(off)
+		if err != nil {
+			return nil, err
+		}
+		attrs[name] = value
+
+		off += size
+	}
+
+	return attrs, nil
+}
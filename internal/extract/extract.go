@@ -0,0 +1,365 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+// Package extract writes (merged) root filesystems out as directories or tar
+// streams, preserving permissions, ownership, timestamps, symlinks, and
+// hardlinks.
+package extract
+
+import (
+	"archive/tar"
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"github.com/immutos/oci2erofs/internal/fsutil"
+)
+
+// Options configures an extraction.
+type Options struct {
+	// SameOwner applies the ownership recorded in the image to the extracted
+	// files (which typically requires root privileges). Ownership is always
+	// applied numerically, the user and group names are not mapped through
+	// the host's user database. Only used when extracting to a directory.
+	SameOwner bool
+	// NumericOwner omits the user and group names, recording only the numeric
+	// IDs. Only used when writing a tar stream.
+	NumericOwner bool
+	// SkipDevices omits character and block devices (which can only be
+	// created with root privileges).
+	SkipDevices bool
+}
+
+// ToDir extracts the contents of fsys into dir, which is created if it does
+// not exist (and otherwise must be empty). If the extraction fails (or is
+// cancelled), anything written to dir is removed.
+func ToDir(ctx context.Context, fsys fs.FS, dir string, opts Options) (err error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return fmt.Errorf("failed to create directory: %w", err)
+	}
+
+	dirEntries, err := os.ReadDir(dir)
+	if err != nil {
+		return fmt.Errorf("failed to read directory: %w", err)
+	}
+
+	if len(dirEntries) > 0 {
+		return fmt.Errorf("directory %q is not empty", dir)
+	}
+
+	defer func() {
+		if err != nil {
+			removeContents(dir)
+		}
+	}()
+
+	var dirs []*entry
+	err = walk(ctx, fsys, opts, func(e *entry) error {
+		dst := filepath.Join(dir, filepath.FromSlash(e.name))
+
+		switch {
+		case e.link != "":
+			// Hardlinks share the metadata of the first link.
+			if err := os.Link(filepath.Join(dir, filepath.FromSlash(e.link)), dst); err != nil {
+				return fmt.Errorf("failed to create hardlink: %w", err)
+			}
+
+			return nil
+		case e.fi.IsDir():
+			if e.name != "." {
+				if err := os.Mkdir(dst, 0o700); err != nil {
+					return fmt.Errorf("failed to create directory: %w", err)
+				}
+			}
+
+			// Directories are finalized last, so that restrictive permissions
+			// (and modification times) are not disturbed by their contents.
+			dirs = append(dirs, e)
+
+			return nil
+		case e.fi.Mode()&fs.ModeSymlink != 0:
+			if err := os.Symlink(e.target, dst); err != nil {
+				return fmt.Errorf("failed to create symlink: %w", err)
+			}
+		case e.fi.Mode().IsRegular():
+			if err := writeFile(fsys, e.name, dst); err != nil {
+				return err
+			}
+		case e.fi.Mode()&(fs.ModeDevice|fs.ModeNamedPipe) != 0:
+			major, minor := deviceOf(e.fi)
+			if err := mknod(dst, e.fi.Mode(), major, minor); err != nil {
+				return fmt.Errorf("failed to create %q: %w", e.name, err)
+			}
+		default:
+			return fmt.Errorf("unsupported file type: %s", e.fi.Mode().Type())
+		}
+
+		return setMetadata(dst, e, opts)
+	})
+	if err != nil {
+		return err
+	}
+
+	for i := len(dirs) - 1; i >= 0; i-- {
+		e := dirs[i]
+		if err := setMetadata(filepath.Join(dir, filepath.FromSlash(e.name)), e, opts); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// removeContents makes a best-effort attempt to remove everything in dir.
+func removeContents(dir string) {
+	dirEntries, err := os.ReadDir(dir)
+	if err != nil {
+		return
+	}
+
+	for _, de := range dirEntries {
+		_ = os.RemoveAll(filepath.Join(dir, de.Name()))
+	}
+}
+
+// ToTar writes the contents of fsys to w as a tar stream.
+func ToTar(ctx context.Context, fsys fs.FS, w io.Writer, opts Options) error {
+	tw := tar.NewWriter(w)
+
+	err := walk(ctx, fsys, opts, func(e *entry) error {
+		// The root directory is implicit.
+		if e.name == "." {
+			return nil
+		}
+
+		hdr, err := tar.FileInfoHeader(e.fi, e.target)
+		if err != nil {
+			return fmt.Errorf("failed to create header for %q: %w", e.name, err)
+		}
+
+		hdr.Name = e.name
+		if e.fi.IsDir() {
+			hdr.Name += "/"
+		}
+
+		if e.fi.Mode()&fs.ModeDevice != 0 {
+			major, minor := deviceOf(e.fi)
+			hdr.Devmajor, hdr.Devminor = int64(major), int64(minor)
+		}
+
+		// Drop any records describing the source archive (eg. sparse maps).
+		hdr.PAXRecords = nil
+
+		if opts.NumericOwner {
+			hdr.Uname, hdr.Gname = "", ""
+		}
+
+		if e.link != "" {
+			hdr.Typeflag = tar.TypeLink
+			hdr.Linkname = e.link
+			hdr.Size = 0
+		}
+
+		if err := tw.WriteHeader(hdr); err != nil {
+			return fmt.Errorf("failed to write header for %q: %w", e.name, err)
+		}
+
+		if hdr.Typeflag != tar.TypeReg {
+			return nil
+		}
+
+		f, err := fsys.Open(e.name)
+		if err != nil {
+			return fmt.Errorf("failed to open file: %w", err)
+		}
+		defer f.Close()
+
+		if _, err := io.Copy(tw, f); err != nil {
+			return fmt.Errorf("failed to write contents of %q: %w", e.name, err)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := tw.Close(); err != nil {
+		return fmt.Errorf("failed to close tar writer: %w", err)
+	}
+
+	return nil
+}
+
+// entry is a file visited while walking the filesystem.
+type entry struct {
+	name string
+	fi   fs.FileInfo
+	// target is the destination of a symlink.
+	target string
+	// link is the name of a previously visited entry, of which this entry is
+	// a hardlink.
+	link string
+}
+
+// walk visits the entries of fsys in lexical order (parents before their
+// children), without following symlinks.
+func walk(ctx context.Context, fsys fs.FS, opts Options, fn func(e *entry) error) error {
+	// Filesystems that track hardlinks (eg. an overlay) report the first name
+	// of each file.
+	hfs, hasHardlinks := fsys.(interface {
+		Hardlink(name string) (string, int, error)
+	})
+
+	// Otherwise regular files are keyed by the (first) name of the file they
+	// are linked to.
+	links := make(map[string]*entry)
+
+	return fs.WalkDir(fsys, ".", func(name string, _ fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		e := &entry{name: name}
+
+		e.fi, err = fsutil.StatLink(fsys, name)
+		if err != nil {
+			return err
+		}
+
+		if opts.SkipDevices && e.fi.Mode()&fs.ModeDevice != 0 {
+			return nil
+		}
+
+		switch {
+		case e.fi.Mode()&fs.ModeSymlink != 0:
+			e.target, err = fsutil.ReadLink(fsys, name)
+			if err != nil {
+				return err
+			}
+		case e.fi.Mode().IsRegular() && hasHardlinks:
+			first, _, err := hfs.Hardlink(name)
+			if err != nil {
+				return fmt.Errorf("failed to read hardlinks of %q: %w", name, err)
+			}
+
+			if first != name {
+				e.link = first
+			}
+		case e.fi.Mode().IsRegular():
+			key := name
+			if hdr, ok := e.fi.Sys().(*tar.Header); ok && hdr.Linkname != "" {
+				key = hdr.Linkname
+			}
+
+			if first, ok := links[key]; ok && sameFile(first.fi, e.fi) {
+				e.link = first.name
+			} else if !ok {
+				links[key] = e
+			}
+		}
+
+		return fn(e)
+	})
+}
+
+// sameFile reports whether two hardlinked entries still refer to the same
+// file (eg. the target may have been replaced by a later layer).
+func sameFile(a, b fs.FileInfo) bool {
+	aUID, aGID := fsutil.Owner(a)
+	bUID, bGID := fsutil.Owner(b)
+
+	return a.Mode() == b.Mode() && a.Size() == b.Size() && a.ModTime().Equal(b.ModTime()) &&
+		aUID == bUID && aGID == bGID
+}
+
+func writeFile(fsys fs.FS, name, dst string) error {
+	src, err := fsys.Open(name)
+	if err != nil {
+		return fmt.Errorf("failed to open file: %w", err)
+	}
+	defer src.Close()
+
+	f, err := os.OpenFile(dst, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o600)
+	if err != nil {
+		return fmt.Errorf("failed to create file: %w", err)
+	}
+	defer f.Close()
+
+	if _, err := io.Copy(f, src); err != nil {
+		return fmt.Errorf("failed to write contents of %q: %w", name, err)
+	}
+
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("failed to close file: %w", err)
+	}
+
+	return nil
+}
+
+// setMetadata applies the ownership, permissions, and timestamps of the entry
+// to the extracted file.
+func setMetadata(dst string, e *entry, opts Options) error {
+	if opts.SameOwner {
+		uid, gid := fsutil.Owner(e.fi)
+		if err := os.Lchown(dst, uid, gid); err != nil {
+			return fmt.Errorf("failed to change ownership of %q: %w", e.name, err)
+		}
+	}
+
+	// Changing the ownership clears the setuid/setgid bits, so permissions are
+	// applied afterwards.
+	if e.fi.Mode()&fs.ModeSymlink == 0 {
+		mode := e.fi.Mode() & (fs.ModePerm | fs.ModeSetuid | fs.ModeSetgid | fs.ModeSticky)
+		if err := os.Chmod(dst, mode); err != nil {
+			return fmt.Errorf("failed to change permissions of %q: %w", e.name, err)
+		}
+	}
+
+	// Eg. implicit directories, which have no recorded timestamps.
+	if e.fi.ModTime().IsZero() {
+		return nil
+	}
+
+	atime := e.fi.ModTime()
+	if hdr, ok := e.fi.Sys().(*tar.Header); ok && !hdr.AccessTime.IsZero() {
+		atime = hdr.AccessTime
+	}
+
+	if err := lchtimes(dst, atime, e.fi.ModTime()); err != nil {
+		return fmt.Errorf("failed to change timestamps of %q: %w", e.name, err)
+	}
+
+	return nil
+}
+
+// deviceOf returns the major and minor numbers of a device.
+func deviceOf(fi fs.FileInfo) (major, minor uint32) {
+	if hdr, ok := fi.Sys().(*tar.Header); ok {
+		return uint32(hdr.Devmajor), uint32(hdr.Devminor)
+	}
+
+	return 0, 0
+}
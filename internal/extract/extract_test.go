@@ -0,0 +1,245 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package extract_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/immutos/oci2erofs/internal/extract"
+	"github.com/immutos/oci2erofs/internal/overlayfs"
+	"github.com/immutos/oci2erofs/internal/tarfs/tarfstest"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExtract(t *testing.T) {
+	ctx := context.Background()
+	modTime := time.Date(2024, 7, 23, 5, 45, 0, 0, time.UTC)
+
+	lower := tarfstest.NewLayer(t, withModTime(modTime, []tar.Header{
+		{Typeflag: tar.TypeDir, Name: "etc/", Mode: 0o755},
+		{Typeflag: tar.TypeReg, Name: "etc/hostname", Mode: 0o644, Uid: 1000, Gid: 1000, Uname: "user", Gname: "users"},
+		{Typeflag: tar.TypeDir, Name: "usr/bin/", Mode: 0o755},
+		{Typeflag: tar.TypeReg, Name: "usr/bin/busybox", Mode: 0o4755},
+		{Typeflag: tar.TypeLink, Name: "usr/bin/ls", Linkname: "usr/bin/busybox"},
+		{Typeflag: tar.TypeSymlink, Name: "bin", Linkname: "usr/bin", Mode: 0o777},
+		{Typeflag: tar.TypeDir, Name: "root/", Mode: 0o700},
+		{Typeflag: tar.TypeReg, Name: "root/.profile", Mode: 0o600},
+	}))
+
+	upper := tarfstest.NewLayer(t, withModTime(modTime.Add(time.Hour), []tar.Header{
+		{Typeflag: tar.TypeDir, Name: "tmp/", Mode: 0o1777},
+		{Typeflag: tar.TypeReg, Name: "etc/.wh.hostname"},
+	}))
+
+	fsys, err := overlayfs.New(context.Background(), []fs.FS{lower, upper})
+	require.NoError(t, err)
+
+	t.Run("Dir", func(t *testing.T) {
+		dir := filepath.Join(t.TempDir(), "rootfs")
+
+		sameOwner := os.Geteuid() == 0
+		require.NoError(t, extract.ToDir(ctx, fsys, dir, extract.Options{SameOwner: sameOwner}))
+
+		_, err := os.Lstat(filepath.Join(dir, "etc/hostname"))
+		require.ErrorIs(t, err, fs.ErrNotExist)
+
+		fi, err := os.Lstat(filepath.Join(dir, "usr/bin/busybox"))
+		require.NoError(t, err)
+		require.Equal(t, 0o755|fs.ModeSetuid, fi.Mode())
+		require.True(t, modTime.Equal(fi.ModTime()))
+
+		data, err := os.ReadFile(filepath.Join(dir, "usr/bin/busybox"))
+		require.NoError(t, err)
+		require.Equal(t, "busybox", string(data))
+
+		linkFI, err := os.Lstat(filepath.Join(dir, "usr/bin/ls"))
+		require.NoError(t, err)
+		require.True(t, os.SameFile(fi, linkFI))
+
+		target, err := os.Readlink(filepath.Join(dir, "bin"))
+		require.NoError(t, err)
+		require.Equal(t, "usr/bin", target)
+
+		fi, err = os.Lstat(filepath.Join(dir, "bin"))
+		require.NoError(t, err)
+		require.True(t, modTime.Equal(fi.ModTime()))
+
+		fi, err = os.Stat(filepath.Join(dir, "root"))
+		require.NoError(t, err)
+		require.Equal(t, 0o700|fs.ModeDir, fi.Mode())
+		require.True(t, modTime.Equal(fi.ModTime()))
+
+		fi, err = os.Stat(filepath.Join(dir, "tmp"))
+		require.NoError(t, err)
+		require.Equal(t, 0o777|fs.ModeDir|fs.ModeSticky, fi.Mode())
+
+		require.Error(t, extract.ToDir(ctx, fsys, dir, extract.Options{}))
+	})
+
+	t.Run("Tar", func(t *testing.T) {
+		var buf bytes.Buffer
+		require.NoError(t, extract.ToTar(ctx, fsys, &buf, extract.Options{}))
+
+		hdrs := make(map[string]*tar.Header)
+		var names []string
+
+		tr := tar.NewReader(&buf)
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			require.NoError(t, err)
+
+			hdrs[hdr.Name] = hdr
+			names = append(names, hdr.Name)
+		}
+
+		require.Equal(t, []string{
+			"bin", "etc/", "root/", "root/.profile", "tmp/",
+			"usr/", "usr/bin/", "usr/bin/busybox", "usr/bin/ls",
+		}, names)
+
+		require.Equal(t, byte(tar.TypeSymlink), hdrs["bin"].Typeflag)
+		require.Equal(t, "usr/bin", hdrs["bin"].Linkname)
+
+		require.Equal(t, byte(tar.TypeReg), hdrs["usr/bin/busybox"].Typeflag)
+		require.Equal(t, int64(0o4755), hdrs["usr/bin/busybox"].Mode)
+		require.True(t, modTime.Equal(hdrs["usr/bin/busybox"].ModTime))
+
+		require.Equal(t, byte(tar.TypeLink), hdrs["usr/bin/ls"].Typeflag)
+		require.Equal(t, "usr/bin/busybox", hdrs["usr/bin/ls"].Linkname)
+
+		require.Equal(t, int64(0o1777), hdrs["tmp/"].Mode)
+	})
+
+	t.Run("Numeric Owner", func(t *testing.T) {
+		layer := tarfstest.NewLayer(t, withModTime(modTime, []tar.Header{
+			{Typeflag: tar.TypeReg, Name: "hostname", Mode: 0o644, Uid: 1000, Gid: 100, Uname: "user", Gname: "users"},
+		}))
+
+		for _, numericOwner := range []bool{false, true} {
+			var buf bytes.Buffer
+			require.NoError(t, extract.ToTar(ctx, layer, &buf, extract.Options{NumericOwner: numericOwner}))
+
+			hdr, err := tar.NewReader(&buf).Next()
+			require.NoError(t, err)
+			require.Equal(t, 1000, hdr.Uid)
+			require.Equal(t, 100, hdr.Gid)
+
+			if numericOwner {
+				require.Empty(t, hdr.Uname)
+				require.Empty(t, hdr.Gname)
+			} else {
+				require.Equal(t, "user", hdr.Uname)
+				require.Equal(t, "users", hdr.Gname)
+			}
+		}
+	})
+
+	t.Run("Devices", func(t *testing.T) {
+		layer := tarfstest.NewLayer(t, withModTime(modTime, []tar.Header{
+			{Typeflag: tar.TypeDir, Name: "dev/", Mode: 0o755},
+			{Typeflag: tar.TypeChar, Name: "dev/null", Mode: 0o666, Devmajor: 1, Devminor: 3},
+			{Typeflag: tar.TypeBlock, Name: "dev/loop0", Mode: 0o660, Devmajor: 7},
+			{Typeflag: tar.TypeFifo, Name: "dev/initctl", Mode: 0o600},
+		}))
+
+		var buf bytes.Buffer
+		require.NoError(t, extract.ToTar(ctx, layer, &buf, extract.Options{}))
+
+		hdrs := make(map[string]*tar.Header)
+		tr := tar.NewReader(&buf)
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			require.NoError(t, err)
+
+			hdrs[hdr.Name] = hdr
+		}
+
+		require.Equal(t, byte(tar.TypeChar), hdrs["dev/null"].Typeflag)
+		require.Equal(t, int64(1), hdrs["dev/null"].Devmajor)
+		require.Equal(t, int64(3), hdrs["dev/null"].Devminor)
+		require.Equal(t, int64(0o666), hdrs["dev/null"].Mode)
+		require.Equal(t, byte(tar.TypeBlock), hdrs["dev/loop0"].Typeflag)
+		require.Equal(t, int64(7), hdrs["dev/loop0"].Devmajor)
+		require.Equal(t, byte(tar.TypeFifo), hdrs["dev/initctl"].Typeflag)
+
+		buf.Reset()
+		require.NoError(t, extract.ToTar(ctx, layer, &buf, extract.Options{SkipDevices: true}))
+
+		var names []string
+		tr = tar.NewReader(&buf)
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			require.NoError(t, err)
+
+			names = append(names, hdr.Name)
+		}
+		require.Equal(t, []string{"dev/", "dev/initctl"}, names)
+
+		// FIFOs can be created without privileges.
+		dir := filepath.Join(t.TempDir(), "rootfs")
+		require.NoError(t, extract.ToDir(ctx, layer, dir, extract.Options{SkipDevices: true}))
+
+		fi, err := os.Lstat(filepath.Join(dir, "dev/initctl"))
+		require.NoError(t, err)
+		require.Equal(t, 0o600|fs.ModeNamedPipe, fi.Mode())
+
+		_, err = os.Lstat(filepath.Join(dir, "dev/null"))
+		require.ErrorIs(t, err, fs.ErrNotExist)
+	})
+
+	t.Run("Cancelled", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(ctx)
+		cancel()
+
+		require.ErrorIs(t, extract.ToTar(ctx, fsys, io.Discard, extract.Options{}), context.Canceled)
+
+		dir := t.TempDir()
+		require.ErrorIs(t, extract.ToDir(ctx, fsys, dir, extract.Options{}), context.Canceled)
+
+		dirEntries, err := os.ReadDir(dir)
+		require.NoError(t, err)
+		require.Empty(t, dirEntries)
+	})
+}
+
+// withModTime sets the modification time of every entry.
+func withModTime(modTime time.Time, hdrs []tar.Header) []tar.Header {
+	for i := range hdrs {
+		hdrs[i].ModTime = modTime
+	}
+
+	return hdrs
+}
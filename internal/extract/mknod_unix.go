@@ -0,0 +1,46 @@
+//go:build unix
+
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package extract
+
+import (
+	"errors"
+	"io/fs"
+
+	"golang.org/x/sys/unix"
+)
+
+// mknod creates a device or named pipe (creating devices typically requires
+// root privileges). The permissions are applied afterwards.
+func mknod(name string, mode fs.FileMode, major, minor uint32) error {
+	var typ uint32
+	switch mode.Type() {
+	case fs.ModeNamedPipe:
+		typ = unix.S_IFIFO
+	case fs.ModeDevice | fs.ModeCharDevice:
+		typ = unix.S_IFCHR
+	case fs.ModeDevice:
+		typ = unix.S_IFBLK
+	default:
+		return errors.ErrUnsupported
+	}
+
+	return unix.Mknod(name, typ|0o600, int(unix.Mkdev(major, minor)))
+}
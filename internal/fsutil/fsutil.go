@@ -0,0 +1,120 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+// Package fsutil provides helpers for describing the files of root
+// filesystems, whether backed by tar layers or EROFS images.
+package fsutil
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+
+	"github.com/dpeckett/archivefs"
+	"github.com/immutos/oci2erofs/internal/erofs"
+)
+
+// StatLink returns information about the named file, without following it if
+// it is a symlink (when the filesystem supports symlinks).
+func StatLink(fsys fs.FS, name string) (fs.FileInfo, error) {
+	var fi fs.FileInfo
+	var err error
+	if rlfs, ok := fsys.(archivefs.ReadLinkFS); ok {
+		fi, err = rlfs.StatLink(name)
+	} else {
+		fi, err = fs.Stat(fsys, name)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat %s: %w", DisplayPath(name), err)
+	}
+
+	return fi, nil
+}
+
+// ReadLink returns the destination of the named symlink.
+func ReadLink(fsys fs.FS, name string) (string, error) {
+	rlfs, ok := fsys.(archivefs.ReadLinkFS)
+	if !ok {
+		return "", errors.New("filesystem does not support symlinks")
+	}
+
+	target, err := rlfs.ReadLink(name)
+	if err != nil {
+		return "", fmt.Errorf("failed to read symlink %s: %w", DisplayPath(name), err)
+	}
+
+	return target, nil
+}
+
+// DisplayPath returns the absolute path of a file within the filesystem.
+func DisplayPath(name string) string {
+	return path.Join("/", name)
+}
+
+// TypeName returns a human readable name for the type of a file.
+func TypeName(mode fs.FileMode) string {
+	switch mode.Type() {
+	case 0:
+		return "regular file"
+	case fs.ModeDir:
+		return "directory"
+	case fs.ModeSymlink:
+		return "symbolic link"
+	case fs.ModeNamedPipe:
+		return "named pipe"
+	case fs.ModeSocket:
+		return "socket"
+	case fs.ModeDevice | fs.ModeCharDevice, fs.ModeCharDevice:
+		return "character device"
+	case fs.ModeDevice:
+		return "block device"
+	default:
+		return "irregular file"
+	}
+}
+
+// UnixPerm returns the Unix permission bits of a file (including the setuid,
+// setgid, and sticky bits).
+func UnixPerm(mode fs.FileMode) uint32 {
+	perm := uint32(mode.Perm())
+	if mode&fs.ModeSetuid != 0 {
+		perm |= 0o4000
+	}
+	if mode&fs.ModeSetgid != 0 {
+		perm |= 0o2000
+	}
+	if mode&fs.ModeSticky != 0 {
+		perm |= 0o1000
+	}
+
+	return perm
+}
+
+// Owner returns the user and group IDs of a file.
+func Owner(fi fs.FileInfo) (uid, gid int) {
+	switch sys := fi.Sys().(type) {
+	case *tar.Header:
+		return sys.Uid, sys.Gid
+	case *erofs.Inode:
+		return int(sys.UID()), int(sys.GID())
+	default:
+		return 0, 0
+	}
+}
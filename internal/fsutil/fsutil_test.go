@@ -0,0 +1,62 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package fsutil_test
+
+import (
+	"io/fs"
+	"testing"
+	"testing/fstest"
+
+	"github.com/immutos/oci2erofs/internal/fsutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStatLink(t *testing.T) {
+	fsys := fstest.MapFS{
+		"etc/hostname": &fstest.MapFile{Data: []byte("localhost\n"), Mode: 0o644},
+	}
+
+	fi, err := fsutil.StatLink(fsys, "etc/hostname")
+	require.NoError(t, err)
+	require.Equal(t, int64(10), fi.Size())
+
+	_, err = fsutil.StatLink(fsys, "etc/missing")
+	require.ErrorIs(t, err, fs.ErrNotExist)
+	require.ErrorContains(t, err, "/etc/missing")
+}
+
+func TestDisplayPath(t *testing.T) {
+	require.Equal(t, "/", fsutil.DisplayPath("."))
+	require.Equal(t, "/etc/hostname", fsutil.DisplayPath("etc/hostname"))
+	require.Equal(t, "/etc/hostname", fsutil.DisplayPath("/etc/hostname"))
+}
+
+func TestTypeName(t *testing.T) {
+	require.Equal(t, "regular file", fsutil.TypeName(0o644))
+	require.Equal(t, "directory", fsutil.TypeName(fs.ModeDir|0o755))
+	require.Equal(t, "symbolic link", fsutil.TypeName(fs.ModeSymlink|0o777))
+	require.Equal(t, "character device", fsutil.TypeName(fs.ModeDevice|fs.ModeCharDevice|0o666))
+	require.Equal(t, "block device", fsutil.TypeName(fs.ModeDevice|0o660))
+}
+
+func TestUnixPerm(t *testing.T) {
+	require.Equal(t, uint32(0o755), fsutil.UnixPerm(fs.ModeDir|0o755))
+	require.Equal(t, uint32(0o4755), fsutil.UnixPerm(fs.ModeSetuid|0o755))
+	require.Equal(t, uint32(0o3775), fsutil.UnixPerm(fs.ModeDir|fs.ModeSetgid|fs.ModeSticky|0o775))
+}
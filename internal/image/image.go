@@ -0,0 +1,114 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package image
+
+import (
+	"io/fs"
+
+	"github.com/opencontainers/go-digest"
+	ocispecs "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Target identifies an image within a Docker or OCI archive.
+type Target struct {
+	// Ref is the image reference (empty if the archive contains a single,
+	// unnamed, image).
+	Ref string
+	// Platform is the platform of the image.
+	Platform ocispecs.Platform
+}
+
+// Image is a container image loaded from a Docker or OCI archive.
+type Image struct {
+	manifest ocispecs.Descriptor
+	config   ocispecs.Descriptor
+	spec     ocispecs.Image
+	layers   []ocispecs.Descriptor
+	rootFS   fs.FS
+	close    func() error
+}
+
+// New creates a new image from its metadata and merged root filesystem. The
+// close function releases the resources backing the root filesystem.
+func New(manifest, config ocispecs.Descriptor, spec ocispecs.Image, layers []ocispecs.Descriptor, rootFS fs.FS, close func() error) *Image {
+	return &Image{
+		manifest: manifest,
+		config:   config,
+		spec:     spec,
+		layers:   layers,
+		rootFS:   rootFS,
+		close:    close,
+	}
+}
+
+// Manifest returns the descriptor of the resolved image manifest. Legacy
+// Docker archives do not include a manifest, in which case the descriptor
+// will be empty.
+func (img *Image) Manifest() ocispecs.Descriptor {
+	return img.manifest
+}
+
+// ManifestDigest returns the digest of the resolved image manifest (if any).
+func (img *Image) ManifestDigest() digest.Digest {
+	return img.manifest.Digest
+}
+
+// ConfigDescriptor returns the descriptor of the image configuration.
+func (img *Image) ConfigDescriptor() ocispecs.Descriptor {
+	return img.config
+}
+
+// Config returns the image configuration (eg. Env, Entrypoint, User, Labels).
+func (img *Image) Config() ocispecs.Image {
+	return img.spec
+}
+
+// Platform returns the platform of the image.
+func (img *Image) Platform() ocispecs.Platform {
+	return img.spec.Platform
+}
+
+// Layers returns the descriptors of the image's layers, from lowest to highest.
+func (img *Image) Layers() []ocispecs.Descriptor {
+	return img.layers
+}
+
+// DiffIDs returns the digests of the uncompressed layer tarballs.
+func (img *Image) DiffIDs() []digest.Digest {
+	return img.spec.RootFS.DiffIDs
+}
+
+// History returns the history of the image's layers.
+func (img *Image) History() []ocispecs.History {
+	return img.spec.History
+}
+
+// RootFS returns the merged root filesystem of the image.
+func (img *Image) RootFS() fs.FS {
+	return img.rootFS
+}
+
+// Close releases the resources backing the root filesystem.
+func (img *Image) Close() error {
+	if img.close == nil {
+		return nil
+	}
+
+	return img.close()
+}
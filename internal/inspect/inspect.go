@@ -0,0 +1,377 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+// Package inspect describes the contents of source images (their refs,
+// manifests, platforms, layers and image configurations).
+package inspect
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"slices"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/platforms"
+	"github.com/immutos/oci2erofs/internal/docker"
+	"github.com/immutos/oci2erofs/internal/oci"
+	"github.com/immutos/oci2erofs/internal/source"
+	"github.com/opencontainers/go-digest"
+	ocispecs "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// maxDepth is the maximum depth of nested image indexes.
+const maxDepth = 8
+
+// Report describes a source image.
+type Report struct {
+	// Format is the archive format of the source image.
+	Format source.Format `json:"format"`
+	// Manifests are the top level manifests (and image indexes) of the source
+	// image.
+	Manifests []Manifest `json:"manifests"`
+}
+
+// Manifest describes an image manifest (or image index).
+type Manifest struct {
+	// Refs are the references of the manifest (from the ref name annotation
+	// of OCI image layouts, or the repo tags of Docker archives).
+	Refs []string `json:"refs,omitempty"`
+	// Descriptor is the descriptor of the manifest. Docker archives do not
+	// include manifests, in which case it is nil.
+	Descriptor *ocispecs.Descriptor `json:"descriptor,omitempty"`
+	// Missing is set if the manifest is referenced but not present in the
+	// source image (eg. an image index that was only partially copied).
+	Missing bool `json:"missing,omitempty"`
+	// Manifests are the child manifests (if the manifest is an image index).
+	Manifests []Manifest `json:"manifests,omitempty"`
+	// Config is the descriptor of the image configuration.
+	Config *ocispecs.Descriptor `json:"config,omitempty"`
+	// Layers are the descriptors of the image's layers.
+	Layers []ocispecs.Descriptor `json:"layers,omitempty"`
+	// Image is the image configuration.
+	Image *ocispecs.Image `json:"image,omitempty"`
+}
+
+// Inspect describes the source image.
+func Inspect(src *source.Source) (*Report, error) {
+	report := &Report{Format: src.Format}
+
+	var err error
+	switch src.Format {
+	case source.FormatDocker:
+		report.Manifests, err = inspectDocker(src.FS)
+	default:
+		report.Manifests, err = inspectOCI(src.FS)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return report, nil
+}
+
+// WriteJSON writes the report as indented JSON.
+func (r *Report) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(r)
+}
+
+// WriteText writes the report in a human readable form.
+func (r *Report) WriteText(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 1, ' ', 0)
+
+	fmt.Fprintf(tw, "Format:\t%s\n", r.Format)
+
+	for _, m := range r.Manifests {
+		fmt.Fprintln(tw)
+
+		if len(m.Refs) > 0 {
+			fmt.Fprintf(tw, "Ref:\t%s\n", strings.Join(m.Refs, ", "))
+		} else {
+			fmt.Fprintf(tw, "Ref:\t<none>\n")
+		}
+
+		writeManifest(tw, m, "")
+	}
+
+	return tw.Flush()
+}
+
+func writeManifest(w io.Writer, m Manifest, indent string) {
+	if m.Descriptor != nil {
+		kind := "Manifest"
+		if isIndex(m.Descriptor.MediaType) {
+			kind = "Index"
+		}
+
+		fmt.Fprintf(w, "%s%s:\t%s\n", indent, kind, formatDescriptor(*m.Descriptor))
+
+		if m.Descriptor.Platform != nil {
+			fmt.Fprintf(w, "%s  Platform:\t%s\n", indent, platforms.Format(*m.Descriptor.Platform))
+		}
+
+		if m.Missing {
+			fmt.Fprintf(w, "%s  Missing:\tnot present in the image\n", indent)
+		}
+
+		indent += "  "
+	}
+
+	for _, child := range m.Manifests {
+		writeManifest(w, child, indent)
+	}
+
+	if m.Config != nil {
+		fmt.Fprintf(w, "%sConfig:\t%s\n", indent, formatDescriptor(*m.Config))
+	}
+
+	if m.Image != nil {
+		// The platform is usually also in the descriptor.
+		if m.Descriptor == nil || m.Descriptor.Platform == nil {
+			fmt.Fprintf(w, "%sPlatform:\t%s\n", indent, platforms.Format(m.Image.Platform))
+		}
+
+		writeImage(w, m.Image, indent)
+	}
+
+	if len(m.Layers) > 0 {
+		fmt.Fprintf(w, "%sLayers:\n", indent)
+
+		for _, layer := range m.Layers {
+			fmt.Fprintf(w, "%s  - %s\n", indent, formatDescriptor(layer))
+		}
+	}
+}
+
+func writeImage(w io.Writer, img *ocispecs.Image, indent string) {
+	field := func(name string, value string) {
+		if value != "" {
+			fmt.Fprintf(w, "%s%s:\t%s\n", indent, name, value)
+		}
+	}
+
+	if img.Created != nil {
+		field("Created", img.Created.UTC().Format("2006-01-02T15:04:05Z"))
+	}
+	field("Author", img.Author)
+	field("User", img.Config.User)
+	field("Working Dir", img.Config.WorkingDir)
+	field("Entrypoint", formatArgs(img.Config.Entrypoint))
+	field("Cmd", formatArgs(img.Config.Cmd))
+	field("Stop Signal", img.Config.StopSignal)
+	field("Exposed Ports", strings.Join(sortedKeys(img.Config.ExposedPorts), ", "))
+	field("Volumes", strings.Join(sortedKeys(img.Config.Volumes), ", "))
+
+	if len(img.Config.Env) > 0 {
+		fmt.Fprintf(w, "%sEnv:\n", indent)
+		for _, env := range img.Config.Env {
+			fmt.Fprintf(w, "%s  - %s\n", indent, env)
+		}
+	}
+
+	if len(img.Config.Labels) > 0 {
+		fmt.Fprintf(w, "%sLabels:\n", indent)
+		for _, key := range sortedKeys(img.Config.Labels) {
+			fmt.Fprintf(w, "%s  - %s=%s\n", indent, key, img.Config.Labels[key])
+		}
+	}
+}
+
+func inspectOCI(imageFS fs.FS) ([]Manifest, error) {
+	indexData, err := fs.ReadFile(imageFS, "index.json")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read index: %w", err)
+	}
+
+	var index ocispecs.Index
+	if err := json.Unmarshal(indexData, &index); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal index: %w", err)
+	}
+
+	manifests := make([]Manifest, len(index.Manifests))
+	for i, desc := range index.Manifests {
+		m, err := inspectDescriptor(imageFS, desc, 0)
+		if err != nil {
+			return nil, err
+		}
+
+		if ref := desc.Annotations[ocispecs.AnnotationRefName]; ref != "" {
+			m.Refs = []string{ref}
+		}
+
+		manifests[i] = *m
+	}
+
+	return manifests, nil
+}
+
+func inspectDescriptor(imageFS fs.FS, desc ocispecs.Descriptor, depth int) (*Manifest, error) {
+	m := &Manifest{Descriptor: &desc}
+
+	data, err := fs.ReadFile(imageFS, oci.BlobPath(desc))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			m.Missing = true
+			return m, nil
+		}
+
+		return nil, fmt.Errorf("failed to read manifest %s: %w", desc.Digest, err)
+	}
+
+	switch {
+	case isIndex(desc.MediaType):
+		if depth >= maxDepth {
+			return nil, fmt.Errorf("image index %s is nested too deeply", desc.Digest)
+		}
+
+		var index ocispecs.Index
+		if err := json.Unmarshal(data, &index); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal image index %s: %w", desc.Digest, err)
+		}
+
+		for _, childDesc := range index.Manifests {
+			child, err := inspectDescriptor(imageFS, childDesc, depth+1)
+			if err != nil {
+				return nil, err
+			}
+
+			m.Manifests = append(m.Manifests, *child)
+		}
+	case isManifest(desc.MediaType):
+		var manifest ocispecs.Manifest
+		if err := json.Unmarshal(data, &manifest); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal manifest %s: %w", desc.Digest, err)
+		}
+
+		m.Config = &manifest.Config
+		m.Layers = manifest.Layers
+
+		// Artifacts (eg. attestations) may not have an image configuration.
+		if manifest.Config.MediaType == ocispecs.MediaTypeImageConfig || manifest.Config.MediaType == images.MediaTypeDockerSchema2Config {
+			configData, err := fs.ReadFile(imageFS, oci.BlobPath(manifest.Config))
+			if err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return nil, fmt.Errorf("failed to read image config %s: %w", manifest.Config.Digest, err)
+			} else if err == nil {
+				var img ocispecs.Image
+				if err := json.Unmarshal(configData, &img); err != nil {
+					return nil, fmt.Errorf("failed to unmarshal image config %s: %w", manifest.Config.Digest, err)
+				}
+
+				m.Image = &img
+			}
+		}
+	}
+
+	return m, nil
+}
+
+func inspectDocker(imageFS fs.FS) ([]Manifest, error) {
+	manifestData, err := fs.ReadFile(imageFS, "manifest.json")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read manifest: %w", err)
+	}
+
+	var dockerManifests []docker.Manifest
+	if err := json.Unmarshal(manifestData, &dockerManifests); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal manifest: %w", err)
+	}
+
+	manifests := make([]Manifest, len(dockerManifests))
+	for i, dockerManifest := range dockerManifests {
+		configData, err := fs.ReadFile(imageFS, dockerManifest.Config)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read image config: %w", err)
+		}
+
+		var img ocispecs.Image
+		if err := json.Unmarshal(configData, &img); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal image config: %w", err)
+		}
+
+		m := Manifest{
+			Refs: dockerManifest.RepoTags,
+			Config: &ocispecs.Descriptor{
+				MediaType: ocispecs.MediaTypeImageConfig,
+				Digest:    digest.FromBytes(configData),
+				Size:      int64(len(configData)),
+			},
+			Image: &img,
+		}
+
+		// Docker archives store layers as uncompressed tarballs.
+		for j, layerPath := range dockerManifest.Layers {
+			fi, err := fs.Stat(imageFS, layerPath)
+			if err != nil {
+				return nil, fmt.Errorf("failed to stat layer: %w", err)
+			}
+
+			layer := ocispecs.Descriptor{
+				MediaType: ocispecs.MediaTypeImageLayer,
+				Size:      fi.Size(),
+			}
+
+			if j < len(img.RootFS.DiffIDs) {
+				layer.Digest = img.RootFS.DiffIDs[j]
+			}
+
+			m.Layers = append(m.Layers, layer)
+		}
+
+		manifests[i] = m
+	}
+
+	return manifests, nil
+}
+
+func isIndex(mediaType string) bool {
+	return mediaType == ocispecs.MediaTypeImageIndex || mediaType == images.MediaTypeDockerSchema2ManifestList
+}
+
+func isManifest(mediaType string) bool {
+	return mediaType == ocispecs.MediaTypeImageManifest || mediaType == images.MediaTypeDockerSchema2Manifest
+}
+
+func formatDescriptor(desc ocispecs.Descriptor) string {
+	return fmt.Sprintf("%s (%s, %d bytes)", desc.Digest, desc.MediaType, desc.Size)
+}
+
+func formatArgs(args []string) string {
+	if len(args) == 0 {
+		return ""
+	}
+
+	data, _ := json.Marshal(args)
+	return string(data)
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+
+	slices.Sort(keys)
+
+	return keys
+}
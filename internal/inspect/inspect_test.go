@@ -0,0 +1,125 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package inspect_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/fs"
+	"os"
+	"testing"
+	"testing/fstest"
+
+	"github.com/immutos/oci2erofs/internal/inspect"
+	"github.com/immutos/oci2erofs/internal/source"
+	ocispecs "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInspect(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("OCI", func(t *testing.T) {
+		src, err := source.Open(ctx, source.Options{Path: "../oci/testdata/toybox-multiarch"})
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			require.NoError(t, src.Close())
+		})
+
+		report, err := inspect.Inspect(src)
+		require.NoError(t, err)
+
+		require.Equal(t, source.FormatOCI, report.Format)
+		require.Len(t, report.Manifests, 1)
+
+		index := report.Manifests[0]
+		require.Equal(t, []string{"docker.io/tianon/toybox:0.8.11"}, index.Refs)
+		require.Equal(t, ocispecs.MediaTypeImageIndex, index.Descriptor.MediaType)
+		require.Len(t, index.Manifests, 4)
+
+		amd64 := index.Manifests[0]
+		require.Equal(t, "sha256:d3b7b26716e98689872d7477fe39571b2128cf3a23eea0498513a1889e86f3ce", amd64.Descriptor.Digest.String())
+		require.Equal(t, "amd64", amd64.Descriptor.Platform.Architecture)
+		require.Len(t, amd64.Layers, 1)
+		require.Equal(t, int64(560609), amd64.Layers[0].Size)
+		require.NotNil(t, amd64.Image)
+		require.Equal(t, []string{"sh"}, amd64.Image.Config.Cmd)
+
+		var buf bytes.Buffer
+		require.NoError(t, report.WriteText(&buf))
+		require.Contains(t, buf.String(), "linux/arm64/v8")
+		require.Contains(t, buf.String(), "sha256:4e4ed2728f23408f0a3be0cf892b607bc5ec32d12941a093d001bc3de60f5425 (application/vnd.oci.image.layer.v1.tar+gzip, 560609 bytes)")
+
+		buf.Reset()
+		require.NoError(t, report.WriteJSON(&buf))
+
+		var decoded inspect.Report
+		require.NoError(t, json.Unmarshal(buf.Bytes(), &decoded))
+		require.Equal(t, *report, decoded)
+	})
+
+	t.Run("Missing", func(t *testing.T) {
+		// Only the amd64 image is present.
+		imageFS := fstest.MapFS{}
+		err := fs.WalkDir(os.DirFS("../oci/testdata/toybox-multiarch"), ".", func(path string, d fs.DirEntry, err error) error {
+			if err != nil || d.IsDir() || path == "blobs/sha256/42841c3db3063a527dc1adc95ff63dcdeb95dab77017fa30d514a121e40ee702" {
+				return err
+			}
+
+			data, err := os.ReadFile("../oci/testdata/toybox-multiarch/" + path)
+			imageFS[path] = &fstest.MapFile{Data: data}
+			return err
+		})
+		require.NoError(t, err)
+
+		src, err := source.Open(ctx, source.Options{FS: imageFS})
+		require.NoError(t, err)
+
+		report, err := inspect.Inspect(src)
+		require.NoError(t, err)
+
+		manifests := report.Manifests[0].Manifests
+		require.False(t, manifests[0].Missing)
+		require.True(t, manifests[2].Missing)
+		require.Equal(t, "arm64", manifests[2].Descriptor.Platform.Architecture)
+	})
+
+	t.Run("Docker", func(t *testing.T) {
+		src, err := source.Open(ctx, source.Options{Path: "../docker/testdata/toybox.tar"})
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			require.NoError(t, src.Close())
+		})
+
+		report, err := inspect.Inspect(src)
+		require.NoError(t, err)
+
+		require.Equal(t, source.FormatDocker, report.Format)
+		require.Len(t, report.Manifests, 1)
+
+		m := report.Manifests[0]
+		require.Equal(t, []string{"docker.io/tianon/toybox:0.8.11"}, m.Refs)
+		require.Nil(t, m.Descriptor)
+		require.Equal(t, "sha256:73e30ac9c7813c3bbd8287d440e693cedb153218d1aefe616b4e1089341edbe6", m.Config.Digest.String())
+		require.Len(t, m.Layers, 1)
+		require.Equal(t, "sha256:a46377b037628d905eef19e767fcd80336256139047f6f9d4dd60d3d05b7771a", m.Layers[0].Digest.String())
+		require.Equal(t, "amd64", m.Image.Architecture)
+	})
+}
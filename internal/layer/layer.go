@@ -0,0 +1,507 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+// Package layer loads (optionally compressed) image layers as filesystems.
+//
+// Uncompressed layers are read in place, and gzip compressed layers are read
+// at random through an index of decompressor checkpoints (see package zran).
+// Layers using other compression formats are decompressed in full.
+package layer
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"runtime"
+	"sync"
+
+	"github.com/dpeckett/uncompr"
+	"github.com/immutos/oci2erofs/internal/cache"
+	"github.com/immutos/oci2erofs/internal/progress"
+	"github.com/immutos/oci2erofs/internal/tarfs"
+	"github.com/immutos/oci2erofs/internal/util"
+	"github.com/immutos/oci2erofs/internal/zran"
+	"github.com/opencontainers/go-digest"
+	"golang.org/x/sync/errgroup"
+)
+
+// indexKind is the kind of the cache entries holding gzip indexes.
+const indexKind = "zran"
+
+// Loader loads image layers. Layers loaded concurrently (or while still in
+// use) by more than one image are shared between them, rather than loaded
+// again.
+type Loader struct {
+	// TempDir is the directory in which layers are stored (if no cache is
+	// configured), when they cannot be read in place.
+	TempDir string
+	// Cache is an optional cache of layers (and their indexes).
+	Cache *cache.Cache
+	// Jobs is the maximum number of layers to load concurrently. If zero,
+	// the number of CPUs is used.
+	Jobs int
+
+	mu sync.Mutex
+	// loaded are the layers currently in use, keyed by diffID.
+	loaded map[digest.Digest]*sharedLayer
+}
+
+// sharedLayer is a loaded layer that is shared between images.
+type sharedLayer struct {
+	// ready is closed once the layer has been loaded (or failed to load).
+	ready   chan struct{}
+	fsys    fs.FS
+	closeFS func() error
+	err     error
+	refs    int
+}
+
+// Layer identifies a layer within an image.
+type Layer struct {
+	// Path is the path of the (optionally compressed) layer tarball.
+	Path string
+	// Digest is the digest of the layer tarball as stored (if known).
+	Digest digest.Digest
+	// DiffID is the digest of the uncompressed layer tarball.
+	DiffID digest.Digest
+}
+
+// LoadAll concurrently loads the layers in imageFS, returning the layer
+// filesystems in the same order as layers. If any layer fails to load, the
+// loading of the remaining layers is cancelled.
+func (l *Loader) LoadAll(ctx context.Context, imageFS fs.FS, layers []Layer) ([]fs.FS, func() error, error) {
+	layerFSs := make([]fs.FS, len(layers))
+	closers := make([]func() error, len(layers))
+
+	closeAll := func() error {
+		var firstErr error
+		for _, close := range closers {
+			if close == nil {
+				continue
+			}
+
+			if err := close(); err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+		return firstErr
+	}
+
+	jobs := l.Jobs
+	if jobs <= 0 {
+		jobs = runtime.NumCPU()
+	}
+
+	g, ctx := errgroup.WithContext(ctx)
+	g.SetLimit(jobs)
+
+	for i, layer := range layers {
+		i, layer := i, layer
+
+		g.Go(func() error {
+			tracker := progress.Start(ctx, progress.Event{
+				Phase:  progress.PhaseDecompress,
+				Layer:  i + 1,
+				Layers: len(layers),
+				Digest: layer.DiffID,
+			})
+
+			layerFS, close, err := l.Load(progress.WithTracker(ctx, tracker), imageFS, layer)
+			if err != nil {
+				return fmt.Errorf("failed to load layer %s: %w", layer.DiffID, err)
+			}
+			tracker.Done()
+
+			// Each worker writes to a distinct index.
+			layerFSs[i] = layerFS
+			closers[i] = close
+
+			return nil
+		})
+	}
+
+	if err := g.Wait(); err != nil {
+		_ = closeAll()
+		return nil, nil, err
+	}
+
+	return layerFSs, closeAll, nil
+}
+
+// Load opens the layer in imageFS as a filesystem. Layers are verified
+// against their diffID when they are opened (or before they are cached).
+func (l *Loader) Load(ctx context.Context, imageFS fs.FS, layer Layer) (fs.FS, func() error, error) {
+	l.mu.Lock()
+	if l.loaded == nil {
+		l.loaded = make(map[digest.Digest]*sharedLayer)
+	}
+
+	shared, ok := l.loaded[layer.DiffID]
+	if !ok {
+		shared = &sharedLayer{ready: make(chan struct{})}
+		l.loaded[layer.DiffID] = shared
+	}
+	shared.refs++
+	l.mu.Unlock()
+
+	if !ok {
+		shared.fsys, shared.closeFS, shared.err = l.load(ctx, imageFS, layer)
+		close(shared.ready)
+	}
+
+	select {
+	case <-shared.ready:
+	case <-ctx.Done():
+		_ = l.release(layer.DiffID, shared)
+		return nil, nil, ctx.Err()
+	}
+
+	if shared.err != nil {
+		_ = l.release(layer.DiffID, shared)
+		return nil, nil, shared.err
+	}
+
+	return shared.fsys, func() error {
+		return l.release(layer.DiffID, shared)
+	}, nil
+}
+
+// release drops a reference to the shared layer, closing it once it is no
+// longer in use.
+func (l *Loader) release(diffID digest.Digest, shared *sharedLayer) error {
+	l.mu.Lock()
+	shared.refs--
+	if shared.refs > 0 {
+		l.mu.Unlock()
+		return nil
+	}
+	delete(l.loaded, diffID)
+	l.mu.Unlock()
+
+	if shared.closeFS == nil {
+		return nil
+	}
+
+	return shared.closeFS()
+}
+
+func (l *Loader) load(ctx context.Context, imageFS fs.FS, layer Layer) (fs.FS, func() error, error) {
+	// Layers that could not be indexed are cached in decompressed form.
+	if l.Cache != nil {
+		if f, err := l.Cache.Lookup(layer.DiffID); err == nil {
+			return openTar(f, f.Close)
+		}
+	}
+
+	ra, size, closeBlob, err := l.openBlob(ctx, imageFS, layer)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	fsys, closeFS, err := l.open(ctx, ra, size, layer)
+	if err != nil {
+		_ = closeBlob()
+		return nil, nil, err
+	}
+
+	return fsys, func() error {
+		return errors.Join(closeFS(), closeBlob())
+	}, nil
+}
+
+// OpenArchive opens the (optionally compressed) tar archive in ra as a
+// filesystem. Archives that cannot be read in place are decompressed into
+// tempDir.
+func OpenArchive(ctx context.Context, ra io.ReaderAt, size int64, tempDir string) (fs.FS, func() error, error) {
+	l := &Loader{TempDir: tempDir}
+	return l.open(ctx, ra, size, Layer{})
+}
+
+// openBlob opens the layer tarball (as stored) for random access. Tarballs
+// that imageFS cannot provide random access to (eg. registry blobs) are
+// copied to the cache (or to a temporary file).
+func (l *Loader) openBlob(ctx context.Context, imageFS fs.FS, layer Layer) (io.ReaderAt, int64, func() error, error) {
+	cacheable := l.Cache != nil && layer.Digest != ""
+	if cacheable {
+		if f, err := l.Cache.Lookup(layer.Digest); err == nil {
+			return openFile(f)
+		}
+	}
+
+	f, err := imageFS.Open(layer.Path)
+	if err != nil {
+		return nil, 0, nil, fmt.Errorf("failed to open layer: %w", err)
+	}
+
+	if ra, ok := f.(io.ReaderAt); ok {
+		fi, err := f.Stat()
+		if err != nil {
+			_ = f.Close()
+			return nil, 0, nil, fmt.Errorf("failed to stat layer: %w", err)
+		}
+
+		return ra, fi.Size(), f.Close, nil
+	}
+	defer f.Close()
+
+	copyBlob := func(w io.Writer) error {
+		var verifier digest.Verifier
+		if layer.Digest != "" {
+			verifier = layer.Digest.Verifier()
+			w = io.MultiWriter(w, verifier)
+		}
+
+		if _, err := io.Copy(w, util.ContextReader(ctx, f)); err != nil {
+			return fmt.Errorf("failed to copy layer: %w", err)
+		}
+
+		if verifier != nil && !verifier.Verified() {
+			return fmt.Errorf("layer digest mismatch: expected %s", layer.Digest)
+		}
+
+		return nil
+	}
+
+	if cacheable {
+		cached, err := l.Cache.Get(layer.Digest, copyBlob)
+		if err != nil {
+			return nil, 0, nil, fmt.Errorf("failed to get cached layer: %w", err)
+		}
+
+		return openFile(cached)
+	}
+
+	tempFile, err := os.CreateTemp(l.TempDir, "layer-*")
+	if err != nil {
+		return nil, 0, nil, fmt.Errorf("failed to create temporary layer file: %w", err)
+	}
+
+	if err := copyBlob(tempFile); err != nil {
+		_ = tempFile.Close()
+		_ = os.Remove(tempFile.Name())
+		return nil, 0, nil, err
+	}
+
+	return openFile(tempFile)
+}
+
+// open opens the layer tarball in ra as a filesystem. Progress is reported
+// (to the tracker in the context, if any) as the tarball is read.
+func (l *Loader) open(ctx context.Context, ra io.ReaderAt, size int64, layer Layer) (fs.FS, func() error, error) {
+	progress.FromContext(ctx).SetTotal(size)
+
+	header := make([]byte, 512)
+	n, err := ra.ReadAt(header, 0)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, nil, fmt.Errorf("failed to read layer: %w", err)
+	}
+	header = header[:n]
+
+	switch {
+	case zran.IsGzip(header):
+		idx, err := l.index(ctx, ra, size, layer)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		return openTar(zran.NewReader(ra, idx), nil)
+	case isTar(header):
+		if err := verify(ctx, io.NewSectionReader(ra, 0, size), layer.DiffID); err != nil {
+			return nil, nil, err
+		}
+
+		return openTar(io.NewSectionReader(ra, 0, size), nil)
+	}
+
+	f, err := l.decompress(ctx, io.NewSectionReader(ra, 0, size), layer)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return openTar(f, f.Close)
+}
+
+// index returns the index of the gzip compressed layer in ra, building it
+// if it is not in the cache.
+func (l *Loader) index(ctx context.Context, ra io.ReaderAt, size int64, layer Layer) (*zran.Index, error) {
+	build := func() (*zran.Index, error) {
+		verifier := verifierFor(layer.DiffID)
+
+		idx, err := zran.BuildIndex(progress.FromContext(ctx).Reader(util.ContextReader(ctx, io.NewSectionReader(ra, 0, size))), zran.DefaultSpan, verifier)
+		if err != nil {
+			return nil, fmt.Errorf("failed to index layer: %w", err)
+		}
+
+		if !verifier.Verified() {
+			return nil, fmt.Errorf("layer digest mismatch: expected %s", layer.DiffID)
+		}
+
+		return idx, nil
+	}
+
+	if l.Cache == nil || layer.Digest == "" {
+		return build()
+	}
+
+	f, err := l.Cache.GetDerived(layer.Digest, indexKind, func(w io.Writer) error {
+		idx, err := build()
+		if err != nil {
+			return err
+		}
+
+		data, err := idx.MarshalBinary()
+		if err != nil {
+			return err
+		}
+
+		_, err = w.Write(data)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get cached layer index: %w", err)
+	}
+	defer f.Close()
+
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read cached layer index: %w", err)
+	}
+
+	var idx zran.Index
+	if err := idx.UnmarshalBinary(data); err != nil {
+		return nil, fmt.Errorf("failed to decode cached layer index: %w", err)
+	}
+
+	return &idx, nil
+}
+
+// decompress decompresses the layer in full, into the cache (or into a
+// temporary file).
+func (l *Loader) decompress(ctx context.Context, r io.Reader, layer Layer) (*os.File, error) {
+	fill := func(w io.Writer) error {
+		dr, err := uncompr.NewReader(progress.FromContext(ctx).Reader(r))
+		if err != nil {
+			return fmt.Errorf("failed to create decompressing reader: %w", err)
+		}
+		defer dr.Close()
+
+		verifier := verifierFor(layer.DiffID)
+		if _, err := io.Copy(io.MultiWriter(w, verifier), util.ContextReader(ctx, dr)); err != nil {
+			return fmt.Errorf("failed to decompress layer: %w", err)
+		}
+
+		if !verifier.Verified() {
+			return fmt.Errorf("layer digest mismatch: expected %s", layer.DiffID)
+		}
+
+		return nil
+	}
+
+	if l.Cache != nil && layer.DiffID != "" {
+		f, err := l.Cache.Get(layer.DiffID, fill)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get cached layer: %w", err)
+		}
+
+		return f, nil
+	}
+
+	f, err := os.CreateTemp(l.TempDir, "layer-*.tar")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temporary tar file: %w", err)
+	}
+
+	if err := fill(f); err != nil {
+		_ = f.Close()
+		_ = os.Remove(f.Name())
+		return nil, err
+	}
+
+	return f, nil
+}
+
+// verify verifies that the content read from r matches the digest (if any).
+func verify(ctx context.Context, r io.Reader, dgst digest.Digest) error {
+	if dgst == "" {
+		return nil
+	}
+
+	verifier := dgst.Verifier()
+	if _, err := io.Copy(verifier, progress.FromContext(ctx).Reader(util.ContextReader(ctx, r))); err != nil {
+		return fmt.Errorf("failed to read layer: %w", err)
+	}
+
+	if !verifier.Verified() {
+		return fmt.Errorf("layer digest mismatch: expected %s", dgst)
+	}
+
+	return nil
+}
+
+func openTar(ra io.ReaderAt, close func() error) (fs.FS, func() error, error) {
+	fsys, err := tarfs.Open(ra)
+	if err != nil {
+		if close != nil {
+			_ = close()
+		}
+		return nil, nil, fmt.Errorf("failed to open layer: %w", err)
+	}
+
+	if close == nil {
+		close = func() error { return nil }
+	}
+
+	return fsys, close, nil
+}
+
+func openFile(f *os.File) (io.ReaderAt, int64, func() error, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return nil, 0, nil, fmt.Errorf("failed to stat layer: %w", err)
+	}
+
+	return f, fi.Size(), f.Close, nil
+}
+
+// isTar returns true if the header is that of a POSIX (or GNU) tar archive.
+func isTar(header []byte) bool {
+	return len(header) >= 262 && bytes.Equal(header[257:262], []byte("ustar"))
+}
+
+// verifierFor returns a verifier for the given digest, if the digest is empty
+// the verifier accepts any content.
+func verifierFor(dgst digest.Digest) digest.Verifier {
+	if dgst == "" {
+		return anyVerifier{io.Discard}
+	}
+
+	return dgst.Verifier()
+}
+
+type anyVerifier struct {
+	io.Writer
+}
+
+func (anyVerifier) Verified() bool {
+	return true
+}
@@ -0,0 +1,283 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package layer_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+
+	"github.com/immutos/oci2erofs/internal/cache"
+	"github.com/immutos/oci2erofs/internal/layer"
+	"github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoader(t *testing.T) {
+	ctx := context.Background()
+
+	first := newTar(t, "first")
+	second := newTar(t, "second")
+
+	// Docker archives store every layer as "<id>/layer.tar".
+	imageFS := fstest.MapFS{
+		"a/layer.tar": &fstest.MapFile{Data: first},
+		"b/layer.tar": &fstest.MapFile{Data: second},
+	}
+
+	t.Run("Temporary Files", func(t *testing.T) {
+		loader := &layer.Loader{TempDir: t.TempDir()}
+
+		firstFS, closeFirst, err := loader.Load(ctx, imageFS, layer.Layer{Path: "a/layer.tar", DiffID: digest.FromBytes(first)})
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			require.NoError(t, closeFirst())
+		})
+
+		secondFS, closeSecond, err := loader.Load(ctx, imageFS, layer.Layer{Path: "b/layer.tar", DiffID: digest.FromBytes(second)})
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			require.NoError(t, closeSecond())
+		})
+
+		data, err := fs.ReadFile(firstFS, "file.txt")
+		require.NoError(t, err)
+		require.Equal(t, "first", string(data))
+
+		data, err = fs.ReadFile(secondFS, "file.txt")
+		require.NoError(t, err)
+		require.Equal(t, "second", string(data))
+	})
+
+	t.Run("Cache", func(t *testing.T) {
+		c, err := cache.Open(t.TempDir(), 0)
+		require.NoError(t, err)
+
+		loader := &layer.Loader{Cache: c}
+
+		// Layers that cannot be read in place are copied to the cache.
+		firstLayer := layer.Layer{Path: "a/layer.tar", Digest: digest.FromBytes(first), DiffID: digest.FromBytes(first)}
+
+		layerFS, closeLayer, err := loader.Load(ctx, streamFS{imageFS}, firstLayer)
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			require.NoError(t, closeLayer())
+		})
+
+		data, err := fs.ReadFile(layerFS, "file.txt")
+		require.NoError(t, err)
+		require.Equal(t, "first", string(data))
+
+		// Served from the cache.
+		cachedFS, closeCached, err := loader.Load(ctx, fstest.MapFS{}, firstLayer)
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			require.NoError(t, closeCached())
+		})
+
+		data, err = fs.ReadFile(cachedFS, "file.txt")
+		require.NoError(t, err)
+		require.Equal(t, "first", string(data))
+	})
+
+	t.Run("Gzip", func(t *testing.T) {
+		var compressed bytes.Buffer
+		gw := gzip.NewWriter(&compressed)
+		_, err := gw.Write(second)
+		require.NoError(t, err)
+		require.NoError(t, gw.Close())
+
+		gzipFS := fstest.MapFS{
+			"layer.tar.gz": &fstest.MapFile{Data: compressed.Bytes()},
+		}
+
+		gzipLayer := layer.Layer{
+			Path:   "layer.tar.gz",
+			Digest: digest.FromBytes(compressed.Bytes()),
+			DiffID: digest.FromBytes(second),
+		}
+
+		cacheDir := t.TempDir()
+		c, err := cache.Open(cacheDir, 0)
+		require.NoError(t, err)
+
+		for _, loader := range []*layer.Loader{{TempDir: t.TempDir()}, {Cache: c}, {Cache: c}} {
+			layerFS, closeLayer, err := loader.Load(ctx, gzipFS, gzipLayer)
+			require.NoError(t, err)
+
+			data, err := fs.ReadFile(layerFS, "file.txt")
+			require.NoError(t, err)
+			require.Equal(t, "second", string(data))
+
+			require.NoError(t, closeLayer())
+		}
+
+		// Only the index is cached.
+		entries, err := os.ReadDir(filepath.Join(cacheDir, "layers"))
+		require.NoError(t, err)
+		require.Len(t, entries, 1)
+		require.Equal(t, "sha256-"+gzipLayer.Digest.Encoded()+".zran", entries[0].Name())
+
+		gzipLayer.DiffID = digest.FromBytes(first)
+
+		_, _, err = (&layer.Loader{TempDir: t.TempDir()}).Load(ctx, gzipFS, gzipLayer)
+		require.ErrorContains(t, err, "layer digest mismatch")
+	})
+
+	t.Run("Shared", func(t *testing.T) {
+		tempDir := t.TempDir()
+		loader := &layer.Loader{TempDir: tempDir}
+
+		// Layers streamed from the image are spooled to temporary files.
+		l := layer.Layer{Path: "a/layer.tar", DiffID: digest.FromBytes(first)}
+
+		firstFS, closeFirst, err := loader.Load(ctx, streamFS{imageFS}, l)
+		require.NoError(t, err)
+
+		secondFS, closeSecond, err := loader.Load(ctx, streamFS{imageFS}, l)
+		require.NoError(t, err)
+
+		entries, err := os.ReadDir(tempDir)
+		require.NoError(t, err)
+		require.Len(t, entries, 1)
+
+		require.NoError(t, closeFirst())
+
+		data, err := fs.ReadFile(secondFS, "file.txt")
+		require.NoError(t, err)
+		require.Equal(t, "first", string(data))
+		require.Same(t, firstFS, secondFS)
+
+		require.NoError(t, closeSecond())
+
+		// Once released, the layer is loaded again.
+		thirdFS, closeThird, err := loader.Load(ctx, streamFS{imageFS}, l)
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			require.NoError(t, closeThird())
+		})
+		require.NotSame(t, firstFS, thirdFS)
+	})
+
+	t.Run("Digest Mismatch", func(t *testing.T) {
+		c, err := cache.Open(t.TempDir(), 0)
+		require.NoError(t, err)
+
+		loader := &layer.Loader{Cache: c}
+
+		_, _, err = loader.Load(ctx, imageFS, layer.Layer{Path: "b/layer.tar", DiffID: digest.FromBytes(first)})
+		require.Error(t, err)
+	})
+}
+
+func TestLoadAll(t *testing.T) {
+	ctx := context.Background()
+
+	imageFS := fstest.MapFS{}
+	var layers []layer.Layer
+	for i := 0; i < 16; i++ {
+		content := fmt.Sprintf("layer %d", i)
+		data := newTar(t, content)
+
+		layerPath := fmt.Sprintf("%d/layer.tar", i)
+		imageFS[layerPath] = &fstest.MapFile{Data: data}
+		layers = append(layers, layer.Layer{Path: layerPath, DiffID: digest.FromBytes(data)})
+	}
+
+	t.Run("Ordering", func(t *testing.T) {
+		loader := &layer.Loader{TempDir: t.TempDir(), Jobs: 4}
+
+		layerFSs, closeAll, err := loader.LoadAll(ctx, imageFS, layers)
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			require.NoError(t, closeAll())
+		})
+
+		require.Len(t, layerFSs, len(layers))
+
+		for i, layerFS := range layerFSs {
+			data, err := fs.ReadFile(layerFS, "file.txt")
+			require.NoError(t, err)
+			require.Equal(t, fmt.Sprintf("layer %d", i), string(data))
+		}
+	})
+
+	t.Run("Error", func(t *testing.T) {
+		c, err := cache.Open(t.TempDir(), 0)
+		require.NoError(t, err)
+
+		loader := &layer.Loader{Cache: c, Jobs: 4}
+
+		badLayers := append([]layer.Layer{}, layers...)
+		badLayers[3].DiffID = digest.FromString("something else")
+
+		_, _, err = loader.LoadAll(ctx, imageFS, badLayers)
+		require.ErrorContains(t, err, "layer digest mismatch")
+	})
+
+	t.Run("Cancelled", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(ctx)
+		cancel()
+
+		loader := &layer.Loader{TempDir: t.TempDir()}
+
+		_, _, err := loader.LoadAll(ctx, imageFS, layers)
+		require.ErrorIs(t, err, context.Canceled)
+	})
+}
+
+// streamFS hides the random access support of the files in the underlying
+// filesystem (as is the case for registry blobs).
+type streamFS struct {
+	fs.FS
+}
+
+func (fsys streamFS) Open(name string) (fs.File, error) {
+	f, err := fsys.FS.Open(name)
+	if err != nil {
+		return nil, err
+	}
+
+	return struct{ fs.File }{f}, nil
+}
+
+func newTar(t *testing.T, content string) []byte {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+
+	require.NoError(t, tw.WriteHeader(&tar.Header{
+		Name: "file.txt",
+		Mode: 0o644,
+		Size: int64(len(content)),
+	}))
+
+	_, err := tw.Write([]byte(content))
+	require.NoError(t, err)
+
+	require.NoError(t, tw.Close())
+
+	return buf.Bytes()
+}
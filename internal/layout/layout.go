@@ -0,0 +1,266 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+// Package layout writes EROFS artifacts into OCI image layout directories.
+package layout
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"github.com/containerd/containerd/platforms"
+	"github.com/immutos/oci2erofs/internal/artifact"
+	"github.com/immutos/oci2erofs/internal/atomicfile"
+	"github.com/opencontainers/go-digest"
+	specs "github.com/opencontainers/image-spec/specs-go"
+	ocispecs "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Layout is an OCI image layout directory.
+type Layout struct {
+	dir       string
+	noClobber bool
+}
+
+// Open opens the OCI image layout in dir, creating it if it does not exist.
+// If noClobber is set, existing artifacts in the layout are never replaced
+// (and Add returns an error satisfying fs.ErrExist instead).
+func Open(dir string, noClobber bool) (*Layout, error) {
+	if err := os.MkdirAll(filepath.Join(dir, ocispecs.ImageBlobsDir, string(digest.SHA256)), 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create layout directory: %w", err)
+	}
+
+	layoutPath := filepath.Join(dir, ocispecs.ImageLayoutFile)
+
+	data, err := os.ReadFile(layoutPath)
+	if errors.Is(err, os.ErrNotExist) {
+		data, err = json.Marshal(ocispecs.ImageLayout{Version: ocispecs.ImageLayoutVersion})
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal image layout: %w", err)
+		}
+
+		if err := writeFile(layoutPath, data); err != nil {
+			return nil, fmt.Errorf("failed to write image layout: %w", err)
+		}
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read image layout: %w", err)
+	}
+
+	var imageLayout ocispecs.ImageLayout
+	if err := json.Unmarshal(data, &imageLayout); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal image layout: %w", err)
+	}
+
+	if imageLayout.Version != ocispecs.ImageLayoutVersion {
+		return nil, fmt.Errorf("unsupported image layout version: %s", imageLayout.Version)
+	}
+
+	return &Layout{dir: dir, noClobber: noClobber}, nil
+}
+
+// Add writes the artifact (with the EROFS filesystem image read from layer)
+// into the layout, and adds its manifest to the image index tagged with tag.
+// Any existing manifest in the index for the same platform is replaced (unless
+// the layout was opened with noClobber).
+func (l *Layout) Add(tag string, art *artifact.Artifact, layer io.Reader) error {
+	rootIndex, err := l.readIndex()
+	if err != nil {
+		return err
+	}
+
+	tagIndex, manifests, err := l.readTagIndex(rootIndex, tag)
+	if err != nil {
+		return err
+	}
+
+	// One manifest per platform.
+	var platformManifests []ocispecs.Descriptor
+	for _, desc := range tagIndex.Manifests {
+		if samePlatform(desc.Platform, art.Manifest.Platform) {
+			if l.noClobber {
+				return &fs.PathError{Op: "add", Path: tag, Err: fs.ErrExist}
+			}
+
+			continue
+		}
+
+		platformManifests = append(platformManifests, desc)
+	}
+	tagIndex.Manifests = append(platformManifests, art.Manifest)
+
+	if err := l.writeBlob(art.Layer, layer); err != nil {
+		return fmt.Errorf("failed to write layer: %w", err)
+	}
+
+	if err := l.writeBlob(art.Config, bytes.NewReader(art.ConfigData)); err != nil {
+		return fmt.Errorf("failed to write config: %w", err)
+	}
+
+	if err := l.writeBlob(art.Manifest, bytes.NewReader(art.ManifestData)); err != nil {
+		return fmt.Errorf("failed to write manifest: %w", err)
+	}
+
+	tagIndexData, err := json.Marshal(tagIndex)
+	if err != nil {
+		return fmt.Errorf("failed to marshal image index: %w", err)
+	}
+
+	tagIndexDescriptor := ocispecs.Descriptor{
+		MediaType: ocispecs.MediaTypeImageIndex,
+		Digest:    digest.FromBytes(tagIndexData),
+		Size:      int64(len(tagIndexData)),
+		Annotations: map[string]string{
+			ocispecs.AnnotationRefName: tag,
+		},
+	}
+
+	if err := l.writeBlob(tagIndexDescriptor, bytes.NewReader(tagIndexData)); err != nil {
+		return fmt.Errorf("failed to write image index: %w", err)
+	}
+
+	rootIndex.Manifests = append(manifests, tagIndexDescriptor)
+
+	rootIndexData, err := json.Marshal(rootIndex)
+	if err != nil {
+		return fmt.Errorf("failed to marshal index: %w", err)
+	}
+
+	if err := writeFile(filepath.Join(l.dir, ocispecs.ImageIndexFile), rootIndexData); err != nil {
+		return fmt.Errorf("failed to write index: %w", err)
+	}
+
+	return nil
+}
+
+// readTagIndex returns the image index for the tag (which is empty if it does
+// not exist yet), and the other manifests in the root index.
+func (l *Layout) readTagIndex(rootIndex *ocispecs.Index, tag string) (*ocispecs.Index, []ocispecs.Descriptor, error) {
+	tagIndex := ocispecs.Index{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ocispecs.MediaTypeImageIndex,
+	}
+
+	var manifests []ocispecs.Descriptor
+	for _, desc := range rootIndex.Manifests {
+		if desc.Annotations[ocispecs.AnnotationRefName] != tag {
+			manifests = append(manifests, desc)
+			continue
+		}
+
+		if desc.MediaType != ocispecs.MediaTypeImageIndex {
+			return nil, nil, fmt.Errorf("tag %q does not refer to an image index", tag)
+		}
+
+		data, err := os.ReadFile(l.blobPath(desc.Digest))
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to read image index: %w", err)
+		}
+
+		if err := json.Unmarshal(data, &tagIndex); err != nil {
+			return nil, nil, fmt.Errorf("failed to unmarshal image index: %w", err)
+		}
+	}
+
+	return &tagIndex, manifests, nil
+}
+
+func (l *Layout) readIndex() (*ocispecs.Index, error) {
+	data, err := os.ReadFile(filepath.Join(l.dir, ocispecs.ImageIndexFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return &ocispecs.Index{
+			Versioned: specs.Versioned{SchemaVersion: 2},
+			MediaType: ocispecs.MediaTypeImageIndex,
+		}, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read index: %w", err)
+	}
+
+	var index ocispecs.Index
+	if err := json.Unmarshal(data, &index); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal index: %w", err)
+	}
+
+	return &index, nil
+}
+
+// writeBlob writes the content of r into the blob store, verifying that it
+// matches the descriptor.
+func (l *Layout) writeBlob(desc ocispecs.Descriptor, r io.Reader) error {
+	path := l.blobPath(desc.Digest)
+
+	// Blobs are content addressed, so there is nothing to do if it exists.
+	if fi, err := os.Stat(path); err == nil && fi.Size() == desc.Size {
+		return nil
+	}
+
+	f, err := atomicfile.Create(path, false)
+	if err != nil {
+		return fmt.Errorf("failed to create blob file: %w", err)
+	}
+	defer f.Close()
+
+	verifier := desc.Digest.Verifier()
+
+	n, err := io.Copy(io.MultiWriter(f, verifier), r)
+	if err != nil {
+		return fmt.Errorf("failed to write blob: %w", err)
+	}
+
+	if n != desc.Size {
+		return fmt.Errorf("blob size mismatch: expected %d, got %d", desc.Size, n)
+	}
+
+	if !verifier.Verified() {
+		return fmt.Errorf("blob digest mismatch: expected %s", desc.Digest)
+	}
+
+	return f.Commit()
+}
+
+func (l *Layout) blobPath(dgst digest.Digest) string {
+	return filepath.Join(l.dir, ocispecs.ImageBlobsDir, dgst.Algorithm().String(), dgst.Encoded())
+}
+
+func samePlatform(a, b *ocispecs.Platform) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+
+	return platforms.Format(platforms.Normalize(*a)) == platforms.Format(platforms.Normalize(*b))
+}
+
+// writeFile atomically replaces the file at path with data.
+func writeFile(path string, data []byte) error {
+	f, err := atomicfile.Create(path, false)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if _, err := f.Write(data); err != nil {
+		return err
+	}
+
+	return f.Commit()
+}
@@ -0,0 +1,148 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package layout_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/immutos/oci2erofs/internal/artifact"
+	"github.com/immutos/oci2erofs/internal/layout"
+	"github.com/opencontainers/go-digest"
+	ocispecs "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLayout(t *testing.T) {
+	dir := t.TempDir()
+
+	l, err := layout.Open(dir, false)
+	require.NoError(t, err)
+
+	amd64Artifact, amd64Layer := newArtifact(t, "amd64", "amd64 image")
+	require.NoError(t, l.Add("latest", amd64Artifact, bytes.NewReader(amd64Layer)))
+
+	arm64Artifact, arm64Layer := newArtifact(t, "arm64", "arm64 image")
+	require.NoError(t, l.Add("latest", arm64Artifact, bytes.NewReader(arm64Layer)))
+
+	// Replaces the existing amd64 manifest.
+	amd64Artifact, amd64Layer = newArtifact(t, "amd64", "updated amd64 image")
+	require.NoError(t, l.Add("latest", amd64Artifact, bytes.NewReader(amd64Layer)))
+
+	// Reopening an existing layout should succeed.
+	l, err = layout.Open(dir, false)
+	require.NoError(t, err)
+
+	require.NoError(t, l.Add("other", arm64Artifact, bytes.NewReader(arm64Layer)))
+
+	var imageLayout ocispecs.ImageLayout
+	readJSON(t, filepath.Join(dir, ocispecs.ImageLayoutFile), &imageLayout)
+	require.Equal(t, ocispecs.ImageLayoutVersion, imageLayout.Version)
+
+	var index ocispecs.Index
+	readJSON(t, filepath.Join(dir, ocispecs.ImageIndexFile), &index)
+	require.Len(t, index.Manifests, 2)
+
+	latest := index.Manifests[0]
+	require.Equal(t, ocispecs.MediaTypeImageIndex, latest.MediaType)
+	require.Equal(t, "latest", latest.Annotations[ocispecs.AnnotationRefName])
+	require.Equal(t, "other", index.Manifests[1].Annotations[ocispecs.AnnotationRefName])
+
+	var latestIndex ocispecs.Index
+	readJSON(t, blobPath(dir, latest.Digest), &latestIndex)
+	require.Len(t, latestIndex.Manifests, 2)
+
+	require.Equal(t, arm64Artifact.Manifest.Digest, latestIndex.Manifests[0].Digest)
+	require.Equal(t, "arm64", latestIndex.Manifests[0].Platform.Architecture)
+	require.Equal(t, amd64Artifact.Manifest.Digest, latestIndex.Manifests[1].Digest)
+	require.Equal(t, "amd64", latestIndex.Manifests[1].Platform.Architecture)
+	require.Equal(t, artifact.ArtifactType, latestIndex.Manifests[1].ArtifactType)
+
+	for _, desc := range []ocispecs.Descriptor{amd64Artifact.Layer, amd64Artifact.Config, amd64Artifact.Manifest} {
+		data, err := os.ReadFile(blobPath(dir, desc.Digest))
+		require.NoError(t, err)
+		require.Equal(t, desc.Digest, digest.FromBytes(data))
+	}
+}
+
+func TestLayoutNoClobber(t *testing.T) {
+	dir := t.TempDir()
+
+	l, err := layout.Open(dir, true)
+	require.NoError(t, err)
+
+	amd64Artifact, amd64Layer := newArtifact(t, "amd64", "amd64 image")
+	require.NoError(t, l.Add("latest", amd64Artifact, bytes.NewReader(amd64Layer)))
+
+	arm64Artifact, arm64Layer := newArtifact(t, "arm64", "arm64 image")
+	require.NoError(t, l.Add("latest", arm64Artifact, bytes.NewReader(arm64Layer)))
+
+	updatedArtifact, updatedLayer := newArtifact(t, "amd64", "updated amd64 image")
+	err = l.Add("latest", updatedArtifact, bytes.NewReader(updatedLayer))
+	require.ErrorIs(t, err, fs.ErrExist)
+
+	// The layout is left untouched.
+	_, err = os.Stat(blobPath(dir, updatedArtifact.Layer.Digest))
+	require.ErrorIs(t, err, fs.ErrNotExist)
+
+	// Other tags can still be added.
+	require.NoError(t, l.Add("other", updatedArtifact, bytes.NewReader(updatedLayer)))
+}
+
+func TestLayoutDigestMismatch(t *testing.T) {
+	l, err := layout.Open(t.TempDir(), false)
+	require.NoError(t, err)
+
+	art, _ := newArtifact(t, "amd64", "amd64 image")
+	require.Error(t, l.Add("latest", art, bytes.NewReader([]byte("something else"))))
+}
+
+func newArtifact(t *testing.T, arch, content string) (*artifact.Artifact, []byte) {
+	layerData := []byte(content)
+
+	art, err := artifact.New(ocispecs.Descriptor{
+		Digest: digest.FromBytes(layerData),
+		Size:   int64(len(layerData)),
+	}, artifact.Options{
+		Config: ocispecs.Image{
+			Platform: ocispecs.Platform{
+				Architecture: arch,
+				OS:           "linux",
+			},
+		},
+	})
+	require.NoError(t, err)
+
+	return art, layerData
+}
+
+func readJSON(t *testing.T, path string, v any) {
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+
+	require.NoError(t, json.Unmarshal(data, v))
+}
+
+func blobPath(dir string, dgst digest.Digest) string {
+	return filepath.Join(dir, ocispecs.ImageBlobsDir, dgst.Algorithm().String(), dgst.Encoded())
+}
@@ -19,117 +19,159 @@
 package oci
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"io"
 	"io/fs"
-	"os"
+	"log/slog"
 	"path/filepath"
 
+	"github.com/containerd/containerd/images"
 	"github.com/containerd/containerd/platforms"
-	"github.com/dpeckett/archivefs/tarfs"
-	"github.com/dpeckett/uncompr"
+	"github.com/immutos/oci2erofs/internal/image"
+	"github.com/immutos/oci2erofs/internal/layer"
 	"github.com/immutos/oci2erofs/internal/overlayfs"
 	ocispecs "github.com/opencontainers/image-spec/specs-go/v1"
 )
 
-// LoadImage loads an OCI image from the given imageFS, ref, and platform.
-// It returns an overlayfs.FS of the image's root filesystem, a function to
-// close the image, and an error if any.
-func LoadImage(tempDir string, imageFS fs.FS, ref string, platform *ocispecs.Platform) (fs.FS, func() error, error) {
+// LoadImage loads an OCI image from the given imageFS, ref, and platform (using
+// loader to load the image layers).
+// It returns the image (including an overlayfs.FS of the image's root
+// filesystem), and an error if any.
+func LoadImage(ctx context.Context, loader *layer.Loader, imageFS fs.FS, ref string, platform *ocispecs.Platform) (*image.Image, error) {
 	if err := verifyImageLayoutVersion(imageFS); err != nil {
-		return nil, nil, err
+		return nil, err
 	}
 
-	manifest, err := manifestForRef(imageFS, ref, platform)
+	manifestDescriptor, manifest, err := manifestForRef(imageFS, ref, platform)
 	if err != nil {
-		return nil, nil, err
+		return nil, err
 	}
 
-	var layers []fs.FS
-	var closers []func() error
+	config, err := readConfig(imageFS, manifest.Config)
+	if err != nil {
+		return nil, err
+	}
 
-	for _, layerDescriptor := range manifest.Layers {
-		layerPath := filepath.Join("blobs", string(layerDescriptor.Digest.Algorithm()), layerDescriptor.Digest.Encoded())
-		layer, close, err := loadLayer(tempDir, imageFS, layerPath)
-		if err != nil {
-			return nil, nil, err
-		}
+	// Manifests referenced directly from the index may not be annotated with
+	// a platform, so fall back to checking the image configuration.
+	if platform != nil && manifestDescriptor.Platform == nil && !platforms.NewMatcher(*platform).Match(config.Platform) {
+		return nil, errors.New("platform is not present in image")
+	}
 
-		layers = append(layers, layer)
-		closers = append(closers, close)
+	if len(config.RootFS.DiffIDs) != len(manifest.Layers) {
+		return nil, fmt.Errorf("image has %d layers but %d diff IDs", len(manifest.Layers), len(config.RootFS.DiffIDs))
 	}
 
-	closeAll := func() error {
-		for _, close := range closers {
-			if err := close(); err != nil {
-				return err
-			}
+	layersToLoad := make([]layer.Layer, len(manifest.Layers))
+	for i, layerDescriptor := range manifest.Layers {
+		layersToLoad[i] = layer.Layer{
+			Path:   BlobPath(layerDescriptor),
+			Digest: layerDescriptor.Digest,
+			DiffID: config.RootFS.DiffIDs[i],
 		}
-		return nil
 	}
 
-	rootFS, err := overlayfs.New(layers)
+	layers, closeAll, err := loader.LoadAll(ctx, imageFS, layersToLoad)
+	if err != nil {
+		return nil, err
+	}
+
+	rootFS, err := overlayfs.New(ctx, layers)
 	if err != nil {
 		_ = closeAll()
-		return nil, nil, fmt.Errorf("failed to create overlayfs: %w", err)
+		return nil, fmt.Errorf("failed to create overlayfs: %w", err)
 	}
 
-	return rootFS, closeAll, nil
+	return image.New(*manifestDescriptor, manifest.Config, *config, manifest.Layers, rootFS, closeAll), nil
 }
 
-func loadLayer(tempDir string, imageFS fs.FS, layerPath string) (fs.FS, func() error, error) {
-	f, err := imageFS.Open(layerPath)
-	if err != nil {
-		return nil, nil, fmt.Errorf("failed to open layer: %w", err)
+// Targets returns the ref and platform of every image in the layout. Images
+// that cannot be selected by ref (eg. unnamed manifests alongside others) and
+// manifests for unknown platforms (eg. attestations) are omitted.
+func Targets(imageFS fs.FS) ([]image.Target, error) {
+	if err := verifyImageLayoutVersion(imageFS); err != nil {
+		return nil, err
 	}
-	defer f.Close()
 
-	dr, err := uncompr.NewReader(f)
+	index, err := readIndex(imageFS, "index.json")
 	if err != nil {
-		return nil, nil, fmt.Errorf("failed to create decompressing reader: %w", err)
+		return nil, fmt.Errorf("failed to read index: %w", err)
 	}
-	defer dr.Close()
 
-	decompressedLayerPath := filepath.Join(tempDir, filepath.Base(layerPath)+".tar")
-	decompressedLayerFile, err := os.OpenFile(decompressedLayerPath, os.O_CREATE|os.O_RDWR, 0o644)
-	if err != nil {
-		return nil, nil, fmt.Errorf("failed to create temporary tar file: %w", err)
-	}
+	var targets []image.Target
+	seen := make(map[string]bool)
+	add := func(ref string, platform ocispecs.Platform) {
+		if platform.OS == "unknown" {
+			return
+		}
 
-	if _, err := io.Copy(decompressedLayerFile, dr); err != nil {
-		return nil, nil, fmt.Errorf("failed to decompress layer: %w", err)
+		key := ref + "@" + platforms.Format(platform)
+		if !seen[key] {
+			seen[key] = true
+			targets = append(targets, image.Target{Ref: ref, Platform: platform})
+		}
 	}
 
-	fsys, err := tarfs.Open(decompressedLayerFile)
-	if err != nil {
-		return nil, nil, fmt.Errorf("failed to open decompressed layer: %w", err)
+	for _, desc := range index.Manifests {
+		ref := desc.Annotations[ocispecs.AnnotationRefName]
+		if ref == "" && len(index.Manifests) > 1 {
+			slog.Warn("Skipping manifest without a ref", slog.String("digest", desc.Digest.String()))
+			continue
+		}
+
+		switch desc.MediaType {
+		case ocispecs.MediaTypeImageIndex, images.MediaTypeDockerSchema2ManifestList:
+			imageIndex, err := readIndex(imageFS, BlobPath(desc))
+			if err != nil {
+				return nil, fmt.Errorf("failed to read image index: %w", err)
+			}
+
+			for _, manifestDesc := range imageIndex.Manifests {
+				if manifestDesc.Platform != nil {
+					add(ref, *manifestDesc.Platform)
+				}
+			}
+		case ocispecs.MediaTypeImageManifest, images.MediaTypeDockerSchema2Manifest:
+			if desc.Platform != nil {
+				add(ref, *desc.Platform)
+				continue
+			}
+
+			manifest, err := readManifest(imageFS, desc)
+			if err != nil {
+				return nil, err
+			}
+
+			config, err := readConfig(imageFS, manifest.Config)
+			if err != nil {
+				return nil, err
+			}
+
+			add(ref, config.Platform)
+		default:
+			return nil, fmt.Errorf("unexpected manifest media type: %s", desc.MediaType)
+		}
 	}
 
-	return fsys, decompressedLayerFile.Close, nil
+	return targets, nil
 }
 
-func manifestForRef(imageFS fs.FS, ref string, platform *ocispecs.Platform) (*ocispecs.Manifest, error) {
-	indexFile, err := imageFS.Open("index.json")
+func manifestForRef(imageFS fs.FS, ref string, platform *ocispecs.Platform) (*ocispecs.Descriptor, *ocispecs.Manifest, error) {
+	index, err := readIndex(imageFS, "index.json")
 	if err != nil {
-		return nil, fmt.Errorf("failed to open index: %w", err)
-	}
-	defer indexFile.Close()
-
-	var index ocispecs.Index
-	if err := json.NewDecoder(indexFile).Decode(&index); err != nil {
-		return nil, fmt.Errorf("failed to unmarshal index: %w", err)
+		return nil, nil, fmt.Errorf("failed to read index: %w", err)
 	}
 
 	if len(index.Manifests) == 0 {
-		return nil, errors.New("no manifests found")
+		return nil, nil, errors.New("no manifests found")
 	}
 
 	var manifestDescriptor *ocispecs.Descriptor
 	if ref == "" {
 		if len(index.Manifests) > 1 {
-			return nil, errors.New("multiple manifests found, ref must be specified")
+			return nil, nil, errors.New("multiple manifests found, ref must be specified")
 		}
 
 		manifestDescriptor = &index.Manifests[0]
@@ -143,21 +185,14 @@ func manifestForRef(imageFS fs.FS, ref string, platform *ocispecs.Platform) (*oc
 		}
 	}
 	if manifestDescriptor == nil {
-		return nil, fmt.Errorf("no manifest found for ref %s", ref)
+		return nil, nil, fmt.Errorf("no manifest found for ref %s", ref)
 	}
 
-	if manifestDescriptor.MediaType == ocispecs.MediaTypeImageIndex {
-		imageIndexPath := filepath.Join("blobs", string(manifestDescriptor.Digest.Algorithm()), manifestDescriptor.Digest.Encoded())
-
-		imageIndexFile, err := imageFS.Open(imageIndexPath)
+	switch manifestDescriptor.MediaType {
+	case ocispecs.MediaTypeImageIndex, images.MediaTypeDockerSchema2ManifestList:
+		imageIndex, err := readIndex(imageFS, BlobPath(*manifestDescriptor))
 		if err != nil {
-			return nil, fmt.Errorf("failed to open image index file: %w", err)
-		}
-		defer imageIndexFile.Close()
-
-		var imageIndex ocispecs.Index
-		if err := json.NewDecoder(imageIndexFile).Decode(&imageIndex); err != nil {
-			return nil, fmt.Errorf("failed to unmarshal image index: %w", err)
+			return nil, nil, fmt.Errorf("failed to read image index: %w", err)
 		}
 
 		// Find the manifest for the platform.
@@ -168,7 +203,7 @@ func manifestForRef(imageFS fs.FS, ref string, platform *ocispecs.Platform) (*oc
 			}
 		} else {
 			for _, desc := range imageIndex.Manifests {
-				if platforms.NewMatcher(*platform).Match(*desc.Platform) {
+				if desc.Platform != nil && platforms.NewMatcher(*platform).Match(*desc.Platform) {
 					desc := desc
 					manifestDescriptor = &desc
 					break
@@ -177,20 +212,42 @@ func manifestForRef(imageFS fs.FS, ref string, platform *ocispecs.Platform) (*oc
 		}
 
 		if manifestDescriptor == nil {
-			return nil, fmt.Errorf("no manifest found for platform %s", platforms.Format(*platform))
+			return nil, nil, fmt.Errorf("no manifest found for platform %s", platforms.Format(*platform))
 		}
-	} else if manifestDescriptor.MediaType == ocispecs.MediaTypeImageManifest {
+	case ocispecs.MediaTypeImageManifest, images.MediaTypeDockerSchema2Manifest:
 		// Check if the platform is correct.
-		if platform != nil && !platforms.NewMatcher(*platform).Match(*manifestDescriptor.Platform) {
-			return nil, errors.New("platform is not present in image")
+		if platform != nil && manifestDescriptor.Platform != nil && !platforms.NewMatcher(*platform).Match(*manifestDescriptor.Platform) {
+			return nil, nil, errors.New("platform is not present in image")
 		}
-	} else {
-		return nil, fmt.Errorf("unexpected manifest media type: %s", manifestDescriptor.MediaType)
+	default:
+		return nil, nil, fmt.Errorf("unexpected manifest media type: %s", manifestDescriptor.MediaType)
+	}
+
+	manifest, err := readManifest(imageFS, *manifestDescriptor)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return manifestDescriptor, manifest, nil
+}
+
+func readIndex(imageFS fs.FS, name string) (*ocispecs.Index, error) {
+	indexFile, err := imageFS.Open(name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open index: %w", err)
 	}
+	defer indexFile.Close()
 
-	manifestPath := filepath.Join("blobs", string(manifestDescriptor.Digest.Algorithm()), manifestDescriptor.Digest.Encoded())
+	var index ocispecs.Index
+	if err := json.NewDecoder(indexFile).Decode(&index); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal index: %w", err)
+	}
+
+	return &index, nil
+}
 
-	manifestFile, err := imageFS.Open(manifestPath)
+func readManifest(imageFS fs.FS, manifestDescriptor ocispecs.Descriptor) (*ocispecs.Manifest, error) {
+	manifestFile, err := imageFS.Open(BlobPath(manifestDescriptor))
 	if err != nil {
 		return nil, fmt.Errorf("failed to open manifest file: %w", err)
 	}
@@ -204,6 +261,21 @@ func manifestForRef(imageFS fs.FS, ref string, platform *ocispecs.Platform) (*oc
 	return &manifest, nil
 }
 
+func readConfig(imageFS fs.FS, configDescriptor ocispecs.Descriptor) (*ocispecs.Image, error) {
+	configFile, err := imageFS.Open(BlobPath(configDescriptor))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open image config: %w", err)
+	}
+	defer configFile.Close()
+
+	var config ocispecs.Image
+	if err := json.NewDecoder(configFile).Decode(&config); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal image config: %w", err)
+	}
+
+	return &config, nil
+}
+
 func verifyImageLayoutVersion(imageFS fs.FS) error {
 	ociLayoutFile, err := imageFS.Open("oci-layout")
 	if err != nil {
@@ -224,3 +296,9 @@ func verifyImageLayoutVersion(imageFS fs.FS) error {
 
 	return nil
 }
+
+// BlobPath returns the path of the blob with the given descriptor (relative to
+// the root of the image layout).
+func BlobPath(desc ocispecs.Descriptor) string {
+	return filepath.Join("blobs", string(desc.Digest.Algorithm()), desc.Digest.Encoded())
+}
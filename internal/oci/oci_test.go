@@ -19,9 +19,12 @@
 package oci_test
 
 import (
+	"context"
 	"os"
 	"testing"
 
+	"github.com/immutos/oci2erofs/internal/image"
+	"github.com/immutos/oci2erofs/internal/layer"
 	"github.com/immutos/oci2erofs/internal/oci"
 	"github.com/immutos/oci2erofs/internal/util"
 	ocispecs "github.com/opencontainers/image-spec/specs-go/v1"
@@ -29,16 +32,24 @@ import (
 )
 
 func TestLoadImage(t *testing.T) {
+	ctx := context.Background()
 	ref := "docker.io/tianon/toybox:0.8.11"
 
 	t.Run("Single Arch", func(t *testing.T) {
-		rootFS, closeAll, err := oci.LoadImage(t.TempDir(), os.DirFS("testdata/toybox"), ref, nil)
+		img, err := oci.LoadImage(ctx, &layer.Loader{TempDir: t.TempDir()}, os.DirFS("testdata/toybox"), ref, nil)
 		require.NoError(t, err)
 		t.Cleanup(func() {
-			require.NoError(t, closeAll())
+			require.NoError(t, img.Close())
 		})
 
-		h, err := util.HashFS(rootFS)
+		require.Equal(t, "sha256:d3b7b26716e98689872d7477fe39571b2128cf3a23eea0498513a1889e86f3ce", img.ManifestDigest().String())
+		require.Equal(t, "sha256:73e30ac9c7813c3bbd8287d440e693cedb153218d1aefe616b4e1089341edbe6", img.ConfigDescriptor().Digest.String())
+		require.Equal(t, []string{"sh"}, img.Config().Config.Cmd)
+		require.Len(t, img.Layers(), 1)
+		require.Equal(t, "sha256:4e4ed2728f23408f0a3be0cf892b607bc5ec32d12941a093d001bc3de60f5425", img.Layers()[0].Digest.String())
+		require.Len(t, img.DiffIDs(), 1)
+
+		h, err := util.HashFS(img.RootFS())
 		require.NoError(t, err)
 
 		require.Equal(t, "h1:J674XgTpeE71MnUmfTovrhKIlFnWOa8rctDF6SL/Kzg=", h)
@@ -51,13 +62,15 @@ func TestLoadImage(t *testing.T) {
 				OS:           "linux",
 			}
 
-			rootFS, closeAll, err := oci.LoadImage(t.TempDir(), os.DirFS("testdata/toybox-multiarch"), ref, &platform)
+			img, err := oci.LoadImage(ctx, &layer.Loader{TempDir: t.TempDir()}, os.DirFS("testdata/toybox-multiarch"), ref, &platform)
 			require.NoError(t, err)
 			t.Cleanup(func() {
-				require.NoError(t, closeAll())
+				require.NoError(t, img.Close())
 			})
 
-			h, err := util.HashFS(rootFS)
+			require.Equal(t, platform.Architecture, img.Platform().Architecture)
+
+			h, err := util.HashFS(img.RootFS())
 			require.NoError(t, err)
 
 			require.Equal(t, "h1:J674XgTpeE71MnUmfTovrhKIlFnWOa8rctDF6SL/Kzg=", h)
@@ -69,16 +82,42 @@ func TestLoadImage(t *testing.T) {
 				OS:           "linux",
 			}
 
-			rootFS, closeAll, err := oci.LoadImage(t.TempDir(), os.DirFS("testdata/toybox-multiarch"), ref, &platform)
+			img, err := oci.LoadImage(ctx, &layer.Loader{TempDir: t.TempDir()}, os.DirFS("testdata/toybox-multiarch"), ref, &platform)
 			require.NoError(t, err)
 			t.Cleanup(func() {
-				require.NoError(t, closeAll())
+				require.NoError(t, img.Close())
 			})
 
-			h, err := util.HashFS(rootFS)
+			require.Equal(t, platform.Architecture, img.Platform().Architecture)
+
+			h, err := util.HashFS(img.RootFS())
 			require.NoError(t, err)
 
 			require.Equal(t, "h1:vep4P8xi3jVOxfV9SWQjzrHUoAIDjgYEGJ+yIYeq2JQ=", h)
 		})
 	})
 }
+
+func TestTargets(t *testing.T) {
+	ref := "docker.io/tianon/toybox:0.8.11"
+
+	t.Run("Single Arch", func(t *testing.T) {
+		targets, err := oci.Targets(os.DirFS("testdata/toybox"))
+		require.NoError(t, err)
+
+		require.Equal(t, []image.Target{
+			{Ref: ref, Platform: ocispecs.Platform{OS: "linux", Architecture: "amd64"}},
+		}, targets)
+	})
+
+	t.Run("Multi Arch", func(t *testing.T) {
+		targets, err := oci.Targets(os.DirFS("testdata/toybox-multiarch"))
+		require.NoError(t, err)
+
+		// Attestation manifests are omitted.
+		require.Equal(t, []image.Target{
+			{Ref: ref, Platform: ocispecs.Platform{OS: "linux", Architecture: "amd64"}},
+			{Ref: ref, Platform: ocispecs.Platform{OS: "linux", Architecture: "arm64", Variant: "v8"}},
+		}, targets)
+	})
+}
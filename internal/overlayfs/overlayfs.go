@@ -19,19 +19,27 @@
 package overlayfs
 
 import (
+	"archive/tar"
+	"context"
 	"errors"
 	"fmt"
 	"io/fs"
+	"path"
 	"path/filepath"
 	"slices"
 	"strings"
 
 	"github.com/dpeckett/archivefs"
+	"github.com/immutos/oci2erofs/internal/progress"
+	"github.com/immutos/oci2erofs/internal/xattr"
 )
 
 const (
 	whiteoutPrefix     = ".wh."
 	opaqueWhiteoutName = ".wh..wh..opq"
+	// maxSymlinks is the maximum number of symlinks followed when resolving a
+	// path (matching Linux's MAXSYMLINKS).
+	maxSymlinks = 40
 )
 
 var (
@@ -39,6 +47,7 @@ var (
 	_ fs.ReadDirFS         = (*FS)(nil)
 	_ fs.StatFS            = (*FS)(nil)
 	_ archivefs.ReadLinkFS = (*FS)(nil)
+	_ xattr.FS             = (*FS)(nil)
 )
 
 // FS is an overlay file system.
@@ -46,14 +55,29 @@ type FS struct {
 	root dirent
 }
 
-// New creates a new overlay file system from the given layers.
-func New(layers []fs.FS) (*FS, error) {
+// New creates a new overlay file system from the given layers. Indexing the
+// layers stops early if the context is cancelled.
+func New(ctx context.Context, layers []fs.FS) (*FS, error) {
 	root := dirent{
 		layer:     layers[len(layers)-1],
 		layerPath: ".",
 	}
 
-	for _, layer := range layers {
+	tracker := progress.Start(ctx, progress.Event{
+		Phase:  progress.PhaseIndex,
+		Layer:  1,
+		Layers: len(layers),
+	})
+
+	for i, layer := range layers {
+		if i > 0 {
+			tracker.SetLayer(i+1, "")
+		}
+
+		// The regular files of the layer keyed by the name of the file they
+		// are linked to (hardlinks can only refer to files in the same layer).
+		links := make(map[string]*hardlink)
+
 		err := fs.WalkDir(layer, ".", func(path string, d fs.DirEntry, err error) error {
 			if err != nil {
 				// Eg. dangling symlinks.
@@ -64,11 +88,17 @@ func New(layers []fs.FS) (*FS, error) {
 				return err
 			}
 
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+
 			if path == "." {
 				return nil
 			}
 
-			dir, err := resolve(&root, filepath.Dir(path))
+			tracker.AddEntries(1)
+
+			dir, err := resolve(&root, filepath.Dir(path), true)
 			if err != nil {
 				return fmt.Errorf("failed to resolve directory %q: %w", filepath.Dir(path), err)
 			}
@@ -83,11 +113,30 @@ func New(layers []fs.FS) (*FS, error) {
 				return nil
 			}
 
-			dir.addChild(&dirent{
+			child := &dirent{
 				DirEntry:  d,
 				layer:     layer,
 				layerPath: path,
-			})
+			}
+
+			if d.Type().IsRegular() {
+				fi, err := d.Info()
+				if err != nil {
+					return fmt.Errorf("failed to stat %q: %w", path, err)
+				}
+
+				key := path
+				if hdr, ok := fi.Sys().(*tar.Header); ok && hdr.Linkname != "" {
+					key = hdr.Linkname
+				}
+
+				if links[key] == nil {
+					links[key] = &hardlink{}
+				}
+				child.link = links[key]
+			}
+
+			dir.addChild(child)
 
 			return nil
 		})
@@ -96,13 +145,19 @@ func New(layers []fs.FS) (*FS, error) {
 		}
 	}
 
+	tracker.Done()
+
+	// Only the links that survived every layer (eg. the original target may
+	// have been whited out) count towards the names of a file.
+	countLinks(&root, ".")
+
 	return &FS{
 		root: root,
 	}, nil
 }
 
 func (fsys *FS) Open(name string) (fs.File, error) {
-	d, err := resolve(&fsys.root, name)
+	d, err := resolve(&fsys.root, name, true)
 	if err != nil {
 		return nil, err
 	}
@@ -110,8 +165,11 @@ func (fsys *FS) Open(name string) (fs.File, error) {
 	return d.layer.Open(d.layerPath)
 }
 
+// ReadDir returns the entries of the named directory sorted by name (whatever
+// the order of the layers' archives), so that walking the filesystem visits
+// files in a deterministic order.
 func (fsys *FS) ReadDir(name string) ([]fs.DirEntry, error) {
-	d, err := resolve(&fsys.root, name)
+	d, err := resolve(&fsys.root, name, true)
 	if err != nil {
 		return nil, err
 	}
@@ -129,7 +187,7 @@ func (fsys *FS) ReadDir(name string) ([]fs.DirEntry, error) {
 }
 
 func (fsys *FS) Stat(name string) (fs.FileInfo, error) {
-	d, err := resolve(&fsys.root, name)
+	d, err := resolve(&fsys.root, name, true)
 	if err != nil {
 		return nil, err
 	}
@@ -138,14 +196,13 @@ func (fsys *FS) Stat(name string) (fs.FileInfo, error) {
 }
 
 func (fsys *FS) ReadLink(name string) (string, error) {
-	d, err := resolve(&fsys.root, filepath.Dir(name))
+	d, err := resolve(&fsys.root, name, false)
 	if err != nil {
 		return "", err
 	}
 
-	d, found := d.findChild(filepath.Base(name))
-	if !found {
-		return "", fs.ErrNotExist
+	if d.DirEntry == nil || d.Type()&fs.ModeSymlink == 0 {
+		return "", fs.ErrInvalid
 	}
 
 	linkFS, ok := d.layer.(archivefs.ReadLinkFS)
@@ -153,85 +210,158 @@ func (fsys *FS) ReadLink(name string) (string, error) {
 		return "", fmt.Errorf("layer does not support symbolic links: %w", fs.ErrInvalid)
 	}
 
-	return linkFS.ReadLink(name)
+	return linkFS.ReadLink(d.layerPath)
 }
 
 func (fsys *FS) StatLink(name string) (fs.FileInfo, error) {
-	d, err := resolve(&fsys.root, filepath.Dir(name))
+	d, err := resolve(&fsys.root, name, false)
 	if err != nil {
 		return nil, err
 	}
 
-	d, found := d.findChild(filepath.Base(name))
-	if !found {
-		return nil, fs.ErrNotExist
-	}
-
 	linkFS, ok := d.layer.(archivefs.ReadLinkFS)
 	if !ok {
 		return nil, fmt.Errorf("layer does not support symbolic links: %w", fs.ErrInvalid)
 	}
 
-	return linkFS.StatLink(name)
+	return linkFS.StatLink(d.layerPath)
 }
 
-// resolve resolves the given path to a dirent.
-func resolve(root *dirent, name string) (*dirent, error) {
-	d := root
+// Xattrs returns the extended attributes of the named file (without following
+// symbolic links). Like the rest of the file's metadata, they are taken from
+// the uppermost layer containing the file.
+func (fsys *FS) Xattrs(name string) (map[string]string, error) {
+	d, err := resolve(&fsys.root, name, false)
+	if err != nil {
+		return nil, err
+	}
+
+	xfs, ok := d.layer.(xattr.FS)
+	if !ok {
+		return nil, nil
+	}
+
+	return xfs.Xattrs(d.layerPath)
+}
 
-	name = sanitizePath(name)
-	if name == "" {
-		return d, nil
+// Hardlink returns the name of the first file (in lexical order) that the
+// named file is a hardlink of, and the number of names the file has. A file
+// that isn't hardlinked (or isn't a regular file) is its own first name, with
+// a single name.
+func (fsys *FS) Hardlink(name string) (string, int, error) {
+	d, err := resolve(&fsys.root, name, false)
+	if err != nil {
+		return "", 0, err
+	}
+
+	if d.link == nil || d.link.nlink < 2 {
+		return path.Clean(name), 1, nil
+	}
+
+	return d.link.first, d.link.nlink, nil
+}
+
+// countLinks visits the dirents in lexical order (parents before their
+// children, the same order as fs.WalkDir), recording the first name and the
+// number of names of each hardlinked file.
+func countLinks(d *dirent, name string) {
+	if d.link != nil {
+		if d.link.nlink == 0 {
+			d.link.first = name
+		}
+		d.link.nlink++
 	}
 
-	for _, component := range strings.Split(name, "/") {
-		var found bool
-		d, found = d.findChild(component)
+	if d.DirEntry != nil && !d.IsDir() {
+		return
+	}
+
+	names := make([]string, 0, len(d.children))
+	for childName := range d.children {
+		names = append(names, childName)
+	}
+	slices.Sort(names)
+
+	for _, childName := range names {
+		countLinks(d.children[childName], path.Join(name, childName))
+	}
+}
+
+// resolve resolves the given path to a dirent, following symlinks in all but
+// the final path component (and the final component too, if follow is set).
+func resolve(root *dirent, name string, follow bool) (*dirent, error) {
+	d := root
+
+	var links int
+	components := strings.Split(filepath.ToSlash(name), "/")
+	for len(components) > 0 {
+		component := components[0]
+		components = components[1:]
+
+		switch component {
+		case "", ".":
+			continue
+		case "..":
+			if d.parent != nil {
+				d = d.parent
+			}
+			continue
+		}
+
+		child, found := d.findChild(component)
 		if !found {
 			return nil, fs.ErrNotExist
 		}
 
-		if d.Type()&fs.ModeSymlink != 0 {
-			linkFS, ok := d.layer.(archivefs.ReadLinkFS)
+		if child.Type()&fs.ModeSymlink != 0 && (follow || len(components) > 0) {
+			links++
+			if links > maxSymlinks {
+				return nil, errors.New("too many levels of symbolic links")
+			}
+
+			linkFS, ok := child.layer.(archivefs.ReadLinkFS)
 			if !ok {
 				return nil, fmt.Errorf("layer does not support symbolic links: %w", fs.ErrInvalid)
 			}
 
 			// Read the symlink target.
-			target, err := linkFS.ReadLink(d.layerPath)
+			target, err := linkFS.ReadLink(child.layerPath)
 			if err != nil {
 				return nil, err
 			}
 
-			// Resolve the target.
-			if !filepath.IsAbs(target) && d.parent != nil {
-				d, err = resolve(d.parent, target)
-				if err != nil {
-					return nil, err
-				}
-			} else {
-				// The target is an absolute path or the dirent is the root dirent.
-				d, err = resolve(root, target)
-				if err != nil {
-					return nil, err
-				}
+			// Absolute targets are resolved from the root, relative targets
+			// from the directory containing the symlink.
+			if path.IsAbs(target) {
+				d = root
 			}
+
+			components = append(strings.Split(target, "/"), components...)
+			continue
 		}
+
+		d = child
 	}
 
 	return d, nil
 }
 
-func sanitizePath(name string) string {
-	return strings.TrimPrefix(strings.TrimPrefix(filepath.Clean(filepath.ToSlash(strings.TrimSpace(name))), "."), "/")
-}
-
 type dirent struct {
 	fs.DirEntry
 	layer     fs.FS
 	layerPath string
 	parent    *dirent
 	children  map[string]*dirent
+	// link is shared by the regular files that are hardlinks of each other.
+	link *hardlink
+}
+
+// hardlink is a file with (potentially) several names.
+type hardlink struct {
+	// first is the first name of the file in lexical order.
+	first string
+	// nlink is the number of names of the file.
+	nlink int
 }
 
 func (d *dirent) findChild(name string) (*dirent, bool) {
@@ -19,16 +19,20 @@
 package overlayfs_test
 
 import (
+	"archive/tar"
+	"context"
 	"io"
 	"io/fs"
 	"os"
 	"path/filepath"
+	"slices"
 	"strings"
 	"testing"
 
-	"github.com/dpeckett/archivefs/tarfs"
 	"github.com/dpeckett/uncompr"
 	"github.com/immutos/oci2erofs/internal/overlayfs"
+	"github.com/immutos/oci2erofs/internal/tarfs"
+	"github.com/immutos/oci2erofs/internal/tarfs/tarfstest"
 	"github.com/rogpeppe/go-internal/dirhash"
 	"github.com/stretchr/testify/require"
 )
@@ -79,7 +83,7 @@ func TestOverlayFS(t *testing.T) {
 		require.NoError(t, err)
 	}
 
-	fsys, err := overlayfs.New(layers)
+	fsys, err := overlayfs.New(context.Background(), layers)
 	require.NoError(t, err)
 
 	t.Run("Open", func(t *testing.T) {
@@ -352,3 +356,271 @@ func TestOverlayFS(t *testing.T) {
 		require.Equal(t, "h1:hJbAbj8GzqpjzKJ7vPyenrzI/QB2YfM5RtMYnVrwiSo=", h)
 	})
 }
+
+func TestOverlayFSSymlinks(t *testing.T) {
+	lower := tarfstest.NewLayer(t, []tar.Header{
+		{Typeflag: tar.TypeReg, Name: "usr/bin/busybox", Mode: 0o755, Size: int64(len("busybox"))},
+		{Typeflag: tar.TypeSymlink, Name: "bin", Linkname: "usr/bin"},
+		{Typeflag: tar.TypeSymlink, Name: "usr/bin/sh", Linkname: "../../bin/busybox"},
+	})
+
+	upper := tarfstest.NewLayer(t, []tar.Header{
+		{Typeflag: tar.TypeSymlink, Name: "usr/bin/ls", Linkname: "busybox"},
+	})
+
+	fsys, err := overlayfs.New(context.Background(), []fs.FS{lower, upper})
+	require.NoError(t, err)
+
+	t.Run("Parent Directory", func(t *testing.T) {
+		data, err := fs.ReadFile(fsys, "usr/bin/sh")
+		require.NoError(t, err)
+		require.Equal(t, "busybox", string(data))
+	})
+
+	t.Run("Symlink Parent", func(t *testing.T) {
+		target, err := fsys.ReadLink("bin/ls")
+		require.NoError(t, err)
+		require.Equal(t, "busybox", target)
+
+		fi, err := fsys.StatLink("bin/ls")
+		require.NoError(t, err)
+		require.Equal(t, fs.ModeSymlink, fi.Mode().Type())
+	})
+
+	t.Run("Root", func(t *testing.T) {
+		fi, err := fsys.StatLink(".")
+		require.NoError(t, err)
+		require.True(t, fi.IsDir())
+	})
+
+	t.Run("Cancelled", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		_, err := overlayfs.New(ctx, []fs.FS{lower, upper})
+		require.ErrorIs(t, err, context.Canceled)
+	})
+}
+
+func TestOverlayFSXattrs(t *testing.T) {
+	lower := tarfstest.NewLayer(t, []tar.Header{
+		{Typeflag: tar.TypeDir, Name: "etc/", Mode: 0o755, PAXRecords: map[string]string{
+			"SCHILY.xattr.user.dir": "lower",
+		}},
+		{Typeflag: tar.TypeDir, Name: "usr/", Mode: 0o755, PAXRecords: map[string]string{
+			"SCHILY.xattr.user.dir": "lower",
+		}},
+		{Typeflag: tar.TypeReg, Name: "usr/ping", Mode: 0o755, PAXRecords: map[string]string{
+			"SCHILY.xattr.security.capability": "lower",
+			"SCHILY.xattr.user.comment":        "lower",
+		}},
+		{Typeflag: tar.TypeReg, Name: "usr/ls", Mode: 0o755, PAXRecords: map[string]string{
+			"LIBARCHIVE.xattr.user.comment": "bG93ZXI",
+		}},
+	})
+
+	upper := tarfstest.NewLayer(t, []tar.Header{
+		{Typeflag: tar.TypeDir, Name: "usr/", Mode: 0o755},
+		{Typeflag: tar.TypeReg, Name: "usr/ping", Mode: 0o755, PAXRecords: map[string]string{
+			"SCHILY.xattr.security.capability": "upper",
+		}},
+		{Typeflag: tar.TypeSymlink, Name: "ping", Linkname: "usr/ping", PAXRecords: map[string]string{
+			"SCHILY.xattr.security.selinux": "upper",
+		}},
+	})
+
+	fsys, err := overlayfs.New(context.Background(), []fs.FS{lower, upper})
+	require.NoError(t, err)
+
+	t.Run("Upper", func(t *testing.T) {
+		attrs, err := fsys.Xattrs("usr/ping")
+		require.NoError(t, err)
+		require.Equal(t, map[string]string{"security.capability": "upper"}, attrs)
+
+		attrs, err = fsys.Xattrs("usr")
+		require.NoError(t, err)
+		require.Empty(t, attrs)
+	})
+
+	t.Run("Lower", func(t *testing.T) {
+		attrs, err := fsys.Xattrs("etc")
+		require.NoError(t, err)
+		require.Equal(t, map[string]string{"user.dir": "lower"}, attrs)
+
+		attrs, err = fsys.Xattrs("usr/ls")
+		require.NoError(t, err)
+		require.Equal(t, map[string]string{"user.comment": "lower"}, attrs)
+	})
+
+	t.Run("Symlink", func(t *testing.T) {
+		attrs, err := fsys.Xattrs("ping")
+		require.NoError(t, err)
+		require.Equal(t, map[string]string{"security.selinux": "upper"}, attrs)
+	})
+
+	t.Run("Not Exist", func(t *testing.T) {
+		_, err := fsys.Xattrs("usr/bang")
+		require.ErrorIs(t, err, fs.ErrNotExist)
+	})
+}
+
+func TestOverlayFSHardlinks(t *testing.T) {
+	lower := tarfstest.NewLayer(t, []tar.Header{
+		{Typeflag: tar.TypeReg, Name: "usr/bin/busybox", Mode: 0o755, Size: int64(len("busybox"))},
+		{Typeflag: tar.TypeLink, Name: "usr/bin/sh", Linkname: "usr/bin/busybox"},
+		{Typeflag: tar.TypeLink, Name: "usr/bin/ls", Linkname: "usr/bin/busybox"},
+		{Typeflag: tar.TypeReg, Name: "etc/passwd", Mode: 0o644, Size: int64(len("passwd"))},
+		{Typeflag: tar.TypeLink, Name: "etc/passwd-", Linkname: "etc/passwd"},
+		{Typeflag: tar.TypeReg, Name: "etc/group", Mode: 0o644, Size: int64(len("group"))},
+		{Typeflag: tar.TypeLink, Name: "etc/group-", Linkname: "etc/group"},
+		{Typeflag: tar.TypeSymlink, Name: "etc/localtime", Linkname: "../usr/share/zoneinfo/UTC"},
+		{Typeflag: tar.TypeLink, Name: "etc/timezone", Linkname: "etc/localtime"},
+	})
+
+	upper := tarfstest.NewLayer(t, []tar.Header{
+		{Typeflag: tar.TypeReg, Name: "usr/bin/.wh.busybox"},
+		{Typeflag: tar.TypeReg, Name: "etc/.wh.passwd"},
+		{Typeflag: tar.TypeReg, Name: "etc/group", Mode: 0o644, Size: int64(len("group"))},
+	})
+
+	fsys, err := overlayfs.New(context.Background(), []fs.FS{lower, upper})
+	require.NoError(t, err)
+
+	t.Run("Whited Out Target", func(t *testing.T) {
+		first, nlink, err := fsys.Hardlink("usr/bin/sh")
+		require.NoError(t, err)
+		require.Equal(t, "usr/bin/ls", first)
+		require.Equal(t, 2, nlink)
+
+		first, nlink, err = fsys.Hardlink("usr/bin/ls")
+		require.NoError(t, err)
+		require.Equal(t, "usr/bin/ls", first)
+		require.Equal(t, 2, nlink)
+
+		data, err := fs.ReadFile(fsys, "usr/bin/sh")
+		require.NoError(t, err)
+		require.Equal(t, "busybox", string(data))
+	})
+
+	t.Run("Single Link", func(t *testing.T) {
+		first, nlink, err := fsys.Hardlink("etc/passwd-")
+		require.NoError(t, err)
+		require.Equal(t, "etc/passwd-", first)
+		require.Equal(t, 1, nlink)
+
+		data, err := fs.ReadFile(fsys, "etc/passwd-")
+		require.NoError(t, err)
+		require.Equal(t, "passwd", string(data))
+	})
+
+	t.Run("Replaced Target", func(t *testing.T) {
+		first, nlink, err := fsys.Hardlink("etc/group")
+		require.NoError(t, err)
+		require.Equal(t, "etc/group", first)
+		require.Equal(t, 1, nlink)
+
+		first, nlink, err = fsys.Hardlink("etc/group-")
+		require.NoError(t, err)
+		require.Equal(t, "etc/group-", first)
+		require.Equal(t, 1, nlink)
+	})
+
+	t.Run("Symlink", func(t *testing.T) {
+		target, err := fsys.ReadLink("etc/timezone")
+		require.NoError(t, err)
+		require.Equal(t, "../usr/share/zoneinfo/UTC", target)
+
+		first, nlink, err := fsys.Hardlink("etc/timezone")
+		require.NoError(t, err)
+		require.Equal(t, "etc/timezone", first)
+		require.Equal(t, 1, nlink)
+	})
+
+	t.Run("Directory", func(t *testing.T) {
+		first, nlink, err := fsys.Hardlink("usr/bin")
+		require.NoError(t, err)
+		require.Equal(t, "usr/bin", first)
+		require.Equal(t, 1, nlink)
+	})
+
+	t.Run("Not Exist", func(t *testing.T) {
+		_, _, err := fsys.Hardlink("usr/bin/busybox")
+		require.ErrorIs(t, err, fs.ErrNotExist)
+	})
+}
+
+func TestOverlayFSDevices(t *testing.T) {
+	lower := tarfstest.NewLayer(t, []tar.Header{
+		{Typeflag: tar.TypeChar, Name: "dev/null", Mode: 0o666, Devmajor: 1, Devminor: 3},
+		{Typeflag: tar.TypeChar, Name: "dev/tty", Mode: 0o666, Devmajor: 5},
+	})
+
+	upper := tarfstest.NewLayer(t, []tar.Header{
+		{Typeflag: tar.TypeChar, Name: "dev/console", Mode: 0o600, Devmajor: 5, Devminor: 1},
+		{Typeflag: tar.TypeFifo, Name: "dev/initctl", Mode: 0o600},
+		{Typeflag: tar.TypeReg, Name: "dev/.wh.tty"},
+	})
+
+	fsys, err := overlayfs.New(context.Background(), []fs.FS{lower, upper})
+	require.NoError(t, err)
+
+	entries, err := fs.ReadDir(fsys, "dev")
+	require.NoError(t, err)
+	require.Len(t, entries, 3)
+
+	fi, err := fsys.StatLink("dev/null")
+	require.NoError(t, err)
+	require.Equal(t, fs.ModeDevice|fs.ModeCharDevice|0o666, fi.Mode())
+	require.Equal(t, int64(1), fi.Sys().(*tar.Header).Devmajor)
+	require.Equal(t, int64(3), fi.Sys().(*tar.Header).Devminor)
+
+	fi, err = fsys.StatLink("dev/initctl")
+	require.NoError(t, err)
+	require.Equal(t, fs.ModeNamedPipe|0o600, fi.Mode())
+
+	_, err = fsys.StatLink("dev/tty")
+	require.ErrorIs(t, err, fs.ErrNotExist)
+}
+
+func TestOverlayFSReadDirOrder(t *testing.T) {
+	lowerHdrs := []tar.Header{
+		{Typeflag: tar.TypeDir, Name: "etc/", Mode: 0o755},
+		{Typeflag: tar.TypeReg, Name: "etc/passwd", Mode: 0o644},
+		{Typeflag: tar.TypeReg, Name: "etc/group", Mode: 0o644},
+		{Typeflag: tar.TypeReg, Name: "etc/hosts", Mode: 0o644},
+		{Typeflag: tar.TypeReg, Name: "etc/fstab", Mode: 0o644},
+	}
+
+	upperHdrs := []tar.Header{
+		{Typeflag: tar.TypeReg, Name: "etc/shadow", Mode: 0o600},
+		{Typeflag: tar.TypeReg, Name: "etc/.wh.hosts"},
+		{Typeflag: tar.TypeReg, Name: "etc/adduser.conf", Mode: 0o644},
+	}
+
+	names := func(t *testing.T, lowerHdrs, upperHdrs []tar.Header) []string {
+		fsys, err := overlayfs.New(context.Background(), []fs.FS{tarfstest.NewLayer(t, lowerHdrs), tarfstest.NewLayer(t, upperHdrs)})
+		require.NoError(t, err)
+
+		entries, err := fsys.ReadDir("etc")
+		require.NoError(t, err)
+
+		var names []string
+		for _, entry := range entries {
+			names = append(names, entry.Name())
+		}
+
+		return names
+	}
+
+	expected := []string{"adduser.conf", "fstab", "group", "passwd", "shadow"}
+
+	// Repeatedly, as the entries of a directory are held in a map.
+	for i := 0; i < 10; i++ {
+		require.Equal(t, expected, names(t, lowerHdrs, upperHdrs))
+	}
+
+	// Whatever the order of the layers' archives.
+	slices.Reverse(lowerHdrs[1:])
+	slices.Reverse(upperHdrs)
+	require.Equal(t, expected, names(t, lowerHdrs, upperHdrs))
+}
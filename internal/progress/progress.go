@@ -0,0 +1,257 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+// Package progress reports the progress of long running operations (eg.
+// decompressing layers, and writing filesystem images).
+package progress
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+)
+
+// Interval is the minimum interval between (incomplete) progress events
+// reported for an operation.
+const Interval = 200 * time.Millisecond
+
+// Phase is a phase of a conversion.
+type Phase string
+
+const (
+	// PhaseDecompress is the decompression (and verification) of a layer.
+	PhaseDecompress Phase = "decompress"
+	// PhaseIndex is the indexing of the layers into the merged root
+	// filesystem.
+	PhaseIndex Phase = "index"
+	// PhaseWrite is the writing of the EROFS filesystem image.
+	PhaseWrite Phase = "write"
+)
+
+// Event describes the progress of an operation.
+type Event struct {
+	// Phase is the phase of the conversion.
+	Phase Phase
+	// Layer is the (one based) position of the layer being processed, or
+	// zero if the operation does not relate to a single layer.
+	Layer int
+	// Layers is the number of layers in the image (if known).
+	Layers int
+	// Digest is the diffID of the layer being processed (if any).
+	Digest digest.Digest
+	// Bytes is the number of bytes processed so far. For layers, this is the
+	// number of bytes of the layer (as stored) that have been read. When
+	// writing, it is the number of bytes written.
+	Bytes int64
+	// TotalBytes is the total number of bytes to process, or zero if unknown.
+	TotalBytes int64
+	// Entries is the number of filesystem entries processed so far.
+	Entries int64
+	// Elapsed is the time since the operation started.
+	Elapsed time.Duration
+	// BytesPerSecond is the average throughput of the operation.
+	BytesPerSecond float64
+	// Done is true for the final event of an operation.
+	Done bool
+}
+
+// Func receives progress events. It may be called concurrently (for
+// operations that run in parallel, such as the loading of layers).
+type Func func(Event)
+
+type funcKey struct{}
+type trackerKey struct{}
+
+// WithFunc returns a context in which progress events are reported to fn.
+func WithFunc(ctx context.Context, fn Func) context.Context {
+	return context.WithValue(ctx, funcKey{}, fn)
+}
+
+// Observe returns a context in which progress events are reported to fn, as
+// well as to any Func already in the context.
+func Observe(ctx context.Context, fn Func) context.Context {
+	next, _ := ctx.Value(funcKey{}).(Func)
+	if next == nil {
+		return WithFunc(ctx, fn)
+	}
+
+	return WithFunc(ctx, func(ev Event) {
+		fn(ev)
+		next(ev)
+	})
+}
+
+// Tracker tracks the progress of an operation. A nil Tracker discards all
+// progress, so callers don't need to check whether progress is reported.
+type Tracker struct {
+	fn    Func
+	mu    sync.Mutex
+	ev    Event
+	start time.Time
+	last  time.Time
+}
+
+// Start starts tracking an operation, returning nil if the context does not
+// report progress. The initial event is reported immediately.
+func Start(ctx context.Context, ev Event) *Tracker {
+	fn, _ := ctx.Value(funcKey{}).(Func)
+	if fn == nil {
+		return nil
+	}
+
+	now := time.Now()
+	t := &Tracker{fn: fn, ev: ev, start: now, last: now}
+	fn(ev)
+
+	return t
+}
+
+// WithTracker returns a context carrying t, so that nested operations can
+// report against it (see FromContext).
+func WithTracker(ctx context.Context, t *Tracker) context.Context {
+	return context.WithValue(ctx, trackerKey{}, t)
+}
+
+// FromContext returns the tracker carried by the context (or nil).
+func FromContext(ctx context.Context) *Tracker {
+	t, _ := ctx.Value(trackerKey{}).(*Tracker)
+	return t
+}
+
+// SetTotal sets the total number of bytes to process.
+func (t *Tracker) SetTotal(n int64) {
+	if t == nil {
+		return
+	}
+
+	t.update(func(ev *Event) { ev.TotalBytes = n }, false)
+}
+
+// SetLayer sets the layer currently being processed.
+func (t *Tracker) SetLayer(layer int, dgst digest.Digest) {
+	if t == nil {
+		return
+	}
+
+	t.update(func(ev *Event) {
+		ev.Layer = layer
+		ev.Digest = dgst
+	}, false)
+}
+
+// AddBytes records that n more bytes have been processed.
+func (t *Tracker) AddBytes(n int64) {
+	if t == nil {
+		return
+	}
+
+	t.update(func(ev *Event) { ev.Bytes += n }, false)
+}
+
+// AddEntries records that n more filesystem entries have been processed.
+func (t *Tracker) AddEntries(n int64) {
+	if t == nil {
+		return
+	}
+
+	t.update(func(ev *Event) { ev.Entries += n }, false)
+}
+
+// Done reports the completion of the operation.
+func (t *Tracker) Done() {
+	if t == nil {
+		return
+	}
+
+	t.update(func(ev *Event) { ev.Done = true }, true)
+}
+
+// Reader returns a reader that records the bytes read from r.
+func (t *Tracker) Reader(r io.Reader) io.Reader {
+	if t == nil {
+		return r
+	}
+
+	return &reader{t: t, r: r}
+}
+
+// WriterAt returns a writer that records the bytes written to w.
+func (t *Tracker) WriterAt(w io.WriterAt) io.WriterAt {
+	if t == nil {
+		return w
+	}
+
+	return &writerAt{t: t, w: w}
+}
+
+// update applies fn to the current event, reporting it if the interval has
+// elapsed since the last report (or if force is set). Events are reported
+// with the lock held, so that they are delivered in order.
+func (t *Tracker) update(fn func(ev *Event), force bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.ev.Done {
+		return
+	}
+
+	fn(&t.ev)
+
+	now := time.Now()
+	if !force && now.Sub(t.last) < Interval {
+		return
+	}
+	t.last = now
+
+	ev := t.ev
+	ev.Elapsed = now.Sub(t.start)
+	if seconds := ev.Elapsed.Seconds(); seconds > 0 {
+		ev.BytesPerSecond = float64(ev.Bytes) / seconds
+	}
+
+	t.fn(ev)
+}
+
+type reader struct {
+	t *Tracker
+	r io.Reader
+}
+
+func (r *reader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if n > 0 {
+		r.t.AddBytes(int64(n))
+	}
+	return n, err
+}
+
+type writerAt struct {
+	t *Tracker
+	w io.WriterAt
+}
+
+func (w *writerAt) WriteAt(p []byte, off int64) (int, error) {
+	n, err := w.w.WriteAt(p, off)
+	if n > 0 {
+		w.t.AddBytes(int64(n))
+	}
+	return n, err
+}
@@ -0,0 +1,112 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package progress_test
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log/slog"
+	"strings"
+	"testing"
+
+	"github.com/immutos/oci2erofs/internal/progress"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTracker(t *testing.T) {
+	t.Run("Reader", func(t *testing.T) {
+		var events []progress.Event
+		ctx := progress.WithFunc(context.Background(), func(ev progress.Event) {
+			events = append(events, ev)
+		})
+
+		tracker := progress.Start(ctx, progress.Event{Phase: progress.PhaseDecompress, Layer: 1, Layers: 2})
+		tracker.SetTotal(1024)
+
+		n, err := io.Copy(io.Discard, tracker.Reader(bytes.NewReader(make([]byte, 1024))))
+		require.NoError(t, err)
+		require.Equal(t, int64(1024), n)
+
+		tracker.Done()
+		// Events following completion are ignored.
+		tracker.AddBytes(1)
+
+		require.GreaterOrEqual(t, len(events), 2)
+		require.Equal(t, progress.Event{Phase: progress.PhaseDecompress, Layer: 1, Layers: 2}, events[0])
+
+		last := events[len(events)-1]
+		require.True(t, last.Done)
+		require.Equal(t, int64(1024), last.Bytes)
+		require.Equal(t, int64(1024), last.TotalBytes)
+	})
+
+	t.Run("Nil", func(t *testing.T) {
+		tracker := progress.Start(context.Background(), progress.Event{Phase: progress.PhaseWrite})
+		require.Nil(t, tracker)
+
+		r := strings.NewReader("hello")
+		require.Equal(t, io.Reader(r), tracker.Reader(r))
+
+		tracker.AddBytes(5)
+		tracker.Done()
+
+		require.Nil(t, progress.FromContext(context.Background()))
+	})
+}
+
+func TestDescribe(t *testing.T) {
+	require.Equal(t, "Decompressing layer 2/3 [===============               ]  50% 1.0 KiB/2.0 KiB (512 B/s)", progress.Describe(progress.Event{
+		Phase:          progress.PhaseDecompress,
+		Layer:          2,
+		Layers:         3,
+		Bytes:          1024,
+		TotalBytes:     2048,
+		BytesPerSecond: 512,
+	}))
+
+	require.Equal(t, "Indexing layer 1/1 (42 entries) done", progress.Describe(progress.Event{
+		Phase:   progress.PhaseIndex,
+		Layer:   1,
+		Layers:  1,
+		Entries: 42,
+		Done:    true,
+	}))
+
+	require.Equal(t, "Writing EROFS image 1.5 MiB", progress.Describe(progress.Event{
+		Phase: progress.PhaseWrite,
+		Bytes: 3 << 19,
+	}))
+}
+
+func TestLog(t *testing.T) {
+	var buf bytes.Buffer
+	report := progress.Log(slog.New(slog.NewTextHandler(&buf, nil)))
+
+	report(progress.Event{Phase: progress.PhaseWrite, Bytes: 1})
+	// Rate limited.
+	report(progress.Event{Phase: progress.PhaseWrite, Bytes: 2})
+	report(progress.Event{Phase: progress.PhaseWrite, Bytes: 3, Done: true})
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	require.Len(t, lines, 2)
+	require.Contains(t, lines[0], "phase=write bytes=1")
+	require.Contains(t, lines[1], "bytes=3")
+	require.Contains(t, lines[1], "done=true")
+}
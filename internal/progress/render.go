@@ -0,0 +1,187 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package progress
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LogInterval is the minimum interval between log lines for an (incomplete)
+// operation.
+const LogInterval = 5 * time.Second
+
+// barWidth is the width in characters of a progress bar.
+const barWidth = 30
+
+// Bar renders progress events as a single, continually updated, line on a
+// terminal.
+type Bar struct {
+	w       io.Writer
+	mu      sync.Mutex
+	pending bool
+}
+
+// NewBar returns a progress bar that renders to w.
+func NewBar(w io.Writer) *Bar {
+	return &Bar{w: w}
+}
+
+// Report renders the event, it is a Func.
+func (b *Bar) Report(ev Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	// Overwrite the current line.
+	fmt.Fprintf(b.w, "\r\x1b[K%s", Describe(ev))
+	b.pending = true
+
+	// The filesystem image is the last thing written.
+	if ev.Phase == PhaseWrite && ev.Done {
+		fmt.Fprintln(b.w)
+		b.pending = false
+	}
+}
+
+// Close terminates the line of an incomplete progress bar (eg. following an
+// error).
+func (b *Bar) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.pending {
+		fmt.Fprintln(b.w)
+		b.pending = false
+	}
+
+	return nil
+}
+
+// Log returns a Func that logs progress events to logger, at most once every
+// LogInterval per operation (and on completion).
+func Log(logger *slog.Logger) Func {
+	var mu sync.Mutex
+	last := make(map[string]time.Time)
+
+	return func(ev Event) {
+		key := fmt.Sprintf("%s/%d", ev.Phase, ev.Layer)
+
+		mu.Lock()
+		now := time.Now()
+		if t, ok := last[key]; ok && !ev.Done && now.Sub(t) < LogInterval {
+			mu.Unlock()
+			return
+		}
+		last[key] = now
+		if ev.Done {
+			delete(last, key)
+		}
+		mu.Unlock()
+
+		attrs := []any{slog.String("phase", string(ev.Phase))}
+		if ev.Layer > 0 {
+			attrs = append(attrs, slog.Int("layer", ev.Layer))
+		}
+		if ev.Layers > 0 {
+			attrs = append(attrs, slog.Int("layers", ev.Layers))
+		}
+		if ev.Digest != "" {
+			attrs = append(attrs, slog.String("digest", ev.Digest.String()))
+		}
+		if ev.Phase == PhaseIndex {
+			attrs = append(attrs, slog.Int64("entries", ev.Entries))
+		} else {
+			attrs = append(attrs, slog.Int64("bytes", ev.Bytes))
+			if ev.TotalBytes > 0 {
+				attrs = append(attrs, slog.Int64("totalBytes", ev.TotalBytes))
+			}
+			attrs = append(attrs, slog.Int64("bytesPerSecond", int64(ev.BytesPerSecond)))
+		}
+		attrs = append(attrs, slog.Duration("elapsed", ev.Elapsed), slog.Bool("done", ev.Done))
+
+		logger.Info("Progress", attrs...)
+	}
+}
+
+// Describe returns a human readable description of the event.
+func Describe(ev Event) string {
+	var sb strings.Builder
+
+	switch ev.Phase {
+	case PhaseDecompress:
+		sb.WriteString("Decompressing layer")
+	case PhaseIndex:
+		sb.WriteString("Indexing layer")
+	case PhaseWrite:
+		sb.WriteString("Writing EROFS image")
+	default:
+		sb.WriteString(string(ev.Phase))
+	}
+
+	if ev.Layer > 0 {
+		fmt.Fprintf(&sb, " %d", ev.Layer)
+		if ev.Layers > 0 {
+			fmt.Fprintf(&sb, "/%d", ev.Layers)
+		}
+	}
+
+	if ev.Phase == PhaseIndex {
+		fmt.Fprintf(&sb, " (%d entries)", ev.Entries)
+	} else {
+		if ev.TotalBytes > 0 {
+			fraction := min(float64(ev.Bytes)/float64(ev.TotalBytes), 1)
+			filled := int(fraction * barWidth)
+			fmt.Fprintf(&sb, " [%s%s] %3.0f%% %s/%s", strings.Repeat("=", filled),
+				strings.Repeat(" ", barWidth-filled), fraction*100,
+				FormatBytes(ev.Bytes), FormatBytes(ev.TotalBytes))
+		} else {
+			fmt.Fprintf(&sb, " %s", FormatBytes(ev.Bytes))
+		}
+
+		if ev.BytesPerSecond > 0 {
+			fmt.Fprintf(&sb, " (%s/s)", FormatBytes(int64(ev.BytesPerSecond)))
+		}
+	}
+
+	if ev.Done {
+		sb.WriteString(" done")
+	}
+
+	return sb.String()
+}
+
+// FormatBytes formats a number of bytes with a binary unit suffix.
+func FormatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,256 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package registry
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/remotes"
+	"github.com/opencontainers/go-digest"
+	specs "github.com/opencontainers/image-spec/specs-go"
+	ocispecs "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Maximum size of a manifest or index that will be buffered in memory.
+const maxManifestSize = 4 << 20
+
+var _ fs.FS = (*ImageFS)(nil)
+
+// ImageFS presents an image in a remote registry as a read-only OCI image
+// layout. Blobs are streamed from the registry when they are opened.
+type ImageFS struct {
+	// The filesystem interface has no way to pass a context through to Open.
+	ctx         context.Context
+	fetcher     remotes.Fetcher
+	index       []byte
+	mu          sync.Mutex
+	descriptors map[digest.Digest]ocispecs.Descriptor
+}
+
+// NewImageFS resolves the given image reference and returns an OCI image
+// layout backed by the registry. The layout contains a single index entry
+// for the resolved manifest (or index), annotated with the fully qualified
+// reference.
+func NewImageFS(ctx context.Context, resolver remotes.Resolver, ref string) (*ImageFS, error) {
+	ctx = withLogger(ctx)
+
+	name, err := ParseReference(ref)
+	if err != nil {
+		return nil, err
+	}
+
+	name, desc, err := resolver.Resolve(ctx, name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve %q: %w", name, err)
+	}
+
+	fetcher, err := resolver.Fetcher(ctx, name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create fetcher: %w", err)
+	}
+
+	desc.Annotations = map[string]string{
+		ocispecs.AnnotationRefName: name,
+	}
+
+	index, err := json.Marshal(ocispecs.Index{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ocispecs.MediaTypeImageIndex,
+		Manifests: []ocispecs.Descriptor{desc},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal index: %w", err)
+	}
+
+	return &ImageFS{
+		ctx:     ctx,
+		fetcher: fetcher,
+		index:   index,
+		descriptors: map[digest.Digest]ocispecs.Descriptor{
+			desc.Digest: desc,
+		},
+	}, nil
+}
+
+func (fsys *ImageFS) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+
+	switch name {
+	case ocispecs.ImageLayoutFile:
+		layout, err := json.Marshal(ocispecs.ImageLayout{Version: ocispecs.ImageLayoutVersion})
+		if err != nil {
+			return nil, err
+		}
+
+		return newBytesFile(name, layout), nil
+	case "index.json":
+		return newBytesFile(name, fsys.index), nil
+	}
+
+	dir, encoded := path.Split(name)
+	if !strings.HasPrefix(dir, ocispecs.ImageBlobsDir+"/") {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+
+	dgst := digest.NewDigestFromEncoded(digest.Algorithm(path.Base(dir)), encoded)
+	if err := dgst.Validate(); err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+
+	fsys.mu.Lock()
+	desc, ok := fsys.descriptors[dgst]
+	fsys.mu.Unlock()
+	if !ok {
+		desc = ocispecs.Descriptor{Digest: dgst, Size: -1}
+	}
+
+	rc, err := fsys.fetcher.Fetch(fsys.ctx, desc)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fmt.Errorf("failed to fetch blob: %w", err)}
+	}
+
+	if !isManifest(desc.MediaType) {
+		return &file{
+			Reader: &verifyingReader{r: rc, verifier: dgst.Verifier()},
+			closer: rc,
+			info:   fileInfo{name: encoded, size: desc.Size},
+		}, nil
+	}
+
+	// Manifests are small, so buffer them in memory so that we can record
+	// the descriptors of their children (the registry needs to know the
+	// media type of a blob to know how to fetch it).
+	defer rc.Close()
+
+	data, err := io.ReadAll(io.LimitReader(rc, maxManifestSize))
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fmt.Errorf("failed to read manifest: %w", err)}
+	}
+
+	if dgst.Algorithm().FromBytes(data) != dgst {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fmt.Errorf("digest mismatch for manifest %s", dgst)}
+	}
+
+	if err := fsys.recordChildren(data); err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+
+	return newBytesFile(encoded, data), nil
+}
+
+// recordChildren records the descriptors referenced by a manifest or index.
+func (fsys *ImageFS) recordChildren(data []byte) error {
+	var manifest struct {
+		Manifests []ocispecs.Descriptor `json:"manifests"`
+		Config    *ocispecs.Descriptor  `json:"config"`
+		Layers    []ocispecs.Descriptor `json:"layers"`
+	}
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return fmt.Errorf("failed to unmarshal manifest: %w", err)
+	}
+
+	children := append(manifest.Manifests, manifest.Layers...)
+	if manifest.Config != nil {
+		children = append(children, *manifest.Config)
+	}
+
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+
+	for _, desc := range children {
+		fsys.descriptors[desc.Digest] = desc
+	}
+
+	return nil
+}
+
+func isManifest(mediaType string) bool {
+	switch mediaType {
+	case ocispecs.MediaTypeImageManifest, ocispecs.MediaTypeImageIndex,
+		images.MediaTypeDockerSchema2Manifest, images.MediaTypeDockerSchema2ManifestList:
+		return true
+	default:
+		return false
+	}
+}
+
+// verifyingReader checks the digest of the content once it has been fully read.
+type verifyingReader struct {
+	r        io.Reader
+	verifier digest.Verifier
+}
+
+func (r *verifyingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	_, _ = r.verifier.Write(p[:n])
+	if err == io.EOF && !r.verifier.Verified() {
+		return n, fmt.Errorf("digest mismatch: %w", io.ErrUnexpectedEOF)
+	}
+
+	return n, err
+}
+
+type file struct {
+	io.Reader
+	closer io.Closer
+	info   fileInfo
+}
+
+func newBytesFile(name string, data []byte) *file {
+	return &file{
+		Reader: bytes.NewReader(data),
+		info:   fileInfo{name: path.Base(name), size: int64(len(data))},
+	}
+}
+
+func (f *file) Stat() (fs.FileInfo, error) {
+	return &f.info, nil
+}
+
+func (f *file) Close() error {
+	if f.closer == nil {
+		return nil
+	}
+
+	return f.closer.Close()
+}
+
+type fileInfo struct {
+	name string
+	size int64
+}
+
+func (fi *fileInfo) Name() string       { return fi.name }
+func (fi *fileInfo) Size() int64        { return fi.size }
+func (fi *fileInfo) Mode() fs.FileMode  { return 0o444 }
+func (fi *fileInfo) ModTime() time.Time { return time.Time{} }
+func (fi *fileInfo) IsDir() bool        { return false }
+func (fi *fileInfo) Sys() any           { return nil }
@@ -0,0 +1,85 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package registry
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/remotes"
+	"github.com/immutos/oci2erofs/internal/artifact"
+	ocispecs "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Push pushes an EROFS artifact to the registry under the given reference.
+// The content of the EROFS filesystem image is read from layer.
+func Push(ctx context.Context, resolver remotes.Resolver, ref string, art *artifact.Artifact, layer io.Reader) error {
+	ctx = withLogger(ctx)
+
+	name, err := ParseReference(ref)
+	if err != nil {
+		return err
+	}
+
+	pusher, err := resolver.Pusher(ctx, name)
+	if err != nil {
+		return fmt.Errorf("failed to create pusher: %w", err)
+	}
+
+	// The manifest must be pushed last, as registries may validate that its
+	// references exist.
+	if err := pushContent(ctx, pusher, art.Layer, layer); err != nil {
+		return fmt.Errorf("failed to push layer: %w", err)
+	}
+
+	if err := pushContent(ctx, pusher, art.Config, bytes.NewReader(art.ConfigData)); err != nil {
+		return fmt.Errorf("failed to push config: %w", err)
+	}
+
+	if err := pushContent(ctx, pusher, art.Manifest, bytes.NewReader(art.ManifestData)); err != nil {
+		return fmt.Errorf("failed to push manifest: %w", err)
+	}
+
+	return nil
+}
+
+func pushContent(ctx context.Context, pusher remotes.Pusher, desc ocispecs.Descriptor, r io.Reader) error {
+	w, err := pusher.Push(ctx, desc)
+	if err != nil {
+		if errdefs.IsAlreadyExists(err) {
+			return nil
+		}
+
+		return err
+	}
+	defer w.Close()
+
+	if _, err := io.Copy(w, r); err != nil {
+		return err
+	}
+
+	if err := w.Commit(ctx, desc.Size, desc.Digest); err != nil && !errdefs.IsAlreadyExists(err) {
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,151 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package registry
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"slices"
+	"strings"
+
+	"github.com/containerd/containerd/reference/docker"
+	"github.com/containerd/containerd/remotes"
+	dockerremote "github.com/containerd/containerd/remotes/docker"
+)
+
+// TransportPrefix is the prefix of image references that should be pulled
+// from (or pushed to) a registry.
+const TransportPrefix = "docker://"
+
+// Options configures access to an OCI distribution registry.
+type Options struct {
+	// Host is the registry (eg. "docker.io" or "localhost:5000") that the
+	// credentials and PlainHTTP apply to. Other registries are accessed
+	// anonymously (and over HTTPS, unless on localhost).
+	Host string
+	// Username is the username used to authenticate with the registry.
+	Username string
+	// Password is the password (or token) used to authenticate with the registry.
+	Password string
+	// PlainHTTP connects to the registry over HTTP rather than HTTPS (this
+	// is always the case for localhost).
+	PlainHTTP bool
+	// Client is the HTTP client used to connect to the registry.
+	Client *http.Client
+}
+
+// ForReference returns a copy of the options that applies to the registry of
+// the image reference, unless a host was already given.
+func (o Options) ForReference(ref string) (*Options, error) {
+	if o.Host == "" {
+		var err error
+		o.Host, err = Host(ref)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &o, nil
+}
+
+// NewResolver returns a resolver for accessing OCI distribution registries.
+// Both token (bearer) and basic authentication are supported. Credentials are
+// only ever sent to the registry given by opts.Host.
+func NewResolver(opts *Options) remotes.Resolver {
+	if opts == nil {
+		opts = &Options{}
+	}
+
+	client := opts.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	// The hosts serving the registry (eg. "registry-1.docker.io" for
+	// "docker.io"), which are the hosts that authentication is requested for.
+	var credHosts []string
+	if opts.Host != "" {
+		hosts, _ := dockerremote.ConfigureDefaultRegistries()(opts.Host)
+		for _, host := range hosts {
+			credHosts = append(credHosts, host.Host)
+		}
+	}
+
+	authorizer := dockerremote.NewDockerAuthorizer(
+		dockerremote.WithAuthClient(client),
+		dockerremote.WithAuthCreds(func(host string) (string, string, error) {
+			if !slices.Contains(credHosts, host) {
+				return "", "", nil
+			}
+
+			return opts.Username, opts.Password, nil
+		}),
+	)
+
+	plainHTTP := func(host string) (bool, error) {
+		if opts.PlainHTTP && host == opts.Host {
+			return true, nil
+		}
+
+		return dockerremote.MatchLocalhost(host)
+	}
+
+	return dockerremote.NewResolver(dockerremote.ResolverOptions{
+		Hosts: dockerremote.ConfigureDefaultRegistries(
+			dockerremote.WithClient(client),
+			dockerremote.WithAuthorizer(authorizer),
+			dockerremote.WithPlainHTTP(plainHTTP),
+		),
+	})
+}
+
+// Host returns the registry of an image reference (optionally prefixed with
+// the docker:// transport), eg. "docker.io".
+func Host(ref string) (string, error) {
+	named, err := docker.ParseDockerRef(strings.TrimPrefix(ref, TransportPrefix))
+	if err != nil {
+		return "", fmt.Errorf("failed to parse image reference %q: %w", ref, err)
+	}
+
+	return docker.Domain(named), nil
+}
+
+// ParseReference parses an image reference (optionally prefixed with the
+// docker:// transport) into its fully qualified form, eg.
+// "docker.io/library/busybox:latest".
+func ParseReference(ref string) (string, error) {
+	named, err := docker.ParseDockerRef(strings.TrimPrefix(ref, TransportPrefix))
+	if err != nil {
+		return "", fmt.Errorf("failed to parse image reference %q: %w", ref, err)
+	}
+
+	return named.String(), nil
+}
+
+// ShortName returns the final path component of an image reference's
+// repository, eg. "busybox" for "docker.io/library/busybox:latest".
+func ShortName(ref string) (string, error) {
+	named, err := docker.ParseDockerRef(strings.TrimPrefix(ref, TransportPrefix))
+	if err != nil {
+		return "", fmt.Errorf("failed to parse image reference %q: %w", ref, err)
+	}
+
+	return path.Base(docker.Path(named)), nil
+}
@@ -0,0 +1,230 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package registry_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"testing"
+
+	"github.com/immutos/oci2erofs/internal/artifact"
+	"github.com/immutos/oci2erofs/internal/layer"
+	"github.com/immutos/oci2erofs/internal/oci"
+	"github.com/immutos/oci2erofs/internal/registry"
+	"github.com/immutos/oci2erofs/internal/registry/registrytest"
+	"github.com/immutos/oci2erofs/internal/util"
+	"github.com/opencontainers/go-digest"
+	ocispecs "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestShortName(t *testing.T) {
+	name, err := registry.ShortName("docker://localhost:5000/tianon/toybox:0.8.11")
+	require.NoError(t, err)
+	require.Equal(t, "toybox", name)
+
+	name, err = registry.ShortName("busybox@sha256:d3b7b26716e98689872d7477fe39571b2128cf3a23eea0498513a1889e86f3ce")
+	require.NoError(t, err)
+	require.Equal(t, "busybox", name)
+}
+
+func TestHost(t *testing.T) {
+	host, err := registry.Host("docker://localhost:5000/tianon/toybox:0.8.11")
+	require.NoError(t, err)
+	require.Equal(t, "localhost:5000", host)
+
+	host, err = registry.Host("busybox")
+	require.NoError(t, err)
+	require.Equal(t, "docker.io", host)
+}
+
+func TestImageFS(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("Token Auth", func(t *testing.T) {
+		reg := registrytest.New(registrytest.WithTokenAuth("user", "secret"))
+		t.Cleanup(reg.Close)
+
+		require.NoError(t, reg.PushLayout("tianon/toybox", "0.8.11", os.DirFS("../oci/testdata/toybox-multiarch")))
+
+		resolver := registry.NewResolver(&registry.Options{
+			Host:     reg.Host(),
+			Username: "user",
+			Password: "secret",
+		})
+
+		imageFS, err := registry.NewImageFS(ctx, resolver, "docker://"+reg.Host()+"/tianon/toybox:0.8.11")
+		require.NoError(t, err)
+
+		platform := ocispecs.Platform{
+			Architecture: "arm64",
+			OS:           "linux",
+		}
+
+		img, err := oci.LoadImage(ctx, &layer.Loader{TempDir: t.TempDir()}, imageFS, "", &platform)
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			require.NoError(t, img.Close())
+		})
+
+		h, err := util.HashFS(img.RootFS())
+		require.NoError(t, err)
+
+		require.Equal(t, "h1:vep4P8xi3jVOxfV9SWQjzrHUoAIDjgYEGJ+yIYeq2JQ=", h)
+	})
+
+	t.Run("Basic Auth", func(t *testing.T) {
+		reg := registrytest.New(registrytest.WithBasicAuth("user", "secret"))
+		t.Cleanup(reg.Close)
+
+		require.NoError(t, reg.PushLayout("tianon/toybox", "latest", os.DirFS("../oci/testdata/toybox")))
+
+		resolver := registry.NewResolver(&registry.Options{
+			Host:     reg.Host(),
+			Username: "user",
+			Password: "secret",
+		})
+
+		imageFS, err := registry.NewImageFS(ctx, resolver, reg.Host()+"/tianon/toybox")
+		require.NoError(t, err)
+
+		img, err := oci.LoadImage(ctx, &layer.Loader{TempDir: t.TempDir()}, imageFS, "", nil)
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			require.NoError(t, img.Close())
+		})
+
+		require.Equal(t, "sha256:d3b7b26716e98689872d7477fe39571b2128cf3a23eea0498513a1889e86f3ce", img.ManifestDigest().String())
+
+		h, err := util.HashFS(img.RootFS())
+		require.NoError(t, err)
+
+		require.Equal(t, "h1:J674XgTpeE71MnUmfTovrhKIlFnWOa8rctDF6SL/Kzg=", h)
+	})
+
+	t.Run("Unauthorized", func(t *testing.T) {
+		reg := registrytest.New(registrytest.WithTokenAuth("user", "secret"))
+		t.Cleanup(reg.Close)
+
+		require.NoError(t, reg.PushLayout("tianon/toybox", "latest", os.DirFS("../oci/testdata/toybox")))
+
+		resolver := registry.NewResolver(&registry.Options{
+			Host:     reg.Host(),
+			Username: "user",
+			Password: "wrong",
+		})
+
+		_, err := registry.NewImageFS(ctx, resolver, reg.Host()+"/tianon/toybox:latest")
+		require.Error(t, err)
+	})
+
+	t.Run("Other Host", func(t *testing.T) {
+		reg := registrytest.New(registrytest.WithTokenAuth("user", "secret"))
+		t.Cleanup(reg.Close)
+
+		require.NoError(t, reg.PushLayout("tianon/toybox", "latest", os.DirFS("../oci/testdata/toybox")))
+
+		// The credentials belong to another registry, so must not be sent.
+		resolver := registry.NewResolver(&registry.Options{
+			Host:     "registry.example.com",
+			Username: "user",
+			Password: "secret",
+		})
+
+		_, err := registry.NewImageFS(ctx, resolver, reg.Host()+"/tianon/toybox:latest")
+		require.Error(t, err)
+	})
+
+	t.Run("Not Found", func(t *testing.T) {
+		reg := registrytest.New()
+		t.Cleanup(reg.Close)
+
+		_, err := registry.NewImageFS(ctx, registry.NewResolver(nil), reg.Host()+"/tianon/toybox:latest")
+		require.Error(t, err)
+	})
+}
+
+func TestPush(t *testing.T) {
+	ctx := context.Background()
+
+	reg := registrytest.New(registrytest.WithTokenAuth("user", "secret"))
+	t.Cleanup(reg.Close)
+
+	resolver := registry.NewResolver(&registry.Options{
+		Host:     reg.Host(),
+		Username: "user",
+		Password: "secret",
+	})
+
+	layerData := []byte("not really an erofs image")
+	subject := ocispecs.Descriptor{
+		MediaType: ocispecs.MediaTypeImageManifest,
+		Digest:    digest.Digest("sha256:d3b7b26716e98689872d7477fe39571b2128cf3a23eea0498513a1889e86f3ce"),
+		Size:      1234,
+	}
+
+	art, err := artifact.New(ocispecs.Descriptor{
+		Digest: digest.FromBytes(layerData),
+		Size:   int64(len(layerData)),
+	}, artifact.Options{
+		Config: ocispecs.Image{
+			Platform: ocispecs.Platform{
+				Architecture: "amd64",
+				OS:           "linux",
+			},
+		},
+		Subject:  &subject,
+		BaseName: "docker.io/tianon/toybox:0.8.11",
+	})
+	require.NoError(t, err)
+
+	err = registry.Push(ctx, resolver, "docker://"+reg.Host()+"/tianon/toybox:0.8.11-erofs", art, bytes.NewReader(layerData))
+	require.NoError(t, err)
+
+	mediaType, manifestData, ok := reg.Manifest("tianon/toybox", "0.8.11-erofs")
+	require.True(t, ok)
+	require.Equal(t, ocispecs.MediaTypeImageManifest, mediaType)
+	require.Equal(t, art.ManifestData, manifestData)
+
+	var manifest ocispecs.Manifest
+	require.NoError(t, json.Unmarshal(manifestData, &manifest))
+
+	require.Equal(t, artifact.ArtifactType, manifest.ArtifactType)
+	require.NotNil(t, manifest.Subject)
+	require.Equal(t, subject.Digest, manifest.Subject.Digest)
+	require.Equal(t, subject.Digest.String(), manifest.Annotations[ocispecs.AnnotationBaseImageDigest])
+	require.Equal(t, "docker.io/tianon/toybox:0.8.11", manifest.Annotations[ocispecs.AnnotationBaseImageName])
+
+	require.Len(t, manifest.Layers, 1)
+	require.Equal(t, artifact.MediaTypeLayer, manifest.Layers[0].MediaType)
+
+	blob, ok := reg.Blob(manifest.Layers[0].Digest)
+	require.True(t, ok)
+	require.Equal(t, layerData, blob)
+
+	blob, ok = reg.Blob(manifest.Config.Digest)
+	require.True(t, ok)
+	require.Equal(t, art.ConfigData, blob)
+
+	// Pushing the same artifact again should be a no-op.
+	err = registry.Push(ctx, resolver, "docker://"+reg.Host()+"/tianon/toybox:0.8.11-erofs", art, bytes.NewReader(layerData))
+	require.NoError(t, err)
+}
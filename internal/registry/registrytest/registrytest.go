@@ -0,0 +1,415 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+// Package registrytest provides an in-process OCI distribution registry for
+// use in tests.
+package registrytest
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path"
+	"regexp"
+	"strconv"
+	"sync"
+
+	"github.com/containerd/containerd/images"
+	"github.com/opencontainers/go-digest"
+	ocispecs "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+const token = "registrytest-token"
+
+var (
+	manifestPath = regexp.MustCompile(`^/v2/(.+)/manifests/([^/]+)$`)
+	blobPath     = regexp.MustCompile(`^/v2/(.+)/blobs/([^/]+)$`)
+	uploadsPath  = regexp.MustCompile(`^/v2/(.+)/blobs/uploads/([^/]*)$`)
+)
+
+// Registry is an in-memory OCI distribution registry.
+type Registry struct {
+	*httptest.Server
+	username  string
+	password  string
+	tokenAuth bool
+
+	mu        sync.Mutex
+	blobs     map[digest.Digest][]byte
+	manifests map[digest.Digest]manifest
+	tags      map[string]digest.Digest
+	uploads   map[string][]byte
+	nextID    int
+}
+
+type manifest struct {
+	mediaType string
+	data      []byte
+}
+
+// Option configures a Registry.
+type Option func(*Registry)
+
+// WithBasicAuth requires clients to authenticate using basic authentication.
+func WithBasicAuth(username, password string) Option {
+	return func(r *Registry) {
+		r.username = username
+		r.password = password
+	}
+}
+
+// WithTokenAuth requires clients to authenticate using a bearer token issued
+// by the registry's token endpoint (which itself requires the given basic
+// authentication credentials, if not empty).
+func WithTokenAuth(username, password string) Option {
+	return func(r *Registry) {
+		r.username = username
+		r.password = password
+		r.tokenAuth = true
+	}
+}
+
+// New starts a new in-memory registry. The caller should call Close when
+// finished, to shut it down.
+func New(opts ...Option) *Registry {
+	r := &Registry{
+		blobs:     map[digest.Digest][]byte{},
+		manifests: map[digest.Digest]manifest{},
+		tags:      map[string]digest.Digest{},
+		uploads:   map[string][]byte{},
+	}
+
+	for _, opt := range opts {
+		opt(r)
+	}
+
+	r.Server = httptest.NewServer(http.HandlerFunc(r.serveHTTP))
+
+	return r
+}
+
+// Host returns the host (and port) of the registry.
+func (r *Registry) Host() string {
+	u, _ := url.Parse(r.URL)
+	return u.Host
+}
+
+// PushLayout copies the contents of an OCI image layout into the registry,
+// tagging the first image in the layout with the given tag.
+func (r *Registry) PushLayout(repo, tag string, layout fs.FS) error {
+	indexData, err := fs.ReadFile(layout, "index.json")
+	if err != nil {
+		return err
+	}
+
+	var index ocispecs.Index
+	if err := json.Unmarshal(indexData, &index); err != nil {
+		return err
+	}
+
+	if len(index.Manifests) == 0 {
+		return fmt.Errorf("no manifests found")
+	}
+
+	err = fs.WalkDir(layout, ocispecs.ImageBlobsDir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+
+		data, err := fs.ReadFile(layout, p)
+		if err != nil {
+			return err
+		}
+
+		dgst := digest.NewDigestFromEncoded(digest.Algorithm(path.Base(path.Dir(p))), d.Name())
+
+		r.mu.Lock()
+		defer r.mu.Unlock()
+
+		if mediaType := manifestMediaType(data); mediaType != "" {
+			r.manifests[dgst] = manifest{mediaType: mediaType, data: data}
+		} else {
+			r.blobs[dgst] = data
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	r.tags[repo+":"+tag] = index.Manifests[0].Digest
+	r.mu.Unlock()
+
+	return nil
+}
+
+// Manifest returns the media type and contents of the manifest with the
+// given tag or digest.
+func (r *Registry) Manifest(repo, ref string) (string, []byte, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	m, ok := r.lookupManifest(repo, ref)
+	return m.mediaType, m.data, ok
+}
+
+// Blob returns the contents of the blob with the given digest.
+func (r *Registry) Blob(dgst digest.Digest) ([]byte, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	data, ok := r.blobs[dgst]
+	return data, ok
+}
+
+func (r *Registry) serveHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.URL.Path == "/token" {
+		r.serveToken(w, req)
+		return
+	}
+
+	if !r.authorized(w, req) {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	switch {
+	case req.URL.Path == "/v2/":
+		w.WriteHeader(http.StatusOK)
+
+	case uploadsPath.MatchString(req.URL.Path):
+		m := uploadsPath.FindStringSubmatch(req.URL.Path)
+		r.serveUpload(w, req, m[1], m[2])
+
+	case manifestPath.MatchString(req.URL.Path):
+		m := manifestPath.FindStringSubmatch(req.URL.Path)
+		r.serveManifest(w, req, m[1], m[2])
+
+	case blobPath.MatchString(req.URL.Path):
+		m := blobPath.FindStringSubmatch(req.URL.Path)
+		r.serveBlob(w, req, m[2])
+
+	default:
+		http.NotFound(w, req)
+	}
+}
+
+func (r *Registry) authorized(w http.ResponseWriter, req *http.Request) bool {
+	switch {
+	case r.tokenAuth:
+		if req.Header.Get("Authorization") == "Bearer "+token {
+			return true
+		}
+
+		scope := "registry:catalog:*"
+		for _, re := range []*regexp.Regexp{manifestPath, uploadsPath, blobPath} {
+			if m := re.FindStringSubmatch(req.URL.Path); m != nil {
+				scope = "repository:" + m[1] + ":pull,push"
+				break
+			}
+		}
+
+		w.Header().Set("WWW-Authenticate",
+			fmt.Sprintf("Bearer realm=%q,service=%q,scope=%q", r.URL+"/token", "registrytest", scope))
+	case r.username != "":
+		if username, password, ok := req.BasicAuth(); ok && username == r.username && password == r.password {
+			return true
+		}
+
+		w.Header().Set("WWW-Authenticate", `Basic realm="registrytest"`)
+	default:
+		return true
+	}
+
+	http.Error(w, "unauthorized", http.StatusUnauthorized)
+	return false
+}
+
+func (r *Registry) serveToken(w http.ResponseWriter, req *http.Request) {
+	if r.username != "" {
+		if username, password, ok := req.BasicAuth(); !ok || username != r.username || password != r.password {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]string{
+		"token":        token,
+		"access_token": token,
+	})
+}
+
+func (r *Registry) serveManifest(w http.ResponseWriter, req *http.Request, repo, ref string) {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead:
+		m, ok := r.lookupManifest(repo, ref)
+		if !ok {
+			http.NotFound(w, req)
+			return
+		}
+
+		w.Header().Set("Content-Type", m.mediaType)
+		w.Header().Set("Content-Length", strconv.Itoa(len(m.data)))
+		w.Header().Set("Docker-Content-Digest", digest.FromBytes(m.data).String())
+		w.WriteHeader(http.StatusOK)
+
+		if req.Method == http.MethodGet {
+			_, _ = w.Write(m.data)
+		}
+
+	case http.MethodPut:
+		data, err := io.ReadAll(req.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		dgst := digest.FromBytes(data)
+		r.manifests[dgst] = manifest{mediaType: req.Header.Get("Content-Type"), data: data}
+
+		if _, err := digest.Parse(ref); err != nil {
+			r.tags[repo+":"+ref] = dgst
+		}
+
+		w.Header().Set("Docker-Content-Digest", dgst.String())
+		w.WriteHeader(http.StatusCreated)
+
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (r *Registry) serveBlob(w http.ResponseWriter, req *http.Request, ref string) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	dgst, err := digest.Parse(ref)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	data, ok := r.blobs[dgst]
+	if !ok {
+		http.NotFound(w, req)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.Header().Set("Docker-Content-Digest", dgst.String())
+	w.WriteHeader(http.StatusOK)
+
+	if req.Method == http.MethodGet {
+		_, _ = w.Write(data)
+	}
+}
+
+func (r *Registry) serveUpload(w http.ResponseWriter, req *http.Request, repo, id string) {
+	switch {
+	case req.Method == http.MethodPost && id == "":
+		r.nextID++
+		id = strconv.Itoa(r.nextID)
+		r.uploads[id] = nil
+
+		w.Header().Set("Location", "/v2/"+repo+"/blobs/uploads/"+id)
+		w.Header().Set("Docker-Upload-UUID", id)
+		w.WriteHeader(http.StatusAccepted)
+
+	case req.Method == http.MethodPatch || req.Method == http.MethodPut:
+		upload, ok := r.uploads[id]
+		if !ok {
+			http.NotFound(w, req)
+			return
+		}
+
+		data, err := io.ReadAll(req.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		upload = append(upload, data...)
+
+		if req.Method == http.MethodPatch {
+			r.uploads[id] = upload
+
+			w.Header().Set("Location", "/v2/"+repo+"/blobs/uploads/"+id)
+			w.Header().Set("Range", fmt.Sprintf("0-%d", len(upload)-1))
+			w.WriteHeader(http.StatusAccepted)
+			return
+		}
+
+		delete(r.uploads, id)
+
+		dgst, err := digest.Parse(req.URL.Query().Get("digest"))
+		if err != nil || digest.FromBytes(upload) != dgst {
+			http.Error(w, "digest invalid", http.StatusBadRequest)
+			return
+		}
+
+		r.blobs[dgst] = upload
+
+		w.Header().Set("Location", "/v2/"+repo+"/blobs/"+dgst.String())
+		w.Header().Set("Docker-Content-Digest", dgst.String())
+		w.WriteHeader(http.StatusCreated)
+
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (r *Registry) lookupManifest(repo, ref string) (manifest, bool) {
+	dgst, err := digest.Parse(ref)
+	if err != nil {
+		var ok bool
+		if dgst, ok = r.tags[repo+":"+ref]; !ok {
+			return manifest{}, false
+		}
+	}
+
+	m, ok := r.manifests[dgst]
+	return m, ok
+}
+
+func manifestMediaType(data []byte) string {
+	var m struct {
+		MediaType string `json:"mediaType"`
+	}
+	if err := json.Unmarshal(data, &m); err != nil {
+		return ""
+	}
+
+	switch m.MediaType {
+	case ocispecs.MediaTypeImageManifest, ocispecs.MediaTypeImageIndex,
+		images.MediaTypeDockerSchema2Manifest, images.MediaTypeDockerSchema2ManifestList:
+		return m.MediaType
+	default:
+		return ""
+	}
+}
@@ -0,0 +1,130 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+// Package report describes completed conversions in a machine-readable
+// (JSON) form, for consumption by build pipelines.
+package report
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/immutos/oci2erofs/internal/atomicfile"
+	"github.com/opencontainers/go-digest"
+	ocispecs "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// SchemaVersion is the version of the report schema. It is incremented for
+// any change that is not backwards compatible (fields are only ever added
+// within a version).
+const SchemaVersion = 1
+
+// Report describes a conversion (of one or more images).
+type Report struct {
+	// SchemaVersion is the version of the report schema (see SchemaVersion).
+	SchemaVersion int `json:"schemaVersion"`
+	// Version is the version of oci2erofs that produced the report.
+	Version string `json:"version"`
+	// Input is the path of the source image (or its registry reference, or
+	// "-" for stdin).
+	Input string `json:"input"`
+	// Images are the converted images.
+	Images []Image `json:"images"`
+	// Warnings are the warnings logged during the conversion.
+	Warnings []string `json:"warnings"`
+}
+
+// Image describes a converted image.
+type Image struct {
+	// Ref is the reference of the image (if any).
+	Ref string `json:"ref,omitempty"`
+	// Platform is the platform of the image.
+	Platform ocispecs.Platform `json:"platform"`
+	// ManifestDigest is the digest of the image manifest. It is omitted for
+	// legacy Docker archives, which do not include a manifest.
+	ManifestDigest digest.Digest `json:"manifestDigest,omitempty"`
+	// ConfigDigest is the digest of the image configuration.
+	ConfigDigest digest.Digest `json:"configDigest"`
+	// LayerDigests are the digests of the image's layers (as stored).
+	LayerDigests []digest.Digest `json:"layerDigests"`
+	// Output describes the EROFS filesystem image.
+	Output Output `json:"output"`
+	// ArtifactDigest is the digest of the artifact manifest (if the EROFS
+	// filesystem image was pushed to a registry or written to an OCI image
+	// layout).
+	ArtifactDigest digest.Digest `json:"artifactDigest,omitempty"`
+	// Stats counts the inodes in the EROFS filesystem image.
+	Stats Stats `json:"stats"`
+	// Timings records the time spent in each phase of the conversion.
+	Timings Timings `json:"timings"`
+}
+
+// Output describes an EROFS filesystem image.
+type Output struct {
+	// Path is the path of the output file (or OCI image layout, or registry
+	// reference, or "-" for stdout).
+	Path string `json:"path"`
+	// Size is the size in bytes of the EROFS filesystem image.
+	Size int64 `json:"size"`
+	// SHA256 is the hex encoded SHA-256 digest of the EROFS filesystem image.
+	SHA256 string `json:"sha256"`
+}
+
+// Stats counts the inodes in an EROFS filesystem image.
+type Stats struct {
+	Inodes   int `json:"inodes"`
+	Files    int `json:"files"`
+	Dirs     int `json:"dirs"`
+	Symlinks int `json:"symlinks"`
+	Other    int `json:"other"`
+}
+
+// Timings records the time in seconds spent in each phase of a conversion.
+type Timings struct {
+	Decompress float64 `json:"decompressSeconds"`
+	Index      float64 `json:"indexSeconds"`
+	Write      float64 `json:"writeSeconds"`
+	Total      float64 `json:"totalSeconds"`
+}
+
+// Encode writes the report to w as (indented) JSON.
+func (r *Report) Encode(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(r)
+}
+
+// Write atomically writes the report to the file at path.
+func (r *Report) Write(path string) error {
+	f, err := atomicfile.Create(path, false)
+	if err != nil {
+		return fmt.Errorf("failed to create report file: %w", err)
+	}
+	defer f.Close()
+
+	if err := r.Encode(f); err != nil {
+		return fmt.Errorf("failed to encode report: %w", err)
+	}
+
+	if err := f.Commit(); err != nil {
+		return fmt.Errorf("failed to write report file: %w", err)
+	}
+
+	return nil
+}
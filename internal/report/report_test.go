@@ -0,0 +1,99 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package report_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/immutos/oci2erofs/internal/report"
+	"github.com/opencontainers/go-digest"
+	ocispecs "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReport(t *testing.T) {
+	r := &report.Report{
+		SchemaVersion: report.SchemaVersion,
+		Version:       "v1.0.0",
+		Input:         "image.tar",
+		Images: []report.Image{{
+			Platform:     ocispecs.Platform{OS: "linux", Architecture: "amd64"},
+			ConfigDigest: digest.FromString("config"),
+			LayerDigests: []digest.Digest{digest.FromString("layer")},
+			Output: report.Output{
+				Path:   "image.erofs",
+				Size:   4096,
+				SHA256: digest.FromString("image").Encoded(),
+			},
+			Stats:   report.Stats{Inodes: 2, Files: 1, Dirs: 1},
+			Timings: report.Timings{Total: 1.5},
+		}},
+		Warnings: []string{},
+	}
+
+	path := filepath.Join(t.TempDir(), "report.json")
+	require.NoError(t, r.Write(path))
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+
+	var decoded map[string]any
+	require.NoError(t, json.Unmarshal(data, &decoded))
+
+	require.Equal(t, float64(1), decoded["schemaVersion"])
+	require.Equal(t, "image.tar", decoded["input"])
+	require.Equal(t, []any{}, decoded["warnings"])
+
+	images := decoded["images"].([]any)
+	require.Len(t, images, 1)
+
+	img := images[0].(map[string]any)
+	require.NotContains(t, img, "manifestDigest")
+	require.Equal(t, digest.FromString("config").String(), img["configDigest"])
+	require.Equal(t, map[string]any{
+		"path":   "image.erofs",
+		"size":   float64(4096),
+		"sha256": digest.FromString("image").Encoded(),
+	}, img["output"])
+	require.Equal(t, 1.5, img["timings"].(map[string]any)["totalSeconds"])
+}
+
+func TestWarningRecorder(t *testing.T) {
+	var buf bytes.Buffer
+	recorder := report.NewWarningRecorder(slog.NewTextHandler(&buf, nil))
+	logger := slog.New(recorder)
+
+	logger.Info("Converting image")
+	logger.With(slog.String("ref", "busybox")).Warn("Skipping file", slog.String("path", "dev/null"))
+	logger.WithGroup("layer").Error("Failed", slog.Int("index", 2))
+
+	require.Equal(t, []string{
+		"Skipping file ref=busybox path=dev/null",
+		"Failed layer.index=2",
+	}, recorder.Warnings())
+
+	// Records are still passed on.
+	require.Contains(t, buf.String(), "Converting image")
+	require.Contains(t, buf.String(), "Skipping file")
+}
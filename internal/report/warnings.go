@@ -0,0 +1,116 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package report
+
+import (
+	"context"
+	"log/slog"
+	"strings"
+	"sync"
+)
+
+// WarningRecorder is a slog.Handler that records the warnings (and errors)
+// that pass through it, before handing them to the wrapped handler.
+type WarningRecorder struct {
+	slog.Handler
+	warnings *warnings
+	// attrs are the attributes added to the handler (with keys qualified by
+	// their group).
+	attrs []slog.Attr
+	group string
+}
+
+type warnings struct {
+	mu       sync.Mutex
+	messages []string
+}
+
+// NewWarningRecorder returns a handler that records warnings before passing
+// them on to h.
+func NewWarningRecorder(h slog.Handler) *WarningRecorder {
+	return &WarningRecorder{Handler: h, warnings: &warnings{}}
+}
+
+// Warnings returns the recorded warnings (each formatted as the message
+// followed by its attributes).
+func (h *WarningRecorder) Warnings() []string {
+	h.warnings.mu.Lock()
+	defer h.warnings.mu.Unlock()
+
+	return append([]string{}, h.warnings.messages...)
+}
+
+func (h *WarningRecorder) Handle(ctx context.Context, r slog.Record) error {
+	if r.Level >= slog.LevelWarn {
+		var sb strings.Builder
+		sb.WriteString(r.Message)
+
+		for _, a := range h.attrs {
+			sb.WriteString(" " + a.Key + "=" + a.Value.String())
+		}
+
+		r.Attrs(func(a slog.Attr) bool {
+			sb.WriteString(" " + h.prefix(a.Key) + "=" + a.Value.String())
+			return true
+		})
+
+		h.warnings.mu.Lock()
+		h.warnings.messages = append(h.warnings.messages, sb.String())
+		h.warnings.mu.Unlock()
+	}
+
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h *WarningRecorder) WithAttrs(attrs []slog.Attr) slog.Handler {
+	prefixed := append([]slog.Attr{}, h.attrs...)
+	for _, a := range attrs {
+		prefixed = append(prefixed, slog.Attr{Key: h.prefix(a.Key), Value: a.Value})
+	}
+
+	return &WarningRecorder{
+		Handler:  h.Handler.WithAttrs(attrs),
+		warnings: h.warnings,
+		attrs:    prefixed,
+		group:    h.group,
+	}
+}
+
+func (h *WarningRecorder) WithGroup(name string) slog.Handler {
+	group := name
+	if h.group != "" {
+		group = h.group + "." + name
+	}
+
+	return &WarningRecorder{
+		Handler:  h.Handler.WithGroup(name),
+		warnings: h.warnings,
+		attrs:    h.attrs,
+		group:    group,
+	}
+}
+
+// prefix qualifies the key with the current group (if any).
+func (h *WarningRecorder) prefix(key string) string {
+	if h.group == "" {
+		return key
+	}
+
+	return h.group + "." + key
+}
@@ -0,0 +1,158 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package source
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/containerd/containerd/images"
+	"github.com/opencontainers/go-digest"
+	specs "github.com/opencontainers/image-spec/specs-go"
+	ocispecs "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+var _ fs.FS = (*dirImageFS)(nil)
+
+// dirImageFS presents an image stored in the layout of skopeo's "dir"
+// transport (a manifest.json alongside blobs named by their digest) as a
+// read-only OCI image layout.
+type dirImageFS struct {
+	fsys           fs.FS
+	index          []byte
+	manifestDigest digest.Digest
+}
+
+func newDirImageFS(fsys fs.FS) (*dirImageFS, error) {
+	manifest, err := fs.ReadFile(fsys, "manifest.json")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read manifest: %w", err)
+	}
+
+	var versioned struct {
+		MediaType string `json:"mediaType"`
+	}
+	if err := json.Unmarshal(manifest, &versioned); err != nil {
+		return nil, fmt.Errorf("failed to decode manifest: %w", err)
+	}
+
+	desc := ocispecs.Descriptor{
+		MediaType: versioned.MediaType,
+		Digest:    digest.FromBytes(manifest),
+		Size:      int64(len(manifest)),
+	}
+	if desc.MediaType == "" {
+		desc.MediaType = ocispecs.MediaTypeImageManifest
+	}
+
+	if !images.IsManifestType(desc.MediaType) && !images.IsIndexType(desc.MediaType) {
+		return nil, fmt.Errorf("unsupported manifest media type %q", desc.MediaType)
+	}
+
+	index, err := json.Marshal(ocispecs.Index{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ocispecs.MediaTypeImageIndex,
+		Manifests: []ocispecs.Descriptor{desc},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal index: %w", err)
+	}
+
+	return &dirImageFS{
+		fsys:           fsys,
+		index:          index,
+		manifestDigest: desc.Digest,
+	}, nil
+}
+
+func (fsys *dirImageFS) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+
+	switch name {
+	case ocispecs.ImageLayoutFile:
+		layout, err := json.Marshal(ocispecs.ImageLayout{Version: ocispecs.ImageLayoutVersion})
+		if err != nil {
+			return nil, err
+		}
+
+		return newBytesFile(name, layout), nil
+	case "index.json":
+		return newBytesFile(name, fsys.index), nil
+	}
+
+	dir, encoded := path.Split(name)
+	if !strings.HasPrefix(dir, ocispecs.ImageBlobsDir+"/") {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+
+	dgst := digest.NewDigestFromEncoded(digest.Algorithm(path.Base(dir)), encoded)
+	if dgst.Validate() != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+
+	if dgst == fsys.manifestDigest {
+		return fsys.fsys.Open("manifest.json")
+	}
+
+	// Blobs are named by the encoded digest (prefixed by the algorithm, for
+	// algorithms other than sha256), the manifests of multi-platform images
+	// have a ".manifest.json" suffix.
+	blobName := encoded
+	if dgst.Algorithm() != digest.SHA256 {
+		blobName = dgst.Algorithm().String() + "-" + encoded
+	}
+
+	f, err := fsys.fsys.Open(blobName)
+	if err == nil {
+		return f, nil
+	}
+
+	if f, err := fsys.fsys.Open(blobName + ".manifest.json"); err == nil {
+		return f, nil
+	}
+
+	return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+}
+
+// bytesFile is an in-memory file.
+type bytesFile struct {
+	*bytes.Reader
+	name string
+	size int64
+}
+
+func newBytesFile(name string, data []byte) *bytesFile {
+	return &bytesFile{Reader: bytes.NewReader(data), name: name, size: int64(len(data))}
+}
+
+func (f *bytesFile) Stat() (fs.FileInfo, error) { return f, nil }
+func (f *bytesFile) Close() error               { return nil }
+func (f *bytesFile) Name() string               { return path.Base(f.name) }
+func (f *bytesFile) Size() int64                { return f.size }
+func (f *bytesFile) Mode() fs.FileMode          { return 0o444 }
+func (f *bytesFile) ModTime() time.Time         { return time.Time{} }
+func (f *bytesFile) IsDir() bool                { return false }
+func (f *bytesFile) Sys() any                   { return nil }
@@ -0,0 +1,288 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+// Package source opens source images (image directories, tarballs, and
+// registry references) as filesystems.
+package source
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+
+	"github.com/immutos/oci2erofs/internal/docker"
+	"github.com/immutos/oci2erofs/internal/image"
+	"github.com/immutos/oci2erofs/internal/layer"
+	"github.com/immutos/oci2erofs/internal/oci"
+	"github.com/immutos/oci2erofs/internal/registry"
+	"github.com/immutos/oci2erofs/internal/util"
+	ocispecs "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Format is the archive format of a source image.
+type Format string
+
+const (
+	// FormatDocker is a Docker archive (as produced by `docker save`).
+	FormatDocker Format = "docker"
+	// FormatOCI is an OCI image layout.
+	FormatOCI Format = "oci"
+)
+
+// Options describes the source image.
+type Options struct {
+	// Path is the path to an image directory, an (optionally compressed)
+	// image tarball, or a registry reference prefixed with "docker://". The
+	// path may be prefixed with a transport (see ParseInput), which selects
+	// the format of the image (and optionally the ref). Exactly one of Path,
+	// FS, or Reader must be set.
+	Path string
+	// FS is an already opened image directory or tarball.
+	FS fs.FS
+	// Reader streams an (optionally compressed) image tarball.
+	Reader io.Reader
+	// Registry configures access to registries (for "docker://" references).
+	// Unless Registry.Host is set, the credentials only apply to the
+	// registry of Path.
+	Registry registry.Options
+	// TempDir is the directory in which temporary files are created (eg. a
+	// copy of a streamed tarball). It must remain until the source is closed.
+	TempDir string
+}
+
+// Source is an opened source image.
+type Source struct {
+	// FS is the image directory (or tarball) as a filesystem.
+	FS fs.FS
+	// Format is the detected archive format.
+	Format Format
+	// Ref is the image reference given inline in the path (if any).
+	Ref   string
+	close func() error
+}
+
+// Open opens the source image described by opts.
+func Open(ctx context.Context, opts Options) (*Source, error) {
+	var input Input
+	if opts.Path != "" {
+		input = ParseInput(opts.Path)
+	}
+
+	imageFS, closeImage, err := openImage(ctx, opts, input)
+	if err != nil {
+		return nil, err
+	}
+
+	format, err := detectFormat(imageFS)
+	if err != nil {
+		_ = closeImage()
+		return nil, err
+	}
+
+	if want := input.Transport.format(); want != "" && format != want {
+		_ = closeImage()
+		return nil, fmt.Errorf("image is not a valid %s image (found a %s image)", want, format)
+	}
+
+	return &Source{
+		FS:     imageFS,
+		Format: format,
+		Ref:    input.Ref,
+		close:  closeImage,
+	}, nil
+}
+
+// ResolveRef returns the image reference to load, which is either given
+// explicitly (as ref) or inline in the path of the source image.
+func (s *Source) ResolveRef(ref string) (string, error) {
+	switch {
+	case ref == "":
+		return s.Ref, nil
+	case s.Ref != "" && ref != s.Ref:
+		return "", fmt.Errorf("ref %q conflicts with the ref %q given in the image path", ref, s.Ref)
+	default:
+		return ref, nil
+	}
+}
+
+// Load loads the image with the given ref and platform (using loader to load
+// the image layers).
+func (s *Source) Load(ctx context.Context, loader *layer.Loader, ref string, platform *ocispecs.Platform) (*image.Image, error) {
+	ref, err := s.ResolveRef(ref)
+	if err != nil {
+		return nil, err
+	}
+
+	switch s.Format {
+	case FormatDocker:
+		img, err := docker.LoadImage(ctx, loader, s.FS, ref, platform)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load Docker image: %w", err)
+		}
+
+		return img, nil
+	default:
+		img, err := oci.LoadImage(ctx, loader, s.FS, ref, platform)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load OCI image: %w", err)
+		}
+
+		return img, nil
+	}
+}
+
+// Targets returns the ref and platform of every image in the source.
+func (s *Source) Targets() ([]image.Target, error) {
+	switch s.Format {
+	case FormatDocker:
+		targets, err := docker.Targets(s.FS)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list Docker images: %w", err)
+		}
+
+		return targets, nil
+	default:
+		targets, err := oci.Targets(s.FS)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list OCI images: %w", err)
+		}
+
+		return targets, nil
+	}
+}
+
+// Close releases the resources backing the source image.
+func (s *Source) Close() error {
+	return s.close()
+}
+
+func openImage(ctx context.Context, opts Options, input Input) (fs.FS, func() error, error) {
+	var inputs int
+	for _, set := range []bool{opts.Path != "", opts.FS != nil, opts.Reader != nil} {
+		if set {
+			inputs++
+		}
+	}
+	if inputs != 1 {
+		return nil, nil, errors.New("exactly one of path, filesystem, or reader must be specified")
+	}
+
+	switch {
+	case opts.FS != nil:
+		return opts.FS, func() error { return nil }, nil
+	case opts.Reader != nil:
+		// Copy the (compressed) tarball so that it can be read at random.
+		tarballFile, err := os.CreateTemp(opts.TempDir, "image-*")
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to create temporary tarball file: %w", err)
+		}
+
+		if _, err := io.Copy(tarballFile, util.ContextReader(ctx, opts.Reader)); err != nil {
+			_ = tarballFile.Close()
+			_ = os.Remove(tarballFile.Name())
+			return nil, nil, fmt.Errorf("failed to copy tarball: %w", err)
+		}
+
+		return openTarball(ctx, opts.TempDir, tarballFile)
+	case input.Transport == TransportDocker:
+		registryOpts, err := opts.Registry.ForReference(input.Path)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		imageFS, err := registry.NewImageFS(ctx, registry.NewResolver(registryOpts), input.Path)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to open image in registry: %w", err)
+		}
+
+		return imageFS, func() error { return nil }, nil
+	}
+
+	// Is the image a directory or a tarball?
+	fi, err := os.Stat(input.Path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open image: %w", err)
+	}
+
+	switch input.Transport {
+	case TransportOCI, TransportDir:
+		if !fi.IsDir() {
+			return nil, nil, fmt.Errorf("the %s transport requires a directory", input.Transport)
+		}
+	case TransportOCIArchive:
+		if fi.IsDir() {
+			return nil, nil, fmt.Errorf("the %s transport requires a tarball", input.Transport)
+		}
+	}
+
+	if input.Transport == TransportDir {
+		imageFS, err := newDirImageFS(os.DirFS(input.Path))
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to open image directory: %w", err)
+		}
+
+		return imageFS, func() error { return nil }, nil
+	}
+
+	if fi.IsDir() {
+		return os.DirFS(input.Path), func() error { return nil }, nil
+	}
+
+	tarballFile, err := os.Open(input.Path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open tarball: %w", err)
+	}
+
+	return openTarball(ctx, opts.TempDir, tarballFile)
+}
+
+// openTarball opens the (optionally compressed) tarball as a filesystem. The
+// tarball is closed when the returned close function is called.
+func openTarball(ctx context.Context, tempDir string, f *os.File) (fs.FS, func() error, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return nil, nil, fmt.Errorf("failed to stat tarball: %w", err)
+	}
+
+	imageFS, closeImage, err := layer.OpenArchive(ctx, f, fi.Size(), tempDir)
+	if err != nil {
+		_ = f.Close()
+		return nil, nil, fmt.Errorf("failed to open tarball: %w", err)
+	}
+
+	return imageFS, func() error {
+		return errors.Join(closeImage(), f.Close())
+	}, nil
+}
+
+// detectFormat determines if the image is a Docker or OCI image.
+func detectFormat(imageFS fs.FS) (Format, error) {
+	if _, err := fs.Stat(imageFS, "manifest.json"); err == nil {
+		return FormatDocker, nil
+	}
+
+	if _, err := fs.Stat(imageFS, "oci-layout"); err == nil {
+		return FormatOCI, nil
+	}
+
+	return "", errors.New("image is not a valid OCI or Docker image")
+}
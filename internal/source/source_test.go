@@ -0,0 +1,156 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package source_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/immutos/oci2erofs/internal/layer"
+	"github.com/immutos/oci2erofs/internal/source"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseInput(t *testing.T) {
+	t.Run("Plain", func(t *testing.T) {
+		require.Equal(t, source.Input{Path: "image.tar"}, source.ParseInput("image.tar"))
+		require.Equal(t, source.Input{Path: "unknown:image.tar"}, source.ParseInput("unknown:image.tar"))
+	})
+
+	t.Run("Registry", func(t *testing.T) {
+		input := source.ParseInput("docker://docker.io/library/busybox:latest")
+		require.Equal(t, source.Input{Transport: source.TransportDocker, Path: "docker://docker.io/library/busybox:latest"}, input)
+	})
+
+	t.Run("Transports", func(t *testing.T) {
+		require.Equal(t, source.Input{Transport: source.TransportOCI, Path: "layout"}, source.ParseInput("oci:layout"))
+		require.Equal(t, source.Input{Transport: source.TransportOCIArchive, Path: "image.tar", Ref: "latest"}, source.ParseInput("oci-archive:image.tar:latest"))
+		require.Equal(t, source.Input{Transport: source.TransportDockerArchive, Path: "image.tar", Ref: "busybox:latest"}, source.ParseInput("docker-archive:image.tar:busybox:latest"))
+		require.Equal(t, source.Input{Transport: source.TransportDir, Path: "image:dir"}, source.ParseInput("dir:image:dir"))
+	})
+
+	t.Run("String", func(t *testing.T) {
+		for _, path := range []string{"image.tar", "oci:layout", "docker-archive:image.tar:busybox:latest", "docker://busybox"} {
+			require.Equal(t, path, source.ParseInput(path).String())
+		}
+	})
+}
+
+func TestOpen(t *testing.T) {
+	ctx := context.Background()
+	ref := "docker.io/tianon/toybox:0.8.11"
+
+	t.Run("OCI", func(t *testing.T) {
+		src := open(t, "oci:../oci/testdata/toybox:"+ref)
+		require.Equal(t, source.FormatOCI, src.Format)
+		require.Equal(t, ref, src.Ref)
+
+		img, err := src.Load(ctx, &layer.Loader{TempDir: t.TempDir()}, "", nil)
+		require.NoError(t, err)
+		require.NoError(t, img.Close())
+
+		_, err = src.Load(ctx, &layer.Loader{TempDir: t.TempDir()}, "docker.io/tianon/toybox:latest", nil)
+		require.ErrorContains(t, err, "conflicts with the ref")
+	})
+
+	t.Run("OCI Archive", func(t *testing.T) {
+		src := open(t, "oci-archive:../../testdata/toybox.tar")
+		require.Equal(t, source.FormatOCI, src.Format)
+	})
+
+	t.Run("Docker Archive", func(t *testing.T) {
+		src := open(t, "docker-archive:../docker/testdata/toybox.tar:"+ref)
+		require.Equal(t, source.FormatDocker, src.Format)
+		require.Equal(t, ref, src.Ref)
+
+		img, err := src.Load(ctx, &layer.Loader{TempDir: t.TempDir()}, "", nil)
+		require.NoError(t, err)
+		require.NoError(t, img.Close())
+	})
+
+	t.Run("Dir", func(t *testing.T) {
+		dir := newSkopeoDir(t, "../oci/testdata/toybox")
+
+		src := open(t, "dir:"+dir)
+		require.Equal(t, source.FormatOCI, src.Format)
+
+		img, err := src.Load(ctx, &layer.Loader{TempDir: t.TempDir()}, "", nil)
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			require.NoError(t, img.Close())
+		})
+
+		require.Equal(t, "amd64", img.Platform().Architecture)
+
+		_, err = img.RootFS().Open("bin/toybox")
+		require.NoError(t, err)
+	})
+
+	t.Run("Mismatched Transport", func(t *testing.T) {
+		_, err := source.Open(ctx, source.Options{Path: "docker-archive:../../testdata/toybox.tar", TempDir: t.TempDir()})
+		require.ErrorContains(t, err, "not a valid docker image")
+
+		_, err = source.Open(ctx, source.Options{Path: "oci:../../testdata/toybox.tar", TempDir: t.TempDir()})
+		require.ErrorContains(t, err, "requires a directory")
+
+		_, err = source.Open(ctx, source.Options{Path: "oci-archive:../oci/testdata/toybox", TempDir: t.TempDir()})
+		require.ErrorContains(t, err, "requires a tarball")
+	})
+}
+
+func open(t *testing.T, path string) *source.Source {
+	src, err := source.Open(context.Background(), source.Options{Path: path, TempDir: t.TempDir()})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, src.Close())
+	})
+
+	return src
+}
+
+// newSkopeoDir converts the single image OCI image layout into the layout of
+// skopeo's dir transport.
+func newSkopeoDir(t *testing.T, layoutDir string) string {
+	dir := t.TempDir()
+
+	blobsDir := filepath.Join(layoutDir, "blobs", "sha256")
+	entries, err := os.ReadDir(blobsDir)
+	require.NoError(t, err)
+
+	// The manifest is the blob referenced by the index.
+	const manifestDigest = "d3b7b26716e98689872d7477fe39571b2128cf3a23eea0498513a1889e86f3ce"
+
+	for _, entry := range entries {
+		data, err := os.ReadFile(filepath.Join(blobsDir, entry.Name()))
+		require.NoError(t, err)
+
+		name := entry.Name()
+		if name == manifestDigest {
+			name = "manifest.json"
+		}
+
+		require.NoError(t, os.WriteFile(filepath.Join(dir, name), data, 0o644))
+	}
+
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "version"), []byte("Directory Transport Version: 1.1\n"), 0o644))
+
+	return dir
+}
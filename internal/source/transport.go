@@ -0,0 +1,110 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package source
+
+import (
+	"strings"
+
+	"github.com/immutos/oci2erofs/internal/registry"
+)
+
+// Transport identifies how a source image is stored (following the naming
+// of skopeo's transports).
+type Transport string
+
+const (
+	// TransportOCI is an OCI image layout directory ("oci:path[:ref]").
+	TransportOCI Transport = "oci"
+	// TransportOCIArchive is a tarball of an OCI image layout
+	// ("oci-archive:path[:ref]").
+	TransportOCIArchive Transport = "oci-archive"
+	// TransportDockerArchive is a Docker archive, as produced by `docker save`
+	// ("docker-archive:path[:tag]").
+	TransportDockerArchive Transport = "docker-archive"
+	// TransportDir is a directory holding a single image manifest alongside
+	// blobs named by their digest, as written by skopeo ("dir:path").
+	TransportDir Transport = "dir"
+	// TransportDocker is an image in a registry ("docker://ref").
+	TransportDocker Transport = "docker"
+)
+
+// Input is a parsed source image path.
+type Input struct {
+	// Transport is the transport given explicitly, or empty if the format
+	// of the image is to be detected.
+	Transport Transport
+	// Path is the path of the image (or the reference, prefixed with
+	// "docker://", for registry images).
+	Path string
+	// Ref is the image reference (or Docker tag) given inline, if any.
+	Ref string
+}
+
+// ParseInput parses a source image path, which is either a plain path (whose
+// format is detected), a registry reference prefixed with "docker://", or a
+// path prefixed with a transport (eg. "oci-archive:image.tar:latest").
+func ParseInput(path string) Input {
+	if strings.HasPrefix(path, registry.TransportPrefix) {
+		return Input{Transport: TransportDocker, Path: path}
+	}
+
+	transport, rest, ok := strings.Cut(path, ":")
+	if !ok {
+		return Input{Path: path}
+	}
+
+	switch Transport(transport) {
+	case TransportOCI, TransportOCIArchive, TransportDockerArchive:
+		// As with skopeo, the path ends at the first colon.
+		path, ref, _ := strings.Cut(rest, ":")
+		return Input{Transport: Transport(transport), Path: path, Ref: ref}
+	case TransportDir:
+		return Input{Transport: TransportDir, Path: rest}
+	default:
+		return Input{Path: path}
+	}
+}
+
+// String returns the input in the form accepted by ParseInput.
+func (in Input) String() string {
+	switch in.Transport {
+	case "", TransportDocker:
+		return in.Path
+	}
+
+	s := string(in.Transport) + ":" + in.Path
+	if in.Ref != "" {
+		s += ":" + in.Ref
+	}
+
+	return s
+}
+
+// format returns the format of images stored using the transport (or an
+// empty string if it is detected).
+func (t Transport) format() Format {
+	switch t {
+	case TransportOCI, TransportOCIArchive, TransportDir, TransportDocker:
+		return FormatOCI
+	case TransportDockerArchive:
+		return FormatDocker
+	default:
+		return ""
+	}
+}
@@ -0,0 +1,511 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+// Package tarfs implements a read-only filesystem backed by a tar archive.
+// File contents are read in place from the archive (which may itself be a
+// random access view of a compressed stream), so the archive never needs to
+// be copied.
+package tarfs
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"math"
+	"path"
+	"slices"
+	"strings"
+
+	"github.com/dpeckett/archivefs"
+	"github.com/immutos/oci2erofs/internal/xattr"
+)
+
+// maxSymlinks is the maximum number of symlinks followed when resolving a
+// path (matching Linux's MAXSYMLINKS).
+const maxSymlinks = 40
+
+var (
+	_ fs.FS                = (*FS)(nil)
+	_ fs.ReadDirFS         = (*FS)(nil)
+	_ fs.StatFS            = (*FS)(nil)
+	_ archivefs.ReadLinkFS = (*FS)(nil)
+	_ xattr.FS             = (*FS)(nil)
+)
+
+// FS is a filesystem backed by a tar archive.
+type FS struct {
+	ra   io.ReaderAt
+	root *dirent
+}
+
+// Open indexes the tar archive read from ra. Only the headers are read, the
+// contents of files are skipped over (and read on demand when opened).
+func Open(ra io.ReaderAt) (*FS, error) {
+	fsys := &FS{
+		ra: ra,
+		root: &dirent{hdr: &tar.Header{
+			Typeflag: tar.TypeDir,
+			Name:     ".",
+			Mode:     0o755,
+		}},
+	}
+
+	// The tar reader seeks past the contents of files.
+	sr := io.NewSectionReader(ra, 0, math.MaxInt64)
+	tr := tar.NewReader(sr)
+
+	// The contents of sparse files cannot be read in place, instead they are
+	// read by rescanning the archive from the last known header boundary.
+	var boundary int64
+	var sinceBoundary int
+
+	var hardlinks []*dirent
+	for {
+		hdr, err := tr.Next()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+
+			return nil, fmt.Errorf("failed to read tar header: %w", err)
+		}
+
+		offset, err := sr.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return nil, err
+		}
+
+		d := &dirent{
+			hdr:    hdr,
+			offset: offset,
+			resume: boundary,
+			skip:   sinceBoundary,
+		}
+
+		if isSparse(hdr) {
+			hdr.Typeflag = tar.TypeReg
+			d.offset = -1
+			sinceBoundary++
+		} else {
+			boundary = offset + blockAlign(dataSize(hdr))
+			sinceBoundary = 0
+		}
+
+		switch hdr.Typeflag {
+		case tar.TypeReg, tar.TypeDir, tar.TypeSymlink, tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+		case tar.TypeLink:
+			hardlinks = append(hardlinks, d)
+		case tar.TypeXGlobalHeader:
+			continue // Ignore metadata-only entries.
+		default:
+			return nil, fmt.Errorf("unsupported file type: %s, %c", hdr.Name, hdr.Typeflag)
+		}
+
+		name := cleanPath(hdr.Name)
+		if name == "." {
+			// Some archives include an entry for the root directory.
+			if hdr.Typeflag == tar.TypeDir {
+				hdr.Name = "."
+				fsys.root.hdr = hdr
+			}
+			continue
+		}
+		hdr.Name = name
+
+		if err := fsys.add(d); err != nil {
+			return nil, err
+		}
+	}
+
+	// Hardlinks share the contents and metadata of their target. The Linkname
+	// of a regular file's header records the target, so that consumers can
+	// recreate the hardlink (the Linkname of other targets, eg. a symlink's
+	// destination, is kept as is).
+	for _, d := range hardlinks {
+		target, err := fsys.resolve(cleanPath(d.hdr.Linkname), false)
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve hardlink %q: %w", d.hdr.Linkname, err)
+		}
+
+		if target.hdr.Typeflag == tar.TypeDir || target.hdr.Typeflag == tar.TypeLink {
+			return nil, fmt.Errorf("invalid hardlink target %q", d.hdr.Linkname)
+		}
+
+		hdr := *target.hdr
+		hdr.Name = d.hdr.Name
+		if hdr.Typeflag == tar.TypeReg {
+			hdr.Linkname = cleanPath(d.hdr.Linkname)
+		}
+		d.hdr = &hdr
+		d.offset = target.offset
+		d.resume = target.resume
+		d.skip = target.skip
+	}
+
+	return fsys, nil
+}
+
+func (fsys *FS) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+
+	d, err := fsys.resolve(name, true)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+
+	f := &file{
+		d:    d,
+		name: path.Base(name),
+	}
+
+	switch {
+	case d.hdr.Typeflag != tar.TypeReg:
+		f.r = strings.NewReader("")
+	case d.offset >= 0:
+		sr := io.NewSectionReader(fsys.ra, d.offset, d.hdr.Size)
+		return &regularFile{file: f, sr: sr}, nil
+	default:
+		f.r, err = fsys.sparseReader(d)
+		if err != nil {
+			return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+		}
+	}
+
+	return f, nil
+}
+
+func (fsys *FS) ReadDir(name string) ([]fs.DirEntry, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrInvalid}
+	}
+
+	d, err := fsys.resolve(name, true)
+	if err != nil {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: err}
+	}
+
+	if d.hdr.Typeflag != tar.TypeDir {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: errors.New("not a directory")}
+	}
+
+	return d.entries(), nil
+}
+
+func (fsys *FS) Stat(name string) (fs.FileInfo, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrInvalid}
+	}
+
+	d, err := fsys.resolve(name, true)
+	if err != nil {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: err}
+	}
+
+	// Use the original name (as we may have resolved a symlink).
+	return d.info(path.Base(name)), nil
+}
+
+// Xattrs returns the extended attributes recorded in the PAX records of the
+// named entry (without following symbolic links).
+func (fsys *FS) Xattrs(name string) (map[string]string, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "getxattr", Path: name, Err: fs.ErrInvalid}
+	}
+
+	d, err := fsys.resolve(name, false)
+	if err != nil {
+		return nil, &fs.PathError{Op: "getxattr", Path: name, Err: err}
+	}
+
+	return xattr.FromHeader(d.hdr)
+}
+
+// ReadLink returns the destination of the named symbolic link.
+// Experimental implementation of fs.ReadLinkFS:
+// https://github.com/golang/go/issues/49580
+func (fsys *FS) ReadLink(name string) (string, error) {
+	if !fs.ValidPath(name) {
+		return "", &fs.PathError{Op: "readlink", Path: name, Err: fs.ErrInvalid}
+	}
+
+	d, err := fsys.resolve(name, false)
+	if err != nil {
+		return "", &fs.PathError{Op: "readlink", Path: name, Err: err}
+	}
+
+	if d.hdr.Typeflag != tar.TypeSymlink {
+		return "", &fs.PathError{Op: "readlink", Path: name, Err: fs.ErrInvalid}
+	}
+
+	return d.hdr.Linkname, nil
+}
+
+// StatLink returns a FileInfo describing the file without following any symbolic links.
+// Experimental implementation of fs.ReadLinkFS:
+// https://github.com/golang/go/issues/49580
+func (fsys *FS) StatLink(name string) (fs.FileInfo, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "lstat", Path: name, Err: fs.ErrInvalid}
+	}
+
+	d, err := fsys.resolve(name, false)
+	if err != nil {
+		return nil, &fs.PathError{Op: "lstat", Path: name, Err: err}
+	}
+
+	return d.info(path.Base(name)), nil
+}
+
+// add inserts the entry into the tree, creating any missing parent
+// directories. Later entries replace earlier entries with the same name.
+func (fsys *FS) add(d *dirent) error {
+	dir := fsys.root
+
+	components := strings.Split(d.hdr.Name, "/")
+	for i, component := range components[:len(components)-1] {
+		parent, ok := dir.children[component]
+		if !ok {
+			parent = &dirent{hdr: &tar.Header{
+				Typeflag: tar.TypeDir,
+				Name:     strings.Join(components[:i+1], "/"),
+				Mode:     0o755,
+			}}
+			dir.addChild(component, parent)
+		} else if parent.hdr.Typeflag != tar.TypeDir {
+			return fmt.Errorf("parent of %q is not a directory", d.hdr.Name)
+		}
+
+		dir = parent
+	}
+
+	name := components[len(components)-1]
+	if existing, ok := dir.children[name]; ok && existing.hdr.Typeflag == tar.TypeDir && d.hdr.Typeflag == tar.TypeDir {
+		// Only the metadata of the directory is replaced.
+		existing.hdr = d.hdr
+		return nil
+	}
+
+	dir.addChild(name, d)
+
+	return nil
+}
+
+// resolve looks up the named entry, following symlinks in all but the final
+// path component (and the final component too, if follow is set).
+func (fsys *FS) resolve(name string, follow bool) (*dirent, error) {
+	d := fsys.root
+
+	var links int
+	components := strings.Split(name, "/")
+	for len(components) > 0 {
+		component := components[0]
+		components = components[1:]
+
+		switch component {
+		case "", ".":
+			continue
+		case "..":
+			if d.parent != nil {
+				d = d.parent
+			}
+			continue
+		}
+
+		if d.hdr.Typeflag != tar.TypeDir {
+			return nil, fs.ErrNotExist
+		}
+
+		child, ok := d.children[component]
+		if !ok {
+			return nil, fs.ErrNotExist
+		}
+
+		if child.hdr.Typeflag == tar.TypeSymlink && (follow || len(components) > 0) {
+			links++
+			if links > maxSymlinks {
+				return nil, errors.New("too many levels of symbolic links")
+			}
+
+			if path.IsAbs(child.hdr.Linkname) {
+				d = fsys.root
+			}
+
+			components = append(strings.Split(child.hdr.Linkname, "/"), components...)
+			continue
+		}
+
+		d = child
+	}
+
+	return d, nil
+}
+
+// sparseReader returns a reader for the contents of a sparse file.
+func (fsys *FS) sparseReader(d *dirent) (io.Reader, error) {
+	tr := tar.NewReader(io.NewSectionReader(fsys.ra, d.resume, math.MaxInt64-d.resume))
+	for i := 0; i <= d.skip; i++ {
+		if _, err := tr.Next(); err != nil {
+			return nil, fmt.Errorf("failed to read tar header: %w", err)
+		}
+	}
+
+	return tr, nil
+}
+
+type dirent struct {
+	hdr      *tar.Header
+	parent   *dirent
+	children map[string]*dirent
+	// offset is the offset of the file contents within the archive (or -1 if
+	// the file is sparse).
+	offset int64
+	// resume is the offset of the last header boundary before the entry, and
+	// skip is the number of entries between that boundary and the entry.
+	resume int64
+	skip   int
+}
+
+func (d *dirent) addChild(name string, child *dirent) {
+	if d.children == nil {
+		d.children = make(map[string]*dirent)
+	}
+
+	child.parent = d
+	d.children[name] = child
+}
+
+func (d *dirent) entries() []fs.DirEntry {
+	entries := make([]fs.DirEntry, 0, len(d.children))
+	for name, child := range d.children {
+		entries = append(entries, fs.FileInfoToDirEntry(child.info(name)))
+	}
+
+	slices.SortFunc(entries, func(a, b fs.DirEntry) int {
+		return strings.Compare(a.Name(), b.Name())
+	})
+
+	return entries
+}
+
+// info returns a FileInfo for the entry (using the given name). The Sys method
+// of the FileInfo returns the entry's *tar.Header.
+func (d *dirent) info(name string) fs.FileInfo {
+	hdr := *d.hdr
+	hdr.Name = name
+	return hdr.FileInfo()
+}
+
+type file struct {
+	d    *dirent
+	name string
+	r    io.Reader
+	// dirOffset is the number of directory entries already returned by ReadDir.
+	dirOffset int
+}
+
+func (f *file) Stat() (fs.FileInfo, error) {
+	return f.d.info(f.name), nil
+}
+
+func (f *file) Read(p []byte) (int, error) {
+	return f.r.Read(p)
+}
+
+func (f *file) ReadDir(n int) ([]fs.DirEntry, error) {
+	if f.d.hdr.Typeflag != tar.TypeDir {
+		return nil, &fs.PathError{Op: "readdir", Path: f.name, Err: errors.New("not a directory")}
+	}
+
+	entries := f.d.entries()[f.dirOffset:]
+	if n > 0 {
+		if len(entries) == 0 {
+			return nil, io.EOF
+		}
+
+		entries = entries[:min(n, len(entries))]
+	}
+
+	f.dirOffset += len(entries)
+
+	return entries, nil
+}
+
+func (f *file) Close() error {
+	return nil
+}
+
+// regularFile is a file whose contents are stored contiguously in the
+// archive, so can be read at random.
+type regularFile struct {
+	*file
+	sr *io.SectionReader
+}
+
+func (f *regularFile) Read(p []byte) (int, error) {
+	return f.sr.Read(p)
+}
+
+func (f *regularFile) ReadAt(p []byte, off int64) (int, error) {
+	return f.sr.ReadAt(p, off)
+}
+
+func (f *regularFile) Seek(offset int64, whence int) (int64, error) {
+	return f.sr.Seek(offset, whence)
+}
+
+// cleanPath converts an archive path into a clean relative path.
+func cleanPath(name string) string {
+	name = path.Clean("/" + name)
+	if name == "/" {
+		return "."
+	}
+
+	return name[1:]
+}
+
+func isSparse(hdr *tar.Header) bool {
+	if hdr.Typeflag == tar.TypeGNUSparse {
+		return true
+	}
+
+	for key := range hdr.PAXRecords {
+		if strings.HasPrefix(key, "GNU.sparse.") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// dataSize returns the number of bytes of data following the header.
+func dataSize(hdr *tar.Header) int64 {
+	switch hdr.Typeflag {
+	case tar.TypeLink, tar.TypeSymlink, tar.TypeChar, tar.TypeBlock, tar.TypeDir, tar.TypeFifo:
+		return 0
+	}
+
+	return hdr.Size
+}
+
+func blockAlign(n int64) int64 {
+	return (n + 511) &^ 511
+}
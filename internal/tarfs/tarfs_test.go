@@ -0,0 +1,218 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package tarfs_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/fs"
+	"testing"
+	"testing/fstest"
+
+	"github.com/immutos/oci2erofs/internal/tarfs"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFS(t *testing.T) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+
+	writeFile := func(name, content string) {
+		require.NoError(t, tw.WriteHeader(&tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     name,
+			Mode:     0o644,
+			Uid:      1000,
+			Size:     int64(len(content)),
+		}))
+
+		_, err := tw.Write([]byte(content))
+		require.NoError(t, err)
+	}
+
+	require.NoError(t, tw.WriteHeader(&tar.Header{Typeflag: tar.TypeDir, Name: "./", Mode: 0o700}))
+	writeFile("./etc/hostname", "localhost\n")
+	require.NoError(t, tw.WriteHeader(&tar.Header{Typeflag: tar.TypeDir, Name: "./etc/", Mode: 0o750, Uid: 1000}))
+	writeFile("./usr/bin/busybox", string(bytes.Repeat([]byte("busybox"), 1000)))
+	require.NoError(t, tw.WriteHeader(&tar.Header{Typeflag: tar.TypeSymlink, Name: "./bin", Linkname: "usr/bin"}))
+	require.NoError(t, tw.WriteHeader(&tar.Header{Typeflag: tar.TypeSymlink, Name: "./usr/bin/sh", Linkname: "../../bin/busybox"}))
+	require.NoError(t, tw.WriteHeader(&tar.Header{Typeflag: tar.TypeLink, Name: "./usr/bin/ls", Linkname: "./usr/bin/busybox"}))
+	writeFile("./etc/hostname", "example\n")
+	require.NoError(t, tw.Close())
+
+	fsys, err := tarfs.Open(bytes.NewReader(buf.Bytes()))
+	require.NoError(t, err)
+
+	t.Run("FS", func(t *testing.T) {
+		require.NoError(t, fstest.TestFS(fsys, "etc/hostname", "usr/bin/busybox", "usr/bin/ls", "usr/bin/sh"))
+	})
+
+	t.Run("Read", func(t *testing.T) {
+		data, err := fs.ReadFile(fsys, "etc/hostname")
+		require.NoError(t, err)
+		require.Equal(t, "example\n", string(data))
+
+		f, err := fsys.Open("usr/bin/busybox")
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			require.NoError(t, f.Close())
+		})
+
+		p := make([]byte, 7)
+		n, err := f.(io.ReaderAt).ReadAt(p, 7*999)
+		require.NoError(t, err)
+		require.Equal(t, "busybox", string(p[:n]))
+	})
+
+	t.Run("Directories", func(t *testing.T) {
+		fi, err := fsys.Stat(".")
+		require.NoError(t, err)
+		require.Equal(t, fs.ModeDir|0o700, fi.Mode())
+
+		fi, err = fsys.Stat("etc")
+		require.NoError(t, err)
+		require.Equal(t, fs.ModeDir|0o750, fi.Mode())
+		require.Equal(t, 1000, fi.Sys().(*tar.Header).Uid)
+
+		// Implicitly created.
+		fi, err = fsys.Stat("usr")
+		require.NoError(t, err)
+		require.Equal(t, fs.ModeDir|0o755, fi.Mode())
+
+		entries, err := fs.ReadDir(fsys, "bin")
+		require.NoError(t, err)
+		require.Len(t, entries, 3)
+		require.Equal(t, "busybox", entries[0].Name())
+		require.Equal(t, "ls", entries[1].Name())
+		require.Equal(t, "sh", entries[2].Name())
+		require.Equal(t, fs.ModeSymlink, entries[2].Type())
+	})
+
+	t.Run("Symlinks", func(t *testing.T) {
+		target, err := fsys.ReadLink("usr/bin/sh")
+		require.NoError(t, err)
+		require.Equal(t, "../../bin/busybox", target)
+
+		fi, err := fsys.StatLink("usr/bin/sh")
+		require.NoError(t, err)
+		require.Equal(t, fs.ModeSymlink, fi.Mode().Type())
+
+		data, err := fs.ReadFile(fsys, "bin/sh")
+		require.NoError(t, err)
+		require.Equal(t, 7000, len(data))
+	})
+
+	t.Run("Unresolvable Symlinks", func(t *testing.T) {
+		var buf bytes.Buffer
+		tw := tar.NewWriter(&buf)
+		require.NoError(t, tw.WriteHeader(&tar.Header{Typeflag: tar.TypeSymlink, Name: "mtab", Linkname: "/proc/self/mounts"}))
+		require.NoError(t, tw.WriteHeader(&tar.Header{Typeflag: tar.TypeSymlink, Name: "loop", Linkname: "./loop"}))
+		require.NoError(t, tw.Close())
+
+		fsys, err := tarfs.Open(bytes.NewReader(buf.Bytes()))
+		require.NoError(t, err)
+
+		_, err = fsys.Open("mtab")
+		require.ErrorIs(t, err, fs.ErrNotExist)
+
+		_, err = fsys.Open("loop")
+		require.ErrorContains(t, err, "too many levels of symbolic links")
+	})
+
+	t.Run("Hardlinks", func(t *testing.T) {
+		fi, err := fsys.StatLink("usr/bin/ls")
+		require.NoError(t, err)
+		require.True(t, fi.Mode().IsRegular())
+		require.Equal(t, "ls", fi.Name())
+		require.Equal(t, int64(7000), fi.Size())
+		require.Equal(t, "usr/bin/busybox", fi.Sys().(*tar.Header).Linkname)
+
+		data, err := fs.ReadFile(fsys, "usr/bin/ls")
+		require.NoError(t, err)
+		require.Equal(t, 7000, len(data))
+	})
+
+	t.Run("Hardlink To Symlink", func(t *testing.T) {
+		var buf bytes.Buffer
+		tw := tar.NewWriter(&buf)
+		require.NoError(t, tw.WriteHeader(&tar.Header{Typeflag: tar.TypeSymlink, Name: "sym", Linkname: "target"}))
+		require.NoError(t, tw.WriteHeader(&tar.Header{Typeflag: tar.TypeLink, Name: "hl", Linkname: "sym"}))
+		require.NoError(t, tw.Close())
+
+		fsys, err := tarfs.Open(bytes.NewReader(buf.Bytes()))
+		require.NoError(t, err)
+
+		fi, err := fsys.StatLink("hl")
+		require.NoError(t, err)
+		require.Equal(t, fs.ModeSymlink, fi.Mode().Type())
+
+		target, err := fsys.ReadLink("hl")
+		require.NoError(t, err)
+		require.Equal(t, "target", target)
+	})
+}
+
+func TestSparse(t *testing.T) {
+	// The standard library cannot write sparse files, so rename placeholder
+	// PAX records to the GNU sparse (format 1.0) records.
+	sparseMap := make([]byte, 512)
+	copy(sparseMap, "1\n5\n5\n")
+	content := append(sparseMap, "hello"...)
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+
+	require.NoError(t, tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     "GNUSparseFile.0/sparse",
+		Mode:     0o644,
+		Size:     int64(len(content)),
+		PAXRecords: map[string]string{
+			"XXX.sparse.major":    "1",
+			"XXX.sparse.minor":    "0",
+			"XXX.sparse.name":     "sparse",
+			"XXX.sparse.realsize": "10",
+		},
+		Format: tar.FormatPAX,
+	}))
+
+	_, err := tw.Write(content)
+	require.NoError(t, err)
+
+	require.NoError(t, tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: "after", Mode: 0o644, Size: 5}))
+
+	_, err = tw.Write([]byte("world"))
+	require.NoError(t, err)
+
+	require.NoError(t, tw.Close())
+
+	data := bytes.ReplaceAll(buf.Bytes(), []byte("XXX.sparse."), []byte("GNU.sparse."))
+
+	fsys, err := tarfs.Open(bytes.NewReader(data))
+	require.NoError(t, err)
+
+	sparse, err := fs.ReadFile(fsys, "sparse")
+	require.NoError(t, err)
+	require.Equal(t, "\x00\x00\x00\x00\x00hello", string(sparse))
+
+	after, err := fs.ReadFile(fsys, "after")
+	require.NoError(t, err)
+	require.Equal(t, "world", string(after))
+}
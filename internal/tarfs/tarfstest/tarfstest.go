@@ -0,0 +1,63 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+// Package tarfstest builds tar layers for use in tests.
+package tarfstest
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/fs"
+	"path"
+	"testing"
+
+	"github.com/immutos/oci2erofs/internal/tarfs"
+	"github.com/stretchr/testify/require"
+)
+
+// NewLayer returns a layer holding the entries described by hdrs. Regular
+// files contain their base name (truncated to their size, if set).
+func NewLayer(t testing.TB, hdrs []tar.Header) fs.FS {
+	t.Helper()
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+
+	for _, hdr := range hdrs {
+		var content []byte
+		if hdr.Typeflag == tar.TypeReg {
+			content = []byte(path.Base(hdr.Name))
+			if hdr.Size > 0 {
+				content = content[:hdr.Size]
+			}
+			hdr.Size = int64(len(content))
+		}
+
+		require.NoError(t, tw.WriteHeader(&hdr))
+
+		_, err := tw.Write(content)
+		require.NoError(t, err)
+	}
+
+	require.NoError(t, tw.Close())
+
+	layer, err := tarfs.Open(bytes.NewReader(buf.Bytes()))
+	require.NoError(t, err)
+
+	return layer
+}
@@ -19,6 +19,9 @@
 package util
 
 import (
+	"slices"
+	"strings"
+
 	"github.com/urfave/cli/v2"
 )
 
@@ -34,3 +37,70 @@ func BeforeAll(fns ...cli.BeforeFunc) cli.BeforeFunc {
 		return nil
 	}
 }
+
+// ReorderArgs moves flags ahead of positional arguments (eg. so that
+// "oci2erofs - -o -" is parsed as intended), as flag parsing otherwise stops
+// at the first positional argument. Arguments following "--" are left as is.
+func ReorderArgs(app *cli.App, args []string) []string {
+	if len(args) == 0 {
+		return args
+	}
+
+	return append([]string{args[0]}, reorderArgs(app.Flags, app.Commands, args[1:])...)
+}
+
+func reorderArgs(flags []cli.Flag, commands []*cli.Command, args []string) []string {
+	var flagArgs, positionalArgs []string
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+
+		if arg == "--" {
+			return append(append(flagArgs, "--"), append(positionalArgs, args[i+1:]...)...)
+		}
+
+		// A lone "-" denotes stdin (or stdout).
+		if strings.HasPrefix(arg, "-") && arg != "-" {
+			flagArgs = append(flagArgs, arg)
+
+			if !strings.Contains(arg, "=") && takesValue(flags, strings.TrimLeft(arg, "-")) && i+1 < len(args) {
+				i++
+				flagArgs = append(flagArgs, args[i])
+			}
+
+			continue
+		}
+
+		// Subcommands parse their own flags.
+		if len(positionalArgs) == 0 {
+			if cmd := findCommand(commands, arg); cmd != nil {
+				return append(append(flagArgs, arg), reorderArgs(cmd.Flags, cmd.Subcommands, args[i+1:])...)
+			}
+		}
+
+		positionalArgs = append(positionalArgs, arg)
+	}
+
+	return append(flagArgs, positionalArgs...)
+}
+
+func takesValue(flags []cli.Flag, name string) bool {
+	for _, flag := range flags {
+		if slices.Contains(flag.Names(), name) {
+			_, isBool := flag.(*cli.BoolFlag)
+			return !isBool
+		}
+	}
+
+	// Eg. the help and version flags.
+	return false
+}
+
+func findCommand(commands []*cli.Command, name string) *cli.Command {
+	for _, cmd := range commands {
+		if cmd.HasName(name) {
+			return cmd
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,176 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package util
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"path"
+
+	"github.com/dpeckett/archivefs"
+	"github.com/immutos/oci2erofs/internal/xattr"
+)
+
+// ContextReader returns a reader that stops reading once the context is
+// cancelled.
+func ContextReader(ctx context.Context, r io.Reader) io.Reader {
+	return &contextReader{ctx: ctx, r: r}
+}
+
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r *contextReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	return r.r.Read(p)
+}
+
+var (
+	_ fs.ReadDirFS         = (*ContextFS)(nil)
+	_ fs.StatFS            = (*ContextFS)(nil)
+	_ archivefs.ReadLinkFS = (*ContextFS)(nil)
+	_ xattr.FS             = (*ContextFS)(nil)
+)
+
+// ContextFS wraps a filesystem so that operations on it (including reads
+// from opened files) fail once the context is cancelled. This allows long
+// running consumers that don't accept a context (eg. erofs.Create) to be
+// interrupted.
+type ContextFS struct {
+	ctx  context.Context
+	fsys fs.FS
+}
+
+// NewContextFS returns fsys wrapped so that it is bound to ctx.
+func NewContextFS(ctx context.Context, fsys fs.FS) *ContextFS {
+	return &ContextFS{ctx: ctx, fsys: fsys}
+}
+
+func (fsys *ContextFS) Open(name string) (fs.File, error) {
+	if err := fsys.ctx.Err(); err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+
+	f, err := fsys.fsys.Open(name)
+	if err != nil {
+		return nil, err
+	}
+
+	return &contextFile{File: f, r: ContextReader(fsys.ctx, f)}, nil
+}
+
+func (fsys *ContextFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	if err := fsys.ctx.Err(); err != nil {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: err}
+	}
+
+	return fs.ReadDir(fsys.fsys, name)
+}
+
+func (fsys *ContextFS) Stat(name string) (fs.FileInfo, error) {
+	if err := fsys.ctx.Err(); err != nil {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: err}
+	}
+
+	return fs.Stat(fsys.fsys, name)
+}
+
+func (fsys *ContextFS) ReadLink(name string) (string, error) {
+	if err := fsys.ctx.Err(); err != nil {
+		return "", &fs.PathError{Op: "readlink", Path: name, Err: err}
+	}
+
+	linkFS, ok := fsys.fsys.(archivefs.ReadLinkFS)
+	if !ok {
+		return "", &fs.PathError{Op: "readlink", Path: name, Err: errors.ErrUnsupported}
+	}
+
+	return linkFS.ReadLink(name)
+}
+
+func (fsys *ContextFS) StatLink(name string) (fs.FileInfo, error) {
+	if err := fsys.ctx.Err(); err != nil {
+		return nil, &fs.PathError{Op: "lstat", Path: name, Err: err}
+	}
+
+	linkFS, ok := fsys.fsys.(archivefs.ReadLinkFS)
+	if !ok {
+		return nil, &fs.PathError{Op: "lstat", Path: name, Err: errors.ErrUnsupported}
+	}
+
+	return linkFS.StatLink(name)
+}
+
+// Xattrs returns the extended attributes of the named file (if the wrapped
+// filesystem exposes them).
+func (fsys *ContextFS) Xattrs(name string) (map[string]string, error) {
+	if err := fsys.ctx.Err(); err != nil {
+		return nil, &fs.PathError{Op: "getxattr", Path: name, Err: err}
+	}
+
+	xfs, ok := fsys.fsys.(xattr.FS)
+	if !ok {
+		return nil, nil
+	}
+
+	return xfs.Xattrs(name)
+}
+
+// Hardlink returns the first name of the named file and its number of names
+// (if the wrapped filesystem tracks hardlinks, otherwise every file has a
+// single name).
+func (fsys *ContextFS) Hardlink(name string) (string, int, error) {
+	if err := fsys.ctx.Err(); err != nil {
+		return "", 0, &fs.PathError{Op: "hardlink", Path: name, Err: err}
+	}
+
+	hfs, ok := fsys.fsys.(interface {
+		Hardlink(name string) (string, int, error)
+	})
+	if !ok {
+		return path.Clean(name), 1, nil
+	}
+
+	return hfs.Hardlink(name)
+}
+
+type contextFile struct {
+	fs.File
+	r io.Reader
+}
+
+func (f *contextFile) Read(p []byte) (int, error) {
+	return f.r.Read(p)
+}
+
+func (f *contextFile) ReadDir(n int) ([]fs.DirEntry, error) {
+	d, ok := f.File.(fs.ReadDirFile)
+	if !ok {
+		return nil, &fs.PathError{Op: "readdir", Err: errors.ErrUnsupported}
+	}
+
+	return d.ReadDir(n)
+}
@@ -0,0 +1,85 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package util
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+var sizeUnits = []struct {
+	suffix string
+	size   int64
+}{
+	{"TiB", 1 << 40}, {"GiB", 1 << 30}, {"MiB", 1 << 20}, {"KiB", 1 << 10},
+	{"T", 1 << 40}, {"G", 1 << 30}, {"M", 1 << 20}, {"K", 1 << 10},
+	{"B", 1},
+}
+
+// SizeFlag is a urfave/cli compatible flag for specifying a size in bytes
+// (with an optional binary unit suffix, eg. "512MiB" or "10G").
+type SizeFlag int64
+
+func FromSize(size int64) *SizeFlag {
+	f := SizeFlag(size)
+	return &f
+}
+
+func (f *SizeFlag) Set(value string) error {
+	size, err := ParseSize(value)
+	if err != nil {
+		return err
+	}
+
+	*f = SizeFlag(size)
+	return nil
+}
+
+func (f *SizeFlag) String() string {
+	size := int64(*f)
+	for _, unit := range sizeUnits {
+		if size != 0 && size%unit.size == 0 {
+			return strconv.FormatInt(size/unit.size, 10) + unit.suffix
+		}
+	}
+
+	return strconv.FormatInt(size, 10)
+}
+
+// ParseSize parses a size in bytes (with an optional binary unit suffix).
+func ParseSize(value string) (int64, error) {
+	number := strings.TrimSpace(value)
+
+	multiplier := int64(1)
+	for _, unit := range sizeUnits {
+		if strings.HasSuffix(strings.ToUpper(number), strings.ToUpper(unit.suffix)) {
+			number = strings.TrimSpace(number[:len(number)-len(unit.suffix)])
+			multiplier = unit.size
+			break
+		}
+	}
+
+	size, err := strconv.ParseInt(number, 10, 64)
+	if err != nil || size < 0 {
+		return 0, fmt.Errorf("invalid size: %q", value)
+	}
+
+	return size * multiplier, nil
+}
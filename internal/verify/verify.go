@@ -0,0 +1,324 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+// Package verify compares an EROFS filesystem image with the root filesystem
+// it was produced from.
+package verify
+
+import (
+	"archive/tar"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"maps"
+	"slices"
+	"strings"
+
+	"github.com/immutos/oci2erofs/internal/erofs"
+	"github.com/immutos/oci2erofs/internal/fsutil"
+	"github.com/immutos/oci2erofs/internal/xattr"
+	"github.com/opencontainers/go-digest"
+)
+
+// Kind is the kind of a difference.
+type Kind string
+
+const (
+	KindMissing    Kind = "missing"
+	KindUnexpected Kind = "unexpected"
+	KindType       Kind = "type"
+	KindMode       Kind = "mode"
+	KindUID        Kind = "uid"
+	KindGID        Kind = "gid"
+	KindSize       Kind = "size"
+	KindContent    Kind = "content"
+	KindTarget     Kind = "target"
+	KindDevice     Kind = "device"
+	KindXattrs     Kind = "xattrs"
+)
+
+// Difference describes a mismatch between an entry of the expected (source)
+// filesystem and the actual (EROFS) filesystem.
+type Difference struct {
+	// Path is the absolute path of the entry.
+	Path string
+	// Kind is the kind of the difference.
+	Kind Kind
+	// Expected is the value in the expected filesystem.
+	Expected string
+	// Actual is the value in the actual filesystem.
+	Actual string
+}
+
+func (d Difference) String() string {
+	switch d.Kind {
+	case KindMissing:
+		return fmt.Sprintf("%s: missing", d.Path)
+	case KindUnexpected:
+		return fmt.Sprintf("%s: unexpected", d.Path)
+	default:
+		return fmt.Sprintf("%s: %s differs (expected %s, actual %s)", d.Path, d.Kind, d.Expected, d.Actual)
+	}
+}
+
+// Options describes how the EROFS filesystem image was created, so that
+// entries it deliberately omits are not reported as differences.
+type Options struct {
+	// SkipDevices expects character and block devices to be omitted.
+	SkipDevices bool
+	// XattrFilter selects the extended attributes expected to be stored
+	// (extended attributes that EROFS cannot store are never expected).
+	XattrFilter xattr.Filter
+}
+
+// Compare compares the expected filesystem with the actual filesystem entry
+// by entry, returning every difference found. Symlinks are not followed.
+//
+// Modification times are not compared (EROFS images may record a single build
+// time), nor are hardlinks (each name of a file is compared as a file of its
+// own).
+func Compare(ctx context.Context, expected, actual fs.FS, opts Options) ([]Difference, error) {
+	var diffs []Difference
+	seen := make(map[string]bool)
+
+	err := fs.WalkDir(expected, ".", func(name string, _ fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		expectedFI, err := fsutil.StatLink(expected, name)
+		if err != nil {
+			return err
+		}
+
+		if opts.SkipDevices && expectedFI.Mode()&fs.ModeDevice != 0 {
+			return nil
+		}
+
+		seen[name] = true
+
+		actualFI, err := fsutil.StatLink(actual, name)
+		if err != nil {
+			if !errors.Is(err, fs.ErrNotExist) {
+				return err
+			}
+
+			diffs = append(diffs, Difference{Path: fsutil.DisplayPath(name), Kind: KindMissing})
+
+			// Don't report every descendant of a missing directory.
+			if expectedFI.IsDir() {
+				return fs.SkipDir
+			}
+
+			return nil
+		}
+
+		entryDiffs, err := compareEntry(expected, actual, name, expectedFI, actualFI, opts)
+		if err != nil {
+			return err
+		}
+		diffs = append(diffs, entryDiffs...)
+
+		// The type difference covers the descendants of a directory that is
+		// not a directory in the actual filesystem.
+		if expectedFI.IsDir() && !actualFI.IsDir() {
+			return fs.SkipDir
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to walk expected filesystem: %w", err)
+	}
+
+	err = fs.WalkDir(actual, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		if seen[name] {
+			return nil
+		}
+
+		diffs = append(diffs, Difference{Path: fsutil.DisplayPath(name), Kind: KindUnexpected})
+
+		if d.IsDir() {
+			return fs.SkipDir
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to walk actual filesystem: %w", err)
+	}
+
+	slices.SortStableFunc(diffs, func(a, b Difference) int {
+		return strings.Compare(a.Path, b.Path)
+	})
+
+	return diffs, nil
+}
+
+func compareEntry(expected, actual fs.FS, name string, expectedFI, actualFI fs.FileInfo, opts Options) ([]Difference, error) {
+	var diffs []Difference
+	add := func(kind Kind, expected, actual string) {
+		diffs = append(diffs, Difference{Path: fsutil.DisplayPath(name), Kind: kind, Expected: expected, Actual: actual})
+	}
+
+	if expectedFI.Mode().Type() != actualFI.Mode().Type() {
+		add(KindType, fsutil.TypeName(expectedFI.Mode()), fsutil.TypeName(actualFI.Mode()))
+		return diffs, nil
+	}
+
+	if expectedFI.Mode() != actualFI.Mode() {
+		add(KindMode, fmt.Sprintf("%04o", fsutil.UnixPerm(expectedFI.Mode())), fmt.Sprintf("%04o", fsutil.UnixPerm(actualFI.Mode())))
+	}
+
+	expectedUID, expectedGID := fsutil.Owner(expectedFI)
+	actualUID, actualGID := fsutil.Owner(actualFI)
+	if expectedUID != actualUID {
+		add(KindUID, fmt.Sprint(expectedUID), fmt.Sprint(actualUID))
+	}
+	if expectedGID != actualGID {
+		add(KindGID, fmt.Sprint(expectedGID), fmt.Sprint(actualGID))
+	}
+
+	expectedXattrs, err := xattrs(expectedFI)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read xattrs of %q: %w", name, err)
+	}
+
+	expectedXattrs = opts.XattrFilter.Apply(expectedXattrs)
+	maps.DeleteFunc(expectedXattrs, func(name, _ string) bool {
+		return !erofs.XattrSupported(name)
+	})
+
+	actualXattrs, err := xattrs(actualFI)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read xattrs of %q: %w", name, err)
+	}
+
+	if !maps.Equal(expectedXattrs, actualXattrs) {
+		add(KindXattrs, formatXattrs(expectedXattrs), formatXattrs(actualXattrs))
+	}
+
+	switch {
+	case expectedFI.Mode().IsRegular():
+		if expectedFI.Size() != actualFI.Size() {
+			add(KindSize, fmt.Sprint(expectedFI.Size()), fmt.Sprint(actualFI.Size()))
+			break
+		}
+
+		expectedDigest, err := digestFile(expected, name)
+		if err != nil {
+			return nil, err
+		}
+
+		actualDigest, err := digestFile(actual, name)
+		if err != nil {
+			return nil, err
+		}
+
+		if expectedDigest != actualDigest {
+			add(KindContent, expectedDigest.String(), actualDigest.String())
+		}
+	case expectedFI.Mode()&fs.ModeSymlink != 0:
+		expectedTarget, err := fsutil.ReadLink(expected, name)
+		if err != nil {
+			return nil, err
+		}
+
+		actualTarget, err := fsutil.ReadLink(actual, name)
+		if err != nil {
+			return nil, err
+		}
+
+		if expectedTarget != actualTarget {
+			add(KindTarget, expectedTarget, actualTarget)
+		}
+	case expectedFI.Mode()&fs.ModeDevice != 0:
+		if expectedDevice, actualDevice := device(expectedFI), device(actualFI); expectedDevice != actualDevice {
+			add(KindDevice, expectedDevice, actualDevice)
+		}
+	}
+
+	return diffs, nil
+}
+
+func digestFile(fsys fs.FS, name string) (digest.Digest, error) {
+	f, err := fsys.Open(name)
+	if err != nil {
+		return "", fmt.Errorf("failed to open %q: %w", name, err)
+	}
+	defer f.Close()
+
+	dgst, err := digest.FromReader(f)
+	if err != nil {
+		return "", fmt.Errorf("failed to read %q: %w", name, err)
+	}
+
+	return dgst, nil
+}
+
+// device returns the major and minor numbers of a device (as "major:minor").
+func device(fi fs.FileInfo) string {
+	var major, minor uint32
+	switch sys := fi.Sys().(type) {
+	case *tar.Header:
+		major, minor = uint32(sys.Devmajor), uint32(sys.Devminor)
+	case *erofs.Inode:
+		major, minor = sys.Device()
+	}
+
+	return fmt.Sprintf("%d:%d", major, minor)
+}
+
+// xattrs returns the extended attributes of the file (if any).
+func xattrs(fi fs.FileInfo) (map[string]string, error) {
+	switch sys := fi.Sys().(type) {
+	case *tar.Header:
+		return xattr.FromHeader(sys)
+	case *erofs.Inode:
+		return sys.Xattrs()
+	default:
+		return nil, nil
+	}
+}
+
+func formatXattrs(attrs map[string]string) string {
+	if len(attrs) == 0 {
+		return "none"
+	}
+
+	names := make([]string, 0, len(attrs))
+	for name := range attrs {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	return strings.Join(names, ",")
+}
@@ -0,0 +1,196 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package verify_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/immutos/oci2erofs/internal/erofs"
+	"github.com/immutos/oci2erofs/internal/tarfs"
+	"github.com/immutos/oci2erofs/internal/tarfs/tarfstest"
+	"github.com/immutos/oci2erofs/internal/verify"
+	"github.com/immutos/oci2erofs/internal/xattr"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompare(t *testing.T) {
+	ctx := context.Background()
+
+	src := tarfstest.NewLayer(t, []tar.Header{
+		{Typeflag: tar.TypeDir, Name: "etc/", Mode: 0o755},
+		{Typeflag: tar.TypeReg, Name: "etc/hostname", Mode: 0o644, Uid: 1000, Gid: 1000},
+		{Typeflag: tar.TypeReg, Name: "etc/passwd", Mode: 0o644},
+		{Typeflag: tar.TypeDir, Name: "root/", Mode: 0o700},
+		{Typeflag: tar.TypeReg, Name: "root/.profile", Mode: 0o600},
+		{Typeflag: tar.TypeSymlink, Name: "sh", Linkname: "busybox", Mode: 0o777},
+		{Typeflag: tar.TypeReg, Name: "busybox", Mode: 0o755, PAXRecords: map[string]string{
+			"SCHILY.xattr.security.capability": "\x01\x00\x00\x02",
+		}},
+		{Typeflag: tar.TypeChar, Name: "console", Mode: 0o600, Devmajor: 5, Devminor: 1},
+		{Typeflag: tar.TypeReg, Name: "su", Mode: 0o4755},
+		{Typeflag: tar.TypeDir, Name: "tmp/", Mode: 0o1777},
+	})
+
+	f, err := os.Create(filepath.Join(t.TempDir(), "rootfs.erofs"))
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, f.Close())
+	})
+
+	require.NoError(t, erofs.Create(f, src, nil))
+
+	erofsFS, err := erofs.Open(f)
+	require.NoError(t, err)
+
+	t.Run("Identical", func(t *testing.T) {
+		diffs, err := verify.Compare(ctx, src, erofsFS, verify.Options{})
+		require.NoError(t, err)
+		require.Empty(t, diffs)
+	})
+
+	t.Run("Differences", func(t *testing.T) {
+		modified := tarfstest.NewLayer(t, []tar.Header{
+			{Typeflag: tar.TypeDir, Name: "etc/", Mode: 0o755},
+			{Typeflag: tar.TypeReg, Name: "etc/hostname", Mode: 0o600, Uid: 0, Gid: 1000},
+			{Typeflag: tar.TypeReg, Name: "etc/passwd", Mode: 0o644, PAXRecords: map[string]string{
+				"SCHILY.xattr.user.comment": "hello",
+			}},
+			{Typeflag: tar.TypeReg, Name: "etc/shadow", Mode: 0o600},
+			{Typeflag: tar.TypeSymlink, Name: "sh", Linkname: "/bin/busybox", Mode: 0o777},
+			{Typeflag: tar.TypeDir, Name: "busybox/", Mode: 0o755},
+			{Typeflag: tar.TypeReg, Name: "busybox/busybox", Mode: 0o755},
+			{Typeflag: tar.TypeChar, Name: "console", Mode: 0o600, Devmajor: 5, Devminor: 2},
+			{Typeflag: tar.TypeReg, Name: "su", Mode: 0o755},
+			{Typeflag: tar.TypeDir, Name: "tmp/", Mode: 0o777},
+		})
+
+		diffs, err := verify.Compare(ctx, modified, erofsFS, verify.Options{})
+		require.NoError(t, err)
+
+		var lines []string
+		for _, diff := range diffs {
+			lines = append(lines, diff.String())
+		}
+
+		require.Equal(t, []string{
+			"/busybox: type differs (expected directory, actual regular file)",
+			"/console: device differs (expected 5:2, actual 5:1)",
+			"/etc/hostname: mode differs (expected 0600, actual 0644)",
+			"/etc/hostname: uid differs (expected 0, actual 1000)",
+			"/etc/passwd: xattrs differs (expected user.comment, actual none)",
+			"/etc/shadow: missing",
+			"/root: unexpected",
+			"/sh: target differs (expected /bin/busybox, actual busybox)",
+			"/su: mode differs (expected 0755, actual 4755)",
+			"/tmp: mode differs (expected 0777, actual 1777)",
+		}, lines)
+	})
+
+	t.Run("Content", func(t *testing.T) {
+		var buf bytes.Buffer
+		tw := tar.NewWriter(&buf)
+
+		for _, hdr := range []tar.Header{
+			{Typeflag: tar.TypeDir, Name: "etc/", Mode: 0o755},
+			{Typeflag: tar.TypeReg, Name: "etc/hostname", Mode: 0o644, Uid: 1000, Gid: 1000, Size: int64(len("hostnamX"))},
+		} {
+			require.NoError(t, tw.WriteHeader(&hdr))
+		}
+		_, err := tw.Write([]byte("hostnamX"))
+		require.NoError(t, err)
+		require.NoError(t, tw.Close())
+
+		modified, err := tarfs.Open(bytes.NewReader(buf.Bytes()))
+		require.NoError(t, err)
+
+		diffs, err := verify.Compare(ctx, modified, erofsFS, verify.Options{})
+		require.NoError(t, err)
+
+		var kinds []verify.Kind
+		for _, diff := range diffs {
+			if diff.Path == "/etc/hostname" {
+				kinds = append(kinds, diff.Kind)
+			}
+		}
+		require.Equal(t, []verify.Kind{verify.KindContent}, kinds)
+	})
+}
+
+func TestCompareOptions(t *testing.T) {
+	ctx := context.Background()
+
+	src := tarfstest.NewLayer(t, []tar.Header{
+		{Typeflag: tar.TypeReg, Name: "busybox", Mode: 0o755, PAXRecords: map[string]string{
+			"SCHILY.xattr.security.capability": "\x01\x00\x00\x02",
+			"SCHILY.xattr.user.comment":        "hello",
+			"SCHILY.xattr.com.example.tag":     "unsupported",
+		}},
+		{Typeflag: tar.TypeChar, Name: "console", Mode: 0o600, Devmajor: 5, Devminor: 1},
+		{Typeflag: tar.TypeFifo, Name: "initctl", Mode: 0o600},
+	})
+
+	filter, err := xattr.ParseFilter("", "user")
+	require.NoError(t, err)
+
+	f, err := os.Create(filepath.Join(t.TempDir(), "rootfs.erofs"))
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, f.Close())
+	})
+
+	require.NoError(t, erofs.Create(f, src, &erofs.CreateOptions{
+		SkipDevices: true,
+		XattrFilter: func(name string) bool {
+			return filter.Allowed(name) && erofs.XattrSupported(name)
+		},
+	}))
+
+	erofsFS, err := erofs.Open(f)
+	require.NoError(t, err)
+
+	t.Run("Matching", func(t *testing.T) {
+		diffs, err := verify.Compare(ctx, src, erofsFS, verify.Options{
+			SkipDevices: true,
+			XattrFilter: filter,
+		})
+		require.NoError(t, err)
+		require.Empty(t, diffs)
+	})
+
+	t.Run("Defaults", func(t *testing.T) {
+		diffs, err := verify.Compare(ctx, src, erofsFS, verify.Options{})
+		require.NoError(t, err)
+
+		var lines []string
+		for _, diff := range diffs {
+			lines = append(lines, diff.String())
+		}
+
+		// Unsupported extended attributes are never expected.
+		require.Equal(t, []string{
+			"/busybox: xattrs differs (expected security.capability,user.comment, actual security.capability)",
+			"/console: missing",
+		}, lines)
+	})
+}
@@ -0,0 +1,173 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+// Package xattr reads the extended attributes recorded in tar archives, and
+// filters them by namespace.
+package xattr
+
+import (
+	"archive/tar"
+	"encoding/base64"
+	"fmt"
+	"io/fs"
+	"net/url"
+	"strings"
+)
+
+const (
+	// schilyPrefix prefixes the PAX records of extended attributes written
+	// by GNU tar, star, and Go's archive/tar (the value is stored as is).
+	schilyPrefix = "SCHILY.xattr."
+	// libarchivePrefix prefixes the PAX records of extended attributes
+	// written by libarchive (the name is URL encoded, the value is base64
+	// encoded).
+	libarchivePrefix = "LIBARCHIVE.xattr."
+)
+
+// FS is a file system that exposes the extended attributes of its files.
+type FS interface {
+	fs.FS
+	// Xattrs returns the extended attributes of the named file (without
+	// following symbolic links).
+	Xattrs(name string) (map[string]string, error)
+}
+
+// FromHeader returns the extended attributes recorded in the PAX records of
+// the tar header (or nil if there are none).
+func FromHeader(hdr *tar.Header) (map[string]string, error) {
+	var attrs map[string]string
+	set := func(name, value string) {
+		if attrs == nil {
+			attrs = make(map[string]string)
+		}
+		attrs[name] = value
+	}
+
+	for key, value := range hdr.PAXRecords {
+		if name, ok := strings.CutPrefix(key, schilyPrefix); ok {
+			set(name, value)
+		}
+	}
+
+	// libarchive writes both forms, the base64 encoded values are binary safe
+	// so take precedence.
+	for key, value := range hdr.PAXRecords {
+		encodedName, ok := strings.CutPrefix(key, libarchivePrefix)
+		if !ok {
+			continue
+		}
+
+		name, err := url.PathUnescape(encodedName)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode extended attribute name %q: %w", encodedName, err)
+		}
+
+		// libarchive omits the padding.
+		decoded, err := base64.RawStdEncoding.DecodeString(strings.TrimRight(value, "="))
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode extended attribute %q: %w", name, err)
+		}
+
+		set(name, string(decoded))
+	}
+
+	return attrs, nil
+}
+
+// Filter selects extended attributes by namespace (eg. "security") or by
+// name (eg. "security.capability"). The pattern "*" matches every
+// attribute.
+type Filter struct {
+	// Allow, if not empty, restricts the attributes to those matching one of
+	// the patterns.
+	Allow []string
+	// Deny excludes the attributes matching any of the patterns (even if
+	// they are allowed).
+	Deny []string
+}
+
+// ParseFilter returns the filter for the comma separated lists of allowed
+// and denied patterns.
+func ParseFilter(allow, deny string) (Filter, error) {
+	var f Filter
+	var err error
+
+	f.Allow, err = parsePatterns(allow)
+	if err != nil {
+		return Filter{}, fmt.Errorf("invalid allowed extended attributes: %w", err)
+	}
+
+	f.Deny, err = parsePatterns(deny)
+	if err != nil {
+		return Filter{}, fmt.Errorf("invalid denied extended attributes: %w", err)
+	}
+
+	return f, nil
+}
+
+// Allowed reports whether the named attribute passes the filter.
+func (f Filter) Allowed(name string) bool {
+	if len(f.Allow) > 0 && !matchAny(f.Allow, name) {
+		return false
+	}
+
+	return !matchAny(f.Deny, name)
+}
+
+// Apply returns the attributes that pass the filter.
+func (f Filter) Apply(attrs map[string]string) map[string]string {
+	var filtered map[string]string
+	for name, value := range attrs {
+		if f.Allowed(name) {
+			if filtered == nil {
+				filtered = make(map[string]string)
+			}
+			filtered[name] = value
+		}
+	}
+
+	return filtered
+}
+
+func parsePatterns(s string) ([]string, error) {
+	var patterns []string
+	for _, pattern := range strings.Split(s, ",") {
+		pattern = strings.TrimSpace(pattern)
+		if pattern == "" {
+			continue
+		}
+
+		if strings.HasPrefix(pattern, ".") || strings.HasSuffix(pattern, ".") {
+			return nil, fmt.Errorf("invalid pattern %q", pattern)
+		}
+
+		patterns = append(patterns, pattern)
+	}
+
+	return patterns, nil
+}
+
+func matchAny(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if pattern == "*" || name == pattern || strings.HasPrefix(name, pattern+".") {
+			return true
+		}
+	}
+
+	return false
+}
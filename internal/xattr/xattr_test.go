@@ -0,0 +1,122 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package xattr_test
+
+import (
+	"archive/tar"
+	"testing"
+
+	"github.com/immutos/oci2erofs/internal/xattr"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFromHeader(t *testing.T) {
+	t.Run("SCHILY", func(t *testing.T) {
+		attrs, err := xattr.FromHeader(&tar.Header{PAXRecords: map[string]string{
+			"SCHILY.xattr.security.capability": "\x01\x00\x00\x02",
+			"SCHILY.xattr.user.comment":        "hello",
+			"GNU.sparse.major":                 "1",
+		}})
+		require.NoError(t, err)
+
+		require.Equal(t, map[string]string{
+			"security.capability": "\x01\x00\x00\x02",
+			"user.comment":        "hello",
+		}, attrs)
+	})
+
+	t.Run("LIBARCHIVE", func(t *testing.T) {
+		attrs, err := xattr.FromHeader(&tar.Header{PAXRecords: map[string]string{
+			"SCHILY.xattr.user.comment":     "truncated",
+			"LIBARCHIVE.xattr.user.comment": "aGVsbG8Ad29ybGQ",
+			"LIBARCHIVE.xattr.user.a%3Db":   "eA==",
+		}})
+		require.NoError(t, err)
+
+		require.Equal(t, map[string]string{
+			"user.comment": "hello\x00world",
+			"user.a=b":     "x",
+		}, attrs)
+	})
+
+	t.Run("None", func(t *testing.T) {
+		attrs, err := xattr.FromHeader(&tar.Header{})
+		require.NoError(t, err)
+		require.Nil(t, attrs)
+	})
+
+	t.Run("Invalid", func(t *testing.T) {
+		_, err := xattr.FromHeader(&tar.Header{PAXRecords: map[string]string{
+			"LIBARCHIVE.xattr.user.comment": "!!!",
+		}})
+		require.ErrorContains(t, err, "failed to decode extended attribute \"user.comment\"")
+	})
+}
+
+func TestFilter(t *testing.T) {
+	attrs := map[string]string{
+		"security.capability": "cap",
+		"security.selinux":    "label",
+		"trusted.overlay":     "y",
+		"user.comment":        "hello",
+	}
+
+	t.Run("Default", func(t *testing.T) {
+		require.Equal(t, attrs, xattr.Filter{}.Apply(attrs))
+	})
+
+	t.Run("Allow", func(t *testing.T) {
+		filter, err := xattr.ParseFilter("security, user.comment", "")
+		require.NoError(t, err)
+
+		require.Equal(t, map[string]string{
+			"security.capability": "cap",
+			"security.selinux":    "label",
+			"user.comment":        "hello",
+		}, filter.Apply(attrs))
+	})
+
+	t.Run("Deny", func(t *testing.T) {
+		filter, err := xattr.ParseFilter("security", "security.selinux,trusted")
+		require.NoError(t, err)
+
+		require.Equal(t, map[string]string{
+			"security.capability": "cap",
+		}, filter.Apply(attrs))
+	})
+
+	t.Run("Deny All", func(t *testing.T) {
+		filter, err := xattr.ParseFilter("", "*")
+		require.NoError(t, err)
+
+		require.Nil(t, filter.Apply(attrs))
+	})
+
+	t.Run("Prefix", func(t *testing.T) {
+		filter, err := xattr.ParseFilter("user.com", "")
+		require.NoError(t, err)
+
+		require.False(t, filter.Allowed("user.comment"))
+	})
+
+	t.Run("Invalid", func(t *testing.T) {
+		_, err := xattr.ParseFilter(".user", "")
+		require.ErrorContains(t, err, "invalid allowed extended attributes: invalid pattern \".user\"")
+	})
+}
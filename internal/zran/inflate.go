@@ -0,0 +1,657 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package zran
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+// The inflate implementation below is only used to build an index, it tracks
+// the bit offset of each DEFLATE block so that decompression can later be
+// resumed at a block boundary (with the standard library's compress/flate).
+
+const (
+	maxCodeBits  = 15
+	numLitLen    = 288
+	numDist      = 32
+	numCodeLen   = 19
+	endOfBlock   = 256
+	gzipID1      = 0x1f
+	gzipID2      = 0x8b
+	gzipDeflate  = 8
+	flagHdrCrc   = 1 << 1
+	flagExtra    = 1 << 2
+	flagName     = 1 << 3
+	flagComment  = 1 << 4
+	maxPadBytes  = 8
+	windowSize   = 1 << 15
+	flushSize    = 1 << 20
+	historyBytes = windowSize
+)
+
+var (
+	lengthBase = [29]uint16{3, 4, 5, 6, 7, 8, 9, 10, 11, 13, 15, 17, 19, 23, 27, 31,
+		35, 43, 51, 59, 67, 83, 99, 115, 131, 163, 195, 227, 258}
+	lengthExtra = [29]uint8{0, 0, 0, 0, 0, 0, 0, 0, 1, 1, 1, 1, 2, 2, 2, 2,
+		3, 3, 3, 3, 4, 4, 4, 4, 5, 5, 5, 5, 0}
+	distBase = [30]uint16{1, 2, 3, 4, 5, 7, 9, 13, 17, 25, 33, 49, 65, 97, 129, 193,
+		257, 385, 513, 769, 1025, 1537, 2049, 3073, 4097, 6145, 8193, 12289, 16385, 24577}
+	distExtra = [30]uint8{0, 0, 0, 0, 1, 1, 2, 2, 3, 3, 4, 4, 5, 5, 6, 6,
+		7, 7, 8, 8, 9, 9, 10, 10, 11, 11, 12, 12, 13, 13}
+	codeLenOrder = [numCodeLen]uint8{16, 17, 18, 0, 8, 7, 9, 6, 10, 5, 11, 4, 12, 3, 13, 2, 14, 1, 15}
+)
+
+var errCorrupt = errors.New("corrupt deflate stream")
+
+// bitReader reads a little endian bit stream.
+type bitReader struct {
+	r        io.Reader
+	buf      []byte
+	off, end int
+	readErr  error
+
+	bits  uint64
+	nbits uint
+	// pos is the number of bytes consumed into bits (including padding).
+	pos int64
+	// padding is the number of zero bytes appended past the end of r.
+	padding int64
+}
+
+func newBitReader(r io.Reader) *bitReader {
+	return &bitReader{
+		r:   r,
+		buf: make([]byte, 1<<16),
+	}
+}
+
+// bitPos returns the offset in bits of the next unread bit.
+func (br *bitReader) bitPos() int64 {
+	return br.pos*8 - int64(br.nbits)
+}
+
+// overrun reports whether any padding has been consumed.
+func (br *bitReader) overrun() bool {
+	return br.bitPos() > (br.pos-br.padding)*8
+}
+
+// refill reads as many bytes as will fit into the bit buffer.
+func (br *bitReader) refill() error {
+	for br.nbits <= 56 {
+		if br.off == br.end {
+			if br.readErr != nil {
+				if errors.Is(br.readErr, io.EOF) {
+					return nil
+				}
+				return br.readErr
+			}
+
+			n, err := br.r.Read(br.buf)
+			br.off, br.end = 0, n
+			br.readErr = err
+			continue
+		}
+
+		br.bits |= uint64(br.buf[br.off]) << br.nbits
+		br.nbits += 8
+		br.off++
+		br.pos++
+	}
+
+	return nil
+}
+
+func (br *bitReader) fill(n uint) error {
+	if br.nbits >= n {
+		return nil
+	}
+
+	if err := br.refill(); err != nil {
+		return err
+	}
+
+	// Pad the stream with zeros so that we can peek past the end, any
+	// consumption of the padding is detected later.
+	for br.nbits < n {
+		if br.padding >= maxPadBytes {
+			return io.ErrUnexpectedEOF
+		}
+
+		br.padding++
+		br.nbits += 8
+		br.pos++
+	}
+
+	return nil
+}
+
+func (br *bitReader) readBits(n uint) (uint32, error) {
+	if n == 0 {
+		return 0, nil
+	}
+
+	if err := br.fill(n); err != nil {
+		return 0, err
+	}
+
+	v := uint32(br.bits & (1<<n - 1))
+	br.bits >>= n
+	br.nbits -= n
+
+	return v, nil
+}
+
+func (br *bitReader) alignToByte() {
+	n := br.nbits % 8
+	br.bits >>= n
+	br.nbits -= n
+}
+
+func (br *bitReader) readByte() (byte, error) {
+	v, err := br.readBits(8)
+	if err != nil {
+		return 0, err
+	}
+
+	if br.overrun() {
+		return 0, io.ErrUnexpectedEOF
+	}
+
+	return byte(v), nil
+}
+
+// copyBytes copies n bytes from the (byte aligned) stream to out.
+func (br *bitReader) copyBytes(n int, out *history) error {
+	for ; n > 0 && br.nbits >= 8; n-- {
+		out.buf = append(out.buf, byte(br.bits))
+		br.bits >>= 8
+		br.nbits -= 8
+	}
+
+	if br.overrun() {
+		return io.ErrUnexpectedEOF
+	}
+
+	for n > 0 {
+		if br.off == br.end {
+			if br.readErr != nil {
+				if errors.Is(br.readErr, io.EOF) {
+					return io.ErrUnexpectedEOF
+				}
+				return br.readErr
+			}
+
+			m, err := br.r.Read(br.buf)
+			br.off, br.end = 0, m
+			br.readErr = err
+			continue
+		}
+
+		m := min(n, br.end-br.off)
+		out.buf = append(out.buf, br.buf[br.off:br.off+m]...)
+		br.off += m
+		br.pos += int64(m)
+		n -= m
+
+		if err := out.maybeFlush(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// atEOF reports whether the (byte aligned) stream has been fully consumed.
+func (br *bitReader) atEOF() (bool, error) {
+	if err := br.refill(); err != nil {
+		return false, err
+	}
+
+	return br.nbits < 8 || br.overrun(), nil
+}
+
+// huffman is a canonical Huffman decoding table, indexed by the next
+// (bit reversed) tableBits bits of the stream. Each entry holds the symbol in
+// the upper bits, and the code length in the lower 4 bits (zero for invalid
+// codes).
+type huffman struct {
+	table     []uint16
+	tableBits uint
+}
+
+func (h *huffman) init(lengths []uint8) error {
+	var count [maxCodeBits + 1]int
+	var maxLen uint
+	for _, l := range lengths {
+		count[l]++
+		if uint(l) > maxLen {
+			maxLen = uint(l)
+		}
+	}
+	count[0] = 0
+
+	if maxLen == 0 {
+		// An empty code, which is permitted for distance codes (if the block
+		// contains only literals).
+		h.tableBits = 0
+		h.table = h.table[:0]
+		return nil
+	}
+
+	// Check for an over subscribed code.
+	left := 1
+	for l := 1; l <= maxCodeBits; l++ {
+		left <<= 1
+		left -= count[l]
+		if left < 0 {
+			return errCorrupt
+		}
+	}
+
+	var nextCode [maxCodeBits + 2]int
+	code := 0
+	for l := 1; l <= maxCodeBits; l++ {
+		code = (code + count[l-1]) << 1
+		nextCode[l] = code
+	}
+
+	size := 1 << maxLen
+	if cap(h.table) < size {
+		h.table = make([]uint16, size)
+	} else {
+		h.table = h.table[:size]
+		clear(h.table)
+	}
+	h.tableBits = maxLen
+
+	for sym, l := range lengths {
+		if l == 0 {
+			continue
+		}
+
+		code := nextCode[l]
+		nextCode[l]++
+
+		reversed := reverseBits(uint16(code), uint(l))
+		for i := int(reversed); i < size; i += 1 << l {
+			h.table[i] = uint16(sym)<<4 | uint16(l)
+		}
+	}
+
+	return nil
+}
+
+func (h *huffman) decode(br *bitReader) (int, error) {
+	if h.tableBits == 0 {
+		return 0, errCorrupt
+	}
+
+	if err := br.fill(h.tableBits); err != nil {
+		return 0, err
+	}
+
+	entry := h.table[br.bits&(1<<h.tableBits-1)]
+	n := uint(entry & 0xf)
+	if n == 0 {
+		return 0, errCorrupt
+	}
+
+	br.bits >>= n
+	br.nbits -= n
+
+	return int(entry >> 4), nil
+}
+
+func reverseBits(v uint16, n uint) uint16 {
+	var r uint16
+	for i := uint(0); i < n; i++ {
+		r = r<<1 | v&1
+		v >>= 1
+	}
+	return r
+}
+
+var fixedLitLen, fixedDist huffman
+
+func init() {
+	var lengths [numLitLen]uint8
+	for i := range lengths {
+		switch {
+		case i < 144:
+			lengths[i] = 8
+		case i < 256:
+			lengths[i] = 9
+		case i < 280:
+			lengths[i] = 7
+		default:
+			lengths[i] = 8
+		}
+	}
+
+	if err := fixedLitLen.init(lengths[:]); err != nil {
+		panic(err)
+	}
+
+	var distLengths [numDist]uint8
+	for i := range distLengths {
+		distLengths[i] = 5
+	}
+
+	if err := fixedDist.init(distLengths[:]); err != nil {
+		panic(err)
+	}
+}
+
+// inflater decompresses a DEFLATE stream, calling checkpoint at each block
+// boundary.
+type inflater struct {
+	br  *bitReader
+	out *history
+
+	litLen, dist huffman
+	lengths      [numLitLen + numDist]uint8
+}
+
+// inflate decompresses a single DEFLATE stream. Before each block (other than
+// the first) checkpoint is called.
+func (f *inflater) inflate(checkpoint func() error) error {
+	for first := true; ; first = false {
+		if !first {
+			if err := checkpoint(); err != nil {
+				return err
+			}
+		}
+
+		final, err := f.br.readBits(1)
+		if err != nil {
+			return err
+		}
+
+		blockType, err := f.br.readBits(2)
+		if err != nil {
+			return err
+		}
+
+		switch blockType {
+		case 0:
+			err = f.storedBlock()
+		case 1:
+			err = f.huffmanBlock(&fixedLitLen, &fixedDist)
+		case 2:
+			if err = f.readDynamicTables(); err == nil {
+				err = f.huffmanBlock(&f.litLen, &f.dist)
+			}
+		default:
+			err = fmt.Errorf("%w: invalid block type", errCorrupt)
+		}
+		if err != nil {
+			return err
+		}
+
+		if f.br.overrun() {
+			return io.ErrUnexpectedEOF
+		}
+
+		if final == 1 {
+			return nil
+		}
+	}
+}
+
+func (f *inflater) storedBlock() error {
+	f.br.alignToByte()
+
+	length, err := f.br.readBits(16)
+	if err != nil {
+		return err
+	}
+
+	nlength, err := f.br.readBits(16)
+	if err != nil {
+		return err
+	}
+
+	if uint16(length) != ^uint16(nlength) {
+		return fmt.Errorf("%w: invalid stored block length", errCorrupt)
+	}
+
+	return f.br.copyBytes(int(length), f.out)
+}
+
+func (f *inflater) readDynamicTables() error {
+	hlit, err := f.br.readBits(5)
+	if err != nil {
+		return err
+	}
+
+	hdist, err := f.br.readBits(5)
+	if err != nil {
+		return err
+	}
+
+	hclen, err := f.br.readBits(4)
+	if err != nil {
+		return err
+	}
+
+	nlit := int(hlit) + 257
+	ndist := int(hdist) + 1
+	if nlit > 286 || ndist > 30 {
+		return fmt.Errorf("%w: too many codes", errCorrupt)
+	}
+
+	var codeLenLengths [numCodeLen]uint8
+	for i := 0; i < int(hclen)+4; i++ {
+		l, err := f.br.readBits(3)
+		if err != nil {
+			return err
+		}
+		codeLenLengths[codeLenOrder[i]] = uint8(l)
+	}
+
+	var codeLen huffman
+	if err := codeLen.init(codeLenLengths[:]); err != nil {
+		return err
+	}
+
+	lengths := f.lengths[:nlit+ndist]
+	for i := 0; i < len(lengths); {
+		sym, err := codeLen.decode(f.br)
+		if err != nil {
+			return err
+		}
+
+		if sym < 16 {
+			lengths[i] = uint8(sym)
+			i++
+			continue
+		}
+
+		var repeat uint32
+		var value uint8
+		switch sym {
+		case 16:
+			if i == 0 {
+				return fmt.Errorf("%w: repeat with no previous length", errCorrupt)
+			}
+			value = lengths[i-1]
+			repeat, err = f.br.readBits(2)
+			repeat += 3
+		case 17:
+			repeat, err = f.br.readBits(3)
+			repeat += 3
+		default:
+			repeat, err = f.br.readBits(7)
+			repeat += 11
+		}
+		if err != nil {
+			return err
+		}
+
+		if i+int(repeat) > len(lengths) {
+			return fmt.Errorf("%w: too many code lengths", errCorrupt)
+		}
+
+		for ; repeat > 0; repeat-- {
+			lengths[i] = value
+			i++
+		}
+	}
+
+	if lengths[endOfBlock] == 0 {
+		return fmt.Errorf("%w: missing end of block code", errCorrupt)
+	}
+
+	if err := f.litLen.init(lengths[:nlit]); err != nil {
+		return err
+	}
+
+	return f.dist.init(lengths[nlit:])
+}
+
+func (f *inflater) huffmanBlock(litLen, dist *huffman) error {
+	for {
+		if err := f.out.maybeFlush(); err != nil {
+			return err
+		}
+
+		sym, err := litLen.decode(f.br)
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case sym < endOfBlock:
+			f.out.buf = append(f.out.buf, byte(sym))
+			continue
+		case sym == endOfBlock:
+			return nil
+		case sym > 285:
+			return fmt.Errorf("%w: invalid length code", errCorrupt)
+		}
+
+		sym -= 257
+		extra, err := f.br.readBits(uint(lengthExtra[sym]))
+		if err != nil {
+			return err
+		}
+		length := int(lengthBase[sym]) + int(extra)
+
+		distSym, err := dist.decode(f.br)
+		if err != nil {
+			return err
+		}
+
+		if distSym >= 30 {
+			return fmt.Errorf("%w: invalid distance code", errCorrupt)
+		}
+
+		extra, err = f.br.readBits(uint(distExtra[distSym]))
+		if err != nil {
+			return err
+		}
+		distance := int(distBase[distSym]) + int(extra)
+
+		if err := f.out.copyBack(distance, length); err != nil {
+			return err
+		}
+	}
+}
+
+// history accumulates the decompressed output, retaining (at least) the last
+// 32KiB for back references.
+type history struct {
+	buf []byte
+	// memberStart is the offset of the start of the current gzip member.
+	memberStart int64
+	// flushed is the number of bytes that have been flushed to w.
+	flushed int64
+	w       io.Writer
+}
+
+func newHistory(w io.Writer) *history {
+	return &history{
+		buf: make([]byte, 0, flushSize+historyBytes+maxMatch),
+		w:   w,
+	}
+}
+
+const maxMatch = 258
+
+// size returns the total number of bytes output.
+func (h *history) size() int64 {
+	return h.flushed + int64(len(h.buf))
+}
+
+// memberSize returns the number of bytes output by the current gzip member.
+func (h *history) memberSize() int64 {
+	return h.size() - h.memberStart
+}
+
+func (h *history) copyBack(distance, length int) error {
+	if int64(distance) > h.memberSize() || distance > len(h.buf) {
+		return fmt.Errorf("%w: invalid distance", errCorrupt)
+	}
+
+	start := len(h.buf) - distance
+	if length <= distance {
+		h.buf = append(h.buf, h.buf[start:start+length]...)
+		return nil
+	}
+
+	// Overlapping copy (a run).
+	for i := 0; i < length; i++ {
+		h.buf = append(h.buf, h.buf[start+i])
+	}
+
+	return nil
+}
+
+func (h *history) maybeFlush() error {
+	if len(h.buf) < flushSize+historyBytes {
+		return nil
+	}
+
+	return h.flush(historyBytes)
+}
+
+// flush writes all but the last keep bytes to the underlying writer.
+func (h *history) flush(keep int) error {
+	n := len(h.buf) - keep
+	if n <= 0 {
+		return nil
+	}
+
+	if _, err := h.w.Write(h.buf[:n]); err != nil {
+		return err
+	}
+
+	h.flushed += int64(n)
+	h.buf = h.buf[:copy(h.buf, h.buf[n:])]
+
+	return nil
+}
+
+// window returns a copy of the last 32KiB (or less) of output.
+func (h *history) window() []byte {
+	n := min(len(h.buf), windowSize)
+	return append([]byte(nil), h.buf[len(h.buf)-n:]...)
+}
@@ -0,0 +1,184 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package zran
+
+import (
+	"bytes"
+	"io"
+	"sync"
+)
+
+// compress/flate can only start decoding at a byte boundary, whereas DEFLATE
+// blocks may start at any bit. Rather than shifting the stream (which would
+// break the byte alignment of stored blocks), we prefix the stream with an
+// empty (non final) block whose length in bits is congruent to the bit offset
+// of the block modulo 8, so that the original byte alignment is preserved.
+// This is equivalent to zlib's inflatePrime().
+
+var (
+	primeOnce   sync.Once
+	primeBlocks [8][]bool
+)
+
+// primedReader returns a reader of the DEFLATE stream in ra starting at the
+// given bit offset.
+func primedReader(ra io.ReaderAt, bitOffset int64) io.Reader {
+	byteOffset := bitOffset / 8
+	shift := uint(bitOffset % 8)
+
+	if shift == 0 {
+		return io.NewSectionReader(ra, byteOffset, maxInt64-byteOffset)
+	}
+
+	primeOnce.Do(initPrimeBlocks)
+
+	var first [1]byte
+	if _, err := ra.ReadAt(first[:], byteOffset); err != nil {
+		return &errReader{err: err}
+	}
+
+	var bw bitWriter
+	for _, bit := range primeBlocks[shift] {
+		bw.writeBit(bit)
+	}
+
+	// The remainder of the first byte of the block.
+	for i := shift; i < 8; i++ {
+		bw.writeBit(first[0]>>i&1 == 1)
+	}
+
+	return io.MultiReader(bytes.NewReader(bw.buf), io.NewSectionReader(ra, byteOffset+1, maxInt64-byteOffset-1))
+}
+
+const maxInt64 = 1<<63 - 1
+
+// initPrimeBlocks constructs an empty dynamic Huffman block for each length
+// (modulo 8). The block has a literal/length code consisting only of the
+// end of block symbol, and a single distance code. The length is varied by the
+// number of code length codes, and how runs of zero lengths are encoded.
+func initPrimeBlocks() {
+	for hclen := 14; hclen <= 15; hclen++ {
+		for zeros := 0; zeros < 8; zeros++ {
+			for shortRuns := 0; shortRuns < 4; shortRuns++ {
+				bits := emptyDynamicBlock(hclen, zeros, shortRuns)
+
+				if n := len(bits) % 8; primeBlocks[n] == nil {
+					primeBlocks[n] = bits
+				}
+			}
+		}
+	}
+
+	for n := 1; n < 8; n++ {
+		if primeBlocks[n] == nil {
+			panic("failed to construct priming block")
+		}
+	}
+}
+
+func emptyDynamicBlock(hclen, zeros, shortRuns int) []bool {
+	var bw bitWriter
+	bw.writeBits(0, 1)             // BFINAL
+	bw.writeBits(2, 2)             // BTYPE (dynamic)
+	bw.writeBits(0, 5)             // HLIT (257 codes)
+	bw.writeBits(0, 5)             // HDIST (1 code)
+	bw.writeBits(uint32(hclen), 4) // HCLEN
+	for i := 0; i < hclen+4; i++ {
+		// Code length symbols 0, 1, 17, and 18 have 2 bit codes.
+		switch codeLenOrder[i] {
+		case 0, 1, 17, 18:
+			bw.writeBits(2, 3)
+		default:
+			bw.writeBits(0, 3)
+		}
+	}
+
+	// Canonical codes (in symbol order) for the code length alphabet.
+	writeCode := func(sym int) {
+		codes := map[int]uint16{0: 0, 1: 1, 17: 2, 18: 3}
+		bw.writeBits(uint32(reverseBits(codes[sym], 2)), 2)
+	}
+
+	// 256 zero lengths (literals), followed by the end of block symbol (length
+	// 1), and the single distance code (length 1).
+	remaining := 256
+	for i := 0; i < zeros; i++ {
+		writeCode(0)
+		remaining--
+	}
+
+	for i := 0; i < shortRuns; i++ {
+		writeCode(17)
+		bw.writeBits(0, 3) // 3 zeros
+		remaining -= 3
+	}
+
+	for remaining > 0 {
+		n := min(remaining, 138)
+		if remaining-n > 0 && remaining-n < 11 {
+			n = remaining - 11
+		}
+
+		writeCode(18)
+		bw.writeBits(uint32(n-11), 7)
+		remaining -= n
+	}
+
+	writeCode(1)
+	writeCode(1)
+
+	// The end of block symbol (the only literal/length code).
+	bw.writeBits(0, 1)
+
+	return bw.bits
+}
+
+// bitWriter writes a little endian bit stream.
+type bitWriter struct {
+	bits  []bool
+	buf   []byte
+	nbits uint
+}
+
+func (bw *bitWriter) writeBit(bit bool) {
+	bw.bits = append(bw.bits, bit)
+
+	if bw.nbits%8 == 0 {
+		bw.buf = append(bw.buf, 0)
+	}
+
+	if bit {
+		bw.buf[len(bw.buf)-1] |= 1 << (bw.nbits % 8)
+	}
+	bw.nbits++
+}
+
+func (bw *bitWriter) writeBits(v uint32, n uint) {
+	for i := uint(0); i < n; i++ {
+		bw.writeBit(v>>i&1 == 1)
+	}
+}
+
+type errReader struct {
+	err error
+}
+
+func (r *errReader) Read(p []byte) (int, error) {
+	return 0, r.err
+}
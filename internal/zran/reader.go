@@ -0,0 +1,137 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package zran
+
+import (
+	"bufio"
+	"compress/flate"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+)
+
+// cachedSpans is the number of decompressed spans retained by a Reader.
+const cachedSpans = 4
+
+// Reader provides random access to gzip compressed data.
+type Reader struct {
+	ra  io.ReaderAt
+	idx *Index
+
+	mu    sync.Mutex
+	spans []cachedSpan
+}
+
+type cachedSpan struct {
+	index int
+	data  []byte
+}
+
+// NewReader returns a Reader that reads the uncompressed data of the gzip
+// stream in ra (using idx to locate checkpoints).
+func NewReader(ra io.ReaderAt, idx *Index) *Reader {
+	return &Reader{
+		ra:  ra,
+		idx: idx,
+	}
+}
+
+// Size returns the size in bytes of the uncompressed data.
+func (r *Reader) Size() int64 {
+	return r.idx.Size
+}
+
+// ReadAt implements io.ReaderAt.
+func (r *Reader) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var n int
+	for n < len(p) {
+		if off >= r.idx.Size {
+			return n, io.EOF
+		}
+
+		// Find the last checkpoint at or before off.
+		i := sort.Search(len(r.idx.Checkpoints), func(i int) bool {
+			return r.idx.Checkpoints[i].Out > off
+		}) - 1
+
+		span, err := r.span(i)
+		if err != nil {
+			return n, err
+		}
+
+		copied := copy(p[n:], span[off-r.idx.Checkpoints[i].Out:])
+		n += copied
+		off += int64(copied)
+	}
+
+	return n, nil
+}
+
+// span returns the decompressed data between checkpoint i and the next. The
+// returned slice is only valid until the next call (and the caller must hold
+// the lock).
+func (r *Reader) span(i int) ([]byte, error) {
+	for j, s := range r.spans {
+		if s.index == i {
+			// Move to the front (most recently used).
+			copy(r.spans[1:j+1], r.spans[:j])
+			r.spans[0] = s
+			return s.data, nil
+		}
+	}
+
+	cp := r.idx.Checkpoints[i]
+
+	end := r.idx.Size
+	if i+1 < len(r.idx.Checkpoints) {
+		end = r.idx.Checkpoints[i+1].Out
+	}
+
+	var data []byte
+	if len(r.spans) == cachedSpans {
+		// Reuse the buffer of the least recently used span.
+		data = r.spans[len(r.spans)-1].data
+		r.spans = r.spans[:len(r.spans)-1]
+	}
+
+	if int64(cap(data)) < end-cp.Out {
+		data = make([]byte, end-cp.Out)
+	}
+	data = data[:end-cp.Out]
+
+	fr := flate.NewReaderDict(bufio.NewReader(primedReader(r.ra, cp.In)), cp.Window)
+	defer fr.Close()
+
+	if _, err := io.ReadFull(fr, data); err != nil {
+		return nil, fmt.Errorf("failed to decompress span: %w", err)
+	}
+
+	r.spans = append([]cachedSpan{{index: i, data: data}}, r.spans...)
+
+	return data, nil
+}
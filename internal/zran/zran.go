@@ -0,0 +1,294 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+// Package zran provides random access to gzip compressed data, by indexing
+// checkpoints (DEFLATE block boundaries and the preceding 32KiB window) from
+// which decompression can be resumed. The approach is the same as zlib's
+// zran.c example.
+package zran
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+)
+
+// DefaultSpan is the default (minimum) distance in bytes of uncompressed data
+// between checkpoints.
+const DefaultSpan = 1 << 20
+
+// Checkpoint is a point from which decompression can be resumed.
+type Checkpoint struct {
+	// In is the offset in bits of the start of a DEFLATE block in the
+	// compressed stream.
+	In int64
+	// Out is the corresponding offset in the uncompressed stream.
+	Out int64
+	// Window is the uncompressed data preceding the checkpoint (up to 32KiB),
+	// that may be referenced by the following blocks.
+	Window []byte
+}
+
+// Index is an index of checkpoints in a gzip stream.
+type Index struct {
+	// Checkpoints are the checkpoints in ascending order. There is always a
+	// checkpoint at the start of each gzip member.
+	Checkpoints []Checkpoint
+	// Size is the total size in bytes of the uncompressed data.
+	Size int64
+}
+
+// IsGzip reports whether the data begins with the gzip magic number.
+func IsGzip(header []byte) bool {
+	return len(header) >= 3 && header[0] == gzipID1 && header[1] == gzipID2 && header[2] == gzipDeflate
+}
+
+// BuildIndex decompresses the gzip stream read from r (which may consist of
+// multiple members), recording a checkpoint roughly every span bytes of
+// uncompressed data. The uncompressed data is written to w (if not nil).
+func BuildIndex(r io.Reader, span int64, w io.Writer) (*Index, error) {
+	if span <= 0 {
+		span = DefaultSpan
+	}
+
+	if w == nil {
+		w = io.Discard
+	}
+
+	crc := crc32.NewIEEE()
+	out := newHistory(io.MultiWriter(w, crc))
+
+	br := newBitReader(r)
+	f := &inflater{br: br, out: out}
+
+	var idx Index
+	addCheckpoint := func(cp Checkpoint) {
+		// Zero length spans are never useful (eg. empty gzip members).
+		if n := len(idx.Checkpoints); n > 0 && idx.Checkpoints[n-1].Out == cp.Out {
+			idx.Checkpoints[n-1] = cp
+			return
+		}
+
+		idx.Checkpoints = append(idx.Checkpoints, cp)
+	}
+
+	for member := 0; ; member++ {
+		if member > 0 {
+			if eof, err := br.atEOF(); err != nil {
+				return nil, err
+			} else if eof {
+				break
+			}
+		}
+
+		if err := readGzipHeader(br); err != nil {
+			if member == 0 {
+				return nil, fmt.Errorf("invalid gzip header: %w", err)
+			}
+
+			return nil, fmt.Errorf("invalid gzip header in member %d: %w", member, err)
+		}
+
+		out.memberStart = out.size()
+		crc.Reset()
+
+		addCheckpoint(Checkpoint{
+			In:  br.bitPos(),
+			Out: out.size(),
+		})
+
+		err := f.inflate(func() error {
+			if out.size()-idx.Checkpoints[len(idx.Checkpoints)-1].Out < span {
+				return nil
+			}
+
+			addCheckpoint(Checkpoint{
+				In:     br.bitPos(),
+				Out:    out.size(),
+				Window: out.window(),
+			})
+
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to decompress: %w", err)
+		}
+
+		if err := out.flush(0); err != nil {
+			return nil, err
+		}
+
+		// Verify the trailer.
+		br.alignToByte()
+
+		var trailer [8]byte
+		for i := range trailer {
+			if trailer[i], err = br.readByte(); err != nil {
+				return nil, fmt.Errorf("failed to read gzip trailer: %w", err)
+			}
+		}
+
+		if binary.LittleEndian.Uint32(trailer[:4]) != crc.Sum32() {
+			return nil, errors.New("gzip checksum mismatch")
+		}
+
+		if binary.LittleEndian.Uint32(trailer[4:]) != uint32(out.memberSize()) {
+			return nil, errors.New("gzip size mismatch")
+		}
+	}
+
+	idx.Size = out.size()
+
+	return &idx, nil
+}
+
+func readGzipHeader(br *bitReader) error {
+	var header [10]byte
+	for i := range header {
+		var err error
+		if header[i], err = br.readByte(); err != nil {
+			return err
+		}
+	}
+
+	if !IsGzip(header[:]) {
+		return errors.New("not a gzip stream")
+	}
+
+	flags := header[3]
+
+	if flags&flagExtra != 0 {
+		lo, err := br.readByte()
+		if err != nil {
+			return err
+		}
+
+		hi, err := br.readByte()
+		if err != nil {
+			return err
+		}
+
+		for n := int(lo) | int(hi)<<8; n > 0; n-- {
+			if _, err := br.readByte(); err != nil {
+				return err
+			}
+		}
+	}
+
+	// Skip the (zero terminated) file name and comment.
+	for _, flag := range []byte{flagName, flagComment} {
+		if flags&flag == 0 {
+			continue
+		}
+
+		for {
+			b, err := br.readByte()
+			if err != nil {
+				return err
+			}
+
+			if b == 0 {
+				break
+			}
+		}
+	}
+
+	if flags&flagHdrCrc != 0 {
+		for i := 0; i < 2; i++ {
+			if _, err := br.readByte(); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+const indexMagic = "ZRAN\x01"
+
+// MarshalBinary encodes the index.
+func (idx *Index) MarshalBinary() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteString(indexMagic)
+
+	_ = binary.Write(&buf, binary.LittleEndian, idx.Size)
+	_ = binary.Write(&buf, binary.LittleEndian, uint32(len(idx.Checkpoints)))
+
+	for _, cp := range idx.Checkpoints {
+		_ = binary.Write(&buf, binary.LittleEndian, cp.In)
+		_ = binary.Write(&buf, binary.LittleEndian, cp.Out)
+		_ = binary.Write(&buf, binary.LittleEndian, uint32(len(cp.Window)))
+		buf.Write(cp.Window)
+	}
+
+	return buf.Bytes(), nil
+}
+
+// UnmarshalBinary decodes an index encoded with MarshalBinary.
+func (idx *Index) UnmarshalBinary(data []byte) error {
+	r := bytes.NewReader(data)
+
+	magic := make([]byte, len(indexMagic))
+	if _, err := io.ReadFull(r, magic); err != nil || string(magic) != indexMagic {
+		return errors.New("invalid index")
+	}
+
+	var count uint32
+	if err := binary.Read(r, binary.LittleEndian, &idx.Size); err != nil {
+		return fmt.Errorf("failed to read index: %w", err)
+	}
+
+	if err := binary.Read(r, binary.LittleEndian, &count); err != nil {
+		return fmt.Errorf("failed to read index: %w", err)
+	}
+
+	idx.Checkpoints = nil
+	for i := uint32(0); i < count; i++ {
+		var cp Checkpoint
+		var windowLen uint32
+		for _, v := range []any{&cp.In, &cp.Out, &windowLen} {
+			if err := binary.Read(r, binary.LittleEndian, v); err != nil {
+				return fmt.Errorf("failed to read index: %w", err)
+			}
+		}
+
+		if windowLen > windowSize || int64(windowLen) > int64(r.Len()) {
+			return errors.New("invalid index")
+		}
+
+		cp.Window = make([]byte, windowLen)
+		if _, err := io.ReadFull(r, cp.Window); err != nil {
+			return fmt.Errorf("failed to read index: %w", err)
+		}
+
+		if n := len(idx.Checkpoints); cp.Out > idx.Size || (n > 0 && cp.Out <= idx.Checkpoints[n-1].Out) {
+			return errors.New("invalid index")
+		}
+
+		idx.Checkpoints = append(idx.Checkpoints, cp)
+	}
+
+	if len(idx.Checkpoints) == 0 || idx.Checkpoints[0].Out != 0 {
+		return errors.New("invalid index")
+	}
+
+	return nil
+}
@@ -0,0 +1,156 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package zran_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"math/rand"
+	"testing"
+
+	"github.com/immutos/oci2erofs/internal/zran"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIndex(t *testing.T) {
+	data := testData(2 << 20)
+
+	for _, level := range []int{gzip.NoCompression, gzip.BestSpeed, gzip.DefaultCompression, gzip.BestCompression, gzip.HuffmanOnly} {
+		var compressed bytes.Buffer
+		gw, err := gzip.NewWriterLevel(&compressed, level)
+		require.NoError(t, err)
+
+		_, err = gw.Write(data)
+		require.NoError(t, err)
+		require.NoError(t, gw.Close())
+
+		checkIndex(t, data, compressed.Bytes())
+	}
+
+	t.Run("Multiple Members", func(t *testing.T) {
+		var compressed bytes.Buffer
+		for _, chunk := range [][]byte{data[:1<<20], nil, data[1<<20:]} {
+			gw := gzip.NewWriter(&compressed)
+			gw.Name = "chunk"
+
+			_, err := gw.Write(chunk)
+			require.NoError(t, err)
+			require.NoError(t, gw.Close())
+		}
+
+		checkIndex(t, data, compressed.Bytes())
+	})
+
+	t.Run("Empty", func(t *testing.T) {
+		var compressed bytes.Buffer
+		require.NoError(t, gzip.NewWriter(&compressed).Close())
+
+		idx, err := zran.BuildIndex(bytes.NewReader(compressed.Bytes()), 0, nil)
+		require.NoError(t, err)
+		require.Zero(t, idx.Size)
+
+		n, err := zran.NewReader(bytes.NewReader(compressed.Bytes()), idx).ReadAt(make([]byte, 1), 0)
+		require.Zero(t, n)
+		require.ErrorIs(t, err, io.EOF)
+	})
+
+	t.Run("Corrupt", func(t *testing.T) {
+		var compressed bytes.Buffer
+		gw := gzip.NewWriter(&compressed)
+		_, err := gw.Write(data[:1<<20])
+		require.NoError(t, err)
+		require.NoError(t, gw.Close())
+
+		truncated := compressed.Bytes()[:compressed.Len()/2]
+		_, err = zran.BuildIndex(bytes.NewReader(truncated), 0, nil)
+		require.Error(t, err)
+
+		corrupted := bytes.Clone(compressed.Bytes())
+		corrupted[len(corrupted)-6] ^= 0xff
+		_, err = zran.BuildIndex(bytes.NewReader(corrupted), 0, nil)
+		require.Error(t, err)
+
+		_, err = zran.BuildIndex(bytes.NewReader([]byte("not gzip compressed")), 0, nil)
+		require.Error(t, err)
+	})
+}
+
+func checkIndex(t *testing.T, data, compressed []byte) {
+	var out bytes.Buffer
+	idx, err := zran.BuildIndex(bytes.NewReader(compressed), 64<<10, &out)
+	require.NoError(t, err)
+
+	require.Equal(t, int64(len(data)), idx.Size)
+	require.True(t, bytes.Equal(data, out.Bytes()))
+	require.Greater(t, len(idx.Checkpoints), 1)
+
+	// Round trip the index.
+	encoded, err := idx.MarshalBinary()
+	require.NoError(t, err)
+
+	var decoded zran.Index
+	require.NoError(t, decoded.UnmarshalBinary(encoded))
+	require.Equal(t, idx.Size, decoded.Size)
+	require.Len(t, decoded.Checkpoints, len(idx.Checkpoints))
+
+	r := zran.NewReader(bytes.NewReader(compressed), &decoded)
+	require.Equal(t, int64(len(data)), r.Size())
+
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < 100; i++ {
+		off := rng.Int63n(int64(len(data)))
+		buf := make([]byte, rng.Intn(256<<10))
+
+		n, err := r.ReadAt(buf, off)
+		if off+int64(len(buf)) > int64(len(data)) {
+			require.ErrorIs(t, err, io.EOF)
+		} else {
+			require.NoError(t, err)
+		}
+
+		require.True(t, bytes.Equal(data[off:off+int64(n)], buf[:n]), "mismatch at offset %d", off)
+	}
+
+	// Sequential reads of the whole stream.
+	all, err := io.ReadAll(io.NewSectionReader(r, 0, r.Size()))
+	require.NoError(t, err)
+	require.True(t, bytes.Equal(data, all))
+}
+
+// testData returns a mixture of compressible and incompressible data.
+func testData(size int) []byte {
+	rng := rand.New(rand.NewSource(0))
+	words := []string{"the ", "quick ", "brown ", "fox ", "jumps ", "over ", "lazy ", "dog\n"}
+
+	var buf bytes.Buffer
+	for buf.Len() < size {
+		if rng.Intn(4) == 0 {
+			random := make([]byte, rng.Intn(4096))
+			_, _ = rng.Read(random)
+			buf.Write(random)
+		} else {
+			for i := rng.Intn(1024); i > 0; i-- {
+				buf.WriteString(words[rng.Intn(len(words))])
+			}
+		}
+	}
+
+	return buf.Bytes()[:size]
+}
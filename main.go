@@ -20,30 +20,35 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
-	"io/fs"
 	"log/slog"
 	"os"
 	"path/filepath"
+	"regexp"
 	"runtime"
 	"strings"
 	"time"
 
-	"github.com/containerd/containerd/platforms"
-	"github.com/dpeckett/archivefs/erofs"
-	"github.com/dpeckett/archivefs/tarfs"
 	"github.com/dpeckett/telemetry"
 	"github.com/dpeckett/telemetry/v1alpha1"
-	"github.com/dpeckett/uncompr"
+	"github.com/immutos/oci2erofs/internal/atomicfile"
+	"github.com/immutos/oci2erofs/internal/buildfile"
 	"github.com/immutos/oci2erofs/internal/constants"
-	"github.com/immutos/oci2erofs/internal/docker"
-	"github.com/immutos/oci2erofs/internal/oci"
+	"github.com/immutos/oci2erofs/internal/progress"
+	"github.com/immutos/oci2erofs/internal/registry"
+	"github.com/immutos/oci2erofs/internal/report"
+	"github.com/immutos/oci2erofs/internal/source"
 	"github.com/immutos/oci2erofs/internal/util"
+	"github.com/immutos/oci2erofs/pkg/convert"
 	ocispecs "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/urfave/cli/v2"
 )
 
+// defaultOutputTemplate names the outputs when converting all images.
+const defaultOutputTemplate = "{ref}-{os}-{arch}.erofs"
+
 func main() {
 	persistentFlags := []cli.Flag{
 		&cli.GenericFlag{
@@ -51,16 +56,59 @@ func main() {
 			Usage: "Set the log verbosity level",
 			Value: util.FromSlogLevel(slog.LevelInfo),
 		},
+		&cli.StringFlag{
+			Name:  "progress",
+			Usage: "How to report progress, either 'bar' (a progress bar), 'log' (structured log lines), 'none', or 'auto' (a progress bar when stderr is a terminal, otherwise log lines)",
+			Value: "auto",
+		},
 	}
 
+	// Warnings are recorded for inclusion in the conversion report.
+	var warnings *report.WarningRecorder
+
 	initLogger := func(c *cli.Context) error {
-		slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{
+		warnings = report.NewWarningRecorder(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{
 			Level: (*slog.Level)(c.Generic("log-level").(*util.LevelFlag)),
-		})))
+		}))
+		slog.SetDefault(slog.New(warnings))
+
+		return nil
+	}
+
+	// Report the progress of long running operations.
+	var progressBar *progress.Bar
+
+	initProgress := func(c *cli.Context) error {
+		mode := c.String("progress")
+		if mode == "auto" {
+			mode = "log"
+			if fi, err := os.Stderr.Stat(); err == nil && fi.Mode()&os.ModeCharDevice != 0 {
+				mode = "bar"
+			}
+		}
+
+		switch mode {
+		case "bar":
+			progressBar = progress.NewBar(os.Stderr)
+			c.Context = progress.WithFunc(c.Context, progressBar.Report)
+		case "log":
+			c.Context = progress.WithFunc(c.Context, progress.Log(slog.Default()))
+		case "none":
+		default:
+			return fmt.Errorf("unsupported progress mode: %s", mode)
+		}
 
 		return nil
 	}
 
+	shutdownProgress := func(c *cli.Context) error {
+		if progressBar == nil {
+			return nil
+		}
+
+		return progressBar.Close()
+	}
+
 	// Collect anonymized usage statistics.
 	var telemetryReporter *telemetry.Reporter
 
@@ -112,151 +160,312 @@ func main() {
 		Name:      "oci2erofs",
 		Usage:     "Convert OCI images into EROFS filesystems",
 		Version:   constants.Version,
-		ArgsUsage: "image_path",
+		ArgsUsage: "image_path | transport:image_path[:ref] | docker://image_ref",
 		Flags: append([]cli.Flag{
 			&cli.StringFlag{
 				Name:    "output",
 				Aliases: []string{"o"},
-				Usage:   "Output EROFS filesystem image",
+				Usage:   "Output EROFS filesystem image (or directory, tar archive, or OCI image layout)",
+			},
+			&cli.StringFlag{
+				Name:  "format",
+				Usage: "Output format, either 'erofs' (a bare EROFS filesystem image), 'oci' (an OCI image layout containing the EROFS filesystem image as an artifact), 'dir' (the extracted root filesystem), or 'tar' (a tar archive of the root filesystem)",
+				Value: "erofs",
+			},
+			&cli.BoolFlag{
+				Name:  "no-clobber",
+				Usage: "Do not overwrite existing output files",
+			},
+			&cli.BoolFlag{
+				Name:  "all",
+				Usage: "Convert every image (each ref and platform) in the archive, the output is a naming template with {ref}, {os}, {arch}, and {variant} placeholders (default: " + defaultOutputTemplate + ")",
 			},
 			&cli.StringFlag{
-				Name:    "ref",
-				Aliases: []string{"r"},
-				Usage:   "Image reference (if more than one image is present)",
+				Name:  "tag",
+				Usage: "Tag of the artifact in the OCI image layout (for the 'oci' output format)",
+				Value: "latest",
+			},
+			&cli.StringFlag{
+				Name:  "push",
+				Usage: "Push the EROFS filesystem image to a registry as an OCI artifact (docker://image_ref)",
+			},
+			&cli.StringFlag{
+				Name:    "push-username",
+				Usage:   "Username for push registry authentication",
+				EnvVars: []string{"OCI2EROFS_PUSH_USERNAME"},
+			},
+			&cli.StringFlag{
+				Name:    "push-password",
+				Usage:   "Password (or token) for push registry authentication",
+				EnvVars: []string{"OCI2EROFS_PUSH_PASSWORD"},
+			},
+			&cli.BoolFlag{
+				Name:  "push-plain-http",
+				Usage: "Connect to the push registry over plain HTTP",
 			},
 			&cli.StringFlag{
-				Name:    "platform",
-				Aliases: []string{"p"},
-				Usage:   "Target platform in the 'os/arch' format",
+				Name:  "report",
+				Usage: "Write a machine-readable (JSON) report describing the conversion to the given path",
 			},
-		}, persistentFlags...),
-		Before: util.BeforeAll(initLogger, initTelemetry),
-		After:  shutdownTelemetry,
+		}, append(append(append(newFilesystemFlags(), newExtractFlags()...), newImageFlags()...), persistentFlags...)...),
+		Commands: append([]*cli.Command{
+			newBuildCommand(func(c *cli.Context, job buildfile.Job) error {
+				return convertJob(c, job, warnings)
+			}),
+			newCacheCommand(),
+			newInspectCommand(),
+			newExtractCommand(),
+			newVerifyCommand(),
+		}, newBrowseCommands()...),
+		Before: util.BeforeAll(initLogger, initProgress, initTelemetry),
+		After: func(c *cli.Context) error {
+			return errors.Join(shutdownProgress(c), shutdownTelemetry(c))
+		},
 		Action: func(c *cli.Context) error {
 			if c.NArg() != 1 {
 				slog.Error("Image path is required")
 				return cli.ShowAppHelp(c)
 			}
-			imagePath := c.Args().First()
 
-			tempDir, err := os.MkdirTemp("", "oci2erofs")
-			if err != nil {
-				return fmt.Errorf("failed to create temporary directory: %w", err)
-			}
-			defer os.RemoveAll(tempDir)
+			job := jobFromFlags(c)
+			job.Input = c.Args().First()
 
-			// Is the image a directory or a tarball?
-			fi, err := os.Stat(imagePath)
-			if err != nil {
-				return fmt.Errorf("failed to open image: %w", err)
-			}
+			return convertJob(c, job, warnings)
+		},
+	}
 
-			var imageFS fs.FS
-			if fi.IsDir() {
-				imageFS = os.DirFS(imagePath)
-			} else {
-				imageFile, err := os.Open(imagePath)
-				if err != nil {
-					return fmt.Errorf("failed to open tarball: %w", err)
-				}
-				defer imageFile.Close()
-
-				// Decompress the image if it is compressed.
-				dr, err := uncompr.NewReader(imageFile)
-				if err != nil {
-					return fmt.Errorf("failed to create decompressing reader: %w", err)
-				}
-				defer dr.Close()
-
-				// Create a temporary file to store the decompressed image.
-				decompressedImageFile, err := os.OpenFile(
-					filepath.Join(tempDir, filepath.Base(imagePath)+".tar"), os.O_CREATE|os.O_RDWR, 0o644)
-				if err != nil {
-					_ = imageFile.Close()
-					return fmt.Errorf("failed to create temporary tar file: %w", err)
-				}
-				defer decompressedImageFile.Close()
-
-				if _, err := io.Copy(decompressedImageFile, dr); err != nil {
-					return fmt.Errorf("failed to decompress image: %w", err)
-				}
-
-				imageFS, err = tarfs.Open(decompressedImageFile)
-				if err != nil {
-					return fmt.Errorf("failed to open tarball: %w", err)
-				}
-			}
+	// Cancel on interrupt, so that temporary data and partially written
+	// outputs are cleaned up.
+	ctx, stop := notifyContext(context.Background())
+	defer stop()
 
-			var platform *ocispecs.Platform
-			if c.String("platform") != "" {
-				parsed, err := platforms.Parse(c.String("platform"))
-				if err != nil {
-					return fmt.Errorf("failed to parse platform: %w", err)
-				}
-				platform = &parsed
-			}
+	if err := app.RunContext(ctx, util.ReorderArgs(app, os.Args)); err != nil {
+		slog.Error("Error", slog.Any("error", err))
+		status := exitStatus(ctx)
+		stop()
+		os.Exit(status)
+	}
+}
 
-			// Determine if the image is a Docker or OCI image.
-			var dockerArchive, ociArchive bool
-			if _, err := imageFS.Open("manifest.json"); err == nil {
-				dockerArchive = true
-			}
-			if !dockerArchive {
-				if _, err := imageFS.Open("oci-layout"); err == nil {
-					ociArchive = true
-				}
-			}
-			if !dockerArchive && !ociArchive {
-				return fmt.Errorf("image is not a valid OCI or Docker image")
-			}
+// convertJob runs a conversion, as described by the job.
+func convertJob(c *cli.Context, job buildfile.Job, warnings *report.WarningRecorder) error {
+	switch job.Format {
+	case "dir", "tar":
+		if job.Push != "" {
+			return fmt.Errorf("cannot push the %s output format", job.Format)
+		}
 
-			var rootFS fs.FS
-			var closeAll func() error
-			if dockerArchive {
-				rootFS, closeAll, err = docker.LoadImage(tempDir, imageFS, c.String("ref"), platform)
-				if err != nil {
-					return fmt.Errorf("failed to load Docker image: %w", err)
-				}
-			} else {
-				rootFS, closeAll, err = oci.LoadImage(tempDir, imageFS, c.String("ref"), platform)
-				if err != nil {
-					return fmt.Errorf("failed to load OCI image: %w", err)
-				}
-			}
-			defer func() {
-				if err := closeAll(); err != nil {
-					slog.Warn("Failed to close image layers", slog.Any("error", err))
-				}
-			}()
-
-			outputPath := c.String("output")
-			if outputPath == "" {
-				if fi.IsDir() {
-					outputPath = filepath.Base(imagePath) + ".erofs"
-				} else {
-					outputPath = strings.TrimSuffix(filepath.Base(imagePath), filepath.Ext(imagePath)) + ".erofs"
-				}
+		if job.Report != "" {
+			return fmt.Errorf("cannot write a report for the %s output format", job.Format)
+		}
+
+		return extractImage(c, job)
+	}
+
+	if job.All {
+		return convertAll(c, job, warnings)
+	}
+
+	platform, err := parsePlatform(job.Platform)
+	if err != nil {
+		return err
+	}
+
+	var output io.Writer
+	var outputFile *atomicfile.File
+	var layoutPath string
+	reportOut := reportOutput{path: job.Push}
+	switch job.Format {
+	case "erofs":
+		if job.Push != "" && job.Output == "" {
+			break
+		}
+
+		outputPath, err := outputPathFor(job.Output, job.Input, ".erofs")
+		if err != nil {
+			return err
+		}
+		reportOut.path = outputPath
+
+		if outputPath == stdioPath {
+			output = os.Stdout
+			if job.Report != "" {
+				output = newHashingWriter(os.Stdout)
 			}
+			break
+		}
+
+		// The output file is only replaced once the conversion succeeds.
+		outputFile, err = atomicfile.Create(outputPath, job.NoClobber)
+		if err != nil {
+			return fmt.Errorf("failed to create output file: %w", err)
+		}
+		defer outputFile.Close()
+
+		output = outputFile.File
+	case "oci":
+		layoutPath, err = outputPathFor(job.Output, job.Input, "-erofs")
+		if err != nil {
+			return err
+		}
+
+		if layoutPath == stdioPath {
+			return errors.New("cannot write an OCI image layout to stdout")
+		}
+		reportOut.path = layoutPath
+	default:
+		return fmt.Errorf("unsupported output format: %s", job.Format)
+	}
+
+	path, reader := imageInput(job.Input)
+
+	opts := convert.Options{
+		Path:     path,
+		Reader:   reader,
+		Ref:      job.Ref,
+		Platform: platform,
+		Registry: registryOptions(c),
+		Output:   output,
+		Push:     job.Push,
+		PushRegistry: convert.RegistryOptions{
+			Username:  c.String("push-username"),
+			Password:  c.String("push-password"),
+			PlainHTTP: c.Bool("push-plain-http"),
+		},
+		Layout:       layoutPath,
+		LayoutTag:    job.Tag,
+		CacheDir:     cacheDirFromFlags(c),
+		CacheMaxSize: int64(*c.Generic("cache-max-size").(*util.SizeFlag)),
+		Jobs:         c.Int("jobs"),
+		NoClobber:    job.NoClobber,
+	}
+	if err := applyFilesystemOptions(job, &opts); err != nil {
+		return err
+	}
+
+	result, err := convert.Convert(c.Context, opts)
+	if err != nil {
+		return err
+	}
+
+	if outputFile != nil {
+		if err := outputFile.Commit(); err != nil {
+			return fmt.Errorf("failed to write output file: %w", err)
+		}
+	}
+
+	if w, ok := output.(*hashingWriter); ok {
+		reportOut.sha256 = w.SHA256()
+	}
+
+	return writeReport(job.Report, job.Input, warnings, []*convert.Result{result}, []reportOutput{reportOut})
+}
+
+// outputPathFor returns the output path, deriving it from the image path (and
+// suffix) if one was not explicitly specified.
+func outputPathFor(outputPath, imagePath, suffix string) (string, error) {
+	if outputPath != "" {
+		return outputPath, nil
+	}
+
+	if imagePath == stdioPath {
+		return "", errors.New("output path is required when reading the image from stdin")
+	}
+
+	input := source.ParseInput(imagePath)
+	if input.Transport == source.TransportDocker {
+		name, err := registry.ShortName(input.Path)
+		if err != nil {
+			return "", err
+		}
 
-			// Remove the output file if it already exists.
-			_ = os.Remove(outputPath)
+		return name + suffix, nil
+	}
+
+	fi, err := os.Stat(input.Path)
+	if err != nil {
+		return "", fmt.Errorf("failed to open image: %w", err)
+	}
+
+	if fi.IsDir() {
+		return filepath.Base(input.Path) + suffix, nil
+	}
+
+	return strings.TrimSuffix(filepath.Base(input.Path), filepath.Ext(input.Path)) + suffix, nil
+}
+
+// convertAll converts every image in the archive, naming the outputs using the
+// output template.
+func convertAll(c *cli.Context, job buildfile.Job, warnings *report.WarningRecorder) error {
+	if job.Format != "erofs" || job.Push != "" {
+		return errors.New("only the erofs output format is supported when converting all images")
+	}
+
+	if job.Ref != "" || job.Platform != "" {
+		return errors.New("ref and platform cannot be specified when converting all images")
+	}
+
+	outputTemplate := job.Output
+	if outputTemplate == "" {
+		outputTemplate = defaultOutputTemplate
+	}
+
+	if outputTemplate == stdioPath {
+		return errors.New("cannot write more than one image to stdout")
+	}
+
+	path, reader := imageInput(job.Input)
 
-			outputFile, err := os.Create(outputPath)
+	opts := convert.Options{
+		Path:         path,
+		Reader:       reader,
+		Registry:     registryOptions(c),
+		CacheDir:     cacheDirFromFlags(c),
+		CacheMaxSize: int64(*c.Generic("cache-max-size").(*util.SizeFlag)),
+		Jobs:         c.Int("jobs"),
+		NoClobber:    job.NoClobber,
+	}
+	if err := applyFilesystemOptions(job, &opts); err != nil {
+		return err
+	}
+
+	results, err := convert.ConvertAll(c.Context, opts, func(target convert.Target) (string, error) {
+		ref := target.Ref
+		if ref == "" {
+			name, err := outputPathFor("", job.Input, "")
 			if err != nil {
-				return fmt.Errorf("failed to create output file: %w", err)
+				return "", err
 			}
-			defer outputFile.Close()
 
-			if err := erofs.Create(outputFile, rootFS); err != nil {
-				return fmt.Errorf("failed to create EROFS filesystem: %w", err)
-			}
+			ref = name
+		}
 
-			return nil
-		},
+		return expandOutputTemplate(outputTemplate, ref, target.Platform), nil
+	})
+	if err != nil {
+		return err
 	}
 
-	if err := app.Run(os.Args); err != nil {
-		slog.Error("Error", slog.Any("error", err))
-		os.Exit(1)
+	slog.Info("Converted images", slog.Int("count", len(results)))
+
+	outputs := make([]reportOutput, len(results))
+	for i, result := range results {
+		outputs[i] = reportOutput{path: result.OutputPath}
 	}
+
+	return writeReport(job.Report, job.Input, warnings, results, outputs)
+}
+
+// unsafeFileNameChars matches characters that are not safe in file names.
+var unsafeFileNameChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// expandOutputTemplate substitutes the placeholders in the output template.
+// Characters in the ref that are not safe in file names are replaced.
+func expandOutputTemplate(template, ref string, platform ocispecs.Platform) string {
+	return strings.NewReplacer(
+		"{ref}", unsafeFileNameChars.ReplaceAllString(ref, "_"),
+		"{os}", platform.OS,
+		"{arch}", platform.Architecture,
+		"{variant}", platform.Variant,
+	).Replace(template)
 }
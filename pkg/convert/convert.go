@@ -0,0 +1,773 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+// Package convert converts OCI (and Docker) images into EROFS filesystems.
+package convert
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/containerd/containerd/platforms"
+	"github.com/immutos/oci2erofs/internal/artifact"
+	"github.com/immutos/oci2erofs/internal/atomicfile"
+	"github.com/immutos/oci2erofs/internal/cache"
+	"github.com/immutos/oci2erofs/internal/erofs"
+	"github.com/immutos/oci2erofs/internal/image"
+	"github.com/immutos/oci2erofs/internal/layer"
+	"github.com/immutos/oci2erofs/internal/layout"
+	"github.com/immutos/oci2erofs/internal/progress"
+	"github.com/immutos/oci2erofs/internal/registry"
+	"github.com/immutos/oci2erofs/internal/source"
+	"github.com/immutos/oci2erofs/internal/util"
+	"github.com/immutos/oci2erofs/internal/xattr"
+	"github.com/opencontainers/go-digest"
+	ocispecs "github.com/opencontainers/image-spec/specs-go/v1"
+	"golang.org/x/sync/errgroup"
+)
+
+// Format is the archive format of a source image.
+type Format = source.Format
+
+const (
+	// FormatDocker is a Docker archive (as produced by `docker save`).
+	FormatDocker = source.FormatDocker
+	// FormatOCI is an OCI image layout.
+	FormatOCI = source.FormatOCI
+)
+
+// DefaultCacheMaxSize is the default maximum size in bytes of the layer cache.
+const DefaultCacheMaxSize = cache.DefaultMaxSize
+
+// RegistryOptions configures access to OCI distribution registries.
+type RegistryOptions = registry.Options
+
+// XattrFilter selects extended attributes by namespace (eg. "security") or by
+// name (eg. "security.capability").
+type XattrFilter = xattr.Filter
+
+// Compression configures the compression of regular files in the EROFS
+// filesystem image.
+type Compression struct {
+	// Algorithm is one of "lz4", "lz4hc", "lzma", or "deflate". If empty,
+	// files are stored uncompressed (and the other fields are ignored).
+	Algorithm string
+	// Level is the compression level (only supported by "lz4hc" and
+	// "deflate", from 1 to 9). If zero, the algorithm's default is used.
+	Level int
+	// PclusterSize is the maximum size in bytes of a physical cluster (the
+	// unit of compressed data), a multiple of 4KiB up to 1MiB. Larger
+	// clusters compress better, but reads decompress more data. If zero,
+	// 4KiB is used.
+	PclusterSize int
+	// Exclude are shell patterns (see path.Match) of the files to store
+	// uncompressed, eg. files that are already compressed or that are read
+	// often. Patterns without a slash match file names (eg. "*.gz"), others
+	// match absolute paths and exclude entire directories (eg.
+	// "/usr/share/fonts").
+	Exclude []string
+}
+
+// Validate checks that the compression options are supported.
+func (c Compression) Validate() error {
+	if c.Algorithm == "" {
+		return nil
+	}
+
+	if err := c.createOptions().Validate(); err != nil {
+		return err
+	}
+
+	for _, pattern := range c.Exclude {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid exclude pattern %q: %w", pattern, err)
+		}
+	}
+
+	return nil
+}
+
+// Excluded reports whether the file at the absolute path name is stored
+// uncompressed.
+func (c Compression) Excluded(name string) bool {
+	for _, pattern := range c.Exclude {
+		if !strings.Contains(pattern, "/") {
+			if ok, _ := path.Match(pattern, path.Base(name)); ok {
+				return true
+			}
+
+			continue
+		}
+
+		for dir := name; dir != "/"; dir = path.Dir(dir) {
+			if ok, _ := path.Match(pattern, dir); ok {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func (c Compression) createOptions() *erofs.CompressionOptions {
+	return &erofs.CompressionOptions{
+		Algorithm:    erofs.Compression(c.Algorithm),
+		Level:        c.Level,
+		PclusterSize: c.PclusterSize,
+		Filter: func(name string) bool {
+			return !c.Excluded("/" + name)
+		},
+	}
+}
+
+// ProgressEvent describes the progress of a phase of a conversion.
+type ProgressEvent = progress.Event
+
+// ProgressPhase is a phase of a conversion.
+type ProgressPhase = progress.Phase
+
+const (
+	// PhaseDecompress is the decompression (and verification) of a layer.
+	PhaseDecompress = progress.PhaseDecompress
+	// PhaseIndex is the indexing of the layers into the merged root
+	// filesystem.
+	PhaseIndex = progress.PhaseIndex
+	// PhaseWrite is the writing of the EROFS filesystem image.
+	PhaseWrite = progress.PhaseWrite
+)
+
+// Options configures a conversion.
+type Options struct {
+	// Path is the path to an image directory, an (optionally compressed)
+	// image tarball, or a registry reference prefixed with "docker://". The
+	// path may be prefixed with a transport (eg. "oci-archive:image.tar:ref"),
+	// which selects the format of the image (and optionally the ref). Exactly
+	// one of Path, FS, or Reader must be set.
+	Path string
+	// FS is an already opened image directory or tarball.
+	FS fs.FS
+	// Reader streams an (optionally compressed) image tarball.
+	Reader io.Reader
+	// Ref is the image reference (if more than one image is present).
+	Ref string
+	// Platform is the target platform (if more than one platform is present).
+	Platform *ocispecs.Platform
+	// Registry configures access to registries (for "docker://" references).
+	// Unless Registry.Host is set, the credentials only apply to the
+	// registry of Path.
+	Registry RegistryOptions
+	// Output receives the EROFS filesystem image. If it implements io.WriterAt
+	// the image is written in place, otherwise it is first assembled in a
+	// temporary file and then copied to Output. Output is optional if Push or
+	// Layout is set.
+	Output io.Writer
+	// Push is a registry reference (prefixed with "docker://") to which the
+	// EROFS filesystem image is pushed as an OCI artifact.
+	Push string
+	// PushRegistry configures access to the registry of Push. Unless
+	// PushRegistry.Host is set, the credentials only apply to the registry
+	// of Push.
+	PushRegistry RegistryOptions
+	// Layout is the path of an OCI image layout directory into which the EROFS
+	// filesystem image is written as an OCI artifact. The layout is created if
+	// it does not exist, otherwise the artifact is added to the existing
+	// layout (replacing any previous artifact for the same tag and platform).
+	Layout string
+	// LayoutTag is the tag of the artifact in the OCI image layout. If empty,
+	// "latest" is used.
+	LayoutTag string
+	// TempDir is the directory in which temporary files are created. If empty,
+	// the default directory for temporary files is used.
+	TempDir string
+	// CacheDir is the directory of a persistent cache of layers (and layer
+	// indexes), which can be shared between concurrent conversions. If empty,
+	// nothing is retained between conversions.
+	CacheDir string
+	// CacheMaxSize is the size in bytes above which the least recently used
+	// entries are evicted from the cache. If zero, DefaultCacheMaxSize is used.
+	CacheMaxSize int64
+	// Jobs is the maximum number of layers to load concurrently (and, when
+	// converting all images, the maximum number of images to convert
+	// concurrently). If zero, the number of CPUs is used.
+	Jobs int
+	// NoClobber prevents ConvertAll from overwriting existing output files, and
+	// existing artifacts in the OCI image layout from being replaced.
+	NoClobber bool
+	// XattrFilter selects the extended attributes (recorded in the layers)
+	// that are stored in the EROFS filesystem image. By default every
+	// attribute in the "user", "trusted", "security", and POSIX ACL
+	// namespaces is stored.
+	XattrFilter XattrFilter
+	// Compression configures the compression of regular files in the EROFS
+	// filesystem image. By default files are stored uncompressed.
+	Compression Compression
+	// SkipDevices omits character and block devices from the EROFS
+	// filesystem image.
+	SkipDevices bool
+	// Reproducible derives the UUID of the EROFS filesystem image from the
+	// manifest digest, and applies SourceDateEpoch (otherwise the UUID and
+	// build time are zero, and modification times are kept as is).
+	Reproducible bool
+	// SourceDateEpoch, if set, is the build time of a reproducible EROFS
+	// filesystem image, and clamps the modification times of its files (see
+	// https://reproducible-builds.org/specs/source-date-epoch/).
+	SourceDateEpoch time.Time
+	// Progress, if set, receives progress events as the conversion proceeds.
+	// Events are rate limited, but it may be called concurrently (eg. as
+	// layers are decompressed in parallel).
+	Progress func(ProgressEvent)
+}
+
+// Target identifies an image (by ref and platform) within a source.
+type Target = image.Target
+
+// Result describes a completed conversion.
+type Result struct {
+	// Format is the detected archive format of the source image.
+	Format Format
+	// Ref is the image reference (if specified).
+	Ref string
+	// Platform is the platform of the image.
+	Platform ocispecs.Platform
+	// Manifest is the descriptor of the resolved image manifest. It is empty
+	// for legacy Docker archives, which do not include a manifest.
+	Manifest ocispecs.Descriptor
+	// Config is the descriptor of the image configuration.
+	Config ocispecs.Descriptor
+	// ImageConfig is the image configuration.
+	ImageConfig ocispecs.Image
+	// Layers are the descriptors of the image's layers.
+	Layers []ocispecs.Descriptor
+	// Size is the size in bytes of the EROFS filesystem image.
+	Size int64
+	// Digest is the digest of the EROFS filesystem image. It is only known
+	// if the image was packaged as an artifact.
+	Digest digest.Digest
+	// Stats counts the inodes in the EROFS filesystem image.
+	Stats Stats
+	// Timings records the time spent in each phase of the conversion.
+	Timings Timings
+	// Artifact is the descriptor of the artifact manifest (if the filesystem
+	// image was pushed to a registry or written to an OCI image layout).
+	Artifact *ocispecs.Descriptor
+	// OutputPath is the path of the output file (when converting all images).
+	OutputPath string
+}
+
+// Convert converts the image described by opts into an EROFS filesystem image.
+func Convert(ctx context.Context, opts Options) (*Result, error) {
+	if opts.Output == nil && opts.Push == "" && opts.Layout == "" {
+		return nil, errors.New("output, push reference, or layout is required")
+	}
+
+	if opts.Push != "" && !strings.HasPrefix(opts.Push, registry.TransportPrefix) {
+		return nil, fmt.Errorf("push reference must be prefixed with %q", registry.TransportPrefix)
+	}
+
+	if err := opts.Compression.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid compression options: %w", err)
+	}
+
+	if opts.Progress != nil {
+		ctx = progress.WithFunc(ctx, opts.Progress)
+	}
+
+	tempDir, err := os.MkdirTemp(opts.TempDir, "oci2erofs")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temporary directory: %w", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	src, loader, err := openSource(ctx, tempDir, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer src.Close()
+
+	return convertImage(ctx, tempDir, opts, src, loader)
+}
+
+// ConvertAll converts every image (each ref and platform) in the source
+// described by opts, writing each EROFS filesystem image to the path returned
+// by outputPath. Images are converted concurrently (up to opts.Jobs at a
+// time), and layers shared between images are only loaded once.
+//
+// The Ref, Platform, Output, Push, and Layout options must not be set. The
+// results are returned in the order the images appear in the source.
+func ConvertAll(ctx context.Context, opts Options, outputPath func(Target) (string, error)) ([]*Result, error) {
+	if opts.Ref != "" || opts.Platform != nil || opts.Output != nil || opts.Push != "" || opts.Layout != "" {
+		return nil, errors.New("ref, platform, output, push reference, and layout are not supported when converting all images")
+	}
+
+	if err := opts.Compression.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid compression options: %w", err)
+	}
+
+	if opts.Progress != nil {
+		ctx = progress.WithFunc(ctx, opts.Progress)
+	}
+
+	tempDir, err := os.MkdirTemp(opts.TempDir, "oci2erofs")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temporary directory: %w", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	src, loader, err := openSource(ctx, tempDir, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer src.Close()
+
+	if src.Ref != "" {
+		return nil, errors.New("ref is not supported when converting all images")
+	}
+
+	targets, err := src.Targets()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(targets) == 0 {
+		return nil, errors.New("no images found")
+	}
+
+	outputPaths := make([]string, len(targets))
+	targetsByPath := make(map[string]Target)
+	for i, target := range targets {
+		outputPaths[i], err = outputPath(target)
+		if err != nil {
+			return nil, err
+		}
+
+		if other, ok := targetsByPath[outputPaths[i]]; ok {
+			return nil, fmt.Errorf("images %s (%s) and %s (%s) have the same output path %q",
+				other.Ref, platforms.Format(other.Platform), target.Ref, platforms.Format(target.Platform), outputPaths[i])
+		}
+		targetsByPath[outputPaths[i]] = target
+	}
+
+	jobs := opts.Jobs
+	if jobs <= 0 {
+		jobs = runtime.NumCPU()
+	}
+
+	g, ctx := errgroup.WithContext(ctx)
+	g.SetLimit(jobs)
+
+	results := make([]*Result, len(targets))
+	for i, target := range targets {
+		i, target := i, target
+
+		g.Go(func() error {
+			logger := slog.With(slog.String("ref", target.Ref), slog.String("platform", platforms.Format(target.Platform)))
+			logger.Info("Converting image", slog.String("output", outputPaths[i]))
+
+			// The output file is only replaced once the conversion succeeds.
+			outputFile, err := atomicfile.Create(outputPaths[i], opts.NoClobber)
+			if err != nil {
+				return fmt.Errorf("failed to create output file: %w", err)
+			}
+			defer outputFile.Close()
+
+			targetOpts := opts
+			targetOpts.Ref = target.Ref
+			targetOpts.Platform = &target.Platform
+			targetOpts.Output = outputFile.File
+
+			// Each worker writes to a distinct index.
+			results[i], err = convertImage(ctx, tempDir, targetOpts, src, loader)
+			if err != nil {
+				return fmt.Errorf("failed to convert image %s (%s): %w", target.Ref, platforms.Format(target.Platform), err)
+			}
+			results[i].OutputPath = outputPaths[i]
+
+			if err := outputFile.Commit(); err != nil {
+				return fmt.Errorf("failed to write output file: %w", err)
+			}
+
+			return nil
+		})
+	}
+
+	if err := g.Wait(); err != nil {
+		return nil, err
+	}
+
+	return results, nil
+}
+
+// openSource opens the source image described by opts, and creates a loader
+// for its layers.
+func openSource(ctx context.Context, tempDir string, opts Options) (*source.Source, *layer.Loader, error) {
+	src, err := source.Open(ctx, source.Options{
+		Path:     opts.Path,
+		FS:       opts.FS,
+		Reader:   opts.Reader,
+		Registry: opts.Registry,
+		TempDir:  tempDir,
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if err := ctx.Err(); err != nil {
+		_ = src.Close()
+		return nil, nil, err
+	}
+
+	loader := &layer.Loader{
+		TempDir: tempDir,
+		Jobs:    opts.Jobs,
+	}
+	if opts.CacheDir != "" {
+		maxSize := opts.CacheMaxSize
+		if maxSize == 0 {
+			maxSize = DefaultCacheMaxSize
+		}
+
+		loader.Cache, err = cache.Open(opts.CacheDir, maxSize)
+		if err != nil {
+			_ = src.Close()
+			return nil, nil, fmt.Errorf("failed to open layer cache: %w", err)
+		}
+	}
+
+	return src, loader, nil
+}
+
+// convertImage converts the image in src selected by opts.
+func convertImage(ctx context.Context, tempDir string, opts Options, src *source.Source, loader *layer.Loader) (*Result, error) {
+	start := time.Now()
+
+	var timer phaseTimer
+	ctx = timer.observe(ctx)
+
+	// The ref may be given inline in the path of the source image.
+	ref, err := src.ResolveRef(opts.Ref)
+	if err != nil {
+		return nil, err
+	}
+	opts.Ref = ref
+
+	img, err := src.Load(ctx, loader, opts.Ref, opts.Platform)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := img.Close(); err != nil {
+			slog.Warn("Failed to close image layers", slog.Any("error", err))
+		}
+	}()
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	result := &Result{
+		Format:      src.Format,
+		Ref:         opts.Ref,
+		Platform:    img.Platform(),
+		Manifest:    img.Manifest(),
+		Config:      img.ConfigDescriptor(),
+		ImageConfig: img.Config(),
+		Layers:      img.Layers(),
+	}
+
+	// The stats are counted by the writer (as hardlinks share an inode, and
+	// some files may be omitted).
+	var stats erofs.Stats
+	createOpts := createOptions(opts, img)
+	createOpts.Stats = &stats
+
+	if opts.Push != "" || opts.Layout != "" {
+		result.Size, result.Digest, result.Artifact, err = writeArtifact(ctx, tempDir, opts, img, createOpts)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		result.Size, err = writeImage(ctx, tempDir, opts.Output, img.RootFS(), createOpts)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create EROFS filesystem: %w", err)
+		}
+	}
+
+	result.Stats = Stats(stats)
+
+	result.Timings = Timings{
+		Decompress: timer.elapsed(progress.PhaseDecompress),
+		Index:      timer.elapsed(progress.PhaseIndex),
+		Write:      timer.elapsed(progress.PhaseWrite),
+		Total:      time.Since(start),
+	}
+
+	return result, nil
+}
+
+// writeArtifact creates the EROFS filesystem image of img and packages it as
+// an OCI artifact, which is pushed to the registry and/or written to the OCI
+// image layout. The filesystem image is also copied to the output, if any.
+func writeArtifact(ctx context.Context, tempDir string, opts Options, img *image.Image, createOpts *erofs.CreateOptions) (int64, digest.Digest, *ocispecs.Descriptor, error) {
+	f, err := os.CreateTemp(tempDir, "*.erofs")
+	if err != nil {
+		return 0, "", nil, fmt.Errorf("failed to create temporary image file: %w", err)
+	}
+	defer f.Close()
+
+	size, err := writeImage(ctx, tempDir, f, img.RootFS(), createOpts)
+	if err != nil {
+		return 0, "", nil, fmt.Errorf("failed to create EROFS filesystem: %w", err)
+	}
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return 0, "", nil, fmt.Errorf("failed to seek temporary image file: %w", err)
+	}
+
+	dgst, err := digest.FromReader(f)
+	if err != nil {
+		return 0, "", nil, fmt.Errorf("failed to digest image: %w", err)
+	}
+
+	artifactOpts := artifact.Options{
+		Config:   img.Config(),
+		BaseName: opts.Ref,
+	}
+
+	if manifest := img.Manifest(); manifest.Digest != "" {
+		artifactOpts.Subject = &manifest
+	}
+
+	if artifactOpts.BaseName == "" && strings.HasPrefix(opts.Path, registry.TransportPrefix) {
+		if name, err := registry.ParseReference(opts.Path); err == nil {
+			artifactOpts.BaseName = name
+		}
+	}
+
+	art, err := artifact.New(ocispecs.Descriptor{Digest: dgst, Size: size}, artifactOpts)
+	if err != nil {
+		return 0, "", nil, fmt.Errorf("failed to create artifact: %w", err)
+	}
+
+	if opts.Push != "" {
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return 0, "", nil, fmt.Errorf("failed to seek temporary image file: %w", err)
+		}
+
+		pushOpts, err := opts.PushRegistry.ForReference(opts.Push)
+		if err != nil {
+			return 0, "", nil, err
+		}
+
+		if err := registry.Push(ctx, registry.NewResolver(pushOpts), opts.Push, art, f); err != nil {
+			return 0, "", nil, fmt.Errorf("failed to push image: %w", err)
+		}
+	}
+
+	if opts.Layout != "" {
+		l, err := layout.Open(opts.Layout, opts.NoClobber)
+		if err != nil {
+			return 0, "", nil, fmt.Errorf("failed to open image layout: %w", err)
+		}
+
+		tag := opts.LayoutTag
+		if tag == "" {
+			tag = "latest"
+		}
+
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return 0, "", nil, fmt.Errorf("failed to seek temporary image file: %w", err)
+		}
+
+		if err := l.Add(tag, art, f); err != nil {
+			return 0, "", nil, fmt.Errorf("failed to write image layout: %w", err)
+		}
+	}
+
+	if opts.Output != nil {
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return 0, "", nil, fmt.Errorf("failed to seek temporary image file: %w", err)
+		}
+
+		if _, err := io.Copy(opts.Output, f); err != nil {
+			return 0, "", nil, fmt.Errorf("failed to copy image to output: %w", err)
+		}
+	}
+
+	return size, dgst, &art.Manifest, nil
+}
+
+// createOptions returns the options for creating the EROFS filesystem image of
+// img.
+func createOptions(opts Options, img *image.Image) *erofs.CreateOptions {
+	warned := make(map[string]bool)
+
+	var compression *erofs.CompressionOptions
+	if opts.Compression.Algorithm != "" {
+		compression = opts.Compression.createOptions()
+	}
+
+	createOpts := &erofs.CreateOptions{
+		XattrFilter: func(name string) bool {
+			if !opts.XattrFilter.Allowed(name) {
+				return false
+			}
+
+			// EROFS can only store the extended attributes of well known
+			// namespaces.
+			if !erofs.XattrSupported(name) {
+				if !warned[name] {
+					slog.Warn("Skipping unsupported extended attribute", slog.String("name", name))
+					warned[name] = true
+				}
+
+				return false
+			}
+
+			return true
+		},
+		Compression: compression,
+		SkipDevices: opts.SkipDevices,
+	}
+
+	if opts.Reproducible {
+		// Legacy Docker archives don't include a manifest, the configuration
+		// identifies the image instead.
+		id := img.ManifestDigest()
+		if id == "" {
+			id = img.ConfigDescriptor().Digest
+		}
+		createOpts.UUID = reproducibleUUID(id)
+		createOpts.BuildTime = opts.SourceDateEpoch
+		createOpts.MaxMtime = opts.SourceDateEpoch
+	}
+
+	return createOpts
+}
+
+// reproducibleUUID derives the UUID of a reproducible EROFS filesystem image
+// from the digest of the source image (as a version 8 UUID, RFC 9562).
+func reproducibleUUID(dgst digest.Digest) [16]byte {
+	var uuid [16]byte
+	sum := sha256.Sum256([]byte("oci2erofs:" + dgst.String()))
+	copy(uuid[:], sum[:])
+
+	uuid[6] = uuid[6]&0x0f | 0x80
+	uuid[8] = uuid[8]&0x3f | 0x80
+
+	return uuid
+}
+
+// writeImage writes the EROFS filesystem image of rootFS to dst, returning
+// the size of the image.
+func writeImage(ctx context.Context, tempDir string, dst io.Writer, rootFS fs.FS, createOpts *erofs.CreateOptions) (int64, error) {
+	// erofs.Create doesn't accept a context, so cancel it by failing reads.
+	rootFS = util.NewContextFS(ctx, rootFS)
+
+	// Files that are not seekable (eg. pipes) are streamed to.
+	if f, ok := dst.(*os.File); ok {
+		if fi, err := f.Stat(); err != nil || !fi.Mode().IsRegular() {
+			dst = struct{ io.Writer }{f}
+		}
+	}
+
+	tracker := progress.Start(ctx, progress.Event{Phase: progress.PhaseWrite})
+
+	switch dst := dst.(type) {
+	case io.WriterAt:
+		w := &sizeTrackingWriterAt{WriterAt: tracker.WriterAt(dst)}
+		if err := erofs.Create(w, rootFS, createOpts); err != nil {
+			return 0, err
+		}
+
+		// Pad the image out to a whole number of blocks (erofs.Create only
+		// takes care of this for files, which w hides).
+		size := roundUp(w.size, erofs.BlockSize)
+		if f, ok := dst.(*os.File); ok {
+			if err := f.Truncate(size); err != nil {
+				return 0, fmt.Errorf("failed to truncate output file: %w", err)
+			}
+		} else if padding := size - w.size; padding > 0 {
+			if _, err := w.WriteAt(make([]byte, padding), w.size); err != nil {
+				return 0, fmt.Errorf("failed to pad image: %w", err)
+			}
+		}
+		tracker.Done()
+
+		return size, nil
+
+	default:
+		f, err := os.CreateTemp(tempDir, "*.erofs")
+		if err != nil {
+			return 0, fmt.Errorf("failed to create temporary image file: %w", err)
+		}
+		defer f.Close()
+
+		if err := erofs.Create(tracker.WriterAt(f), rootFS, createOpts); err != nil {
+			return 0, err
+		}
+
+		// Pad the image out to a whole number of blocks.
+		fi, err := f.Stat()
+		if err != nil {
+			return 0, fmt.Errorf("failed to stat temporary image file: %w", err)
+		}
+
+		if err := f.Truncate(roundUp(fi.Size(), erofs.BlockSize)); err != nil {
+			return 0, fmt.Errorf("failed to truncate temporary image file: %w", err)
+		}
+		tracker.Done()
+
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return 0, fmt.Errorf("failed to seek temporary image file: %w", err)
+		}
+
+		n, err := io.Copy(dst, f)
+		if err != nil {
+			return 0, fmt.Errorf("failed to copy image to output: %w", err)
+		}
+
+		return n, nil
+	}
+}
+
+// sizeTrackingWriterAt records the high water mark of the data written to
+// the underlying io.WriterAt.
+type sizeTrackingWriterAt struct {
+	io.WriterAt
+	size int64
+}
+
+func (w *sizeTrackingWriterAt) WriteAt(p []byte, off int64) (int, error) {
+	n, err := w.WriterAt.WriteAt(p, off)
+	w.size = max(w.size, off+int64(n))
+	return n, err
+}
+
+func roundUp(x, align int64) int64 {
+	return (x + align - 1) / align * align
+}
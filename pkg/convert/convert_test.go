@@ -0,0 +1,624 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package convert_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/immutos/oci2erofs/internal/erofs"
+	"github.com/immutos/oci2erofs/internal/registry/registrytest"
+	"github.com/immutos/oci2erofs/internal/tarfs"
+	"github.com/immutos/oci2erofs/internal/util"
+	"github.com/immutos/oci2erofs/pkg/convert"
+	"github.com/opencontainers/go-digest"
+	ocispecs "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConvert(t *testing.T) {
+	ctx := context.Background()
+	ref := "docker.io/tianon/toybox:0.8.11"
+
+	t.Run("Path", func(t *testing.T) {
+		outputFile, err := os.Create(filepath.Join(t.TempDir(), "toybox.erofs"))
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			require.NoError(t, outputFile.Close())
+		})
+
+		result, err := convert.Convert(ctx, convert.Options{
+			Path:    "../../testdata/toybox.tar",
+			Ref:     ref,
+			Output:  outputFile,
+			TempDir: t.TempDir(),
+		})
+		require.NoError(t, err)
+
+		require.Equal(t, convert.FormatOCI, result.Format)
+
+		fi, err := outputFile.Stat()
+		require.NoError(t, err)
+		require.Equal(t, fi.Size(), result.Size)
+
+		fsys, err := erofs.Open(outputFile)
+		require.NoError(t, err)
+
+		h, err := util.HashFS(fsys)
+		require.NoError(t, err)
+
+		require.Equal(t, "h1:adgxkqVceeKMyJdMZMvcUIbg94TthnXUmOeufCPuzQI=", h)
+
+		require.Equal(t, convert.Stats{Inodes: 266, Files: 6, Dirs: 16, Symlinks: 244}, result.Stats)
+		require.Positive(t, result.Timings.Decompress)
+		require.Positive(t, result.Timings.Write)
+		require.GreaterOrEqual(t, result.Timings.Total, result.Timings.Write)
+	})
+
+	t.Run("Compression", func(t *testing.T) {
+		outputFile, err := os.Create(filepath.Join(t.TempDir(), "toybox.erofs"))
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			require.NoError(t, outputFile.Close())
+		})
+
+		_, err = convert.Convert(ctx, convert.Options{
+			Path:    "../../testdata/toybox.tar",
+			Ref:     ref,
+			Output:  outputFile,
+			TempDir: t.TempDir(),
+			Compression: convert.Compression{
+				Algorithm:    "lzma",
+				PclusterSize: 64 << 10,
+				Exclude:      []string{"/etc"},
+			},
+		})
+		require.NoError(t, err)
+
+		fsys, err := erofs.Open(outputFile)
+		require.NoError(t, err)
+
+		// The contents are unchanged.
+		h, err := util.HashFS(fsys)
+		require.NoError(t, err)
+
+		require.Equal(t, "h1:adgxkqVceeKMyJdMZMvcUIbg94TthnXUmOeufCPuzQI=", h)
+
+		fi, err := fs.Stat(fsys, "bin/toybox")
+		require.NoError(t, err)
+		require.Equal(t, uint16(erofs.InodeDataLayoutFlatCompressionLegacy), fi.Sys().(*erofs.Inode).DataLayout())
+
+		_, err = convert.Convert(ctx, convert.Options{
+			Path:        "../../testdata/toybox.tar",
+			Output:      outputFile,
+			Compression: convert.Compression{Algorithm: "deflate", Level: 12},
+		})
+		require.ErrorContains(t, err, "invalid compression options: invalid deflate compression level 12 (expected 1-9)")
+	})
+
+	t.Run("Reproducible", func(t *testing.T) {
+		epoch := time.Unix(1000000000, 0)
+
+		convertImage := func(t *testing.T, reproducible bool) []byte {
+			var buf bytes.Buffer
+			_, err := convert.Convert(ctx, convert.Options{
+				Path:            "../../testdata/toybox.tar",
+				Ref:             ref,
+				Output:          &buf,
+				TempDir:         t.TempDir(),
+				Reproducible:    reproducible,
+				SourceDateEpoch: epoch,
+			})
+			require.NoError(t, err)
+
+			return buf.Bytes()
+		}
+
+		first := convertImage(t, true)
+		second := convertImage(t, true)
+		require.True(t, bytes.Equal(first, second), "images differ")
+
+		img, err := erofs.OpenImage(bytes.NewReader(first))
+		require.NoError(t, err)
+		require.Equal(t, uint64(epoch.Unix()), img.SuperBlock().BuildTime)
+		require.NotEqual(t, [16]byte{}, img.SuperBlock().UUID)
+
+		// Modification times are clamped to SOURCE_DATE_EPOCH.
+		fsys, err := erofs.Open(bytes.NewReader(first))
+		require.NoError(t, err)
+
+		err = fs.WalkDir(fsys, ".", func(name string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+
+			fi, err := d.Info()
+			if err != nil {
+				return err
+			}
+
+			require.False(t, fi.ModTime().After(epoch), name)
+			return nil
+		})
+		require.NoError(t, err)
+
+		// Otherwise the UUID and build time are zero, and modification times
+		// are kept as is.
+		unclamped := convertImage(t, false)
+		require.True(t, bytes.Equal(unclamped, convertImage(t, false)), "images differ")
+		require.False(t, bytes.Equal(first, unclamped))
+
+		img, err = erofs.OpenImage(bytes.NewReader(unclamped))
+		require.NoError(t, err)
+		require.Zero(t, img.SuperBlock().BuildTime)
+		require.Equal(t, [16]byte{}, img.SuperBlock().UUID)
+	})
+
+	t.Run("FS", func(t *testing.T) {
+		imageFile, err := os.Open("../../internal/docker/testdata/toybox.tar")
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			require.NoError(t, imageFile.Close())
+		})
+
+		imageFS, err := tarfs.Open(imageFile)
+		require.NoError(t, err)
+
+		var buf bytes.Buffer
+		result, err := convert.Convert(ctx, convert.Options{
+			FS:      imageFS,
+			Ref:     ref,
+			Output:  &buf,
+			TempDir: t.TempDir(),
+		})
+		require.NoError(t, err)
+
+		require.Equal(t, convert.FormatDocker, result.Format)
+		require.Equal(t, int64(buf.Len()), result.Size)
+
+		fsys, err := erofs.Open(bytes.NewReader(buf.Bytes()))
+		require.NoError(t, err)
+
+		h, err := util.HashFS(fsys)
+		require.NoError(t, err)
+
+		require.Equal(t, "h1:J674XgTpeE71MnUmfTovrhKIlFnWOa8rctDF6SL/Kzg=", h)
+	})
+
+	t.Run("Reader", func(t *testing.T) {
+		imageFile, err := os.Open("../../testdata/toybox.tar")
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			require.NoError(t, imageFile.Close())
+		})
+
+		var buf bytes.Buffer
+		result, err := convert.Convert(ctx, convert.Options{
+			Reader:  imageFile,
+			Output:  &buf,
+			TempDir: t.TempDir(),
+		})
+		require.NoError(t, err)
+
+		require.Equal(t, convert.FormatOCI, result.Format)
+
+		fsys, err := erofs.Open(bytes.NewReader(buf.Bytes()))
+		require.NoError(t, err)
+
+		h, err := util.HashFS(fsys)
+		require.NoError(t, err)
+
+		require.Equal(t, "h1:adgxkqVceeKMyJdMZMvcUIbg94TthnXUmOeufCPuzQI=", h)
+	})
+
+	t.Run("Pipe", func(t *testing.T) {
+		imageFile, err := os.Open("../../testdata/toybox.tar")
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			require.NoError(t, imageFile.Close())
+		})
+
+		pr, pw, err := os.Pipe()
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			require.NoError(t, pr.Close())
+		})
+
+		done := make(chan []byte)
+		go func() {
+			data, _ := io.ReadAll(pr)
+			done <- data
+		}()
+
+		result, err := convert.Convert(ctx, convert.Options{
+			Reader:  imageFile,
+			Output:  pw,
+			TempDir: t.TempDir(),
+		})
+		require.NoError(t, pw.Close())
+		require.NoError(t, err)
+
+		data := <-done
+		require.Equal(t, int64(len(data)), result.Size)
+
+		fsys, err := erofs.Open(bytes.NewReader(data))
+		require.NoError(t, err)
+
+		h, err := util.HashFS(fsys)
+		require.NoError(t, err)
+
+		require.Equal(t, "h1:adgxkqVceeKMyJdMZMvcUIbg94TthnXUmOeufCPuzQI=", h)
+	})
+
+	t.Run("Registry", func(t *testing.T) {
+		reg := registrytest.New(registrytest.WithTokenAuth("user", "secret"))
+		t.Cleanup(reg.Close)
+
+		require.NoError(t, reg.PushLayout("tianon/toybox", "0.8.11", os.DirFS("../../internal/oci/testdata/toybox")))
+
+		var buf bytes.Buffer
+		result, err := convert.Convert(ctx, convert.Options{
+			Path: "docker://" + reg.Host() + "/tianon/toybox:0.8.11",
+			Registry: convert.RegistryOptions{
+				Username: "user",
+				Password: "secret",
+			},
+			Output:  &buf,
+			TempDir: t.TempDir(),
+		})
+		require.NoError(t, err)
+
+		require.Equal(t, "sha256:d3b7b26716e98689872d7477fe39571b2128cf3a23eea0498513a1889e86f3ce", result.Manifest.Digest.String())
+
+		fsys, err := erofs.Open(bytes.NewReader(buf.Bytes()))
+		require.NoError(t, err)
+
+		h, err := util.HashFS(fsys)
+		require.NoError(t, err)
+
+		require.Equal(t, "h1:J674XgTpeE71MnUmfTovrhKIlFnWOa8rctDF6SL/Kzg=", h)
+	})
+
+	t.Run("Push", func(t *testing.T) {
+		reg := registrytest.New()
+		t.Cleanup(reg.Close)
+
+		require.NoError(t, reg.PushLayout("tianon/toybox", "0.8.11", os.DirFS("../../internal/oci/testdata/toybox")))
+
+		result, err := convert.Convert(ctx, convert.Options{
+			Path:    "docker://" + reg.Host() + "/tianon/toybox:0.8.11",
+			Push:    "docker://" + reg.Host() + "/tianon/toybox:0.8.11-erofs",
+			TempDir: t.TempDir(),
+		})
+		require.NoError(t, err)
+		require.NotNil(t, result.Artifact)
+
+		_, manifestData, ok := reg.Manifest("tianon/toybox", "0.8.11-erofs")
+		require.True(t, ok)
+
+		var manifest ocispecs.Manifest
+		require.NoError(t, json.Unmarshal(manifestData, &manifest))
+
+		require.Equal(t, result.Artifact.Digest, digest.FromBytes(manifestData))
+		require.NotNil(t, manifest.Subject)
+		require.Equal(t, result.Manifest.Digest, manifest.Subject.Digest)
+		require.Equal(t, reg.Host()+"/tianon/toybox:0.8.11", manifest.Annotations[ocispecs.AnnotationBaseImageName])
+		require.Len(t, manifest.Layers, 1)
+		require.Equal(t, result.Size, manifest.Layers[0].Size)
+
+		layerData, ok := reg.Blob(manifest.Layers[0].Digest)
+		require.True(t, ok)
+
+		fsys, err := erofs.Open(bytes.NewReader(layerData))
+		require.NoError(t, err)
+
+		h, err := util.HashFS(fsys)
+		require.NoError(t, err)
+
+		require.Equal(t, "h1:J674XgTpeE71MnUmfTovrhKIlFnWOa8rctDF6SL/Kzg=", h)
+	})
+
+	t.Run("Push Credentials", func(t *testing.T) {
+		src := registrytest.New(registrytest.WithTokenAuth("user", "secret"))
+		t.Cleanup(src.Close)
+
+		require.NoError(t, src.PushLayout("tianon/toybox", "0.8.11", os.DirFS("../../internal/oci/testdata/toybox")))
+
+		dst := registrytest.New(registrytest.WithTokenAuth("pushuser", "pushsecret"))
+		t.Cleanup(dst.Close)
+
+		opts := convert.Options{
+			Path: "docker://" + src.Host() + "/tianon/toybox:0.8.11",
+			Registry: convert.RegistryOptions{
+				Username: "user",
+				Password: "secret",
+			},
+			Push:    "docker://" + dst.Host() + "/tianon/toybox:0.8.11-erofs",
+			TempDir: t.TempDir(),
+		}
+
+		// The source credentials must not be sent to the push registry.
+		_, err := convert.Convert(ctx, opts)
+		require.Error(t, err)
+
+		opts.PushRegistry = convert.RegistryOptions{
+			Username: "pushuser",
+			Password: "pushsecret",
+		}
+
+		result, err := convert.Convert(ctx, opts)
+		require.NoError(t, err)
+		require.NotNil(t, result.Artifact)
+
+		_, _, ok := dst.Manifest("tianon/toybox", "0.8.11-erofs")
+		require.True(t, ok)
+	})
+
+	t.Run("Layout", func(t *testing.T) {
+		layoutDir := filepath.Join(t.TempDir(), "toybox-erofs")
+
+		result, err := convert.Convert(ctx, convert.Options{
+			Path:      "../../internal/oci/testdata/toybox",
+			Layout:    layoutDir,
+			LayoutTag: "0.8.11",
+			TempDir:   t.TempDir(),
+		})
+		require.NoError(t, err)
+		require.NotNil(t, result.Artifact)
+
+		indexData, err := os.ReadFile(filepath.Join(layoutDir, "index.json"))
+		require.NoError(t, err)
+
+		var index ocispecs.Index
+		require.NoError(t, json.Unmarshal(indexData, &index))
+		require.Len(t, index.Manifests, 1)
+		require.Equal(t, "0.8.11", index.Manifests[0].Annotations[ocispecs.AnnotationRefName])
+
+		tagIndexData, err := os.ReadFile(filepath.Join(layoutDir, "blobs", "sha256", index.Manifests[0].Digest.Encoded()))
+		require.NoError(t, err)
+
+		var tagIndex ocispecs.Index
+		require.NoError(t, json.Unmarshal(tagIndexData, &tagIndex))
+		require.Len(t, tagIndex.Manifests, 1)
+		require.Equal(t, result.Artifact.Digest, tagIndex.Manifests[0].Digest)
+
+		manifestData, err := os.ReadFile(filepath.Join(layoutDir, "blobs", "sha256", result.Artifact.Digest.Encoded()))
+		require.NoError(t, err)
+
+		var manifest ocispecs.Manifest
+		require.NoError(t, json.Unmarshal(manifestData, &manifest))
+		require.Len(t, manifest.Layers, 1)
+
+		layerFile, err := os.Open(filepath.Join(layoutDir, "blobs", "sha256", manifest.Layers[0].Digest.Encoded()))
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			require.NoError(t, layerFile.Close())
+		})
+
+		fsys, err := erofs.Open(layerFile)
+		require.NoError(t, err)
+
+		h, err := util.HashFS(fsys)
+		require.NoError(t, err)
+
+		require.Equal(t, "h1:J674XgTpeE71MnUmfTovrhKIlFnWOa8rctDF6SL/Kzg=", h)
+	})
+
+	t.Run("Cache", func(t *testing.T) {
+		cacheDir := t.TempDir()
+
+		for i := 0; i < 2; i++ {
+			var buf bytes.Buffer
+			_, err := convert.Convert(ctx, convert.Options{
+				Path:     "../../internal/oci/testdata/toybox",
+				Ref:      ref,
+				Output:   &buf,
+				TempDir:  t.TempDir(),
+				CacheDir: cacheDir,
+			})
+			require.NoError(t, err)
+
+			fsys, err := erofs.Open(bytes.NewReader(buf.Bytes()))
+			require.NoError(t, err)
+
+			h, err := util.HashFS(fsys)
+			require.NoError(t, err)
+
+			require.Equal(t, "h1:J674XgTpeE71MnUmfTovrhKIlFnWOa8rctDF6SL/Kzg=", h)
+		}
+
+		// The compressed layer is indexed (rather than decompressed).
+		entries, err := os.ReadDir(filepath.Join(cacheDir, "layers"))
+		require.NoError(t, err)
+		require.Len(t, entries, 1)
+		require.True(t, strings.HasSuffix(entries[0].Name(), ".zran"))
+	})
+
+	t.Run("Progress", func(t *testing.T) {
+		var mu sync.Mutex
+		done := make(map[convert.ProgressPhase]convert.ProgressEvent)
+
+		var buf bytes.Buffer
+		result, err := convert.Convert(ctx, convert.Options{
+			Path:    "../../testdata/toybox.tar",
+			Output:  &buf,
+			TempDir: t.TempDir(),
+			Progress: func(ev convert.ProgressEvent) {
+				mu.Lock()
+				defer mu.Unlock()
+
+				if ev.Done {
+					done[ev.Phase] = ev
+				}
+			},
+		})
+		require.NoError(t, err)
+
+		decompress := done[convert.PhaseDecompress]
+		require.Equal(t, 1, decompress.Layers)
+		require.Equal(t, result.Layers[0].Size, decompress.TotalBytes)
+
+		require.Equal(t, int64(265), done[convert.PhaseIndex].Entries)
+
+		written := done[convert.PhaseWrite].Bytes
+		require.Positive(t, written)
+		require.LessOrEqual(t, written, result.Size)
+	})
+
+	t.Run("Cancelled", func(t *testing.T) {
+		imageFile, err := os.Open("../../testdata/toybox.tar")
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			require.NoError(t, imageFile.Close())
+		})
+
+		ctx, cancel := context.WithCancel(ctx)
+		t.Cleanup(cancel)
+
+		// Interrupt the conversion part way through reading the image.
+		r := &cancellingReader{r: imageFile, cancel: cancel, remaining: 64 << 10}
+
+		tempDir := t.TempDir()
+		_, err = convert.Convert(ctx, convert.Options{
+			Reader:  r,
+			Output:  io.Discard,
+			TempDir: tempDir,
+		})
+		require.ErrorIs(t, err, context.Canceled)
+
+		// No temporary data is left behind.
+		entries, err := os.ReadDir(tempDir)
+		require.NoError(t, err)
+		require.Empty(t, entries)
+	})
+
+	t.Run("No Input", func(t *testing.T) {
+		_, err := convert.Convert(ctx, convert.Options{
+			Output: &bytes.Buffer{},
+		})
+		require.Error(t, err)
+	})
+}
+
+func TestConvertAll(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("Multi Arch", func(t *testing.T) {
+		outputDir := t.TempDir()
+
+		results, err := convert.ConvertAll(ctx, convert.Options{
+			Path:    "../../internal/oci/testdata/toybox-multiarch",
+			TempDir: t.TempDir(),
+		}, func(target convert.Target) (string, error) {
+			return filepath.Join(outputDir, target.Platform.Architecture+".erofs"), nil
+		})
+		require.NoError(t, err)
+		require.Len(t, results, 2)
+
+		expected := map[string]string{
+			"amd64": "h1:J674XgTpeE71MnUmfTovrhKIlFnWOa8rctDF6SL/Kzg=",
+			"arm64": "h1:vep4P8xi3jVOxfV9SWQjzrHUoAIDjgYEGJ+yIYeq2JQ=",
+		}
+
+		for _, result := range results {
+			require.Equal(t, "docker.io/tianon/toybox:0.8.11", result.Ref)
+
+			outputFile, err := os.Open(filepath.Join(outputDir, result.Platform.Architecture+".erofs"))
+			require.NoError(t, err)
+			t.Cleanup(func() {
+				require.NoError(t, outputFile.Close())
+			})
+
+			fsys, err := erofs.Open(outputFile)
+			require.NoError(t, err)
+
+			h, err := util.HashFS(fsys)
+			require.NoError(t, err)
+
+			require.Equal(t, expected[result.Platform.Architecture], h)
+		}
+	})
+
+	t.Run("Conflicting Outputs", func(t *testing.T) {
+		outputPath := filepath.Join(t.TempDir(), "toybox.erofs")
+
+		_, err := convert.ConvertAll(ctx, convert.Options{
+			Path:    "../../internal/oci/testdata/toybox-multiarch",
+			TempDir: t.TempDir(),
+		}, func(target convert.Target) (string, error) {
+			return outputPath, nil
+		})
+		require.ErrorContains(t, err, "have the same output path")
+
+		_, err = os.Stat(outputPath)
+		require.ErrorIs(t, err, os.ErrNotExist)
+	})
+
+	t.Run("No Clobber", func(t *testing.T) {
+		outputDir := t.TempDir()
+		existingPath := filepath.Join(outputDir, "arm64.erofs")
+		require.NoError(t, os.WriteFile(existingPath, []byte("existing"), 0o644))
+
+		_, err := convert.ConvertAll(ctx, convert.Options{
+			Path:      "../../internal/oci/testdata/toybox-multiarch",
+			TempDir:   t.TempDir(),
+			NoClobber: true,
+		}, func(target convert.Target) (string, error) {
+			return filepath.Join(outputDir, target.Platform.Architecture+".erofs"), nil
+		})
+		require.ErrorIs(t, err, os.ErrExist)
+
+		data, err := os.ReadFile(existingPath)
+		require.NoError(t, err)
+		require.Equal(t, "existing", string(data))
+
+		// No partially written files are left behind.
+		entries, err := os.ReadDir(outputDir)
+		require.NoError(t, err)
+		for _, entry := range entries {
+			require.False(t, strings.HasPrefix(entry.Name(), "."), entry.Name())
+		}
+	})
+}
+
+// cancellingReader cancels the context once remaining bytes have been read.
+type cancellingReader struct {
+	r         io.Reader
+	cancel    context.CancelFunc
+	remaining int
+}
+
+func (r *cancellingReader) Read(p []byte) (int, error) {
+	if r.remaining <= 0 {
+		r.cancel()
+	}
+
+	n, err := r.r.Read(p)
+	r.remaining -= n
+	return n, err
+}
@@ -0,0 +1,97 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package convert
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/immutos/oci2erofs/internal/progress"
+)
+
+// Stats counts the inodes in the EROFS filesystem image of a converted image.
+type Stats struct {
+	// Inodes is the total number of inodes (the names of a hardlinked file
+	// share a single inode).
+	Inodes int
+	// Files is the number of regular files.
+	Files int
+	// Dirs is the number of directories.
+	Dirs int
+	// Symlinks is the number of symbolic links.
+	Symlinks int
+	// Other is the number of other inodes (eg. device nodes).
+	Other int
+}
+
+// Timings records the (wall clock) time spent in each phase of a conversion.
+type Timings struct {
+	// Decompress is the time spent decompressing (and verifying) layers.
+	Decompress time.Duration
+	// Index is the time spent indexing the layers into the root filesystem.
+	Index time.Duration
+	// Write is the time spent writing the EROFS filesystem image.
+	Write time.Duration
+	// Total is the time taken to convert the image.
+	Total time.Duration
+}
+
+// phaseTimer measures the time spent in each phase, from the first progress
+// event of a phase to its last completion (phases such as decompression run
+// concurrently for many layers).
+type phaseTimer struct {
+	mu    sync.Mutex
+	start map[progress.Phase]time.Time
+	end   map[progress.Phase]time.Time
+}
+
+// observe returns a context in which the progress of phases is measured.
+func (t *phaseTimer) observe(ctx context.Context) context.Context {
+	t.start = make(map[progress.Phase]time.Time)
+	t.end = make(map[progress.Phase]time.Time)
+
+	return progress.Observe(ctx, func(ev progress.Event) {
+		now := time.Now()
+
+		t.mu.Lock()
+		defer t.mu.Unlock()
+
+		if _, ok := t.start[ev.Phase]; !ok {
+			t.start[ev.Phase] = now
+		}
+
+		if ev.Done {
+			t.end[ev.Phase] = now
+		}
+	})
+}
+
+// elapsed returns the time spent in the phase.
+func (t *phaseTimer) elapsed(phase progress.Phase) time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	start, end := t.start[phase], t.end[phase]
+	if start.IsZero() || end.IsZero() {
+		return 0
+	}
+
+	return end.Sub(start)
+}
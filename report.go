@@ -0,0 +1,149 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/immutos/oci2erofs/internal/constants"
+	"github.com/immutos/oci2erofs/internal/registry"
+	"github.com/immutos/oci2erofs/internal/report"
+	"github.com/immutos/oci2erofs/pkg/convert"
+	"github.com/opencontainers/go-digest"
+)
+
+// reportOutput describes where a converted image was written to.
+type reportOutput struct {
+	// path is the path of the output (file, OCI image layout, registry
+	// reference, or "-" for stdout).
+	path string
+	// sha256 is the hex encoded digest of the image if it was computed while
+	// streaming the image, otherwise it is derived from the result (or the
+	// output file).
+	sha256 string
+}
+
+// writeReport writes a report describing the conversion to the path given
+// by the --report flag (if any).
+func writeReport(reportPath, imagePath string, warnings *report.WarningRecorder, results []*convert.Result, outputs []reportOutput) error {
+	if reportPath == "" {
+		return nil
+	}
+
+	r := &report.Report{
+		SchemaVersion: report.SchemaVersion,
+		Version:       constants.Version,
+		Input:         imagePath,
+		Images:        []report.Image{},
+		Warnings:      warnings.Warnings(),
+	}
+
+	for i, result := range results {
+		output := outputs[i]
+
+		sha := output.sha256
+		switch {
+		case sha != "":
+		case result.Digest != "":
+			sha = result.Digest.Encoded()
+		case output.path != stdioPath:
+			var err error
+			sha, err = fileSHA256(output.path)
+			if err != nil {
+				return err
+			}
+		}
+
+		// Registry references are resolved to the image's manifest.
+		ref := result.Ref
+		if ref == "" && strings.HasPrefix(imagePath, registry.TransportPrefix) {
+			ref = strings.TrimPrefix(imagePath, registry.TransportPrefix)
+		}
+
+		img := report.Image{
+			Ref:            ref,
+			Platform:       result.Platform,
+			ManifestDigest: result.Manifest.Digest,
+			ConfigDigest:   result.Config.Digest,
+			LayerDigests:   []digest.Digest{},
+			Output: report.Output{
+				Path:   output.path,
+				Size:   result.Size,
+				SHA256: sha,
+			},
+			Stats: report.Stats(result.Stats),
+			Timings: report.Timings{
+				Decompress: result.Timings.Decompress.Seconds(),
+				Index:      result.Timings.Index.Seconds(),
+				Write:      result.Timings.Write.Seconds(),
+				Total:      result.Timings.Total.Seconds(),
+			},
+		}
+
+		for _, layer := range result.Layers {
+			img.LayerDigests = append(img.LayerDigests, layer.Digest)
+		}
+
+		if result.Artifact != nil {
+			img.ArtifactDigest = result.Artifact.Digest
+		}
+
+		r.Images = append(r.Images, img)
+	}
+
+	return r.Write(reportPath)
+}
+
+// fileSHA256 returns the hex encoded SHA-256 digest of the file.
+func fileSHA256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to open output file: %w", err)
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", fmt.Errorf("failed to digest output file: %w", err)
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// hashingWriter computes the SHA-256 digest of the data written to it.
+type hashingWriter struct {
+	io.Writer
+	h hash.Hash
+}
+
+func newHashingWriter(w io.Writer) *hashingWriter {
+	h := sha256.New()
+	return &hashingWriter{Writer: io.MultiWriter(w, h), h: h}
+}
+
+// SHA256 returns the hex encoded digest of the data written so far.
+func (w *hashingWriter) SHA256() string {
+	return hex.EncodeToString(w.h.Sum(nil))
+}
@@ -0,0 +1,76 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// interruptedError is the cause of the context being cancelled by a signal.
+type interruptedError struct {
+	sig os.Signal
+}
+
+func (e *interruptedError) Error() string {
+	return fmt.Sprintf("interrupted by %s", e.sig)
+}
+
+// notifyContext returns a context that is cancelled when an interrupt (or
+// termination) signal is received, giving in-flight work the chance to clean
+// up temporary data and partially written outputs. A second signal terminates
+// the program immediately.
+func notifyContext(parent context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancelCause(parent)
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+
+	go func() {
+		select {
+		case sig := <-sigs:
+			signal.Stop(sigs)
+			slog.Warn("Interrupted, cleaning up (signal again to exit immediately)",
+				slog.String("signal", sig.String()))
+			cancel(&interruptedError{sig: sig})
+		case <-ctx.Done():
+			signal.Stop(sigs)
+		}
+	}()
+
+	return ctx, func() { cancel(nil) }
+}
+
+// exitStatus returns the exit status for a failed run. Runs interrupted by a
+// signal exit with 128 plus the signal number (as shells report them).
+func exitStatus(ctx context.Context) int {
+	var interruptedErr *interruptedError
+	if errors.As(context.Cause(ctx), &interruptedErr) {
+		if sig, ok := interruptedErr.sig.(syscall.Signal); ok {
+			return 128 + int(sig)
+		}
+	}
+
+	return 1
+}
@@ -0,0 +1,100 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+
+	"github.com/immutos/oci2erofs/internal/erofs"
+	"github.com/immutos/oci2erofs/internal/verify"
+	"github.com/immutos/oci2erofs/internal/xattr"
+	"github.com/urfave/cli/v2"
+)
+
+func newVerifyCommand() *cli.Command {
+	return &cli.Command{
+		Name:      "verify",
+		Usage:     "Verify that an EROFS filesystem image matches the root filesystem of its source image",
+		ArgsUsage: "image_path erofs_path",
+		Flags: append(newImageFlags(),
+			&cli.BoolFlag{
+				Name:  "skip-devices",
+				Usage: "Expect character and block devices to have been omitted from the EROFS filesystem image",
+			},
+			&cli.StringFlag{
+				Name:  "xattrs-allow",
+				Usage: "Comma separated extended attribute namespaces or names expected to be stored in the EROFS filesystem image (default: all)",
+			},
+			&cli.StringFlag{
+				Name:  "xattrs-deny",
+				Usage: "Comma separated extended attribute namespaces or names expected not to be stored in the EROFS filesystem image ('*' for all)",
+			},
+		),
+		Action: func(c *cli.Context) error {
+			if c.NArg() != 2 {
+				slog.Error("Image path and EROFS filesystem image path are required")
+				return cli.ShowSubcommandHelp(c)
+			}
+
+			filter, err := xattr.ParseFilter(c.String("xattrs-allow"), c.String("xattrs-deny"))
+			if err != nil {
+				return err
+			}
+
+			erofsFile, err := os.Open(c.Args().Get(1))
+			if err != nil {
+				return fmt.Errorf("failed to open EROFS filesystem image: %w", err)
+			}
+			defer erofsFile.Close()
+
+			erofsFS, err := erofs.Open(erofsFile)
+			if err != nil {
+				return fmt.Errorf("failed to open EROFS filesystem: %w", err)
+			}
+
+			img, release, err := loadImage(c, c.Args().First(), c.String("ref"), c.String("platform"))
+			if err != nil {
+				return err
+			}
+			defer release()
+
+			diffs, err := verify.Compare(c.Context, img.RootFS(), erofsFS, verify.Options{
+				SkipDevices: c.Bool("skip-devices"),
+				XattrFilter: filter,
+			})
+			if err != nil {
+				return fmt.Errorf("failed to verify EROFS filesystem: %w", err)
+			}
+
+			for _, diff := range diffs {
+				fmt.Println(diff)
+			}
+
+			if len(diffs) > 0 {
+				return fmt.Errorf("found %d differences", len(diffs))
+			}
+
+			slog.Info("EROFS filesystem matches the source image")
+
+			return nil
+		},
+	}
+}